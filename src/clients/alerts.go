@@ -0,0 +1,154 @@
+package clients
+
+import "time"
+
+const (
+	AlertStatePending  = "pending"
+	AlertStateFiring   = "firing"
+	AlertStateResolved = "resolved"
+)
+
+const (
+	ReceiverWebhook = "webhook"
+	ReceiverFile    = "file"
+	ReceiverSMTP    = "smtp"
+)
+
+const (
+	SilencePending = "pending"
+	SilenceActive  = "active"
+	SilenceExpired = "expired"
+)
+
+// AlertRule fires an alert for every series of a metric, or of the result of a query, whose
+// latest value meets the condition for at least the For duration, e.g. "5m". Annotations are
+// templates which can refer to the {{ .Labels }} and {{ .Value }} of the alert.
+// SLO rules rather evaluate the lowest burn rate of the SLO over the BurnWindows, e.g.
+// ["1h", "5m"], so that the alert only fires while the budget is spent fast over all of them.
+// Anomaly rules evaluate the anomaly score of the last rollup window of every instance of
+// the Anomaly metric, in standard deviations from its baseline.
+type AlertRule struct {
+	Name        string            `json:"name"`
+	Metric      string            `json:"metric,omitempty"`
+	Service     string            `json:"service,omitempty"`
+	Query       string            `json:"query,omitempty"`
+	SLO         string            `json:"slo,omitempty"`
+	Anomaly     string            `json:"anomaly,omitempty"`
+	BurnWindows []string          `json:"burn_windows,omitempty"`
+	Condition   AlertCondition    `json:"condition"`
+	For         string            `json:"for,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// AlertCondition compares a value to the threshold, Op is one of >, >=, <, <=, == and !=
+type AlertCondition struct {
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+}
+
+// AlertReceiver is where notifications are sent: an AlertNotification posted to the URL of a
+// webhook, appended as a json line to the file at Path, or mailed through the SMTP server at
+// SMTPAddress, e.g. a local relay or stand-in such as MailHog.
+type AlertReceiver struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	SMTPAddress string   `json:"smtp_address,omitempty"`
+	From        string   `json:"from,omitempty"`
+	To          []string `json:"to,omitempty"`
+}
+
+// LabelMatcher matches the labels of alerts whose Name label equals Value, or fully matches
+// the regular expression Value when IsRegex is set
+type LabelMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"is_regex,omitempty"`
+}
+
+// AlertRoute is a node of the routing tree. An alert descends into the first child route
+// whose matchers it matches, and into the next ones as well while those Continue, and is sent
+// to the receiver of the deepest routes it matched. Alerts of a route sharing the values of the
+// GroupBy labels are sent together, changes at most once every GroupInterval and, while they
+// keep firing, again every RepeatInterval. Unset fields are inherited from the parent route.
+type AlertRoute struct {
+	Receiver       string         `json:"receiver,omitempty"`
+	Matchers       []LabelMatcher `json:"matchers,omitempty"`
+	GroupBy        []string       `json:"group_by,omitempty"`
+	GroupInterval  string         `json:"group_interval,omitempty"`
+	RepeatInterval string         `json:"repeat_interval,omitempty"`
+	Continue       bool           `json:"continue,omitempty"`
+	InhibitRules   []InhibitRule  `json:"inhibit_rules,omitempty"`
+	Routes         []AlertRoute   `json:"routes,omitempty"`
+}
+
+// InhibitRule mutes the alerts matching the target matchers, among those routed through the
+// route it belongs to, while an alert matching the source matchers fires with the same values
+// of the Equal labels
+type InhibitRule struct {
+	SourceMatchers []LabelMatcher `json:"source_matchers"`
+	TargetMatchers []LabelMatcher `json:"target_matchers"`
+	Equal          []string       `json:"equal,omitempty"`
+}
+
+// Silence mutes the alerts matching every matcher from StartsAt until EndsAt
+type Silence struct {
+	ID        string         `json:"id,omitempty"`
+	Matchers  []LabelMatcher `json:"matchers"`
+	StartsAt  time.Time      `json:"starts_at"`
+	EndsAt    time.Time      `json:"ends_at"`
+	CreatedBy string         `json:"created_by"`
+	Comment   string         `json:"comment"`
+	State     string         `json:"state,omitempty"`
+}
+
+type SilencesResponse struct {
+	Silences []Silence `json:"silences"`
+}
+
+// AlertRuleStatus is a rule along with the outcome of its last evaluation
+type AlertRuleStatus struct {
+	AlertRule
+	Health         string    `json:"health"`
+	LastError      string    `json:"last_error,omitempty"`
+	LastEvaluation time.Time `json:"last_evaluation"`
+}
+
+// Alert is the state of a rule for a series, a resolved alert is kept for a while after
+// its condition stopped holding. Silenced and inhibited alerts are not notified, InhibitedBy
+// holds the keys of the alerts inhibiting it.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	State       string            `json:"state"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"active_at"`
+	FiredAt     *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+	SilencedBy  []string          `json:"silenced_by,omitempty"`
+	InhibitedBy []string          `json:"inhibited_by,omitempty"`
+}
+
+type AlertsResponse struct {
+	Alerts []Alert `json:"alerts"`
+}
+
+type AlertRulesResponse struct {
+	Rules []AlertRuleStatus `json:"rules"`
+}
+
+type AlertReceiversResponse struct {
+	Receivers []AlertReceiver `json:"receivers"`
+}
+
+// AlertNotification is the json posted to receivers, Status is firing while any of the
+// alerts is firing and resolved once they all are
+type AlertNotification struct {
+	Receiver    string            `json:"receiver"`
+	Status      string            `json:"status"`
+	GroupLabels map[string]string `json:"group_labels"`
+	Alerts      []Alert           `json:"alerts"`
+}
@@ -0,0 +1,23 @@
+package clients
+
+import "time"
+
+// AnomalyEvent is a rollup window of a series whose value fell outside the band expected from
+// the baseline of the series. Score is the distance to the expected value in standard
+// deviations, negative below it.
+type AnomalyEvent struct {
+	MetricID  string            `json:"metric_id"`
+	ServiceID string            `json:"service_id"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	TS        time.Time         `json:"time"`
+	Value     float64           `json:"value"`
+	Expected  float64           `json:"expected"`
+	Lower     float64           `json:"lower"`
+	Upper     float64           `json:"upper"`
+	Score     float64           `json:"score"`
+}
+
+// AnomaliesResponse is the json returned by GET /anomalies
+type AnomaliesResponse struct {
+	Anomalies []AnomalyEvent `json:"anomalies"`
+}
@@ -0,0 +1,117 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidRequest is the cause of errors for requests the orchestrator rejected, 400
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrNotFound is the cause of errors for missing resources, 404
+	ErrNotFound = errors.New("not found")
+	// ErrMethodNotAllowed is the cause of errors for methods an endpoint does not support, 405
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	// ErrConflict is the cause of errors for resources which already exist, 409
+	ErrConflict = errors.New("conflict")
+	// ErrServer is the cause of errors for requests the orchestrator failed to serve, 5xx
+	ErrServer = errors.New("server error")
+	// ErrStreamDropped is the cause of errors for streams the orchestrator ended for falling behind
+	ErrStreamDropped = errors.New("stream dropped")
+	// ErrUnexpectedStatus is the cause of errors for any other status code
+	ErrUnexpectedStatus = errors.New("unexpected status")
+)
+
+// Codes of the errors returned by the orchestrator, one per status code
+const (
+	ErrorCodeInvalidRequest   = "invalid_request"
+	ErrorCodeNotFound         = "not_found"
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeConflict         = "conflict"
+	ErrorCodePayloadTooLarge  = "payload_too_large"
+	ErrorCodeInternal         = "internal"
+	ErrorCodeUnavailable      = "unavailable"
+	ErrorCodeUnknown          = "unknown"
+)
+
+// ErrorCode returns the code of the errors answered with the status code
+func ErrorCode(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return ErrorCodeInvalidRequest
+	case http.StatusNotFound:
+		return ErrorCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrorCodeMethodNotAllowed
+	case http.StatusConflict:
+		return ErrorCodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return ErrorCodePayloadTooLarge
+	case http.StatusInternalServerError:
+		return ErrorCodeInternal
+	case http.StatusServiceUnavailable:
+		return ErrorCodeUnavailable
+	default:
+		return ErrorCodeUnknown
+	}
+}
+
+// ErrorResponse is the body of every error answered by the orchestrator
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError is returned for responses with an error status code. Its cause is the error of the
+// status code, so that callers can check errors.Cause(err) == clients.ErrNotFound. Details
+// hold what the error applies to, e.g. the allowed methods of a 405.
+type APIError struct {
+	StatusCode int                    `json:"-"`
+	Code       string                 `json:"code"`
+	Message    string                 `json:"message"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: status=%d code=%s message=%s", e.Cause().Error(), e.StatusCode, e.Code, e.Message)
+}
+
+// Cause returns the error of the status code
+func (e *APIError) Cause() error {
+	switch {
+	case e.StatusCode == http.StatusBadRequest:
+		return ErrInvalidRequest
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusMethodNotAllowed:
+		return ErrMethodNotAllowed
+	case e.StatusCode == http.StatusConflict:
+		return ErrConflict
+	case e.StatusCode >= http.StatusInternalServerError:
+		return ErrServer
+	default:
+		return ErrUnexpectedStatus
+	}
+}
+
+// checkResponse returns an APIError for responses which are not 2xx, bodies which are not an
+// ErrorResponse, e.g. from a proxy, become its message
+func checkResponse(httpResp *http.Response) error {
+	if httpResp.StatusCode >= 200 && httpResp.StatusCode <= 299 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(httpResp.Body)
+
+	errResp := ErrorResponse{}
+	if err := json.Unmarshal(body, &errResp); err != nil || len(errResp.Error.Message) == 0 {
+		errResp.Error = APIError{Code: ErrorCode(httpResp.StatusCode), Message: strings.TrimSpace(string(body))}
+	}
+	errResp.Error.StatusCode = httpResp.StatusCode
+
+	return &errResp.Error
+}
@@ -58,8 +58,8 @@ func (c *heartbeatClient) Heartbeat(ctx context.Context, req *HeartbeatRequest)
 	}
 	defer httpResp.Body.Close()
 
-	if httpResp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("http error encountered! status=%d", httpResp.StatusCode)
+	if err := checkResponse(httpResp); err != nil {
+		return nil, err
 	}
 
 	result := HeartbeatResponse{}
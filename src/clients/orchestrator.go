@@ -1,16 +1,29 @@
 package clients
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"fmt"
+	"encoding/json"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// maxEventSize bounds the size of the lines of the server-sent event streams
+const maxEventSize = 1024 * 1024
+
 type orchestratorClient struct {
-	client  *http.Client
-	address string
+	client *http.Client
+	// streamClient has no timeout, for the server-sent event streams which never end by themselves
+	streamClient *http.Client
+	address      string
 }
 
 // NewOrchestratorClient creates a new orchestrator client
@@ -34,38 +47,452 @@ func NewOrchestratorClient(address string) OrchestratorClient {
 	}
 
 	c := orchestratorClient{
-		client:  client,
-		address: address,
+		client:       client,
+		streamClient: &http.Client{Transport: client.Transport},
+		address:      address,
 	}
 
 	return &c
 }
 
+// RegisterSidecar registers a sidecar, the error being caused by ErrConflict when it is already
+// registered
 func (c *orchestratorClient) RegisterSidecar(ctx context.Context, req *RegisterRequest) (*RegisterResponse, error) {
-	url := fmt.Sprintf("%s%s", c.address, RegisterURL)
-	httpReq, err := toHTTPRequest(ctx, http.MethodPost, url, *req)
+	result := RegisterResponse{}
+	if err := c.do(ctx, http.MethodPost, RegisterURL, nil, *req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UnregisterSidecar stops the health checks of a registered sidecar
+func (c *orchestratorClient) UnregisterSidecar(ctx context.Context, req *RegisterRequest) error {
+	return c.do(ctx, http.MethodDelete, RegisterURL, nil, *req, nil)
+}
+
+func (c *orchestratorClient) DrainSidecar(ctx context.Context, req *RegisterRequest) error {
+	return c.do(ctx, http.MethodPost, DrainURL, nil, *req, nil)
+}
+
+func (c *orchestratorClient) UndrainSidecar(ctx context.Context, req *RegisterRequest) error {
+	return c.do(ctx, http.MethodDelete, DrainURL, nil, *req, nil)
+}
+
+func (c *orchestratorClient) GetServices(ctx context.Context) (*ServicesResponse, error) {
+	result := ServicesResponse{}
+	if err := c.do(ctx, http.MethodGet, ServicesURL, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) StreamInstanceEvents(ctx context.Context, serviceName string, fn func(event InstanceEvent) error) error {
+	params := url.Values{}
+	setParam(params, "service", serviceName)
+
+	return c.events(ctx, EventsURL, params, func(data []byte) error {
+		event := InstanceEvent{}
+		if err := json.Unmarshal(data, &event); err != nil {
+			return errors.Wrapf(err, "failed to read events of %s", EventsURL)
+		}
+		return fn(event)
+	})
+}
+
+func (c *orchestratorClient) GetStats(ctx context.Context, req *StatsRequest) (*StatsResponse, error) {
+	result := StatsResponse{}
+	if err := c.do(ctx, http.MethodGet, StatsURL, statsParams(req), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) StreamStats(ctx context.Context, req *StatsRequest, fn func(row Aggregation) error) (*StatsResponse, error) {
+	params := statsParams(req)
+	params.Set("format", "ndjson")
+
+	result := StatsResponse{MetricID: req.MetricID, StartTS: req.StartTS, EndTS: req.EndTS}
+	err := c.stream(ctx, StatsURL, params, func(httpResp *http.Response) {
+		result.Tier = httpResp.Header.Get("X-Stats-Tier")
+		result.Resolution, _ = strconv.ParseInt(httpResp.Header.Get("X-Stats-Resolution"), 10, 64)
+	}, fn)
 	if err != nil {
 		return nil, err
 	}
+	return &result, nil
+}
 
-	httpResp, err := c.client.Do(httpReq)
+func (c *orchestratorClient) StreamDataPoints(ctx context.Context, req *LiveStatsRequest, fn func(dp DataPoint) error) error {
+	params := url.Values{"metricID": req.MetricIDs}
+	setParam(params, "service", req.ServiceName)
+	setParam(params, "serviceID", req.ServiceID)
+	if req.Buffer > 0 {
+		params.Set("buffer", strconv.Itoa(req.Buffer))
+	}
+
+	return c.events(ctx, LiveStatsURL, params, func(data []byte) error {
+		dp := DataPoint{}
+		if err := json.Unmarshal(data, &dp); err != nil {
+			return errors.Wrapf(err, "failed to read data points of %s", LiveStatsURL)
+		}
+		return fn(dp)
+	})
+}
+
+func (c *orchestratorClient) Query(ctx context.Context, req *QueryRequest) (*QueryResponse, error) {
+	params := url.Values{}
+	params.Set("q", req.Query)
+	params.Set("start", strconv.FormatInt(req.StartTS.Unix(), 10))
+	if !req.EndTS.IsZero() {
+		params.Set("end", strconv.FormatInt(req.EndTS.Unix(), 10))
+	}
+	if req.Step > 0 {
+		params.Set("step", req.Step.String())
+	}
+
+	result := QueryResponse{}
+	if err := c.do(ctx, http.MethodGet, QueryURL, params, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) Backfill(ctx context.Context, req *BackfillRequest) (*BackfillJob, error) {
+	result := BackfillJob{}
+	if err := c.do(ctx, http.MethodPost, BackfillURL, nil, *req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) GetBackfill(ctx context.Context, id string) (*BackfillJob, error) {
+	result := BackfillJob{}
+	if err := c.do(ctx, http.MethodGet, BackfillURL, url.Values{"id": {id}}, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) Export(ctx context.Context, req *ExportRequest, fn func(row Aggregation) error) error {
+	params := url.Values{}
+	setParam(params, "tier", req.Tier)
+	setParam(params, "metricID", req.MetricID)
+	setParam(params, "serviceID", req.ServiceID)
+	setParam(params, "service", req.ServiceName)
+	setTimeParam(params, "startTS", req.StartTS)
+	setTimeParam(params, "endTS", req.EndTS)
+	params.Set("format", "ndjson")
+
+	return c.stream(ctx, ExportURL, params, nil, fn)
+}
+
+// Import sends the rows as NDJSON, the rows preceding an invalid one remain imported
+func (c *orchestratorClient) Import(ctx context.Context, tier string, rows []Aggregation) (*ImportResponse, error) {
+	body := bytes.Buffer{}
+	encoder := json.NewEncoder(&body)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+
+	params := url.Values{}
+	params.Set("tier", tier)
+	params.Set("format", "ndjson")
+	httpReq, err := http.NewRequest(http.MethodPost, c.url(ImportURL, params), &body)
 	if err != nil {
 		return nil, err
 	}
+	httpReq.Header.Set("Content-Type", "application/x-ndjson")
+
+	result := ImportResponse{}
+	if err := c.send(httpReq.WithContext(ctx), &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) GetAlerts(ctx context.Context) (*AlertsResponse, error) {
+	result := AlertsResponse{}
+	if err := c.do(ctx, http.MethodGet, AlertsURL, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) GetAlertRules(ctx context.Context) (*AlertRulesResponse, error) {
+	result := AlertRulesResponse{}
+	if err := c.do(ctx, http.MethodGet, AlertRulesURL, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PutAlertRule adds the rule, or replaces the rule with the same name
+func (c *orchestratorClient) PutAlertRule(ctx context.Context, rule *AlertRule) error {
+	return c.do(ctx, http.MethodPost, AlertRulesURL, nil, *rule, nil)
+}
+
+func (c *orchestratorClient) DeleteAlertRule(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, AlertRulesURL, url.Values{"name": {name}}, nil, nil)
+}
+
+func (c *orchestratorClient) GetAlertReceivers(ctx context.Context) (*AlertReceiversResponse, error) {
+	result := AlertReceiversResponse{}
+	if err := c.do(ctx, http.MethodGet, AlertReceiversURL, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PutAlertReceiver adds the receiver, or replaces the receiver with the same name
+func (c *orchestratorClient) PutAlertReceiver(ctx context.Context, receiver *AlertReceiver) error {
+	return c.do(ctx, http.MethodPost, AlertReceiversURL, nil, *receiver, nil)
+}
+
+func (c *orchestratorClient) DeleteAlertReceiver(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, AlertReceiversURL, url.Values{"name": {name}}, nil, nil)
+}
+
+// GetAlertRoute returns the routing tree, an error caused by ErrNotFound until one is set
+func (c *orchestratorClient) GetAlertRoute(ctx context.Context) (*AlertRoute, error) {
+	result := AlertRoute{}
+	if err := c.do(ctx, http.MethodGet, AlertRouteURL, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) PutAlertRoute(ctx context.Context, route *AlertRoute) error {
+	return c.do(ctx, http.MethodPost, AlertRouteURL, nil, *route, nil)
+}
+
+func (c *orchestratorClient) GetSilences(ctx context.Context) (*SilencesResponse, error) {
+	result := SilencesResponse{}
+	if err := c.do(ctx, http.MethodGet, AlertSilencesURL, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PutSilence creates the silence, or updates it when it has an id, and returns it with its id and state
+func (c *orchestratorClient) PutSilence(ctx context.Context, silence *Silence) (*Silence, error) {
+	result := Silence{}
+	if err := c.do(ctx, http.MethodPost, AlertSilencesURL, nil, *silence, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) ExpireSilence(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, AlertSilencesURL, url.Values{"id": {id}}, nil, nil)
+}
+
+func (c *orchestratorClient) GetSLOs(ctx context.Context, name string) (*SLOResponse, error) {
+	params := url.Values{}
+	setParam(params, "name", name)
+
+	result := SLOResponse{}
+	if err := c.do(ctx, http.MethodGet, SLOURL, params, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) GetAnomalies(ctx context.Context, req *AnomaliesRequest) (*AnomaliesResponse, error) {
+	params := url.Values{}
+	setParam(params, "metricID", req.MetricID)
+	setParam(params, "serviceID", req.ServiceID)
+	setParam(params, "service", req.ServiceName)
+	setTimeParam(params, "startTS", req.StartTS)
+	setTimeParam(params, "endTS", req.EndTS)
+
+	result := AnomaliesResponse{}
+	if err := c.do(ctx, http.MethodGet, AnomaliesURL, params, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) ReloadConfig(ctx context.Context) (*ConfigEvent, error) {
+	result := ConfigEvent{}
+	if err := c.do(ctx, http.MethodPost, ConfigReloadURL, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) GetConfigEvents(ctx context.Context) (*ConfigEventsResponse, error) {
+	result := ConfigEventsResponse{}
+	if err := c.do(ctx, http.MethodGet, ConfigEventsURL, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *orchestratorClient) url(path string, params url.Values) string {
+	if len(params) == 0 {
+		return c.address + APIPrefix + path
+	}
+	return c.address + APIPrefix + path + "?" + params.Encode()
+}
+
+// do sends body, when not nil, as json and decodes the json response into result, when not nil
+func (c *orchestratorClient) do(ctx context.Context, method, path string, params url.Values, body interface{}, result interface{}) error {
+	httpReq, err := toHTTPRequest(ctx, method, c.url(path, params), body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(httpReq, result)
+}
+
+func (c *orchestratorClient) send(httpReq *http.Request, result interface{}) error {
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if err := checkResponse(httpResp); err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(httpResp.Body).Decode(result); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal response of %s %s", httpReq.Method, httpReq.URL.Path)
+	}
+	return nil
+}
+
+// stream calls header with the response once its status is checked, and then fn with every
+// NDJSON row of its body
+func (c *orchestratorClient) stream(ctx context.Context, path string, params url.Values, header func(httpResp *http.Response),
+	fn func(row Aggregation) error) error {
+	httpReq, err := toHTTPRequest(ctx, http.MethodGet, c.url(path, params), nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Accept", "application/x-ndjson")
+
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if err := checkResponse(httpResp); err != nil {
+		return err
+	}
+	if header != nil {
+		header(httpResp)
+	}
+
+	decoder := json.NewDecoder(httpResp.Body)
+	for {
+		row := Aggregation{}
+		if err := decoder.Decode(&row); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to read rows of %s", path)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// events calls fn with the data of every server-sent event of the stream but the dropped event,
+// which ends it with ErrStreamDropped. It returns the error of ctx once done.
+func (c *orchestratorClient) events(ctx context.Context, path string, params url.Values, fn func(data []byte) error) error {
+	httpReq, err := toHTTPRequest(ctx, http.MethodGet, c.url(path, params), nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+
+	httpResp, err := c.streamClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
 	defer httpResp.Body.Close()
 
-	resp := RegisterResponse{}
+	if err := checkResponse(httpResp); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(httpResp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	name, data := "", []byte{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case len(line) == 0:
+			if name == "dropped" {
+				return errors.Wrapf(ErrStreamDropped, "%s fell behind", path)
+			}
+			if len(data) > 0 {
+				if err := fn(data); err != nil {
+					return err
+				}
+			}
+			name, data = "", []byte{}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "failed to read events of %s", path)
+	}
+	return errors.Wrapf(io.ErrUnexpectedEOF, "%s ended", path)
+}
+
+func statsParams(req *StatsRequest) url.Values {
+	params := url.Values{}
+	setParam(params, "metricID", req.MetricID)
+	setParam(params, "serviceID", req.ServiceID)
+	setParam(params, "service", req.ServiceName)
+	setParam(params, "resolution", req.Resolution)
+	setTimeParam(params, "startTS", req.StartTS)
+	setTimeParam(params, "endTS", req.EndTS)
+	if req.Step > 0 {
+		params.Set("step", req.Step.String())
+	}
+	if req.Points > 0 {
+		params.Set("points", strconv.Itoa(req.Points))
+	}
+	setParam(params, "fn", req.Function)
+	setParam(params, "fill", req.Fill)
+	setParam(params, "apply", req.Apply)
+	if req.PageSize > 0 {
+		params.Set("page_size", strconv.Itoa(req.PageSize))
+	}
+	setParam(params, "page_token", req.PageToken)
+	return params
+}
 
-	switch httpResp.StatusCode {
-	case http.StatusConflict:
-		resp.Code = RegisterFailed
-		resp.ErrMessage = "Registrant already exists!"
-	case http.StatusOK:
-		resp.Code = RegisterSuccess
-	default:
-		resp.Code = RegisterFailed
-		resp.ErrMessage = fmt.Sprintf("Unknown error! HTTP CODE=%d", httpResp.StatusCode)
+func setParam(params url.Values, name, value string) {
+	if len(value) > 0 {
+		params.Set(name, value)
 	}
+}
 
-	return &resp, nil
+func setTimeParam(params url.Values, name string, ts time.Time) {
+	if !ts.IsZero() {
+		params.Set(name, strconv.FormatInt(ts.Unix(), 10))
+	}
 }
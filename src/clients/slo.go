@@ -0,0 +1,42 @@
+package clients
+
+import "time"
+
+// SLOBurnWindows are the windows over which the burn rates of every SLO are reported
+var SLOBurnWindows = []string{"5m", "30m", "1h", "6h", "1d", "3d"}
+
+// SLO is a service level objective on the requests of a service, e.g. 99.9% of the requests
+// to /echo succeed within 200ms over 30 days
+type SLO struct {
+	Name    string `json:"name"`
+	Service string `json:"service"`
+	// Route restricts the SLO to the requests of one route, every route counts when empty
+	Route string `json:"route,omitempty"`
+	// Objective is the percentage of good requests, e.g. 99.9
+	Objective float64 `json:"objective"`
+	// Latency makes slower successful requests bad, it must be one of RequestLatencyBuckets
+	// e.g. "200ms"
+	Latency string `json:"latency,omitempty"`
+	// Window is the compliance window, e.g. "30d", and defaults to 30 days
+	Window string `json:"window,omitempty"`
+}
+
+// SLOStatus is the state of an SLO over its window. The ratios are missing when no request
+// was counted. The error budget is the fraction of requests allowed to be bad, the budget
+// remaining is the fraction of it left, and the burn rates say how fast the budget is spent
+// over every window of SLOBurnWindows, 1 spending it exactly over the SLO window.
+type SLOStatus struct {
+	SLO
+	Total           float64             `json:"total"`
+	Good            float64             `json:"good"`
+	SLI             *float64            `json:"sli"`
+	ErrorBudget     float64             `json:"error_budget"`
+	BudgetRemaining *float64            `json:"budget_remaining"`
+	BurnRates       map[string]*float64 `json:"burn_rates"`
+	EvaluatedAt     time.Time           `json:"evaluated_at"`
+}
+
+// SLOResponse is the json returned by GET /slo
+type SLOResponse struct {
+	SLOs []SLOStatus `json:"slos"`
+}
@@ -10,36 +10,142 @@ const (
 	RegisterFailed
 )
 
+// APIPrefix is the version prefix of the orchestrator api, every URL below is relative to it
+// except for the health checks and metrics of the sidecars, MetricsURL and RemoteWriteURL
+const APIPrefix = "/v1"
+
 const (
 	ProxyHealthURL = "/health"
 	RegisterURL    = "/register"
 	ServicesURL    = "/services"
 	StatsURL       = "/stats"
+	BackfillURL    = "/admin/backfill"
+	QueryURL       = "/query"
+	MetricsURL     = "/metrics"
+	RemoteWriteURL = "/api/v1/write"
+	ExportURL      = "/export"
+	ImportURL      = "/import"
+
+	AlertsURL         = "/alerts"
+	AlertRulesURL     = "/alerts/rules"
+	AlertReceiversURL = "/alerts/receivers"
+	AlertRouteURL     = "/alerts/route"
+	AlertSilencesURL  = "/alerts/silences"
+
+	SLOURL       = "/slo"
+	AnomaliesURL = "/anomalies"
+	OpenAPIURL   = "/openapi.json"
+	DrainURL     = "/drain"
+	EventsURL    = "/events"
+	LiveStatsURL = "/stats/live"
+
+	ConfigEventsURL = "/config/events"
+	ConfigReloadURL = "/config/reload"
+)
+
+const (
+	BackfillInsert = "insert"
+	BackfillUpdate = "update"
 )
 
-// HeartbeatRequest TODO: add filter params
-type HeartbeatRequest struct{}
+// HeartbeatRequest tells the sidecar whether it is draining
+type HeartbeatRequest struct {
+	Drain bool `json:"drain,omitempty"`
+}
 
 // HeartbeatResponse is the json returned by the sidecars to the service orchestrator
 type HeartbeatResponse struct {
-	Stats []Stats `json:"stats"`
+	Stats    []Stats        `json:"stats"`
+	Requests []RequestStats `json:"requests,omitempty"`
 }
 
-type Aggregation struct {
-	MetricID  string    `json:"metric_id"`
+// RequestLatencyBuckets are the upper bounds in seconds of the request latency buckets
+// reported by the sidecars
+var RequestLatencyBuckets = []float64{.005, .01, .025, .05, .1, .2, .25, .3, .5, .75, 1, 2.5, 5, 10}
+
+// RequestStats counts the requests served on a route since the previous heartbeat. Latency
+// holds, for every bucket of RequestLatencyBuckets, the successful requests which took at
+// most the bucket bound.
+type RequestStats struct {
 	TS        time.Time `json:"time"`
 	ServiceID string    `json:"service_id"`
-	Max       float64   `json:"max"`
-	Min       float64   `json:"min"`
-	Average   float64   `json:"avg"`
-	NumValues int       `json:"val"`
+	Route     string    `json:"route"`
+	Requests  int       `json:"requests"`
+	Errors    int       `json:"errors"`
+	Latency   []int     `json:"latency"`
+}
+
+// LabelService is the label holding the name of the service which reported a metric
+const LabelService = "service"
+
+type Aggregation struct {
+	MetricID  string            `json:"metric_id"`
+	TS        time.Time         `json:"time"`
+	ServiceID string            `json:"service_id"`
+	Max       float64           `json:"max"`
+	Min       float64           `json:"min"`
+	Average   float64           `json:"avg"`
+	NumValues int               `json:"val"`
+	Labels    map[string]string `json:"labels,omitempty"`
 }
 
+// DataPoint is a sample of a metric as ingested by the orchestrator, streamed by GET /stats/live
 type DataPoint struct {
-	MetricID  string
-	TS        time.Time
-	ServiceID string
-	Value     float64
+	MetricID  string            `json:"metric_id"`
+	TS        time.Time         `json:"time"`
+	ServiceID string            `json:"service_id"`
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// StatsResponse holds the aggregations of a metric along with the tier which served them.
+// When a step is requested the aggregations are re-bucketed into one series per service instead,
+// and then optionally transformed by a pipeline of functions.
+type StatsResponse struct {
+	MetricID      string        `json:"metric_id"`
+	Tier          string        `json:"tier"`
+	Resolution    int64         `json:"resolution"`
+	StartTS       time.Time     `json:"start_ts"`
+	EndTS         time.Time     `json:"end_ts"`
+	Aggregations  []Aggregation `json:"aggregations,omitempty"`
+	Step          int64         `json:"step,omitempty"`
+	Function      string        `json:"function,omitempty"`
+	Pipeline      string        `json:"pipeline,omitempty"`
+	Series        []Series      `json:"series,omitempty"`
+	NextPageToken string        `json:"next_page_token,omitempty"`
+}
+
+// QueryResponse holds the result of a query evaluated with a point every Step seconds in
+// [StartTS, EndTS). Scalar results are returned as a single series without labels.
+type QueryResponse struct {
+	Query      string    `json:"query"`
+	ResultType string    `json:"result_type"`
+	StartTS    time.Time `json:"start_ts"`
+	EndTS      time.Time `json:"end_ts"`
+	Step       int64     `json:"step"`
+	Series     []Series  `json:"series"`
+}
+
+// ImportResponse summarizes the rows upserted into Tier by an import. Expired rows, past the
+// retention of the tier, are skipped.
+type ImportResponse struct {
+	Tier     string `json:"tier"`
+	Imported int    `json:"imported"`
+	Expired  int    `json:"expired,omitempty"`
+	Batches  int    `json:"batches"`
+}
+
+// Series holds evenly spaced points of a single service instance
+type Series struct {
+	ServiceID string            `json:"service_id"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Points    []Point           `json:"points"`
+}
+
+// Point is the value of a series at a step, Value is null for steps without data
+type Point struct {
+	TS    time.Time `json:"time"`
+	Value *float64  `json:"value"`
 }
 
 // Stats is the json containing relevant info about the host
@@ -59,15 +165,245 @@ type RegisterRequest struct {
 	ServiceName    string `json:"service_name"`
 }
 
+// ServicesResponse lists the registered services with their sidecars
+type ServicesResponse struct {
+	Services []ServiceInfo `json:"services"`
+}
+
+// ServiceInfo is a registered service with its sidecars
+type ServiceInfo struct {
+	ServiceName string       `json:"service_name"`
+	Registrants []Registrant `json:"registrants"`
+}
+
+// Registrant is a sidecar registered for a service, a draining sidecar keeps serving its
+// current clients but should not be sent new ones. Health is pending until the first
+// heartbeat succeeds, ServiceID being the instance the stats of the last heartbeat were
+// reported for.
+type Registrant struct {
+	ControlAddress string     `json:"control_address"`
+	DataAddress    string     `json:"data_address"`
+	ServiceName    string     `json:"service_name"`
+	Draining       bool       `json:"draining,omitempty"`
+	Health         string     `json:"health,omitempty"`
+	LastHeartbeat  *time.Time `json:"last_heartbeat,omitempty"`
+	ServiceID      string     `json:"service_id,omitempty"`
+}
+
+const (
+	HealthPending = "pending"
+	HealthHealthy = "healthy"
+)
+
+const (
+	InstanceRegistered   = "registered"
+	InstanceHeartbeat    = "heartbeat"
+	InstanceDraining     = "draining"
+	InstanceServing      = "serving"
+	InstanceUnhealthy    = "unhealthy"
+	InstanceDeregistered = "deregistered"
+)
+
+// InstanceEvent is a change of a registered sidecar streamed by GET /events. Unhealthy
+// sidecars, whose heartbeat failed, are deregistered right after.
+type InstanceEvent struct {
+	TS         time.Time  `json:"time"`
+	Type       string     `json:"type"`
+	Registrant Registrant `json:"registrant"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Results of the reloads of a configuration
+const (
+	ConfigApplied   = "applied"
+	ConfigUnchanged = "unchanged"
+	ConfigRejected  = "rejected"
+)
+
+// ConfigEvent records a reload of a configuration, on SIGHUP, a change of its files or a
+// POST /config/reload. A rejected reload keeps the previous configuration, Error telling why.
+type ConfigEvent struct {
+	TS      time.Time `json:"time"`
+	Trigger string    `json:"trigger"`
+	Result  string    `json:"result"`
+	Changes []string  `json:"changes,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type ConfigEventsResponse struct {
+	Events []ConfigEvent `json:"events"`
+}
+
+// LiveStatsRequest selects the data points streamed by GET /stats/live, every data point when
+// empty. Buffer is the number of data points buffered by the orchestrator, the default when 0.
+type LiveStatsRequest struct {
+	MetricIDs   []string
+	ServiceName string
+	ServiceID   string
+	Buffer      int
+}
+
+// StatsRequest selects the aggregations of a metric, see GET /stats for the parameters.
+// StartTS is required and EndTS defaults to now.
+type StatsRequest struct {
+	MetricID    string
+	ServiceID   string
+	ServiceName string
+	Resolution  string
+	StartTS     time.Time
+	EndTS       time.Time
+	Step        time.Duration
+	Points      int
+	Function    string
+	Fill        string
+	Apply       string
+	PageSize    int
+	PageToken   string
+}
+
+// QueryRequest evaluates a query over [StartTS, EndTS) with a point every Step, the step
+// being picked by the orchestrator when zero
+type QueryRequest struct {
+	Query   string
+	StartTS time.Time
+	EndTS   time.Time
+	Step    time.Duration
+}
+
+// ExportRequest selects the rows of a metric in a tier, the raw tier when empty
+type ExportRequest struct {
+	Tier        string
+	MetricID    string
+	ServiceID   string
+	ServiceName string
+	StartTS     time.Time
+	EndTS       time.Time
+}
+
+// AnomaliesRequest selects the detected anomalies, every field is optional
+type AnomaliesRequest struct {
+	MetricID    string
+	ServiceID   string
+	ServiceName string
+	StartTS     time.Time
+	EndTS       time.Time
+}
+
 // RegisterResponse is the message sent by the orchestrator to the host
 type RegisterResponse struct {
 	Code       int    `json:"code"`
 	ErrMessage string `json:"err_message"`
 }
 
-// OrchestratorClient interface for interacting with the orchestrator service
+// BackfillRequest asks the orchestrator to recompute a rollup tier from its source tier.
+// An empty ServiceID recomputes every service of the metric.
+type BackfillRequest struct {
+	Tier      string    `json:"tier"`
+	MetricID  string    `json:"metric_id"`
+	ServiceID string    `json:"service_id,omitempty"`
+	StartTS   time.Time `json:"start_ts"`
+	EndTS     time.Time `json:"end_ts"`
+	DryRun    bool      `json:"dry_run"`
+}
+
+// MaxBackfillChanges bounds the changes listed by a backfill, its counts covering every row
+const MaxBackfillChanges = 1000
+
+// BackfillResponse summarizes a backfill, Changes lists the first MaxBackfillChanges rows which
+// were, or with a dry run would be, written and Truncated tells whether there were more
+type BackfillResponse struct {
+	Tier      string           `json:"tier"`
+	MetricID  string           `json:"metric_id"`
+	StartTS   time.Time        `json:"start_ts"`
+	EndTS     time.Time        `json:"end_ts"`
+	DryRun    bool             `json:"dry_run"`
+	Inserted  int              `json:"inserted"`
+	Updated   int              `json:"updated"`
+	Unchanged int              `json:"unchanged"`
+	Changes   []BackfillChange `json:"changes"`
+	Truncated bool             `json:"truncated,omitempty"`
+}
+
+// Statuses of a backfill job
+const (
+	BackfillRunning   = "running"
+	BackfillSucceeded = "succeeded"
+	BackfillFailed    = "failed"
+)
+
+// BackfillJob is a backfill run in the background. Its progress is counted in windows of the
+// tier, Result is set once it succeeded and Error once it failed.
+type BackfillJob struct {
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Request     BackfillRequest   `json:"request"`
+	Windows     int               `json:"windows"`
+	WindowsDone int               `json:"windows_done"`
+	StartedAt   time.Time         `json:"started_at"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Result      *BackfillResponse `json:"result,omitempty"`
+}
+
+// BackfillChange is a recomputed row which differs from the stored one
+type BackfillChange struct {
+	Action     string       `json:"action"`
+	Stored     *Aggregation `json:"stored,omitempty"`
+	Recomputed Aggregation  `json:"recomputed"`
+}
+
+// OrchestratorClient interface for interacting with the orchestrator service. Error status
+// codes are returned as an *APIError, whose cause is one of ErrInvalidRequest, ErrNotFound,
+// ErrMethodNotAllowed, ErrConflict, ErrServer or ErrUnexpectedStatus.
 type OrchestratorClient interface {
 	RegisterSidecar(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	UnregisterSidecar(context.Context, *RegisterRequest) error
+	// DrainSidecar marks a registered sidecar as draining until UndrainSidecar is called
+	DrainSidecar(context.Context, *RegisterRequest) error
+	UndrainSidecar(context.Context, *RegisterRequest) error
+	GetServices(context.Context) (*ServicesResponse, error)
+	// StreamInstanceEvents calls fn with the changes of the registered sidecars, of every service
+	// when serviceName is empty, like StreamDataPoints
+	StreamInstanceEvents(ctx context.Context, serviceName string, fn func(event InstanceEvent) error) error
+
+	GetStats(context.Context, *StatsRequest) (*StatsResponse, error)
+	// StreamStats calls fn with every row of the stats as they are received, and returns the
+	// response without aggregations
+	StreamStats(ctx context.Context, req *StatsRequest, fn func(row Aggregation) error) (*StatsResponse, error)
+	// StreamDataPoints calls fn with every data point matching req as the orchestrator ingests
+	// them, until ctx is done or fn fails. Its error is caused by ErrStreamDropped when the
+	// orchestrator dropped the stream for falling behind.
+	StreamDataPoints(ctx context.Context, req *LiveStatsRequest, fn func(dp DataPoint) error) error
+	Query(context.Context, *QueryRequest) (*QueryResponse, error)
+	// Backfill starts a backfill in the background, GetBackfill returning its progress
+	Backfill(context.Context, *BackfillRequest) (*BackfillJob, error)
+	GetBackfill(ctx context.Context, id string) (*BackfillJob, error)
+	// Export calls fn with every exported row as they are received
+	Export(ctx context.Context, req *ExportRequest, fn func(row Aggregation) error) error
+	Import(ctx context.Context, tier string, rows []Aggregation) (*ImportResponse, error)
+
+	GetAlerts(context.Context) (*AlertsResponse, error)
+	GetAlertRules(context.Context) (*AlertRulesResponse, error)
+	PutAlertRule(context.Context, *AlertRule) error
+	DeleteAlertRule(ctx context.Context, name string) error
+	GetAlertReceivers(context.Context) (*AlertReceiversResponse, error)
+	PutAlertReceiver(context.Context, *AlertReceiver) error
+	DeleteAlertReceiver(ctx context.Context, name string) error
+	GetAlertRoute(context.Context) (*AlertRoute, error)
+	PutAlertRoute(context.Context, *AlertRoute) error
+	GetSilences(context.Context) (*SilencesResponse, error)
+	PutSilence(context.Context, *Silence) (*Silence, error)
+	ExpireSilence(ctx context.Context, id string) error
+
+	// GetSLOs returns every SLO, or only the named one
+	GetSLOs(ctx context.Context, name string) (*SLOResponse, error)
+	GetAnomalies(context.Context, *AnomaliesRequest) (*AnomaliesResponse, error)
+
+	// ReloadConfig reloads the config of the orchestrator, the event telling whether it was
+	// applied or rejected
+	ReloadConfig(context.Context) (*ConfigEvent, error)
+	// GetConfigEvents returns the last reloads of the config, oldest first
+	GetConfigEvents(context.Context) (*ConfigEventsResponse, error)
 }
 
 type HeartbeatClient interface {
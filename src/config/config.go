@@ -0,0 +1,253 @@
+// Package config loads typed configurations from a json or yaml file, environment variables and
+// flags, each overriding the previous one. The fields of a configuration are named by their tags:
+//
+//	Interval config.Duration `json:"interval" env:"INTERVAL" flag:"interval" usage:"Interval between checks"`
+//
+// json names the field in the file, env the environment variable once prefixed and flag the
+// command-line flag. Nested structs are walked, their fields being tagged the same way. A
+// Reloader applies the changes of a configuration to a running process.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Duration is a time.Duration which is read from, and written to, json as a string e.g. "10s"
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Wrapf(err, "duration must be a string e.g. \"10s\"")
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// Validator is implemented by the configurations checking their values once loaded
+type Validator interface {
+	Validate() error
+}
+
+// Bind registers on fs the flags of the fields of cfg, a pointer to a struct, defaulting to
+// their current values. Their values are only applied to cfg by Load, and only when set on the
+// command line, so that the defaults do not override the file or the environment.
+func Bind(fs *flag.FlagSet, cfg interface{}) {
+	walk(reflect.ValueOf(cfg).Elem(), func(field reflect.StructField, value reflect.Value) error {
+		name, usage := field.Tag.Get("flag"), field.Tag.Get("usage")
+		if len(name) == 0 {
+			return nil
+		}
+
+		switch {
+		case value.Type() == durationType:
+			fs.Duration(name, time.Duration(value.Int()), usage)
+		case value.Kind() == reflect.Bool:
+			fs.Bool(name, value.Bool(), usage)
+		case value.Kind() == reflect.Int || value.Kind() == reflect.Int64:
+			fs.Int64(name, value.Int(), usage)
+		case value.Kind() == reflect.Float64:
+			fs.Float64(name, value.Float(), usage)
+		default:
+			fs.String(name, format(value), usage)
+		}
+		return nil
+	})
+}
+
+// Load overrides cfg, a pointer to a struct holding the defaults, with the json or yaml file at
+// path when not empty, the environment variables named by prefix and the env tags, and the flags
+// of fs set on the command line, fs being nil when there are none. The configuration is then
+// validated when it implements Validator.
+func Load(cfg interface{}, path, prefix string, fs *flag.FlagSet) error {
+	if len(path) > 0 {
+		if err := loadFile(cfg, path); err != nil {
+			return err
+		}
+	}
+
+	root := reflect.ValueOf(cfg).Elem()
+	if err := walk(root, func(field reflect.StructField, value reflect.Value) error {
+		name := field.Tag.Get("env")
+		if len(name) == 0 {
+			return nil
+		}
+		raw, ok := os.LookupEnv(prefix + name)
+		if !ok {
+			return nil
+		}
+		return errors.Wrapf(parse(value, raw), "Invalid environment variable %s=%q", prefix+name, raw)
+	}); err != nil {
+		return err
+	}
+
+	if fs != nil {
+		set := map[string]string{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+
+		if err := walk(root, func(field reflect.StructField, value reflect.Value) error {
+			name := field.Tag.Get("flag")
+			raw, ok := set[name]
+			if len(name) == 0 || !ok {
+				return nil
+			}
+			return errors.Wrapf(parse(value, raw), "Invalid flag -%s=%q", name, raw)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return errors.Wrapf(err, "Invalid config")
+		}
+	}
+	return nil
+}
+
+// Print logs the effective configuration as json
+func Print(name string, cfg interface{}) {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		log.Printf("Failed marshalling %s config! err=%s", name, err.Error())
+		return
+	}
+	log.Printf("Effective %s config:\n%s", name, data)
+}
+
+// loadFile reads the json or yaml file at path into cfg, fields unknown to cfg being rejected so
+// that misspelled settings are not silently ignored. Files ending with .yaml or .yml are read as
+// yaml, see yamlToJSON for the syntax supported.
+func loadFile(cfg interface{}, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed reading config=%s", path)
+	}
+
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return errors.Wrapf(err, "Failed parsing config=%s", path)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return errors.Wrapf(err, "Failed parsing config=%s", path)
+	}
+	return nil
+}
+
+// walk calls fn with every field of the struct v, descending into the nested structs
+func walk(v reflect.Value, fn func(field reflect.StructField, value reflect.Value) error) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		if value.Kind() == reflect.Struct {
+			if err := walk(value, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parse sets the field value from raw, slices being comma separated
+func parse(value reflect.Value, raw string) error {
+	if value.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type=%s", value.Type())
+		}
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type=%s", value.Type())
+	}
+	return nil
+}
+
+// format returns the value as parse reads it, for the defaults of the flags
+func format(value reflect.Value) string {
+	if value.Kind() == reflect.Slice {
+		items := make([]string, value.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(value.Index(i).Interface())
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
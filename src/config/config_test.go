@@ -0,0 +1,139 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Address  string            `json:"address" env:"ADDRESS" flag:"address"`
+	Interval Duration          `json:"interval" env:"INTERVAL" flag:"interval"`
+	Enabled  bool              `json:"enabled" env:"ENABLED" flag:"enabled"`
+	Ratio    float64           `json:"ratio"`
+	Store    testStore         `json:"store"`
+	Rules    []testRule        `json:"rules"`
+	Labels   map[string]string `json:"labels"`
+}
+
+type testStore struct {
+	Seeds    []string `json:"seeds" env:"SEEDS" flag:"seeds"`
+	NumConns int      `json:"num_conns" env:"NUM_CONNS" flag:"num-conns"`
+}
+
+type testRule struct {
+	Name  string   `json:"name"`
+	Hosts []string `json:"hosts"`
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadYAML(t *testing.T) {
+	jsonPath := writeFile(t, "config.json", `{
+  "address": "http://localhost:8500/#api",
+  "interval": "10s",
+  "enabled": true,
+  "ratio": 0.5,
+  "store": {"seeds": ["10.0.0.1", "10.0.0.2"], "num_conns": 4},
+  "rules": [{"name": "a", "hosts": ["x"]}, {"name": "it's", "hosts": []}],
+  "labels": {"team": "ops", "zone": "1"}
+}`)
+	yamlPath := writeFile(t, "config.yaml", `---
+# the api
+address: "http://localhost:8500/#api"  # quoted, so the # is kept
+interval: 10s
+enabled: true
+ratio: .5
+
+store:
+  seeds:
+  - 10.0.0.1
+  - '10.0.0.2'
+  num_conns: 4
+rules:
+  - name: a
+    hosts: [x]
+  - name: 'it''s'
+    hosts: []
+labels:
+  team: ops
+  "zone": "1"
+`)
+
+	want, got := testConfig{}, testConfig{}
+	if err := Load(&want, jsonPath, "TEST_", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(&got, yamlPath, "TEST_", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got config=%+v, want %+v", got, want)
+	}
+	if want.Interval.Duration() != 10*time.Second || want.Address != "http://localhost:8500/#api" {
+		t.Errorf("got config=%+v", want)
+	}
+}
+
+func TestLoadYAMLErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"adress: x\n", `unknown field "adress"`},
+		{"store:\n\tnum_conns: 4\n", "line 2: tabs can not indent"},
+		{"store: {num_conns: 4}\n", "line 1: flow mappings are not supported"},
+		{"store:\n  num_conns: 4\n    seeds: [a]\n", "line 3: unexpected indentation"},
+		{"address: a\naddress: b\n", `line 2: duplicate key "address"`},
+		{"address: |\n  a\n", "line 1: anchors, aliases, tags and multi-line strings are not supported"},
+		{"store:\n  seeds: [a, [b]]\n", "nested flow collections are not supported"},
+		{"address\n", `line 1: expected a "key: value" mapping entry`},
+		{"store:\n  num_conns: four\n", "cannot unmarshal string"},
+	}
+
+	for _, test := range tests {
+		cfg := testConfig{}
+		err := Load(&cfg, writeFile(t, "config.yml", test.content), "TEST_", nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got err=%v, want %q", test.content, err, test.err)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", "address: file\ninterval: 1s\nstore:\n  num_conns: 2\n")
+	os.Setenv("TEST_INTERVAL", "2s")
+	os.Setenv("TEST_NUM_CONNS", "3")
+	defer os.Unsetenv("TEST_INTERVAL")
+	defer os.Unsetenv("TEST_NUM_CONNS")
+
+	cfg := testConfig{Address: "default", Enabled: true}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	Bind(fs, &cfg)
+	if err := fs.Parse([]string{"-num-conns=4", "-seeds=a, b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(&cfg, path, "TEST_", fs); err != nil {
+		t.Fatal(err)
+	}
+
+	want := testConfig{
+		Address:  "file",
+		Interval: Duration(2 * time.Second),
+		Enabled:  true,
+		Store:    testStore{Seeds: []string{"a", "b"}, NumConns: 4},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got config=%+v, want %+v", cfg, want)
+	}
+}
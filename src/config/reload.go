@@ -0,0 +1,163 @@
+package config
+
+import (
+	"clients"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxEvents bounds the reloads kept in the event log of a Reloader
+const maxEvents = 100
+
+// Reloader reloads a configuration on SIGHUP and whenever one of its files changes, the files
+// being polled for their size and modification time since there is no file notification
+// across platforms. Reloads are serialized and recorded in an event log, except for those of
+// files which changed without changing the configuration, e.g. rewritten as they were, unless
+// they follow a rejected reload and thus tell that the previous configuration is current again.
+type Reloader struct {
+	reload   func() ([]string, error)
+	paths    func() []string
+	interval time.Duration
+	// lock serializes the reloads, eventsLock guards the event log
+	lock       *sync.Mutex
+	events     []clients.ConfigEvent
+	eventsLock *sync.RWMutex
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+// fileStamp tells whether a polled file changed, a missing file having a zero stamp
+type fileStamp struct {
+	size    int64
+	modTime int64
+}
+
+// NewReloader creates a reloader of the configuration applied by reload, which returns the
+// changes it applied, or an error once it left the previous configuration in place. paths
+// returns the files to poll every interval, empty paths being skipped.
+func NewReloader(reload func() ([]string, error), paths func() []string, interval time.Duration) *Reloader {
+	return &Reloader{
+		reload:     reload,
+		paths:      paths,
+		interval:   interval,
+		lock:       &sync.Mutex{},
+		eventsLock: &sync.RWMutex{},
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// Start starts handling SIGHUP and polling the files
+func (r *Reloader) Start() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go r.run(hup)
+}
+
+// Stop stops handling SIGHUP and polling the files, once the reload in progress is over
+func (r *Reloader) Stop() {
+	close(r.done)
+	<-r.stopped
+}
+
+func (r *Reloader) run(hup chan os.Signal) {
+	defer close(r.stopped)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	stamps := r.stamps()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-hup:
+			r.apply("SIGHUP", true)
+			stamps = r.stamps()
+		case <-ticker.C:
+			current := r.stamps()
+			for path, stamp := range current {
+				if previous, ok := stamps[path]; ok && previous != stamp {
+					r.apply("file="+path, false)
+					current = r.stamps()
+					break
+				}
+			}
+			stamps = current
+		}
+	}
+}
+
+// Reload reloads the configuration now, trigger telling what asked for it
+func (r *Reloader) Reload(trigger string) clients.ConfigEvent {
+	return r.apply(trigger, true)
+}
+
+// Events returns the last reloads, oldest first
+func (r *Reloader) Events() []clients.ConfigEvent {
+	r.eventsLock.RLock()
+	defer r.eventsLock.RUnlock()
+
+	return append([]clients.ConfigEvent{}, r.events...)
+}
+
+// apply reloads the configuration and records the event, unless it is unchanged and
+// recordUnchanged is false
+func (r *Reloader) apply(trigger string, recordUnchanged bool) clients.ConfigEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	event := clients.ConfigEvent{TS: time.Now().UTC(), Trigger: trigger}
+	changes, err := r.reload()
+	switch {
+	case err != nil:
+		event.Result, event.Error = clients.ConfigRejected, err.Error()
+		log.Printf("Failed reloading config trigger=%s, keeping the previous config! err=%s", trigger, err.Error())
+	case len(changes) == 0:
+		event.Result = clients.ConfigUnchanged
+		log.Printf("Reloaded config trigger=%s, nothing changed", trigger)
+		if !recordUnchanged && !r.lastRejected() {
+			return event
+		}
+	default:
+		event.Result, event.Changes = clients.ConfigApplied, changes
+		log.Printf("Reloaded config trigger=%s changes=%q", trigger, changes)
+	}
+
+	r.eventsLock.Lock()
+	r.events = append(r.events, event)
+	if len(r.events) > maxEvents {
+		r.events = r.events[len(r.events)-maxEvents:]
+	}
+	r.eventsLock.Unlock()
+
+	return event
+}
+
+func (r *Reloader) lastRejected() bool {
+	r.eventsLock.RLock()
+	defer r.eventsLock.RUnlock()
+
+	return len(r.events) > 0 && r.events[len(r.events)-1].Result == clients.ConfigRejected
+}
+
+// stamps returns the stamps of the files to poll
+func (r *Reloader) stamps() map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	for _, path := range r.paths() {
+		if len(path) == 0 {
+			continue
+		}
+		stamp := fileStamp{}
+		if info, err := os.Stat(path); err == nil {
+			stamp = fileStamp{size: info.Size(), modTime: info.ModTime().UnixNano()}
+		}
+		stamps[path] = stamp
+	}
+	return stamps
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"clients"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testReloads is a configuration whose reloads return the next of its results
+type testReloads struct {
+	results []error
+	changes []string
+	calls   int
+	lock    sync.Mutex
+}
+
+func (r *testReloads) reload() ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.calls++
+	if len(r.results) == 0 {
+		return nil, nil
+	}
+	err := r.results[0]
+	r.results = r.results[1:]
+	if err != nil {
+		return nil, err
+	}
+	return r.changes, nil
+}
+
+func eventResults(events []clients.ConfigEvent) []string {
+	results := []string{}
+	for _, event := range events {
+		results = append(results, event.Trigger+" "+event.Result)
+	}
+	return results
+}
+
+func waitEvents(t *testing.T, r *Reloader, n int) []clients.ConfigEvent {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); len(r.Events()) < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got events=%v, want %d", eventResults(r.Events()), n)
+		}
+	}
+	return r.Events()
+}
+
+func TestReload(t *testing.T) {
+	reloads := &testReloads{results: []error{nil, errors.New("invalid port"), nil}, changes: []string{"port: 1 -> 2"}}
+	r := NewReloader(reloads.reload, func() []string { return nil }, time.Hour)
+
+	if event := r.Reload("api"); event.Result != clients.ConfigApplied || !reflect.DeepEqual(event.Changes, reloads.changes) {
+		t.Errorf("got event=%+v, want the changes applied", event)
+	}
+	if event := r.Reload("api"); event.Result != clients.ConfigRejected || event.Error != "invalid port" {
+		t.Errorf("got event=%+v, want the reload rejected", event)
+	}
+	r.Reload("api")
+	reloads.results = []error{nil}
+	reloads.changes = nil
+	r.Reload("api")
+
+	want := []string{"api applied", "api rejected", "api applied", "api unchanged"}
+	if got := eventResults(r.Events()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got events=%v, want %v", got, want)
+	}
+
+	for i := 0; i < maxEvents; i++ {
+		r.Reload("api")
+	}
+	if events := r.Events(); len(events) != maxEvents || events[0].Result != clients.ConfigUnchanged {
+		t.Errorf("got events=%d, want the last %d", len(events), maxEvents)
+	}
+}
+
+// TestReloadOnChanges checks that the files are reloaded when they change, unchanged configs
+// only being recorded after a rejected reload, and on SIGHUP
+func TestReloadOnChanges(t *testing.T) {
+	path := writeFile(t, "config.json", `{"port": 1}`)
+	reloads := &testReloads{results: []error{nil, errors.New("invalid port"), nil, nil}}
+	r := NewReloader(reloads.reload, func() []string { return []string{path, ""} }, time.Millisecond)
+	r.Start()
+	defer r.Stop()
+	// the files are stamped as the reloader starts
+	time.Sleep(50 * time.Millisecond)
+
+	// the same config is written again, then an invalid one, then the previous one
+	for i, content := range []string{`{"port": 1} `, `{"port": -10}`, `{"port": 1}`} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			reloads.lock.Lock()
+			calls := reloads.calls
+			reloads.lock.Unlock()
+			if calls > i {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the change %d of the file was not reloaded", i)
+			}
+		}
+	}
+	waitEvents(t, r, 2)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	events := waitEvents(t, r, 3)
+
+	want := []string{"file=" + path + " rejected", "file=" + path + " unchanged", "SIGHUP unchanged"}
+	if got := eventResults(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("got events=%v, want %v", got, want)
+	}
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// yamlNumber matches the plain scalars read as numbers, other plain scalars being strings
+var yamlNumber = regexp.MustCompile(`^[-+]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// yamlToJSON converts a YAML document to json, so that config files of either format are
+// decoded the same way. It reads the subset config files need: block mappings and sequences,
+// flow sequences of scalars, quoted and plain scalars and comments. Anchors, tags, flow mappings
+// and multi-line scalars are rejected.
+func yamlToJSON(data []byte) ([]byte, error) {
+	p := yamlParser{}
+	for i, line := range strings.Split(string(data), "\n") {
+		text := strings.TrimRight(stripComment(line), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if len(trimmed) == 0 || trimmed == "---" {
+			continue
+		}
+		if trimmed == "..." {
+			break
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can not indent", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+
+	var doc interface{}
+	if len(p.lines) > 0 {
+		var err error
+		if doc, err = p.parseBlock(p.lines[0].indent); err != nil {
+			return nil, err
+		}
+		if p.pos < len(p.lines) {
+			return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// stripComment removes the comment of a line, a # outside of quotes at its start or following a space
+func stripComment(line string) string {
+	quote := rune(0)
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// parseBlock parses the mapping or sequence starting at the current line
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if isSequenceItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	result := map[string]interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		if isSequenceItem(line.text) {
+			return nil, fmt.Errorf("line %d: unexpected sequence item in a mapping", line.num)
+		}
+		key, rest, err := splitKey(line.text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line.num, err.Error())
+		}
+		if _, ok := result[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.num, key)
+		}
+		p.pos++
+
+		if len(rest) > 0 {
+			if result[key], err = parseScalar(rest); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line.num, err.Error())
+			}
+			continue
+		}
+		// the value is the nested block, sequences may be as indented as their key
+		result[key] = nil
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || (next.indent == indent && isSequenceItem(next.text)) {
+				if result[key], err = p.parseBlock(next.indent); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	result := []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSequenceItem(p.lines[p.pos].text) {
+		line := p.lines[p.pos]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+
+		// an item holding a mapping, e.g. "- name: a", is parsed as a mapping indented to its first key
+		if _, _, err := splitKey(rest); err == nil && !strings.HasPrefix(rest, "[") {
+			p.lines[p.pos] = yamlLine{num: line.num, indent: line.indent + len(line.text) - len(rest), text: rest}
+			item, err := p.parseMapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, item)
+			continue
+		}
+
+		p.pos++
+		var item interface{}
+		var err error
+		switch {
+		case len(rest) > 0:
+			if item, err = parseScalar(rest); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line.num, err.Error())
+			}
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			if item, err = p.parseBlock(p.lines[p.pos].indent); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// splitKey splits a mapping entry into its key and the text of its value
+func splitKey(text string) (string, string, error) {
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated quoted key")
+		}
+		key, err := parseScalar(text[:end+2])
+		if err != nil {
+			return "", "", err
+		}
+		rest := text[end+2:]
+		if rest != ":" && !strings.HasPrefix(rest, ": ") {
+			return "", "", fmt.Errorf("expected \":\" after key %q", key)
+		}
+		return key.(string), strings.TrimSpace(rest[1:]), nil
+	}
+
+	if strings.HasSuffix(text, ":") && !strings.Contains(text, ": ") {
+		return strings.TrimSpace(text[:len(text)-1]), "", nil
+	}
+	i := strings.Index(text, ": ")
+	if i <= 0 {
+		return "", "", fmt.Errorf("expected a \"key: value\" mapping entry")
+	}
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+2:]), nil
+}
+
+// parseScalar parses a quoted or plain scalar, or a flow sequence of them
+func parseScalar(text string) (interface{}, error) {
+	switch text[0] {
+	case '"':
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid double quoted string %s", text)
+		}
+		return s, nil
+	case '\'':
+		if len(text) < 2 || text[len(text)-1] != '\'' {
+			return nil, fmt.Errorf("invalid single quoted string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case '[':
+		return parseFlowSequence(text)
+	case '{':
+		return nil, fmt.Errorf("flow mappings are not supported, use a block mapping")
+	case '&', '*', '!', '|', '>':
+		return nil, fmt.Errorf("anchors, aliases, tags and multi-line strings are not supported")
+	}
+
+	switch text {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if yamlNumber.MatchString(text) {
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return n, nil
+		}
+		return strconv.ParseFloat(text, 64)
+	}
+	return text, nil
+}
+
+func parseFlowSequence(text string) (interface{}, error) {
+	if text[len(text)-1] != ']' {
+		return nil, fmt.Errorf("unterminated flow sequence %s", text)
+	}
+
+	result := []interface{}{}
+	inner := strings.TrimSpace(text[1 : len(text)-1])
+	if len(inner) == 0 {
+		return result, nil
+	}
+
+	items := []string{}
+	quote, start := byte(0), 0
+	for i := 0; i < len(inner); i++ {
+		switch c := inner[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			return nil, fmt.Errorf("nested flow collections are not supported")
+		case c == ',':
+			items = append(items, inner[start:i])
+			start = i + 1
+		}
+	}
+	items = append(items, inner[start:])
+
+	for _, item := range items {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			return nil, fmt.Errorf("empty item in flow sequence %s", text)
+		}
+		value, err := parseScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
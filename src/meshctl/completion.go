@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+func setupCompletion(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args, "bash|zsh"); err != nil {
+			return err
+		}
+
+		switch args[0] {
+		case "bash":
+			writeBashCompletion(c.out)
+		case "zsh":
+			fmt.Fprintf(c.out, "autoload -U +X bashcompinit && bashcompinit\n")
+			writeBashCompletion(c.out)
+		default:
+			return fmt.Errorf("unknown shell=%s, expected bash or zsh", args[0])
+		}
+		return nil
+	}
+}
+
+// writeBashCompletion prints a completion script of the command table: the words before the
+// first flag select the command, whose subcommands or flags are then completed
+func writeBashCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# meshctl completion, load with: source <(meshctl completion bash)\n")
+	fmt.Fprintf(w, "_meshctl() {\n")
+	fmt.Fprintf(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" path=\"\" i\n")
+	fmt.Fprintf(w, "\tfor ((i = 1; i < COMP_CWORD; i++)); do\n")
+	fmt.Fprintf(w, "\t\tcase \"${COMP_WORDS[i]}\" in -*) break ;; *) path=\"${path:+$path }${COMP_WORDS[i]}\" ;; esac\n")
+	fmt.Fprintf(w, "\tdone\n")
+	fmt.Fprintf(w, "\tcase \"$path\" in\n")
+
+	subcommands := map[string][]string{}
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t\"%s\"|\"%s \"*) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n", cmd.name, cmd.name,
+			strings.Join(commandFlags(cmd), " "))
+
+		words := strings.Fields(cmd.name)
+		if len(words) > 1 {
+			subcommands[words[0]] = append(subcommands[words[0]], words[1])
+		}
+	}
+	for _, group := range groups() {
+		if names, ok := subcommands[group]; ok {
+			fmt.Fprintf(w, "\t\"%s\") COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n", group, strings.Join(names, " "))
+		}
+	}
+
+	fmt.Fprintf(w, "\t\"\") COMPREPLY=($(compgen -W \"%s help\" -- \"$cur\")) ;;\n", strings.Join(groups(), " "))
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -F _meshctl meshctl\n")
+}
+
+// commandFlags returns the flags of a command, prefixed with a dash
+func commandFlags(cmd *command) []string {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	addGlobalFlags(fs)
+	cmd.setup(fs)
+
+	names := []string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+	})
+	return names
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"clients"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	envAddress        = "MESHCTL_ADDRESS"
+	envConfig         = "MESHCTL_CONFIG"
+	defaultAddress    = "http://localhost:8500"
+	defaultConfigPath = "~/.meshctl.json"
+)
+
+const (
+	outputTable     = "table"
+	outputJSON      = "json"
+	outputSparkline = "sparkline"
+)
+
+// config is the json file of the defaults of meshctl, e.g.
+// {"address": "http://orchestrator:8500", "output": "json"}
+type config struct {
+	Address string `json:"address"`
+	Output  string `json:"output"`
+}
+
+// globalFlags are the flags of every command
+type globalFlags struct {
+	address *string
+	config  *string
+	output  *string
+}
+
+func addGlobalFlags(fs *flag.FlagSet) *globalFlags {
+	return &globalFlags{
+		address: fs.String("address", "", "Orchestrator address, overrides $"+envAddress+" and the config file"),
+		config:  fs.String("config", "", "Config file, $"+envConfig+" or "+defaultConfigPath+" by default"),
+		output:  fs.String("o", "", "Output format: table or json, stats query also supports sparkline"),
+	}
+}
+
+// cli resolves the address and output format, the flags taking precedence over the
+// environment and the environment over the config file
+func (f *globalFlags) cli() (*cli, error) {
+	path := *f.config
+	explicit := len(path) > 0
+	if !explicit {
+		if path = os.Getenv(envConfig); len(path) > 0 {
+			explicit = true
+		} else {
+			path = defaultConfigPath
+		}
+	}
+
+	cfg, err := loadConfig(path, explicit)
+	if err != nil {
+		return nil, err
+	}
+
+	address := cfg.Address
+	if env := os.Getenv(envAddress); len(env) > 0 {
+		address = env
+	}
+	if len(*f.address) > 0 {
+		address = *f.address
+	}
+	if len(address) == 0 {
+		address = defaultAddress
+	}
+
+	output := cfg.Output
+	if len(*f.output) > 0 {
+		output = *f.output
+	}
+	switch output {
+	case "", outputTable, outputJSON, outputSparkline:
+	default:
+		return nil, fmt.Errorf("unknown output format=%s", output)
+	}
+
+	return &cli{
+		client: clients.NewOrchestratorClient(address),
+		output: output,
+		out:    os.Stdout,
+	}, nil
+}
+
+// loadConfig reads the config file, a missing file is only an error when it was set explicitly
+func loadConfig(path string, explicit bool) (*config, error) {
+	if len(path) > 1 && path[:2] == "~/" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &config{}, nil
+		}
+		path = filepath.Join(home, path[2:])
+	}
+
+	cfg := config{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return &cfg, nil
+		}
+		return nil, errors.Wrapf(err, "failed reading config=%s", path)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed parsing config=%s", path)
+	}
+	return &cfg, nil
+}
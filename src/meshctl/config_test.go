@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// addressServer answers the services of an empty mesh, recording that it was called
+func addressServer(t *testing.T, called *string, name string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*called = name
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"services": []}`))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// TestCLIPrecedence checks that -address overrides the environment, which overrides the config file
+func TestCLIPrecedence(t *testing.T) {
+	called := ""
+	fromFile := addressServer(t, &called, "file")
+	fromEnv := addressServer(t, &called, "env")
+	fromFlag := addressServer(t, &called, "flag")
+
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	path := filepath.Join(dir, "meshctl.json")
+	if err := ioutil.WriteFile(path, []byte(`{"address": "`+fromFile+`", "output": "json"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(envConfig, "")
+	for _, tc := range []struct {
+		name, env string
+		args      []string
+		want      string
+		output    string
+	}{
+		{"file", "", []string{"-config", path}, "file", "json"},
+		{"env", fromEnv, []string{"-config", path, "-o", "table"}, "env", "table"},
+		{"flag", fromEnv, []string{"-config", path, "-address", fromFlag}, "flag", "json"},
+	} {
+		t.Setenv(envAddress, tc.env)
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		opts := addGlobalFlags(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		c, err := opts.cli()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if _, err := c.client.GetServices(context.Background()); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if called != tc.want || c.output != tc.output {
+			t.Errorf("%s: got address of %s and output=%s, want %s and %s", tc.name, called, c.output, tc.want, tc.output)
+		}
+	}
+}
+
+func TestCLIErrors(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv(envAddress, "")
+	invalid := filepath.Join(dir, "invalid.json")
+	ioutil.WriteFile(invalid, []byte("{"), 0644)
+
+	for _, tc := range []struct {
+		name string
+		env  string
+		args []string
+	}{
+		{"unknown output", "", []string{"-o", "yaml"}},
+		{"missing config", "", []string{"-config", filepath.Join(dir, "missing.json")}},
+		{"missing config of the environment", filepath.Join(dir, "missing.json"), nil},
+		{"invalid config", "", []string{"-config", invalid}},
+	} {
+		t.Setenv(envConfig, tc.env)
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		opts := addGlobalFlags(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := opts.cli(); err == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+
+	// the default config file is optional
+	t.Setenv(envConfig, "")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if _, err := addGlobalFlags(fs).cli(); err != nil {
+		t.Errorf("got err=%v without a config file", err)
+	}
+}
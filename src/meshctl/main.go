@@ -0,0 +1,142 @@
+package main
+
+import (
+	"clients"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a command of meshctl, e.g. "services list". Setup declares the flags of the
+// command on the flag set and returns the function running it with the remaining arguments.
+type command struct {
+	name    string
+	args    string
+	summary string
+	setup   func(fs *flag.FlagSet) func(c *cli, args []string) error
+}
+
+// cli is what the commands run with, the client of the orchestrator at the resolved address
+// and the output format
+type cli struct {
+	client clients.OrchestratorClient
+	output string
+	out    io.Writer
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"services list", "", "List the registered services", setupServicesList},
+		{"services get", "<service>", "Show the instances of a service", setupServicesGet},
+		{"instances drain", "<service> <control-address>", "Drain an instance, or stop draining it with -undo", setupInstancesDrain},
+		{"stats query", "", "Chart or list the stats of a metric", setupStatsQuery},
+		{"stats tail", "", "Print the data points as the orchestrator ingests them", setupStatsTail},
+		{"register", "", "Register a sidecar", setupRegister},
+		{"deregister", "", "Deregister a sidecar", setupDeregister},
+		{"watch", "", "Print the changes of the instances and alerts as they happen", setupWatch},
+		{"config reload", "", "Reload the config of the orchestrator, failing when it is rejected", setupConfigReload},
+		{"config events", "", "List the last reloads of the config of the orchestrator", setupConfigEvents},
+		{"completion", "bash|zsh", "Print the shell completion script", setupCompletion},
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("meshctl: ")
+
+	cmd, args := findCommand(os.Args[1:])
+	if cmd == nil {
+		usage(os.Stderr)
+		if len(os.Args) > 1 && os.Args[1] != "help" && os.Args[1] != "-h" && os.Args[1] != "-help" {
+			os.Exit(2)
+		}
+		return
+	}
+
+	fs := flag.NewFlagSet("meshctl "+cmd.name, flag.ExitOnError)
+	opts := addGlobalFlags(fs)
+	run := cmd.setup(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: meshctl %s [flags] %s\n\n%s\n\nFlags:\n", cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+	positional := parseFlags(fs, args)
+
+	c, err := opts.cli()
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+
+	if err := run(c, positional); err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+}
+
+// findCommand returns the command named by the first arguments, along with the others
+func findCommand(args []string) (*command, []string) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "meshctl operates the mesh through the orchestrator api.\n\nUsage:\n")
+	t := newTable(w)
+	for _, cmd := range commands {
+		t.row("  meshctl "+strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
+	}
+	t.flush()
+	fmt.Fprintf(w, "\nThe orchestrator address is read from -address, $%s or the address of the config file,\n", envAddress)
+	fmt.Fprintf(w, "$%s or %s, and defaults to %s. Run meshctl <command> -h for the flags.\n", envConfig, defaultConfigPath, defaultAddress)
+}
+
+// groups returns the first words of the command names, e.g. services and register
+func groups() []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, cmd := range commands {
+		group := strings.Fields(cmd.name)[0]
+		if !seen[group] {
+			seen[group] = true
+			result = append(result, group)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// parseFlags parses the flags wherever they are among the arguments, e.g. services get echo
+// -o json, and returns the positional arguments
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// requireArgs checks the number of positional arguments of a command
+func requireArgs(args []string, names ...string) error {
+	if len(args) != len(names) {
+		return fmt.Errorf("expected %d arguments: %s", len(names), strings.Join(names, " "))
+	}
+	return nil
+}
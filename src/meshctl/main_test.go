@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestFindCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		name string
+		rest []string
+	}{
+		{[]string{"services", "get", "echo", "-o", "json"}, "services get", []string{"echo", "-o", "json"}},
+		{[]string{"register", "-service", "echo"}, "register", []string{"-service", "echo"}},
+		{[]string{"services"}, "", nil},
+		{[]string{"get", "services"}, "", nil},
+		{nil, "", nil},
+	} {
+		cmd, rest := findCommand(tc.args)
+		name := ""
+		if cmd != nil {
+			name = cmd.name
+		}
+		if name != tc.name || !reflect.DeepEqual(rest, tc.rest) {
+			t.Errorf("args=%v: got command=%q args=%v, want %q %v", tc.args, name, rest, tc.name, tc.rest)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	output := fs.String("o", "", "")
+	undo := fs.Bool("undo", false, "")
+
+	positional := parseFlags(fs, []string{"echo", "-o", "json", "http://127.0.0.1:8080", "-undo"})
+	if want := []string{"echo", "http://127.0.0.1:8080"}; !reflect.DeepEqual(positional, want) {
+		t.Errorf("got positional=%v, want %v", positional, want)
+	}
+	if *output != "json" || !*undo {
+		t.Errorf("got o=%s undo=%t, want the flags after the positional arguments parsed", *output, *undo)
+	}
+
+	if err := requireArgs(positional, "service", "control-address"); err != nil {
+		t.Error(err)
+	}
+	if err := requireArgs(positional, "service"); err == nil {
+		t.Error("got no error for an extra argument")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	want := []string{"completion", "config", "deregister", "instances", "register", "services", "stats", "watch"}
+	if got := groups(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups=%v, want %v", got, want)
+	}
+}
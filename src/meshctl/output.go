@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// writeJSON prints v as indented json
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// table prints rows aligned under their header
+type table struct {
+	writer *tabwriter.Writer
+}
+
+func newTable(w io.Writer, header ...string) *table {
+	t := table{writer: tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)}
+	if len(header) > 0 {
+		t.row(header...)
+	}
+	return &t
+}
+
+func (t *table) row(cells ...string) {
+	fmt.Fprintln(t.writer, strings.Join(cells, "\t"))
+}
+
+func (t *table) flush() error {
+	return t.writer.Flush()
+}
+
+func formatFloat(v float64) string {
+	return fmt.Sprintf("%.6g", v)
+}
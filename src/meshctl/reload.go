@@ -0,0 +1,69 @@
+package main
+
+import (
+	"clients"
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func setupConfigReload(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args); err != nil {
+			return err
+		}
+
+		event, err := c.client.ReloadConfig(context.Background())
+		if err != nil {
+			return err
+		}
+		if c.output == outputJSON {
+			if err := writeJSON(c.out, event); err != nil {
+				return err
+			}
+		} else {
+			printConfigEvent(c, *event)
+		}
+
+		if event.Result == clients.ConfigRejected {
+			return errors.New("the config was rejected, the previous config is kept")
+		}
+		return nil
+	}
+}
+
+func setupConfigEvents(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args); err != nil {
+			return err
+		}
+
+		resp, err := c.client.GetConfigEvents(context.Background())
+		if err != nil {
+			return err
+		}
+		if c.output == outputJSON {
+			return writeJSON(c.out, resp)
+		}
+
+		for _, event := range resp.Events {
+			printConfigEvent(c, event)
+		}
+		return nil
+	}
+}
+
+// printConfigEvent prints the reload on a line, followed by its changes or error indented
+func printConfigEvent(c *cli, event clients.ConfigEvent) {
+	fmt.Fprintf(c.out, "%s  %-9s  %s\n", event.TS.Format(time.RFC3339), event.Result, event.Trigger)
+	if len(event.Error) > 0 {
+		fmt.Fprintf(c.out, "    %s\n", event.Error)
+	}
+	if len(event.Changes) > 0 {
+		fmt.Fprintf(c.out, "    %s\n", strings.Join(event.Changes, "\n    "))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"clients"
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+func setupServicesList(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args); err != nil {
+			return err
+		}
+
+		resp, err := getServices(c)
+		if err != nil {
+			return err
+		}
+		if c.output == outputJSON {
+			return writeJSON(c.out, resp)
+		}
+
+		t := newTable(c.out, "SERVICE", "INSTANCES", "DRAINING")
+		for _, service := range resp.Services {
+			draining := 0
+			for _, registrant := range service.Registrants {
+				if registrant.Draining {
+					draining++
+				}
+			}
+			t.row(service.ServiceName, strconv.Itoa(len(service.Registrants)), strconv.Itoa(draining))
+		}
+		return t.flush()
+	}
+}
+
+func setupServicesGet(fs *flag.FlagSet) func(c *cli, args []string) error {
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args, "<service>"); err != nil {
+			return err
+		}
+
+		resp, err := getServices(c)
+		if err != nil {
+			return err
+		}
+
+		for _, service := range resp.Services {
+			if service.ServiceName != args[0] {
+				continue
+			}
+			if c.output == outputJSON {
+				return writeJSON(c.out, service)
+			}
+
+			t := newTable(c.out, "CONTROL ADDRESS", "DATA ADDRESS", "STATE")
+			for _, registrant := range service.Registrants {
+				t.row(registrant.ControlAddress, registrant.DataAddress, registrantState(registrant))
+			}
+			return t.flush()
+		}
+
+		return fmt.Errorf("service %s is not registered", args[0])
+	}
+}
+
+func setupInstancesDrain(fs *flag.FlagSet) func(c *cli, args []string) error {
+	undo := fs.Bool("undo", false, "Stop draining the instance")
+
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args, "<service>", "<control-address>"); err != nil {
+			return err
+		}
+
+		req := clients.RegisterRequest{ServiceName: args[0], ControlAddress: args[1]}
+		drain, action := c.client.DrainSidecar, "Draining"
+		if *undo {
+			drain, action = c.client.UndrainSidecar, "Stopped draining"
+		}
+		if err := drain(context.Background(), &req); err != nil {
+			if errors.Cause(err) == clients.ErrNotFound {
+				return fmt.Errorf("service %s has no instance %s", req.ServiceName, req.ControlAddress)
+			}
+			return err
+		}
+
+		fmt.Fprintf(c.out, "%s %s %s, the sidecar is told on its next heartbeat\n", action, req.ServiceName, req.ControlAddress)
+		return nil
+	}
+}
+
+func setupRegister(fs *flag.FlagSet) func(c *cli, args []string) error {
+	req := registrantFlags(fs)
+	dataAddress := fs.String("data", "", "Data address of the service, e.g. http://localhost:10010")
+
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args); err != nil {
+			return err
+		}
+		req.DataAddress = *dataAddress
+
+		if _, err := c.client.RegisterSidecar(context.Background(), req); err != nil {
+			if errors.Cause(err) == clients.ErrConflict {
+				return errors.Errorf("%s %s is already registered", req.ServiceName, req.ControlAddress)
+			}
+			return err
+		}
+
+		fmt.Fprintf(c.out, "Registered %s %s\n", req.ServiceName, req.ControlAddress)
+		return nil
+	}
+}
+
+func setupDeregister(fs *flag.FlagSet) func(c *cli, args []string) error {
+	req := registrantFlags(fs)
+
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args); err != nil {
+			return err
+		}
+
+		if err := c.client.UnregisterSidecar(context.Background(), req); err != nil {
+			if errors.Cause(err) == clients.ErrNotFound {
+				return fmt.Errorf("service %s has no instance %s", req.ServiceName, req.ControlAddress)
+			}
+			return err
+		}
+
+		fmt.Fprintf(c.out, "Deregistered %s %s\n", req.ServiceName, req.ControlAddress)
+		return nil
+	}
+}
+
+// registrantFlags declares the -service and -control flags, the request is filled in once the
+// flags are parsed
+func registrantFlags(fs *flag.FlagSet) *clients.RegisterRequest {
+	req := clients.RegisterRequest{}
+	fs.StringVar(&req.ServiceName, "service", "", "Service name")
+	fs.StringVar(&req.ControlAddress, "control", "", "Control address of the sidecar, e.g. http://localhost:8060")
+	return &req
+}
+
+// getServices returns the services sorted by name, along with their instances
+func getServices(c *cli) (*clients.ServicesResponse, error) {
+	resp, err := c.client.GetServices(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(resp.Services, func(i, j int) bool { return resp.Services[i].ServiceName < resp.Services[j].ServiceName })
+	for _, service := range resp.Services {
+		registrants := service.Registrants
+		sort.Slice(registrants, func(i, j int) bool { return registrants[i].ControlAddress < registrants[j].ControlAddress })
+	}
+	return resp, nil
+}
+
+func registrantState(registrant clients.Registrant) string {
+	if registrant.Draining {
+		return "draining"
+	}
+	return "serving"
+}
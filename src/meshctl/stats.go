@@ -0,0 +1,202 @@
+package main
+
+import (
+	"clients"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sparkTicks are the bars of sparklines from the lowest to the highest value
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// defaultSparklinePoints is the width of sparklines without -step or -points
+const defaultSparklinePoints = 60
+
+func setupStatsQuery(fs *flag.FlagSet) func(c *cli, args []string) error {
+	metricID := fs.String("metric", "", "Metric to read, e.g. mem (required)")
+	service := fs.String("service", "", "Only read the instances of this service")
+	instance := fs.String("instance", "", "Only read this service instance")
+	since := fs.Duration("since", time.Hour, "Length of the range ending at -end, when -start is not set")
+	start := fs.String("start", "", "Start of the range, RFC3339 or unix timestamp")
+	end := fs.String("end", "", "End of the range, RFC3339 or unix timestamp, defaults to now")
+	resolution := fs.String("resolution", "", "Tier to read, e.g. raw or 5m, picked from the range by default")
+	step := fs.Duration("step", 0, "Re-bucket into one series per instance with a point every step")
+	points := fs.Int("points", 0, "Split the range into this many points, instead of -step")
+	fn := fs.String("fn", "", "Combines the rows of a step: min, max, avg, sum, count or last")
+	apply := fs.String("apply", "", "Pipeline of functions applied to the series, e.g. rate|moving_avg(5m)")
+
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args); err != nil {
+			return err
+		}
+		if len(*metricID) == 0 {
+			return errors.New("-metric is required")
+		}
+
+		endTS, err := parseTime(*end, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("invalid -end: %s", err.Error())
+		}
+		startTS, err := parseTime(*start, endTS.Add(-*since))
+		if err != nil {
+			return fmt.Errorf("invalid -start: %s", err.Error())
+		}
+
+		req := clients.StatsRequest{
+			MetricID:    *metricID,
+			ServiceID:   *instance,
+			ServiceName: *service,
+			Resolution:  *resolution,
+			StartTS:     startTS,
+			EndTS:       endTS,
+			Step:        *step,
+			Points:      *points,
+			Function:    *fn,
+			Apply:       *apply,
+		}
+		if c.output == "" || c.output == outputSparkline {
+			if req.Step == 0 && req.Points == 0 {
+				req.Points = defaultSparklinePoints
+			}
+		}
+
+		resp, err := c.client.GetStats(context.Background(), &req)
+		if err != nil {
+			return err
+		}
+
+		switch c.output {
+		case outputJSON:
+			return writeJSON(c.out, resp)
+		case outputTable:
+			return writeStatsTable(c, resp)
+		default:
+			return writeSparklines(c, resp)
+		}
+	}
+}
+
+// writeSparklines prints a line per series with its sparkline, the bars being scaled between
+// the lowest and highest values of the series
+func writeSparklines(c *cli, resp *clients.StatsResponse) error {
+	fmt.Fprintf(c.out, "%s %s to %s, %ds steps from tier %s\n", resp.MetricID, resp.StartTS.Format(time.RFC3339),
+		resp.EndTS.Format(time.RFC3339), resp.Step, resp.Tier)
+
+	t := newTable(c.out, "INSTANCE", "SPARKLINE", "MIN", "MAX", "LAST")
+	for _, series := range resp.Series {
+		min, max, last := math.Inf(1), math.Inf(-1), math.NaN()
+		for _, point := range series.Points {
+			if point.Value == nil {
+				continue
+			}
+			min, max, last = math.Min(min, *point.Value), math.Max(max, *point.Value), *point.Value
+		}
+		if math.IsNaN(last) {
+			t.row(series.ServiceID, strings.Repeat(" ", len(series.Points)), "-", "-", "-")
+			continue
+		}
+		t.row(series.ServiceID, sparkline(series.Points, min, max), formatFloat(min), formatFloat(max), formatFloat(last))
+	}
+	return t.flush()
+}
+
+func sparkline(points []clients.Point, min, max float64) string {
+	line := make([]rune, 0, len(points))
+	for _, point := range points {
+		switch {
+		case point.Value == nil:
+			line = append(line, ' ')
+		case max == min:
+			line = append(line, sparkTicks[len(sparkTicks)/2])
+		default:
+			tick := int((*point.Value - min) / (max - min) * float64(len(sparkTicks)-1))
+			line = append(line, sparkTicks[tick])
+		}
+	}
+	return string(line)
+}
+
+// writeStatsTable prints a row per point of the series, or per stored row without a step
+func writeStatsTable(c *cli, resp *clients.StatsResponse) error {
+	if len(resp.Series) > 0 {
+		t := newTable(c.out, "TIME", "INSTANCE", "VALUE")
+		for _, series := range resp.Series {
+			for _, point := range series.Points {
+				value := "-"
+				if point.Value != nil {
+					value = formatFloat(*point.Value)
+				}
+				t.row(point.TS.Format(time.RFC3339), series.ServiceID, value)
+			}
+		}
+		return t.flush()
+	}
+
+	t := newTable(c.out, "TIME", "INSTANCE", "MIN", "MAX", "AVG", "COUNT")
+	for _, row := range resp.Aggregations {
+		t.row(row.TS.Format(time.RFC3339), row.ServiceID, formatFloat(row.Min), formatFloat(row.Max),
+			formatFloat(row.Average), strconv.Itoa(row.NumValues))
+	}
+	return t.flush()
+}
+
+func setupStatsTail(fs *flag.FlagSet) func(c *cli, args []string) error {
+	metricIDs := fs.String("metric", "", "Comma separated metrics to print, every metric by default")
+	service := fs.String("service", "", "Only print the data points of the instances of this service")
+	instance := fs.String("instance", "", "Only print the data points of this service instance")
+	buffer := fs.Int("buffer", 0, "Data points buffered by the orchestrator before dropping the stream")
+
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args); err != nil {
+			return err
+		}
+
+		req := clients.LiveStatsRequest{
+			ServiceName: *service,
+			ServiceID:   *instance,
+			Buffer:      *buffer,
+		}
+		if len(*metricIDs) > 0 {
+			req.MetricIDs = strings.Split(*metricIDs, ",")
+		}
+
+		for {
+			err := c.client.StreamDataPoints(context.Background(), &req, c.printDataPoint)
+			if errors.Cause(err) != clients.ErrStreamDropped {
+				return err
+			}
+			// data points were missed, the stream is resumed from the next ones
+			log.Printf("Fell behind the data points, reconnecting")
+		}
+	}
+}
+
+func (c *cli) printDataPoint(dp clients.DataPoint) error {
+	if c.output == outputJSON {
+		data, _ := json.Marshal(dp)
+		_, err := fmt.Fprintf(c.out, "%s\n", data)
+		return err
+	}
+	_, err := fmt.Fprintf(c.out, "%s  %-16s  %-24s  %s\n", dp.TS.Format(time.RFC3339), dp.MetricID, dp.ServiceID, formatFloat(dp.Value))
+	return err
+}
+
+// parseTime parses an RFC3339 time or a unix timestamp, returning def for an empty value
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return def, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"clients"
+	"context"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsClient answers GetStats with resp, recording the request
+type statsClient struct {
+	clients.OrchestratorClient
+	req  *clients.StatsRequest
+	resp *clients.StatsResponse
+}
+
+func (c *statsClient) GetStats(ctx context.Context, req *clients.StatsRequest) (*clients.StatsResponse, error) {
+	c.req = req
+	return c.resp, nil
+}
+
+func points(values ...float64) []clients.Point {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	result := []clients.Point{}
+	for i, v := range values {
+		point := clients.Point{TS: start.Add(time.Duration(i) * time.Minute)}
+		if v >= 0 {
+			value := v
+			point.Value = &value
+		}
+		result = append(result, point)
+	}
+	return result
+}
+
+func TestSparkline(t *testing.T) {
+	for _, tc := range []struct {
+		points []clients.Point
+		want   string
+	}{
+		{points(0, 1, 2, 3, 4, 5, 6, 7), "▁▂▃▄▅▆▇█"},
+		{points(10, -1, 20), "▁ █"},
+		{points(3, 3), "▅▅"},
+	} {
+		min, max := 1e9, -1e9
+		for _, p := range tc.points {
+			if p.Value != nil {
+				if *p.Value < min {
+					min = *p.Value
+				}
+				if *p.Value > max {
+					max = *p.Value
+				}
+			}
+		}
+		if got := sparkline(tc.points, min, max); got != tc.want {
+			t.Errorf("got sparkline=%q, want %q", got, tc.want)
+		}
+	}
+}
+
+func runStatsQuery(t *testing.T, output string, resp *clients.StatsResponse, args ...string) (*clients.StatsRequest, string, error) {
+	t.Helper()
+
+	fs := flag.NewFlagSet("stats query", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	run := setupStatsQuery(fs)
+	positional := parseFlags(fs, args)
+
+	client := &statsClient{resp: resp}
+	out := &bytes.Buffer{}
+	err := run(&cli{client: client, output: output, out: out}, positional)
+	return client.req, out.String(), err
+}
+
+func TestStatsQuery(t *testing.T) {
+	resp := &clients.StatsResponse{
+		MetricID: "mem",
+		Tier:     "rollups300",
+		Step:     60,
+		StartTS:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndTS:    time.Date(2024, 1, 1, 0, 3, 0, 0, time.UTC),
+		Series: []clients.Series{
+			{ServiceID: "echo-1", Points: points(1, 2, 3)},
+			{ServiceID: "echo-2", Points: points(-1, -1, -1)},
+		},
+	}
+
+	// sparklines default to 60 points
+	req, out, err := runStatsQuery(t, "", resp, "-metric", "mem", "-start", "1704067200", "-end", "2024-01-01T01:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Points != defaultSparklinePoints || req.MetricID != "mem" || !req.StartTS.Equal(resp.StartTS) || req.EndTS.Sub(req.StartTS) != time.Hour {
+		t.Errorf("got request=%+v, want 60 points of mem over the hour", req)
+	}
+	for _, want := range []string{"mem 2024-01-01T00:00:00Z to 2024-01-01T00:03:00Z, 60s steps from tier rollups300", "echo-1    ▁▄█        1    3    3", "echo-2               -    -    -"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("got output=%q, want it to contain %q", out, want)
+		}
+	}
+
+	// tables only ask for the step they are given
+	req, out, err = runStatsQuery(t, outputTable, resp, "-metric", "mem", "-since", "30m", "-step", "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Points != 0 || req.Step != time.Minute || req.EndTS.Sub(req.StartTS) != 30*time.Minute {
+		t.Errorf("got request=%+v, want a 1m step over 30m", req)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 7 || !strings.Contains(lines[6], "echo-2    -") {
+		t.Errorf("got output=%q, want a header and a row per point", out)
+	}
+
+	for _, args := range [][]string{{}, {"-metric", "mem", "-start", "yesterday"}, {"-metric", "mem", "extra"}} {
+		if _, _, err := runStatsQuery(t, "", resp, args...); err == nil {
+			t.Errorf("args=%v: got no error", args)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	def := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"", def},
+		{"1704070800", def.Add(time.Hour)},
+		{"2024-01-01T02:00:00Z", def.Add(2 * time.Hour)},
+	} {
+		got, err := parseTime(tc.value, def)
+		if err != nil || !got.Equal(tc.want) {
+			t.Errorf("value=%q: got time=%s err=%v, want %s", tc.value, got, err, tc.want)
+		}
+	}
+	if _, err := parseTime("an hour ago", def); err == nil {
+		t.Error("got no error for an invalid time")
+	}
+}
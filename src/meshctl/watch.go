@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// watchEvent is a change of an instance or of an alert between two polls
+type watchEvent struct {
+	TS      time.Time         `json:"time"`
+	Kind    string            `json:"kind"`
+	Name    string            `json:"name"`
+	State   string            `json:"state"`
+	Address string            `json:"address,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+const (
+	eventInstance = "instance"
+	eventAlert    = "alert"
+)
+
+func setupWatch(fs *flag.FlagSet) func(c *cli, args []string) error {
+	interval := fs.Duration("interval", 5*time.Second, "Interval between polls of the orchestrator")
+	alerts := fs.Bool("alerts", true, "Also watch the alerts")
+
+	return func(c *cli, args []string) error {
+		if err := requireArgs(args); err != nil {
+			return err
+		}
+
+		// the first poll prints the current state as events
+		instances, firing := map[string]watchEvent{}, map[string]watchEvent{}
+		for {
+			now := time.Now().UTC()
+			if err := c.pollInstances(now, instances); err != nil {
+				log.Printf("Failed polling the instances! err=%s", err.Error())
+			}
+			if *alerts {
+				if err := c.pollAlerts(now, firing); err != nil {
+					log.Printf("Failed polling the alerts! err=%s", err.Error())
+				}
+			}
+			time.Sleep(*interval)
+		}
+	}
+}
+
+// pollInstances prints the instances which were registered, deregistered or changed state
+// since the previous poll
+func (c *cli) pollInstances(now time.Time, previous map[string]watchEvent) error {
+	resp, err := c.client.GetServices(context.Background())
+	if err != nil {
+		return err
+	}
+
+	current := map[string]watchEvent{}
+	for _, service := range resp.Services {
+		for _, registrant := range service.Registrants {
+			current[service.ServiceName+" "+registrant.ControlAddress] = watchEvent{
+				TS:      now,
+				Kind:    eventInstance,
+				Name:    service.ServiceName,
+				State:   registrantState(registrant),
+				Address: registrant.ControlAddress,
+			}
+		}
+	}
+
+	c.printChanges(now, previous, current, "deregistered")
+	return nil
+}
+
+// pollAlerts prints the alerts which changed state since the previous poll, the resolved
+// alerts being forgotten once the orchestrator drops them
+func (c *cli) pollAlerts(now time.Time, previous map[string]watchEvent) error {
+	resp, err := c.client.GetAlerts(context.Background())
+	if err != nil {
+		return err
+	}
+
+	current := map[string]watchEvent{}
+	for _, alert := range resp.Alerts {
+		current[alert.Rule+" "+alertKey(alert.Labels)] = watchEvent{
+			TS:     now,
+			Kind:   eventAlert,
+			Name:   alert.Rule,
+			State:  alert.State,
+			Labels: alert.Labels,
+		}
+	}
+
+	c.printChanges(now, previous, current, "")
+	return nil
+}
+
+// printChanges prints the events of current whose state differs from previous, and the gone
+// state for those of previous missing from current when set, then updates previous
+func (c *cli) printChanges(now time.Time, previous, current map[string]watchEvent, gone string) {
+	keys := make([]string, 0, len(current)+len(previous))
+	for key := range current {
+		keys = append(keys, key)
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		event, ok := current[key]
+		if !ok {
+			event = previous[key]
+			delete(previous, key)
+			if len(gone) == 0 {
+				continue
+			}
+			event.TS, event.State = now, gone
+			c.printEvent(event)
+			continue
+		}
+		if prev, ok := previous[key]; ok && prev.State == event.State {
+			continue
+		}
+		previous[key] = event
+		c.printEvent(event)
+	}
+}
+
+func (c *cli) printEvent(event watchEvent) {
+	if c.output == outputJSON {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(c.out, "%s\n", data)
+		return
+	}
+
+	target := event.Address
+	if event.Kind == eventAlert {
+		target = "{" + alertKey(event.Labels) + "}"
+	}
+	fmt.Fprintf(c.out, "%s  %-8s  %-12s  %s %s\n", event.TS.Format(time.RFC3339), event.Kind, event.State, event.Name, target)
+}
+
+// alertKey formats the labels of an alert sorted by name, e.g. service=echo,severity=page
+func alertKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestPrintChanges checks that only the events whose state changed since the previous poll
+// are printed, along with the gone events
+func TestPrintChanges(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := &cli{out: out}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	previous := map[string]watchEvent{}
+	c.printChanges(now, previous, map[string]watchEvent{
+		"echo-1": {TS: now, Kind: eventInstance, Name: "echo", State: "healthy", Address: "http://echo-1"},
+		"echo-2": {TS: now, Kind: eventInstance, Name: "echo", State: "healthy", Address: "http://echo-2"},
+	}, "deregistered")
+	c.printChanges(now.Add(time.Minute), previous, map[string]watchEvent{
+		"echo-1": {TS: now, Kind: eventInstance, Name: "echo", State: "draining", Address: "http://echo-1"},
+	}, "deregistered")
+	c.printChanges(now.Add(2*time.Minute), previous, map[string]watchEvent{
+		"high-mem": {TS: now, Kind: eventAlert, Name: "high-mem", State: "firing", Labels: map[string]string{"service": "echo", "severity": "page"}},
+	}, "")
+
+	want := "2024-01-01T00:00:00Z  instance  healthy       echo http://echo-1\n" +
+		"2024-01-01T00:00:00Z  instance  healthy       echo http://echo-2\n" +
+		"2024-01-01T00:00:00Z  instance  draining      echo http://echo-1\n" +
+		"2024-01-01T00:01:00Z  instance  deregistered  echo http://echo-2\n" +
+		"2024-01-01T00:00:00Z  alert     firing        high-mem {service=echo,severity=page}\n"
+	if out.String() != want {
+		t.Errorf("got output=\n%s\nwant\n%s", out.String(), want)
+	}
+	if len(previous) != 1 {
+		t.Errorf("got previous=%v, want the alert only", previous)
+	}
+}
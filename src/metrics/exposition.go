@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ContentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	ContentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Collector writes the current samples of one or more metric families
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// CollectorFunc adapts a function to a Collector, e.g. to expose values computed on scrape
+type CollectorFunc func(w *Writer)
+
+func (f CollectorFunc) Collect(w *Writer) {
+	f(w)
+}
+
+// Registry holds the collectors exposed together on a /metrics endpoint
+type Registry struct {
+	collectors []Collector
+	lock       *sync.RWMutex
+}
+
+// DefaultRegistry is the registry of the process wide metrics
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	r := Registry{
+		lock: &sync.RWMutex{},
+	}
+
+	return &r
+}
+
+func (r *Registry) Register(collectors ...Collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Register adds collectors to the default registry
+func Register(collectors ...Collector) {
+	DefaultRegistry.Register(collectors...)
+}
+
+// ServeHTTP writes every collector in the OpenMetrics text format, or in the Prometheus text
+// format for scrapers which only accept text/plain
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	accept := req.Header.Get("Accept")
+	openMetrics := strings.Contains(accept, "application/openmetrics-text") || !strings.Contains(accept, "text/plain")
+
+	buf := bytes.Buffer{}
+	writer := NewWriter(&buf, openMetrics)
+	r.lock.RLock()
+	for _, collector := range r.collectors {
+		collector.Collect(writer)
+	}
+	r.lock.RUnlock()
+	writer.Close()
+
+	contentType := ContentTypeText
+	if openMetrics {
+		contentType = ContentTypeOpenMetrics
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Unable to write metrics! err=%s", err.Error())
+	}
+}
+
+// Writer formats metric families and their samples, in the OpenMetrics text format or
+// else in the Prometheus text format
+type Writer struct {
+	out         io.Writer
+	openMetrics bool
+}
+
+func NewWriter(out io.Writer, openMetrics bool) *Writer {
+	w := Writer{
+		out:         out,
+		openMetrics: openMetrics,
+	}
+
+	return &w
+}
+
+// Close ends the exposition, OpenMetrics requires a final # EOF line
+func (w *Writer) Close() {
+	if w.openMetrics {
+		io.WriteString(w.out, "# EOF\n")
+	}
+}
+
+// Family starts a metric family. Counter families are named without the _total suffix
+// of their samples.
+func (w *Writer) Family(name, typ, help string) {
+	if typ == TypeCounter && !w.openMetrics {
+		name += "_total"
+	}
+	fmt.Fprintf(w.out, "# TYPE %s %s\n", name, typ)
+	if len(help) > 0 {
+		fmt.Fprintf(w.out, "# HELP %s %s\n", name, escape(help, false))
+	}
+}
+
+// Sample writes a sample of the current family, labels are sorted by name
+func (w *Writer) Sample(name string, labels map[string]string, value float64) {
+	w.writeSample(name, labels, value, "")
+}
+
+// SampleAt writes a sample of the current family along with its timestamp, e.g. when
+// exporting stored values
+func (w *Writer) SampleAt(name string, labels map[string]string, value float64, ts time.Time) {
+	// OpenMetrics timestamps are in seconds, Prometheus text ones in milliseconds
+	timestamp := strconv.FormatInt(ts.UnixNano()/int64(time.Millisecond), 10)
+	if w.openMetrics {
+		timestamp = strconv.FormatFloat(float64(ts.UnixNano())/float64(time.Second), 'f', -1, 64)
+	}
+	w.writeSample(name, labels, value, timestamp)
+}
+
+func (w *Writer) writeSample(name string, labels map[string]string, value float64, timestamp string) {
+	sb := strings.Builder{}
+	sb.WriteString(name)
+
+	if len(labels) > 0 {
+		names := make([]string, 0, len(labels))
+		for label := range labels {
+			names = append(names, label)
+		}
+		sort.Strings(names)
+
+		sb.WriteByte('{')
+		for i, label := range names {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, "%s=\"%s\"", label, escape(labels[label], true))
+		}
+		sb.WriteByte('}')
+	}
+
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(value))
+	if len(timestamp) > 0 {
+		sb.WriteByte(' ')
+		sb.WriteString(timestamp)
+	}
+	sb.WriteByte('\n')
+
+	io.WriteString(w.out, sb.String())
+}
+
+// SanitizeName replaces the characters which are not allowed in metric and label names by _
+func SanitizeName(name string) string {
+	sb := strings.Builder{}
+	for i, r := range name {
+		valid := r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')
+		if valid {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+// NewRuntimeCollector exposes the goroutines and memory of the process along with its start time
+func NewRuntimeCollector() Collector {
+	startTime := time.Now()
+
+	return CollectorFunc(func(w *Writer) {
+		memStats := runtime.MemStats{}
+		runtime.ReadMemStats(&memStats)
+
+		w.Family("go_goroutines", TypeGauge, "Number of goroutines that currently exist.")
+		w.Sample("go_goroutines", nil, float64(runtime.NumGoroutine()))
+		w.Family("go_memstats_alloc_bytes", TypeGauge, "Number of bytes allocated and still in use.")
+		w.Sample("go_memstats_alloc_bytes", nil, float64(memStats.Alloc))
+		w.Family("go_memstats_sys_bytes", TypeGauge, "Number of bytes obtained from the system.")
+		w.Sample("go_memstats_sys_bytes", nil, float64(memStats.Sys))
+		w.Family("process_start_time_seconds", TypeGauge, "Start time of the process since unix epoch in seconds.")
+		w.Sample("process_start_time_seconds", nil, float64(startTime.Unix()))
+	})
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
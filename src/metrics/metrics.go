@@ -0,0 +1,262 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of latency histograms
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Value is a float64 which can be updated concurrently
+type Value struct {
+	bits uint64
+}
+
+// Add adds delta to the value, counters must only be given positive deltas
+func (v *Value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+func (v *Value) Set(value float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(value))
+}
+
+func (v *Value) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Vec is a family of counters or gauges, with a value per combination of label values
+type Vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	values     map[string]*labeledValue
+	lock       *sync.Mutex
+}
+
+type labeledValue struct {
+	labelValues []string
+	value       *Value
+}
+
+// NewCounterVec creates a family of counters, name must not have the _total suffix
+func NewCounterVec(name, help string, labelNames ...string) *Vec {
+	return newVec(name, help, TypeCounter, labelNames)
+}
+
+// NewGaugeVec creates a family of gauges
+func NewGaugeVec(name, help string, labelNames ...string) *Vec {
+	return newVec(name, help, TypeGauge, labelNames)
+}
+
+func newVec(name, help, typ string, labelNames []string) *Vec {
+	v := Vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		values:     make(map[string]*labeledValue),
+		lock:       &sync.Mutex{},
+	}
+
+	return &v
+}
+
+// With returns the value of the given label values, in the order of the label names
+func (v *Vec) With(labelValues ...string) *Value {
+	checkLabelValues(v.name, v.labelNames, labelValues)
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	lv, ok := v.values[key]
+	if !ok {
+		lv = &labeledValue{labelValues: labelValues, value: &Value{}}
+		v.values[key] = lv
+	}
+	return lv.value
+}
+
+// Delete removes the value of the given label values, e.g. once a service is gone
+func (v *Vec) Delete(labelValues ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+func (v *Vec) Collect(w *Writer) {
+	v.lock.Lock()
+	values := make([]*labeledValue, 0, len(v.values))
+	for _, lv := range v.values {
+		values = append(values, lv)
+	}
+	v.lock.Unlock()
+
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labelValues, "\xff") < strings.Join(values[j].labelValues, "\xff")
+	})
+
+	name := v.name
+	if v.typ == TypeCounter {
+		name += "_total"
+	}
+
+	w.Family(v.name, v.typ, v.help)
+	for _, lv := range values {
+		w.Sample(name, labelMap(v.labelNames, lv.labelValues), lv.value.Get())
+	}
+}
+
+// HistogramVec is a family of histograms, with a histogram per combination of label values
+type HistogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+	histograms map[string]*Histogram
+	lock       *sync.Mutex
+}
+
+// Histogram counts observations in buckets of increasing upper bounds
+type Histogram struct {
+	labelValues []string
+	buckets     []float64
+	counts      []uint64
+	count       uint64
+	sum         float64
+	lock        *sync.Mutex
+}
+
+// NewHistogramVec creates a family of histograms with the given, sorted, bucket upper bounds
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := HistogramVec{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		histograms: make(map[string]*Histogram),
+		lock:       &sync.Mutex{},
+	}
+
+	return &h
+}
+
+// With returns the histogram of the given label values, in the order of the label names
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	checkLabelValues(h.name, h.labelNames, labelValues)
+
+	key := strings.Join(labelValues, "\xff")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	histogram, ok := h.histograms[key]
+	if !ok {
+		histogram = &Histogram{
+			labelValues: labelValues,
+			buckets:     h.buckets,
+			counts:      make([]uint64, len(h.buckets)),
+			lock:        &sync.Mutex{},
+		}
+		h.histograms[key] = histogram
+	}
+	return histogram
+}
+
+func (h *HistogramVec) Collect(w *Writer) {
+	h.lock.Lock()
+	histograms := make([]*Histogram, 0, len(h.histograms))
+	for _, histogram := range h.histograms {
+		histograms = append(histograms, histogram)
+	}
+	h.lock.Unlock()
+
+	sort.Slice(histograms, func(i, j int) bool {
+		return strings.Join(histograms[i].labelValues, "\xff") < strings.Join(histograms[j].labelValues, "\xff")
+	})
+
+	w.Family(h.name, TypeHistogram, h.help)
+	for _, histogram := range histograms {
+		histogram.lock.Lock()
+		counts := append([]uint64{}, histogram.counts...)
+		count, sum := histogram.count, histogram.sum
+		histogram.lock.Unlock()
+
+		labels := labelMap(h.labelNames, histogram.labelValues)
+		cumulative := uint64(0)
+		for i, upperBound := range h.buckets {
+			cumulative += counts[i]
+			w.Sample(h.name+"_bucket", withLabel(labels, "le", formatFloat(upperBound)), float64(cumulative))
+		}
+		w.Sample(h.name+"_bucket", withLabel(labels, "le", "+Inf"), float64(count))
+		w.Sample(h.name+"_count", labels, float64(count))
+		w.Sample(h.name+"_sum", labels, sum)
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.count++
+	h.sum += value
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+// ObserveSince observes the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func checkLabelValues(name string, labelNames, labelValues []string) {
+	if len(labelNames) != len(labelValues) {
+		panic("metrics: " + name + " expects label values for " + strings.Join(labelNames, ", "))
+	}
+}
+
+func labelMap(names, values []string) map[string]string {
+	labels := make(map[string]string, len(names))
+	for i, name := range names {
+		labels[name] = values[i]
+	}
+	return labels
+}
+
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		result[k] = v
+	}
+	result[name] = value
+	return result
+}
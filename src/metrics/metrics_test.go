@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func collect(openMetrics bool, collectors ...Collector) string {
+	buf := bytes.Buffer{}
+	w := NewWriter(&buf, openMetrics)
+	for _, c := range collectors {
+		c.Collect(w)
+	}
+	w.Close()
+	return buf.String()
+}
+
+func TestCounterAndGauge(t *testing.T) {
+	requests := NewCounterVec("test_requests", "Requests, by \\ route.", "route", "code")
+	requests.With("/b", "200").Inc()
+	requests.With("/a", "500").Add(2)
+	requests.With("/a", "500").Inc()
+	queue := NewGaugeVec("test_queue_depth", "Queued items.")
+	queue.With().Set(7)
+
+	want := `# TYPE test_requests counter
+# HELP test_requests Requests, by \\ route.
+test_requests_total{code="500",route="/a"} 3
+test_requests_total{code="200",route="/b"} 1
+# TYPE test_queue_depth gauge
+# HELP test_queue_depth Queued items.
+test_queue_depth 7
+# EOF
+`
+	if got := collect(true, requests, queue); got != want {
+		t.Errorf("got openmetrics=\n%s\nwant\n%s", got, want)
+	}
+
+	// the Prometheus text format names counter families with their _total suffix, without # EOF
+	got := collect(false, requests)
+	if !strings.HasPrefix(got, "# TYPE test_requests_total counter\n# HELP test_requests_total") || strings.Contains(got, "# EOF") {
+		t.Errorf("got text=\n%s", got)
+	}
+
+	requests.Delete("/b", "200")
+	if got := collect(false, requests); strings.Contains(got, `route="/b"`) {
+		t.Errorf("got text=\n%s, want the deleted value gone", got)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "", []float64{.1, 1}, "table")
+	for _, v := range []float64{.05, .1, .5, 3} {
+		h.With("metrics").Observe(v)
+	}
+
+	want := `# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1",table="metrics"} 2
+test_duration_seconds_bucket{le="1",table="metrics"} 3
+test_duration_seconds_bucket{le="+Inf",table="metrics"} 4
+test_duration_seconds_count{table="metrics"} 4
+test_duration_seconds_sum{table="metrics"} 3.65
+`
+	if got := collect(false, h); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSampleFormatting(t *testing.T) {
+	got := collect(false, CollectorFunc(func(w *Writer) {
+		w.Sample("a", map[string]string{"path": "C:\\x", "q": `say "hi"`, "n": "a\nb"}, math.Inf(1))
+		w.Sample("b", nil, math.NaN())
+		w.Sample("c", nil, 1e-7)
+	}))
+	want := `a{n="a\nb",path="C:\\x",q="say \"hi\""} +Inf
+b NaN
+c 1e-07
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	for name, want := range map[string]string{"cpu": "cpu", "http.requests-total": "http_requests_total", "9lives": "_lives", "a:b9": "a:b9"} {
+		if got := SanitizeName(name); got != want {
+			t.Errorf("SanitizeName(%q): got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLabelValuesMustMatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("With with missing label values did not panic")
+		}
+	}()
+	NewCounterVec("test_panics", "", "route").With()
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	g := NewGaugeVec("test_up", "")
+	g.With().Set(1)
+	r.Register(g)
+
+	for accept, contentType := range map[string]string{
+		"":                                  ContentTypeOpenMetrics,
+		"application/openmetrics-text;q=1":  ContentTypeOpenMetrics,
+		"text/plain;version=0.0.4;q=0.5":    ContentTypeText,
+		"application/openmetrics-text, */*": ContentTypeOpenMetrics,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("Accept=%q: got Content-Type=%s, want %s", accept, got, contentType)
+		}
+		body := rec.Body.String()
+		if !strings.Contains(body, "test_up 1\n") || strings.HasSuffix(body, "# EOF\n") != (contentType == ContentTypeOpenMetrics) {
+			t.Errorf("Accept=%q: got body=\n%s", accept, body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status=%d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,34 @@
+package sidecar
+
+import (
+	"config"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Config holds the settings of a sidecar shared by the services embedding it, which embed it
+// in their own configuration
+type Config struct {
+	OrchestratorAddress string          `json:"orchestrator_address" env:"ORCHESTRATOR_ADDRESS" flag:"orchestrator" usage:"Address of the orchestrator the sidecar registers to"`
+	RegisterInterval    config.Duration `json:"register_interval" env:"REGISTER_INTERVAL" flag:"register-interval" usage:"Interval after which a sidecar without heartbeats registers again"`
+}
+
+// DefaultConfig returns the settings of a sidecar registering to a local orchestrator
+func DefaultConfig() Config {
+	return Config{
+		OrchestratorAddress: "http://localhost:8500",
+		RegisterInterval:    config.Duration(time.Minute),
+	}
+}
+
+func (c Config) Validate() error {
+	u, err := url.Parse(c.OrchestratorAddress)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("orchestrator_address=%s must be an http url, e.g. http://localhost:8500", c.OrchestratorAddress)
+	}
+	if c.RegisterInterval <= 0 {
+		return fmt.Errorf("register_interval=%s must be positive", c.RegisterInterval)
+	}
+	return nil
+}
@@ -5,11 +5,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"metrics"
 	"net/http"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eapache/go-resiliency/retrier"
@@ -17,32 +22,62 @@ import (
 )
 
 type Proxy struct {
-	controlAddress      string
+	controlAddress string
+	serviceName    string
+	dataAddress    string
+	// the orchestrator and register interval are replaced by Reconfigure
 	orchestratorAddress string
-	serviceName         string
-	dataAddress         string
+	registerInterval    time.Duration
+	client              clients.OrchestratorClient
+	configLock          *sync.RWMutex
 	lastUpdatedTime     time.Time
 	lastUpdatedLock     *sync.Mutex
-	client              clients.OrchestratorClient
+	metrics             *metrics.Registry
+	heartbeats          *metrics.Vec
+	lastHeartbeat       *metrics.Vec
+	registrations       *metrics.Vec
+	requests            *metrics.Vec
+	requestDuration     *metrics.HistogramVec
+	requestStats        map[string]*clients.RequestStats
+	requestStatsLock    *sync.Mutex
+	draining            int32
+	drainingGauge       *metrics.Vec
 }
 
-// NewProxy creates a new sidecar instance
+// NewProxy creates a new sidecar instance, registering to the orchestrator of cfg
 func NewProxy(
-	orchestratorAddress string,
+	cfg Config,
 	controlAddress string,
 	serviceName, serviceLocalAddress string) *Proxy {
 
-	client := clients.NewOrchestratorClient(orchestratorAddress)
+	client := clients.NewOrchestratorClient(cfg.OrchestratorAddress)
 
 	s := Proxy{
 		serviceName:         serviceName,
 		dataAddress:         serviceLocalAddress,
 		controlAddress:      controlAddress,
-		orchestratorAddress: orchestratorAddress,
-		lastUpdatedLock:     &sync.Mutex{},
+		orchestratorAddress: cfg.OrchestratorAddress,
+		registerInterval:    cfg.RegisterInterval.Duration(),
 		client:              client,
+		configLock:          &sync.RWMutex{},
+		lastUpdatedLock:     &sync.Mutex{},
+		metrics:             metrics.NewRegistry(),
+		heartbeats:          metrics.NewCounterVec("sidecar_heartbeats", "Heartbeats answered to the orchestrator."),
+		lastHeartbeat:       metrics.NewGaugeVec("sidecar_last_heartbeat_timestamp_seconds", "Time of the last heartbeat since unix epoch in seconds."),
+		registrations:       metrics.NewCounterVec("sidecar_registrations", "Registrations to the orchestrator, by result.", "result"),
+		requests:            metrics.NewCounterVec("sidecar_requests", "Requests served by the service, by route and status code.", "route", "code"),
+		requestDuration: metrics.NewHistogramVec("sidecar_request_duration_seconds", "Time taken to serve the requests of the service.",
+			clients.RequestLatencyBuckets, "route"),
+		requestStats:     map[string]*clients.RequestStats{},
+		requestStatsLock: &sync.Mutex{},
+		drainingGauge:    metrics.NewGaugeVec("sidecar_draining", "Whether the orchestrator drains the sidecar."),
 	}
 
+	info := metrics.NewGaugeVec("sidecar_info", "Service proxied by the sidecar.", "service", "data_address")
+	info.With(serviceName, serviceLocalAddress).Set(1)
+	s.metrics.Register(info, s.heartbeats, s.lastHeartbeat, s.registrations, s.requests, s.requestDuration,
+		s.drainingGauge, metrics.NewRuntimeCollector())
+
 	log.Printf("Creating sidecar: %s", s.String())
 
 	return &s
@@ -58,49 +93,197 @@ func (s *Proxy) Start() {
 	}()
 }
 
+// Instrument counts the requests served by handler under route, so that they are reported to
+// the orchestrator on the next heartbeat. Responses with a 5xx status code count as errors.
+// While the sidecar is draining the connections are closed after every response, so that
+// clients reconnect to the other instances.
+func (s *Proxy) Instrument(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.Draining() {
+			w.Header().Set("Connection", "close")
+		}
+
+		start := time.Now()
+		recorder := statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(&recorder, req)
+		s.observeRequest(route, recorder.status, time.Since(start))
+	})
+}
+
+// Draining tells whether the orchestrator drains the sidecar
+func (s *Proxy) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+func (s *Proxy) setDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.draining, value) != value {
+		log.Printf("Set draining=%t: %s", draining, s.String())
+	}
+	s.drainingGauge.With().Set(float64(value))
+}
+
+func (s *Proxy) observeRequest(route string, status int, duration time.Duration) {
+	seconds := duration.Seconds()
+	s.requests.With(route, strconv.Itoa(status)).Inc()
+	s.requestDuration.With(route).Observe(seconds)
+
+	s.requestStatsLock.Lock()
+	defer s.requestStatsLock.Unlock()
+
+	stats, ok := s.requestStats[route]
+	if !ok {
+		stats = &clients.RequestStats{Route: route, Latency: make([]int, len(clients.RequestLatencyBuckets))}
+		s.requestStats[route] = stats
+	}
+	stats.Requests++
+	if status >= http.StatusInternalServerError {
+		stats.Errors++
+		return
+	}
+	for i, bound := range clients.RequestLatencyBuckets {
+		if seconds <= bound {
+			stats.Latency[i]++
+		}
+	}
+}
+
+// takeRequestStats returns the request counts since the previous call
+func (s *Proxy) takeRequestStats(ts time.Time, serviceID string) []clients.RequestStats {
+	s.requestStatsLock.Lock()
+	stats := s.requestStats
+	s.requestStats = map[string]*clients.RequestStats{}
+	s.requestStatsLock.Unlock()
+
+	result := make([]clients.RequestStats, 0, len(stats))
+	for _, routeStats := range stats {
+		routeStats.TS = ts
+		routeStats.ServiceID = serviceID
+		result = append(result, *routeStats)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Route < result[j].Route })
+	return result
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
 func (s *Proxy) String() string {
 	return fmt.Sprintf("[%s] data=%s control=%s", s.serviceName, s.dataAddress, s.controlAddress)
 }
 
-func (s *Proxy) register() error {
-	log.Printf("Registering to service=%s control address=%s", s.orchestratorAddress, s.controlAddress)
+// Reconfigure applies cfg to the running sidecar, the register interval from its next tick.
+// When the orchestrator address changes the sidecar unregisters from the previous orchestrator,
+// so that it stops being health checked by it, and registers to the new one.
+func (s *Proxy) Reconfigure(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.configLock.Lock()
+	previous, previousAddress := s.client, s.orchestratorAddress
+	if cfg.OrchestratorAddress != previousAddress {
+		s.client = clients.NewOrchestratorClient(cfg.OrchestratorAddress)
+		s.orchestratorAddress = cfg.OrchestratorAddress
+	}
+	s.registerInterval = cfg.RegisterInterval.Duration()
+	s.configLock.Unlock()
 
-	var err error
-	var resp *clients.RegisterResponse
-	var expRetrier = retrier.New(retrier.ExponentialBackoff(4, 500*time.Millisecond), nil)
+	if cfg.OrchestratorAddress != previousAddress {
+		log.Printf("Moving from orchestrator=%s to orchestrator=%s", previousAddress, cfg.OrchestratorAddress)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
 
-	if err = expRetrier.Run(func() error {
-		req := clients.RegisterRequest{
-			ControlAddress: fmt.Sprintf("http://%s", s.controlAddress),
-			ServiceName:    s.serviceName,
-			DataAddress:    s.dataAddress,
-		}
+			if err := previous.UnregisterSidecar(ctx, s.registerRequest()); err != nil {
+				log.Printf("Failed unregistering from %s! err=%s", previousAddress, err.Error())
+			}
+			if err := s.register(); err != nil {
+				log.Printf("Failed registering! err=%s", err.Error())
+			}
+		}()
+	}
+	return nil
+}
+
+// orchestrator returns the client and the address of the orchestrator
+func (s *Proxy) orchestrator() (clients.OrchestratorClient, string) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	return s.client, s.orchestratorAddress
+}
+
+func (s *Proxy) getRegisterInterval() time.Duration {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	return s.registerInterval
+}
+
+func (s *Proxy) registerRequest() *clients.RegisterRequest {
+	return &clients.RegisterRequest{
+		ControlAddress: fmt.Sprintf("http://%s", s.controlAddress),
+		ServiceName:    s.serviceName,
+		DataAddress:    s.dataAddress,
+	}
+}
 
-		resp, err = s.client.RegisterSidecar(context.Background(), &req)
-		if err != nil {
-			log.Printf("Error registering to %s! err=%s", s.orchestratorAddress, err.Error())
+func (s *Proxy) register() error {
+	client, orchestratorAddress := s.orchestrator()
+	log.Printf("Registering to service=%s control address=%s", orchestratorAddress, s.controlAddress)
+
+	var expRetrier = retrier.New(retrier.ExponentialBackoff(4, 500*time.Millisecond), registerClassifier{})
+
+	if err := expRetrier.Run(func() error {
+		if _, err := client.RegisterSidecar(context.Background(), s.registerRequest()); err != nil {
+			log.Printf("Error registering to %s! err=%s", orchestratorAddress, err.Error())
 			return err
 		}
 
 		return nil
 	}); err != nil {
+		s.registrations.With("failure").Inc()
 		return err
 	}
 
-	if resp.Code != clients.RegisterSuccess {
-		log.Printf("Error received when registering to %s! err=%s", s.orchestratorAddress, resp.ErrMessage)
-		return errors.New(resp.ErrMessage)
-	}
-
+	s.registrations.With("success").Inc()
 	s.setUpdatedTime()
 
 	return nil
 }
 
+// registerClassifier retries the registrations which failed, except those the orchestrator
+// rejected since they would be rejected again, e.g. for a sidecar already registered
+type registerClassifier struct{}
+
+func (registerClassifier) Classify(err error) retrier.Action {
+	switch errors.Cause(err) {
+	case nil:
+		return retrier.Succeed
+	case clients.ErrConflict, clients.ErrInvalidRequest:
+		return retrier.Fail
+	default:
+		return retrier.Retry
+	}
+}
+
 func (s *Proxy) listenForHeartBeats() error {
 	log.Printf("Starting sidecar on address=%s", s.controlAddress)
 
 	http.HandleFunc(clients.ProxyHealthURL, s.handleHeartbeat)
+	http.Handle(clients.MetricsURL, s.metrics)
 	return http.ListenAndServe(s.controlAddress, nil)
 }
 
@@ -111,13 +294,18 @@ func (s *Proxy) connectToOrchestrator() {
 		log.Printf("Failed registering! err=%s", err.Error())
 	}
 
-	ticker := time.NewTicker(1 * time.Minute)
+	registerInterval := s.getRegisterInterval()
+	ticker := time.NewTicker(registerInterval)
 	for range ticker.C {
 		register := false
+		if interval := s.getRegisterInterval(); interval != registerInterval {
+			registerInterval = interval
+			ticker.Reset(registerInterval)
+		}
 
 		s.lastUpdatedLock.Lock()
 		duration := time.Now().Sub(s.lastUpdatedTime)
-		if duration.Minutes() > 1 {
+		if duration > registerInterval {
 			register = true
 		}
 		s.lastUpdatedLock.Unlock()
@@ -138,17 +326,27 @@ func (s *Proxy) handleHeartbeat(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	heartbeatReq := clients.HeartbeatRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&heartbeatReq); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.setDraining(heartbeatReq.Drain)
+
 	s.setUpdatedTime()
+	s.heartbeats.With().Inc()
+	s.lastHeartbeat.With().Set(float64(time.Now().Unix()))
 
 	memStats := runtime.MemStats{}
 	runtime.ReadMemStats(&memStats)
 
 	hostname, _ := os.Hostname()
+	now := time.Now().UTC()
 
 	resp := clients.HeartbeatResponse{
 		Stats: []clients.Stats{
 			{
-				TS:            time.Now().UTC(),
+				TS:            now,
 				ServiceID:     s.serviceName + hostname,
 				CPU:           20,
 				Mem:           float64(memStats.Sys),
@@ -156,6 +354,7 @@ func (s *Proxy) handleHeartbeat(w http.ResponseWriter, req *http.Request) {
 				NumGoroutines: float64(runtime.NumGoroutine()),
 			},
 		},
+		Requests: s.takeRequestStats(now, s.serviceName+hostname),
 	}
 
 	respBytes, err := json.Marshal(resp)
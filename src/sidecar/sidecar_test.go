@@ -0,0 +1,86 @@
+package sidecar
+
+import (
+	"config"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// orchestratorServer records the registration requests it receives, as their method and host
+func orchestratorServer(t *testing.T, requests chan<- string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- req.Method + " " + req.Host
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"code": 0}`))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, cfg := range []Config{
+		{OrchestratorAddress: "localhost:8500", RegisterInterval: config.Duration(time.Minute)},
+		{OrchestratorAddress: "ftp://localhost:8500", RegisterInterval: config.Duration(time.Minute)},
+		{OrchestratorAddress: "http://", RegisterInterval: config.Duration(time.Minute)},
+		{OrchestratorAddress: "http://localhost:8500"},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("config=%+v: got no error", cfg)
+		}
+	}
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("got err=%v for the default config", err)
+	}
+}
+
+// TestReconfigure checks that a sidecar moving to another orchestrator unregisters from the
+// previous one and registers to the next, and that invalid configs leave it unchanged
+func TestReconfigure(t *testing.T) {
+	requests := make(chan string, 10)
+	previous := orchestratorServer(t, requests)
+	next := orchestratorServer(t, requests)
+
+	s := NewProxy(Config{OrchestratorAddress: previous, RegisterInterval: config.Duration(time.Minute)},
+		"127.0.0.1:8060", "echo", "127.0.0.1:10010")
+
+	if err := s.Reconfigure(Config{OrchestratorAddress: "localhost", RegisterInterval: config.Duration(time.Second)}); err == nil {
+		t.Fatal("got no error for an invalid config")
+	}
+	if _, address := s.orchestrator(); address != previous || s.getRegisterInterval() != time.Minute {
+		t.Errorf("got orchestrator=%s register interval=%s, want the previous config", address, s.getRegisterInterval())
+	}
+
+	if err := s.Reconfigure(Config{OrchestratorAddress: next, RegisterInterval: config.Duration(time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, address := s.orchestrator(); address != next || s.getRegisterInterval() != time.Second {
+		t.Errorf("got orchestrator=%s register interval=%s, want the next config", address, s.getRegisterInterval())
+	}
+
+	got := []string{}
+	for len(got) < 2 {
+		select {
+		case request := <-requests:
+			got = append(got, request)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got requests=%v, want the sidecar to move", got)
+		}
+	}
+	want := []string{http.MethodDelete + " " + previous[len("http://"):], http.MethodPost + " " + next[len("http://"):]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests=%v, want %v", got, want)
+	}
+
+	// only the register interval changes, the sidecar stays registered
+	if err := s.Reconfigure(Config{OrchestratorAddress: next, RegisterInterval: config.Duration(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case request := <-requests:
+		t.Errorf("got request=%s, want none", request)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
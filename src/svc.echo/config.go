@@ -0,0 +1,72 @@
+package main
+
+import (
+	"config"
+	"flag"
+	"fmt"
+	"os"
+	"sidecar"
+)
+
+// envPrefix prefixes the environment variables of the echo config, e.g. ECHO_APP_PORT
+const envPrefix = "ECHO_"
+
+// echoConfig is read from the json or yaml file of -config, then overridden by the environment
+// variables and then by the flags
+type echoConfig struct {
+	ControlPort int            `json:"control_port" env:"CONTROL_PORT" flag:"control-port" usage:"Control port"`
+	AppPort     int            `json:"app_port" env:"APP_PORT" flag:"app-port" usage:"Application port"`
+	Sidecar     sidecar.Config `json:"sidecar"`
+}
+
+func defaultEchoConfig() echoConfig {
+	return echoConfig{
+		ControlPort: 8060,
+		AppPort:     10010,
+		Sidecar:     sidecar.DefaultConfig(),
+	}
+}
+
+// loadConfig parses the command line and returns the effective config along with the path of
+// its file, -config naming the file to read, or else ECHO_CONFIG
+func loadConfig() (*echoConfig, string, error) {
+	cfg := defaultEchoConfig()
+	path := flag.String("config", "", "JSON or YAML config file, overridden by the "+envPrefix+"* environment variables and the flags")
+	config.Bind(flag.CommandLine, &cfg)
+	flag.Parse()
+
+	if len(*path) == 0 {
+		*path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if err := config.Load(&cfg, *path, envPrefix, flag.CommandLine); err != nil {
+		return nil, "", err
+	}
+	return &cfg, *path, nil
+}
+
+// readConfig reads the effective config again once the command line is parsed, for reloads
+func readConfig(path string) (*echoConfig, error) {
+	cfg := defaultEchoConfig()
+	if err := config.Load(&cfg, path, envPrefix, flag.CommandLine); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *echoConfig) Validate() error {
+	for _, port := range []struct {
+		name  string
+		value int
+	}{{"control_port", c.ControlPort}, {"app_port", c.AppPort}} {
+		if port.value < 1 || port.value > 65535 {
+			return fmt.Errorf("%s=%d must be between 1 and 65535", port.name, port.value)
+		}
+	}
+	if c.ControlPort == c.AppPort {
+		return fmt.Errorf("control_port and app_port must differ, both are %d", c.AppPort)
+	}
+	if err := c.Sidecar.Validate(); err != nil {
+		return fmt.Errorf("sidecar.%s", err.Error())
+	}
+	return nil
+}
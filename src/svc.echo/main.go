@@ -1,8 +1,9 @@
 package main
 
 import (
+	"clients"
+	"config"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,33 +11,38 @@ import (
 	"sidecar"
 )
 
-var controlPort, appLocalPort *int
-
 type EchoRequest struct {
 	Message string `json:"message"`
 }
 
-func parseArgs() {
-	controlPort = flag.Int("control-port", 8060, "Control port")
-	appLocalPort = flag.Int("app-port", 10010, "Application port")
-
-	flag.Parse()
-}
-
 func main() {
-	parseArgs()
+	cfg, configPath, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	config.Print("echo", cfg)
 
-	log.Printf("Starting ECHO server on data port=%d control port=%d", *appLocalPort, *controlPort)
+	log.Printf("Starting ECHO server on data port=%d control port=%d", cfg.AppPort, cfg.ControlPort)
 
 	// start control plane
 	proxy := sidecar.NewProxy(
-		"http://localhost:8500",
-		fmt.Sprintf("localhost:%d", *controlPort),
+		cfg.Sidecar,
+		fmt.Sprintf("localhost:%d", cfg.ControlPort),
 		"echo",
-		fmt.Sprintf("http://localhost:%d", *appLocalPort))
+		fmt.Sprintf("http://localhost:%d", cfg.AppPort))
 	proxy.Start()
 
-	http.HandleFunc("/echo", func(w http.ResponseWriter, req *http.Request) {
+	// the sidecar settings are reloaded on SIGHUP and when the config file changes
+	reloads := &configReloads{path: configPath, proxy: proxy, cfg: cfg}
+	reloader := config.NewReloader(reloads.reload, reloads.paths, reloadPollInterval)
+	reloader.Start()
+
+	http.HandleFunc(clients.ConfigEventsURL, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients.ConfigEventsResponse{Events: reloader.Events()})
+	})
+
+	http.Handle("/echo", proxy.Instrument("/echo", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != http.MethodPost {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("Method not allowed"))
@@ -70,10 +76,10 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		w.Write(data)
 
-	})
+	})))
 
 	// start data plane
-	err := http.ListenAndServe(fmt.Sprintf(":%d", *appLocalPort), nil)
+	err = http.ListenAndServe(fmt.Sprintf(":%d", cfg.AppPort), nil)
 	if err != nil {
 		log.Fatalf("Error starting server: %+v", err)
 	}
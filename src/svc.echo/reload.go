@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"sidecar"
+	"time"
+)
+
+// reloadPollInterval is how often the config file is polled for changes
+const reloadPollInterval = 5 * time.Second
+
+// configReloads applies the sidecar settings of the reloaded config, the ports need a restart
+type configReloads struct {
+	path  string
+	proxy *sidecar.Proxy
+	// cfg is the applied config, only accessed by the reloads which are serialized
+	cfg *echoConfig
+}
+
+func (c *configReloads) paths() []string {
+	return []string{c.path}
+}
+
+func (c *configReloads) reload() ([]string, error) {
+	next, err := readConfig(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if next.ControlPort != c.cfg.ControlPort || next.AppPort != c.cfg.AppPort {
+		return nil, fmt.Errorf("control_port and app_port can not be reloaded, the echo service must be restarted to change them")
+	}
+
+	if err := c.proxy.Reconfigure(next.Sidecar); err != nil {
+		return nil, err
+	}
+
+	changes := []string{}
+	if next.Sidecar.OrchestratorAddress != c.cfg.Sidecar.OrchestratorAddress {
+		changes = append(changes, fmt.Sprintf("sidecar.orchestrator_address: %q -> %q", c.cfg.Sidecar.OrchestratorAddress, next.Sidecar.OrchestratorAddress))
+	}
+	if next.Sidecar.RegisterInterval != c.cfg.Sidecar.RegisterInterval {
+		changes = append(changes, fmt.Sprintf("sidecar.register_interval: %q -> %q", c.cfg.Sidecar.RegisterInterval, next.Sidecar.RegisterInterval))
+	}
+	c.cfg = next
+
+	return changes, nil
+}
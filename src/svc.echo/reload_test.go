@@ -0,0 +1,59 @@
+package main
+
+import (
+	"config"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sidecar"
+	"testing"
+	"time"
+)
+
+// TestReload checks that the sidecar settings are reloaded while the ports, which need a
+// restart, and invalid configs are rejected and leave the applied config in place
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.json")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"control_port": 8060, "app_port": 10010}`)
+
+	cfg, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := sidecar.NewProxy(cfg.Sidecar, "127.0.0.1:8060", "echo", "127.0.0.1:10010")
+	reloads := &configReloads{path: path, proxy: proxy, cfg: cfg}
+
+	for _, tc := range []struct {
+		content string
+		changes []string
+		fails   bool
+	}{
+		{`{"control_port": 8060, "app_port": 10010}`, []string{}, false},
+		{`{"control_port": 8061, "app_port": 10010}`, nil, true},
+		{`{"control_port": 8060, "app_port": 10010, "sidecar": {"register_interval": "0s"}}`, nil, true},
+		{`{"control_port": 8060,`, nil, true},
+		{`{"control_port": 8060, "app_port": 10010, "sidecar": {"register_interval": "30s"}}`,
+			[]string{`sidecar.register_interval: "1m0s" -> "30s"`}, false},
+	} {
+		write(tc.content)
+		changes, err := reloads.reload()
+		if tc.fails {
+			if err == nil {
+				t.Errorf("config=%s: got no error", tc.content)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(changes, tc.changes) {
+			t.Errorf("config=%s: got changes=%q err=%v, want %q", tc.content, changes, err, tc.changes)
+		}
+	}
+
+	if reloads.cfg.Sidecar.RegisterInterval != config.Duration(30*time.Second) || reloads.cfg.ControlPort != 8060 {
+		t.Errorf("got config=%+v, want the last valid one", reloads.cfg)
+	}
+}
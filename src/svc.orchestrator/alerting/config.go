@@ -0,0 +1,247 @@
+package alerting
+
+import (
+	"bytes"
+	"clients"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"svc.orchestrator/query"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultGroupInterval  = 5 * time.Minute
+	defaultRepeatInterval = 4 * time.Hour
+)
+
+var (
+	// ErrInvalidConfig is returned for rules, receivers, routes and silences which can not be applied
+	ErrInvalidConfig = errors.New("invalid alerting config")
+	// ErrNotFound is returned for rules, receivers and silences which do not exist
+	ErrNotFound = errors.New("not found")
+)
+
+// Config is the persisted set of rules, receivers, routing tree and silences
+type Config struct {
+	Rules     []clients.AlertRule     `json:"rules"`
+	Receivers []clients.AlertReceiver `json:"receivers"`
+	Route     *clients.AlertRoute     `json:"route,omitempty"`
+	Silences  []clients.Silence       `json:"silences,omitempty"`
+}
+
+// compiledConfig is a validated config, ready to be applied
+type compiledConfig struct {
+	rules     map[string]*rule
+	receivers map[string]*receiver
+	route     *route
+	silences  map[string]*silence
+}
+
+// rule is a validated rule, ready to be evaluated
+type rule struct {
+	clients.AlertRule
+	forDuration time.Duration
+	burnWindows []time.Duration
+	compare     func(value float64) bool
+	annotations map[string]*template.Template
+}
+
+// loadConfig reads the config at path, a missing file is an empty config
+func loadConfig(path string) (*Config, error) {
+	config := Config{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &config, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading alerting config=%s", path)
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(err, "Failed parsing alerting config=%s", path)
+	}
+
+	return &config, nil
+}
+
+// saveConfig replaces the config at path, through a rename so that it is never left half written
+func saveConfig(path string, config *Config) error {
+	// conditions read better unescaped, e.g. ">" rather than "\u003e"
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(config); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "Failed writing alerting config=%s", path)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "Failed writing alerting config=%s", path)
+	}
+
+	return nil
+}
+
+func compileRule(r clients.AlertRule) (*rule, error) {
+	compiled := rule{AlertRule: r, annotations: map[string]*template.Template{}}
+
+	switch {
+	case len(r.Name) == 0:
+		return nil, errors.Wrapf(ErrInvalidConfig, "rule name is missing")
+	case sources(r) == 0:
+		return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: either metric, query, slo or anomaly is required", r.Name)
+	case sources(r) > 1:
+		return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: metric, query, slo and anomaly can not be combined", r.Name)
+	case len(r.Service) > 0 && len(r.Metric) == 0 && len(r.Anomaly) == 0:
+		return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: service only applies to metric and anomaly rules, use a matcher in the query", r.Name)
+	case len(r.SLO) > 0 && len(r.BurnWindows) == 0:
+		return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: burn_windows are required by slo rules", r.Name)
+	case len(r.SLO) == 0 && len(r.BurnWindows) > 0:
+		return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: burn_windows only apply to slo rules", r.Name)
+	}
+
+	for _, window := range r.BurnWindows {
+		d, err := query.ParseDuration(window)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: burn window=%q is not a valid duration", r.Name, window)
+		}
+		compiled.burnWindows = append(compiled.burnWindows, d)
+	}
+
+	if len(r.Query) > 0 {
+		if _, err := query.Parse(r.Query); err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: %s", r.Name, err)
+		}
+	}
+
+	threshold := r.Condition.Threshold
+	switch r.Condition.Op {
+	case ">":
+		compiled.compare = func(v float64) bool { return v > threshold }
+	case ">=":
+		compiled.compare = func(v float64) bool { return v >= threshold }
+	case "<":
+		compiled.compare = func(v float64) bool { return v < threshold }
+	case "<=":
+		compiled.compare = func(v float64) bool { return v <= threshold }
+	case "==":
+		compiled.compare = func(v float64) bool { return v == threshold }
+	case "!=":
+		compiled.compare = func(v float64) bool { return v != threshold }
+	default:
+		return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: unknown condition op=%q", r.Name, r.Condition.Op)
+	}
+
+	if len(r.For) > 0 {
+		d, err := time.ParseDuration(r.For)
+		if err != nil || d < 0 {
+			return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: for=%q is not a valid duration", r.Name, r.For)
+		}
+		compiled.forDuration = d
+	}
+
+	for name, text := range r.Annotations {
+		t, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s: annotation=%s: %s", r.Name, name, err)
+		}
+		compiled.annotations[name] = t
+	}
+
+	return &compiled, nil
+}
+
+// sources counts the sources of values a rule sets, among metric, query, slo and anomaly
+func sources(r clients.AlertRule) int {
+	count := 0
+	for _, source := range []string{r.Metric, r.Query, r.SLO, r.Anomaly} {
+		if len(source) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// compileConfig validates a whole config, receivers first since routes refer to them
+func compileConfig(config *Config) (*compiledConfig, error) {
+	compiled := compiledConfig{
+		rules:     map[string]*rule{},
+		receivers: map[string]*receiver{},
+		silences:  map[string]*silence{},
+	}
+
+	for _, r := range config.Receivers {
+		receiver, err := compileReceiver(r)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := compiled.receivers[r.Name]; ok {
+			return nil, errors.Wrapf(ErrInvalidConfig, "receiver=%s is declared more than once", r.Name)
+		}
+		compiled.receivers[r.Name] = receiver
+	}
+
+	for _, r := range config.Rules {
+		rule, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := compiled.rules[r.Name]; ok {
+			return nil, errors.Wrapf(ErrInvalidConfig, "rule=%s is declared more than once", r.Name)
+		}
+		compiled.rules[r.Name] = rule
+	}
+
+	if config.Route != nil {
+		route, err := compileRoute(*config.Route, nil, "root", compiled.receivers)
+		if err != nil {
+			return nil, err
+		}
+		compiled.route = route
+	}
+
+	for _, s := range config.Silences {
+		silence, err := compileSilence(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "silence=%s", s.ID)
+		}
+		compiled.silences[s.ID] = silence
+	}
+
+	return &compiled, nil
+}
+
+// annotate renders the annotations of the rule for an alert, a template failing to execute
+// is left as is rather than dropping the annotation
+func (r *rule) annotate(labels map[string]string, value float64) map[string]string {
+	if len(r.annotations) == 0 {
+		return nil
+	}
+
+	data := struct {
+		Labels map[string]string
+		Value  float64
+	}{labels, value}
+
+	annotations := make(map[string]string, len(r.annotations))
+	for name, t := range r.annotations {
+		buf := bytes.Buffer{}
+		if err := t.Execute(&buf, data); err != nil {
+			annotations[name] = r.Annotations[name]
+			continue
+		}
+		annotations[name] = strings.TrimSpace(buf.String())
+	}
+	return annotations
+}
@@ -0,0 +1,606 @@
+package alerting
+
+import (
+	"clients"
+	"log"
+	"metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"svc.orchestrator/query"
+	"svc.orchestrator/storage"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// lookback bounds the age of the latest value of a series for it to be evaluated
+	lookback = 5 * time.Minute
+	// queryStep is the step the queries of rules are evaluated with
+	queryStep = time.Minute
+	// resolvedRetention is how long resolved alerts are kept around
+	resolvedRetention = 15 * time.Minute
+
+	healthOK  = "ok"
+	healthErr = "err"
+
+	labelAlertName = "alertname"
+	labelServiceID = "service_id"
+)
+
+// Manager periodically evaluates the alert rules against the metrics store and routes the
+// resulting alerts, unless silenced or inhibited, to their receivers. Rules, receivers, the
+// routing tree and silences are persisted in a json file.
+type Manager struct {
+	store     storage.MetricsStore
+	engine    *query.Engine
+	slos      SLOSource
+	anomalies AnomalySource
+	path      string
+	interval  time.Duration
+	config    *Config
+	// generation counts the changes of config, see Reload.Apply
+	generation int
+	rules      map[string]*rule
+	receivers  map[string]*receiver
+	route      *route
+	silences   map[string]*silence
+	status     map[string]*clients.AlertRuleStatus
+	alerts     map[string]*alert
+	lock       *sync.RWMutex
+	// evalLock serializes evaluations, groups are only accessed while holding it
+	evalLock *sync.Mutex
+	groups   map[string]*group
+	done     chan bool
+}
+
+// SLOSource computes the burn rates evaluated by SLO rules
+type SLOSource interface {
+	// SLOLabels returns the labels identifying the SLO, ok being false when it does not exist
+	SLOLabels(name string) (map[string]string, bool)
+	// BurnRate returns how fast the error budget of the SLO was spent over the window, ok
+	// being false when no request was counted
+	BurnRate(name string, window time.Duration, now time.Time) (float64, bool, error)
+}
+
+// AnomalySource provides the anomaly scores evaluated by anomaly rules
+type AnomalySource interface {
+	// Watches reports whether the anomalies of the metric are detected
+	Watches(metricID string) bool
+	// Latest returns the evaluation of the last window of every series of the metric,
+	// optionally of a single service
+	Latest(metricID, serviceName string) []clients.AnomalyEvent
+}
+
+// alert is the state of a rule for a series, keyed by the rule and the labels of the alert
+type alert struct {
+	clients.Alert
+	key string
+}
+
+// sample is the latest value of a series a rule is evaluated against
+type sample struct {
+	labels map[string]string
+	value  float64
+}
+
+// NewManager loads the config persisted at path, which does not need to exist yet. anomalies
+// is nil when anomaly detection is disabled.
+func NewManager(store storage.MetricsStore, slos SLOSource, anomalies AnomalySource, path string, interval time.Duration) (*Manager, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled, err := compileConfig(config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid alerting config=%s", path)
+	}
+
+	m := Manager{
+		store:     store,
+		engine:    query.NewEngine(store),
+		slos:      slos,
+		anomalies: anomalies,
+		path:      path,
+		interval:  interval,
+		config:    config,
+		rules:     compiled.rules,
+		receivers: compiled.receivers,
+		route:     compiled.route,
+		silences:  compiled.silences,
+		status:    map[string]*clients.AlertRuleStatus{},
+		alerts:    map[string]*alert{},
+		lock:      &sync.RWMutex{},
+		evalLock:  &sync.Mutex{},
+		groups:    map[string]*group{},
+		done:      make(chan bool),
+	}
+
+	return &m, nil
+}
+
+func (m *Manager) Start() {
+	go m.run()
+}
+
+func (m *Manager) Stop() {
+	close(m.done)
+}
+
+func (m *Manager) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.evaluate(time.Now().UTC())
+		}
+	}
+}
+
+// evaluate runs every rule and notifies the receivers of the alerts which changed. A rule
+// which fails to evaluate keeps its alerts as they are.
+func (m *Manager) evaluate(now time.Time) {
+	m.evalLock.Lock()
+	defer m.evalLock.Unlock()
+
+	m.lock.RLock()
+	rules := make([]*rule, 0, len(m.rules))
+	for _, r := range m.rules {
+		rules = append(rules, r)
+	}
+	m.lock.RUnlock()
+
+	for _, r := range rules {
+		samples, err := m.sample(r, now)
+
+		m.lock.Lock()
+		// the rule may have been replaced or deleted while it was evaluated
+		if m.rules[r.Name] == r {
+			status := clients.AlertRuleStatus{AlertRule: r.AlertRule, Health: healthOK, LastEvaluation: now}
+			if err != nil {
+				log.Printf("Failed evaluating alert rule=%s! err=%s", r.Name, err.Error())
+				status.Health, status.LastError = healthErr, err.Error()
+			} else {
+				m.update(r, samples, now)
+			}
+			m.status[r.Name] = &status
+		}
+		m.lock.Unlock()
+	}
+
+	m.lock.Lock()
+	for key, a := range m.alerts {
+		if a.State == clients.AlertStateResolved && now.Sub(*a.ResolvedAt) > resolvedRetention {
+			delete(m.alerts, key)
+		}
+	}
+	m.suppress(now)
+	m.lock.Unlock()
+
+	m.notify(now)
+}
+
+// sample returns the latest value of every series of the rule, metric rules read the raw rows
+// of the metric, query rules the last point of every series of the query, SLO rules the
+// lowest burn rate over their windows and anomaly rules the latest anomaly scores
+func (m *Manager) sample(r *rule, now time.Time) ([]sample, error) {
+	if len(r.Anomaly) > 0 {
+		if m.anomalies == nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "anomaly detection is disabled")
+		}
+
+		events := m.anomalies.Latest(r.Anomaly, r.Service)
+		samples := make([]sample, 0, len(events))
+		for _, event := range events {
+			labels := copyLabels(event.Labels)
+			labels[labelServiceID] = event.ServiceID
+			samples = append(samples, sample{labels: labels, value: event.Score})
+		}
+		return samples, nil
+	}
+
+	if len(r.SLO) > 0 {
+		labels, ok := m.slos.SLOLabels(r.SLO)
+		if !ok {
+			return nil, errors.Wrapf(ErrNotFound, "slo=%s", r.SLO)
+		}
+
+		lowest := 0.0
+		for i, window := range r.burnWindows {
+			rate, ok, err := m.slos.BurnRate(r.SLO, window, now)
+			if err != nil || !ok {
+				return nil, err
+			}
+			if i == 0 || rate < lowest {
+				lowest = rate
+			}
+		}
+		return []sample{{labels: labels, value: lowest}}, nil
+	}
+
+	if len(r.Query) > 0 {
+		resp, err := m.engine.Query(r.Query, query.Range{StartTS: now.Add(-lookback), EndTS: now, Step: queryStep})
+		if err != nil {
+			return nil, err
+		}
+
+		samples := make([]sample, 0, len(resp.Series))
+		for _, s := range resp.Series {
+			for i := len(s.Points) - 1; i >= 0; i-- {
+				if s.Points[i].Value == nil {
+					continue
+				}
+				labels := copyLabels(s.Labels)
+				if len(s.ServiceID) > 0 {
+					labels[labelServiceID] = s.ServiceID
+				}
+				samples = append(samples, sample{labels: labels, value: *s.Points[i].Value})
+				break
+			}
+		}
+		return samples, nil
+	}
+
+	resp, err := m.store.GetStats(&storage.StatsQuery{
+		MetricID:    r.Metric,
+		ServiceName: r.Service,
+		Resolution:  "raw",
+		StartTS:     now.Add(-lookback),
+		EndTS:       now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// instances can have several series of the metric, told apart by their labels
+	latest := map[string]clients.Aggregation{}
+	for _, row := range resp.Aggregations {
+		key := row.ServiceID + labelsKey(row.Labels)
+		if current, ok := latest[key]; !ok || row.TS.After(current.TS) {
+			latest[key] = row
+		}
+	}
+
+	samples := make([]sample, 0, len(latest))
+	for _, row := range latest {
+		labels := copyLabels(row.Labels)
+		labels[labelServiceID] = row.ServiceID
+		samples = append(samples, sample{labels: labels, value: row.Average})
+	}
+	return samples, nil
+}
+
+// update moves the alerts of a rule through their states: a series meeting the condition is
+// pending until it did so for the for duration and then firing, until it no longer does
+func (m *Manager) update(r *rule, samples []sample, now time.Time) {
+	active := map[string]bool{}
+
+	for _, s := range samples {
+		if !r.compare(s.value) {
+			continue
+		}
+
+		labels := alertLabels(r, s.labels)
+		key := r.Name + labelsKey(labels)
+		active[key] = true
+
+		a, ok := m.alerts[key]
+		if !ok || a.State == clients.AlertStateResolved {
+			a = &alert{
+				Alert: clients.Alert{
+					Rule:     r.Name,
+					State:    clients.AlertStatePending,
+					Labels:   labels,
+					ActiveAt: now,
+				},
+				key: key,
+			}
+			m.alerts[key] = a
+		}
+		a.Value = s.value
+		a.Annotations = r.annotate(labels, s.value)
+
+		if a.State == clients.AlertStatePending && now.Sub(a.ActiveAt) >= r.forDuration {
+			firedAt := now
+			a.State, a.FiredAt = clients.AlertStateFiring, &firedAt
+			log.Printf("Alert rule=%s is firing for labels=%s value=%g", r.Name, labelsKey(labels), s.value)
+		}
+	}
+
+	for key, a := range m.alerts {
+		if a.Rule == r.Name && !active[key] {
+			m.deactivate(a, now)
+		}
+	}
+}
+
+// deactivate drops a pending alert and resolves a firing one
+func (m *Manager) deactivate(a *alert, now time.Time) {
+	switch a.State {
+	case clients.AlertStatePending:
+		delete(m.alerts, a.key)
+	case clients.AlertStateFiring:
+		resolvedAt := now
+		a.State, a.ResolvedAt = clients.AlertStateResolved, &resolvedAt
+		log.Printf("Alert rule=%s is resolved for labels=%s", a.Rule, labelsKey(a.Labels))
+	}
+}
+
+// Alerts returns the pending, firing and recently resolved alerts
+func (m *Manager) Alerts() []clients.Alert {
+	m.lock.RLock()
+	alerts := make([]*alert, 0, len(m.alerts))
+	for _, a := range m.alerts {
+		alerts = append(alerts, a)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].key < alerts[j].key })
+
+	result := make([]clients.Alert, 0, len(alerts))
+	for _, a := range alerts {
+		result = append(result, a.Alert)
+	}
+	m.lock.RUnlock()
+
+	return result
+}
+
+// Rules returns the rules along with the outcome of their last evaluation
+func (m *Manager) Rules() []clients.AlertRuleStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	result := make([]clients.AlertRuleStatus, 0, len(m.config.Rules))
+	for _, r := range m.config.Rules {
+		status := clients.AlertRuleStatus{AlertRule: r}
+		if s, ok := m.status[r.Name]; ok {
+			status = *s
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// PutRule adds a rule, or replaces the rule with the same name while keeping its alerts
+func (m *Manager) PutRule(r clients.AlertRule) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	compiled, err := compileRule(r)
+	if err != nil {
+		return err
+	}
+	if err := m.checkSources(r); err != nil {
+		return err
+	}
+
+	config := *m.config
+	config.Rules = replaceRule(config.Rules, r)
+	if err := saveConfig(m.path, &config); err != nil {
+		return err
+	}
+
+	m.setConfig(&config)
+	m.rules[r.Name] = compiled
+	delete(m.status, r.Name)
+	log.Printf("Saved alert rule=%s", r.Name)
+
+	return nil
+}
+
+// DeleteRule removes a rule, its firing alerts are resolved
+func (m *Manager) DeleteRule(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.rules[name]; !ok {
+		return errors.Wrapf(ErrNotFound, "rule=%s", name)
+	}
+
+	config := *m.config
+	config.Rules = make([]clients.AlertRule, 0, len(m.config.Rules))
+	for _, r := range m.config.Rules {
+		if r.Name != name {
+			config.Rules = append(config.Rules, r)
+		}
+	}
+	if err := saveConfig(m.path, &config); err != nil {
+		return err
+	}
+
+	m.setConfig(&config)
+	delete(m.rules, name)
+	delete(m.status, name)
+	now := time.Now().UTC()
+	for _, a := range m.alerts {
+		if a.Rule == name {
+			m.deactivate(a, now)
+		}
+	}
+	log.Printf("Deleted alert rule=%s", name)
+
+	return nil
+}
+
+func (m *Manager) Receivers() []clients.AlertReceiver {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return append([]clients.AlertReceiver{}, m.config.Receivers...)
+}
+
+// PutReceiver adds a receiver, or replaces the receiver with the same name
+func (m *Manager) PutReceiver(r clients.AlertReceiver) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	compiled, err := compileReceiver(r)
+	if err != nil {
+		return err
+	}
+
+	config := *m.config
+	config.Receivers = make([]clients.AlertReceiver, 0, len(m.config.Receivers)+1)
+	replaced := false
+	for _, existing := range m.config.Receivers {
+		if existing.Name == r.Name {
+			existing, replaced = r, true
+		}
+		config.Receivers = append(config.Receivers, existing)
+	}
+	if !replaced {
+		config.Receivers = append(config.Receivers, r)
+	}
+	if err := saveConfig(m.path, &config); err != nil {
+		return err
+	}
+
+	m.setConfig(&config)
+	m.receivers[r.Name] = compiled
+	log.Printf("Saved alert receiver=%s", r.Name)
+
+	return nil
+}
+
+// DeleteReceiver removes a receiver which no route refers to
+func (m *Manager) DeleteReceiver(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.receivers[name]; !ok {
+		return errors.Wrapf(ErrNotFound, "receiver=%s", name)
+	}
+	if m.config.Route != nil && usesReceiver(m.config.Route, name) {
+		return errors.Wrapf(ErrInvalidConfig, "receiver=%s is used by the routing tree", name)
+	}
+
+	config := *m.config
+	config.Receivers = make([]clients.AlertReceiver, 0, len(m.config.Receivers))
+	for _, r := range m.config.Receivers {
+		if r.Name != name {
+			config.Receivers = append(config.Receivers, r)
+		}
+	}
+	if err := saveConfig(m.path, &config); err != nil {
+		return err
+	}
+
+	m.setConfig(&config)
+	delete(m.receivers, name)
+	log.Printf("Deleted alert receiver=%s", name)
+
+	return nil
+}
+
+// Route returns the routing tree, nil until one is set
+func (m *Manager) Route() *clients.AlertRoute {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.config.Route
+}
+
+// PutRoute replaces the routing tree, the groups of alerts are formed again along it
+func (m *Manager) PutRoute(r clients.AlertRoute) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	compiled, err := compileRoute(r, nil, "root", m.receivers)
+	if err != nil {
+		return err
+	}
+
+	config := *m.config
+	config.Route = &r
+	if err := saveConfig(m.path, &config); err != nil {
+		return err
+	}
+
+	m.setConfig(&config)
+	m.route = compiled
+	m.suppress(time.Now().UTC())
+	log.Printf("Saved alert routing tree")
+
+	return nil
+}
+
+// Collect exposes the number of alerts by rule and state, and the notifications sent
+func (m *Manager) Collect(w *metrics.Writer) {
+	m.lock.RLock()
+	counts := map[[2]string]int{}
+	for _, a := range m.alerts {
+		counts[[2]string{a.Rule, a.State}]++
+	}
+	m.lock.RUnlock()
+
+	keys := make([][2]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	w.Family("orchestrator_alerts", metrics.TypeGauge, "Alerts, by rule and state.")
+	for _, key := range keys {
+		w.Sample("orchestrator_alerts", map[string]string{"rule": key[0], "state": key[1]}, float64(counts[key]))
+	}
+
+	alertNotifications.Collect(w)
+}
+
+func replaceRule(rules []clients.AlertRule, r clients.AlertRule) []clients.AlertRule {
+	result := make([]clients.AlertRule, 0, len(rules)+1)
+	replaced := false
+	for _, existing := range rules {
+		if existing.Name == r.Name {
+			existing, replaced = r, true
+		}
+		result = append(result, existing)
+	}
+	if !replaced {
+		result = append(result, r)
+	}
+	return result
+}
+
+// alertLabels are the labels of the series overridden by those of the rule, and the alertname
+func alertLabels(r *rule, seriesLabels map[string]string) map[string]string {
+	labels := copyLabels(seriesLabels)
+	for k, v := range r.Labels {
+		labels[k] = v
+	}
+	labels[labelAlertName] = r.Name
+	return labels
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels)+2)
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
+
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"=\""+labels[name]+"\"")
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
@@ -0,0 +1,67 @@
+package alerting
+
+import (
+	"clients"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"svc.orchestrator/storage"
+)
+
+// TestSampleMetricSeries checks that a metric rule samples the latest row of every series of an
+// instance, and not only of the instance
+func TestSampleMetricSeries(t *testing.T) {
+	store := storage.NewMemoryStore(storage.DefaultRollupTiers())
+	m, err := NewManager(store, noSLOs{}, nil, filepath.Join(t.TempDir(), "alerting.json"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	rows := map[string]*clients.Aggregation{}
+	for i, row := range []struct {
+		serviceID, code string
+		age             time.Duration
+		value           float64
+	}{
+		{"echo-1", "200", 2 * time.Minute, 1},
+		{"echo-1", "200", time.Minute, 2},
+		{"echo-1", "500", 3 * time.Minute, 3},
+		{"echo-2", "500", time.Minute, 4},
+	} {
+		labels := map[string]string{clients.LabelService: "echo", "code": row.code}
+		rows[fmt.Sprint(i)] = &clients.Aggregation{MetricID: "http_requests", ServiceID: row.serviceID, Labels: labels,
+			TS: now.Add(-row.age), Min: row.value, Max: row.value, Average: row.value, NumValues: 1}
+	}
+	if err := store.InsertAggregations(rows); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := compileRule(clients.AlertRule{Name: "errors", Metric: "http_requests", Service: "echo",
+		Condition: clients.AlertCondition{Op: ">", Threshold: 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, err := m.sample(r, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, s := range samples {
+		got = append(got, fmt.Sprintf("%s=%g", labelsKey(s.labels), s.value))
+	}
+	sort.Strings(got)
+	want := []string{
+		`{code="200", service="echo", service_id="echo-1"}=2`,
+		`{code="500", service="echo", service_id="echo-1"}=3`,
+		`{code="500", service="echo", service_id="echo-2"}=4`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples=%v, want %v", got, want)
+	}
+}
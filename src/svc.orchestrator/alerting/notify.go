@@ -0,0 +1,153 @@
+package alerting
+
+import (
+	"clients"
+	"log"
+	"metrics"
+	"sort"
+	"strings"
+	"time"
+)
+
+var alertNotifications = metrics.NewCounterVec("orchestrator_alert_notifications",
+	"Notifications posted to alert receivers, by receiver and result.", "receiver", "result")
+
+// group is the alerts of a route sharing the values of its group_by labels, they are
+// notified together
+type group struct {
+	route     *route
+	labels    map[string]string
+	lastSent  time.Time
+	signature string
+	// firing holds the keys of the alerts last notified as firing, only those are notified
+	// once resolved
+	firing map[string]bool
+}
+
+// notification is a notification of a group which is due
+type notification struct {
+	key       string
+	receiver  *receiver
+	payload   clients.AlertNotification
+	signature string
+	firing    []string
+}
+
+// notify sends the groups which changed, at most once every group interval, and the groups
+// still firing every repeat interval. A failed notification is retried at the next evaluation.
+func (m *Manager) notify(now time.Time) {
+	due := m.dueNotifications(now)
+
+	for _, n := range due {
+		err := n.receiver.notifier.notify(&n.payload)
+		if err != nil {
+			log.Printf("Failed notifying receiver=%s! err=%s", n.payload.Receiver, err.Error())
+			alertNotifications.With(n.payload.Receiver, "failed").Inc()
+			continue
+		}
+		alertNotifications.With(n.payload.Receiver, "sent").Inc()
+
+		g := m.groups[n.key]
+		g.lastSent, g.signature = now, n.signature
+		g.firing = map[string]bool{}
+		for _, key := range n.firing {
+			g.firing[key] = true
+		}
+		if len(g.firing) == 0 {
+			delete(m.groups, n.key)
+		}
+	}
+}
+
+// dueNotifications groups the alerts along the routes they match. Silenced and inhibited
+// alerts are left out, as if they were not firing.
+func (m *Manager) dueNotifications(now time.Time) []notification {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.route == nil {
+		m.groups = map[string]*group{}
+		return nil
+	}
+
+	byGroup := map[string][]*alert{}
+	for _, a := range m.alerts {
+		notifiable := a.State == clients.AlertStateFiring && len(a.SilencedBy) == 0 && len(a.InhibitedBy) == 0
+
+		for _, r := range m.route.match(a.Labels) {
+			groupLabels := map[string]string{}
+			for _, name := range r.groupBy {
+				groupLabels[name] = a.Labels[name]
+			}
+			key := r.path + labelsKey(groupLabels)
+
+			g, ok := m.groups[key]
+			if !ok {
+				if !notifiable {
+					continue
+				}
+				g = &group{labels: groupLabels, firing: map[string]bool{}}
+				m.groups[key] = g
+			}
+			g.route = r
+
+			if notifiable || (a.State == clients.AlertStateResolved && g.firing[a.key]) {
+				byGroup[key] = append(byGroup[key], a)
+			}
+		}
+	}
+
+	due := []notification{}
+	for key, g := range m.groups {
+		r, ok := m.receivers[g.route.receiver]
+		if !ok {
+			delete(m.groups, key)
+			continue
+		}
+
+		alerts := byGroup[key]
+		if len(alerts) == 0 {
+			delete(m.groups, key)
+			continue
+		}
+		sort.Slice(alerts, func(i, j int) bool { return alerts[i].key < alerts[j].key })
+
+		firing := false
+		states := make([]string, 0, len(alerts))
+		for _, a := range alerts {
+			firing = firing || a.State == clients.AlertStateFiring
+			states = append(states, a.key+"="+a.State)
+		}
+		signature := strings.Join(states, ",")
+
+		changed := signature != g.signature && now.Sub(g.lastSent) >= g.route.groupInterval
+		repeat := firing && now.Sub(g.lastSent) >= g.route.repeatInterval
+		if !changed && !repeat {
+			continue
+		}
+
+		n := notification{
+			key:       key,
+			receiver:  r,
+			signature: signature,
+			payload: clients.AlertNotification{
+				Receiver:    r.Name,
+				Status:      clients.AlertStateResolved,
+				GroupLabels: g.labels,
+				Alerts:      make([]clients.Alert, 0, len(alerts)),
+			},
+		}
+		if firing {
+			n.payload.Status = clients.AlertStateFiring
+		}
+		for _, a := range alerts {
+			n.payload.Alerts = append(n.payload.Alerts, a.Alert)
+			if a.State == clients.AlertStateFiring {
+				n.firing = append(n.firing, a.key)
+			}
+		}
+		due = append(due, n)
+	}
+
+	return due
+}
@@ -0,0 +1,151 @@
+package alerting
+
+import (
+	"bytes"
+	"clients"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// notifier delivers the notifications of a receiver
+type notifier interface {
+	notify(n *clients.AlertNotification) error
+}
+
+// receiver is a validated receiver
+type receiver struct {
+	clients.AlertReceiver
+	notifier notifier
+}
+
+func compileReceiver(r clients.AlertReceiver) (*receiver, error) {
+	if len(r.Name) == 0 {
+		return nil, errors.Wrapf(ErrInvalidConfig, "receiver name is missing")
+	}
+
+	compiled := receiver{AlertReceiver: r}
+
+	switch r.Type {
+	case clients.ReceiverWebhook, "":
+		u, err := url.Parse(r.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, errors.Wrapf(ErrInvalidConfig, "receiver=%s: url=%q must be an http(s) url", r.Name, r.URL)
+		}
+		compiled.notifier = &webhookNotifier{url: r.URL, client: &http.Client{Timeout: 10 * time.Second}}
+	case clients.ReceiverFile:
+		if len(r.Path) == 0 {
+			return nil, errors.Wrapf(ErrInvalidConfig, "receiver=%s: path is missing", r.Name)
+		}
+		compiled.notifier = &fileNotifier{path: r.Path, lock: &sync.Mutex{}}
+	case clients.ReceiverSMTP:
+		if _, _, err := net.SplitHostPort(r.SMTPAddress); err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "receiver=%s: smtp_address=%q must be a host:port", r.Name, r.SMTPAddress)
+		}
+		if len(r.From) == 0 || len(r.To) == 0 {
+			return nil, errors.Wrapf(ErrInvalidConfig, "receiver=%s: from and to are required", r.Name)
+		}
+		compiled.notifier = &smtpNotifier{address: r.SMTPAddress, from: r.From, to: r.To}
+	default:
+		return nil, errors.Wrapf(ErrInvalidConfig, "receiver=%s: unknown type=%s", r.Name, r.Type)
+	}
+
+	return &compiled, nil
+}
+
+// webhookNotifier posts notifications as json
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookNotifier) notify(n *clients.AlertNotification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered with status=%d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// fileNotifier appends notifications to a file, one json object per line
+type fileNotifier struct {
+	path string
+	lock *sync.Mutex
+}
+
+func (f *fileNotifier) notify(n *clients.AlertNotification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(body, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// smtpNotifier mails notifications as plain text, without authentication
+type smtpNotifier struct {
+	address string
+	from    string
+	to      []string
+}
+
+func (s *smtpNotifier) notify(n *clients.AlertNotification) error {
+	firing := 0
+	for _, a := range n.Alerts {
+		if a.State == clients.AlertStateFiring {
+			firing++
+		}
+	}
+
+	subject := fmt.Sprintf("[%s:%d] %s", strings.ToUpper(n.Status), firing, labelsKey(n.GroupLabels))
+
+	body := bytes.Buffer{}
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+		s.from, strings.Join(s.to, ", "), subject)
+	for _, a := range n.Alerts {
+		fmt.Fprintf(&body, "[%s] %s %s value=%g\r\n", strings.ToUpper(a.State), a.Rule, labelsKey(a.Labels), a.Value)
+
+		names := make([]string, 0, len(a.Annotations))
+		for name := range a.Annotations {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&body, "  %s: %s\r\n", name, a.Annotations[name])
+		}
+	}
+
+	return smtp.SendMail(s.address, nil, s.from, s.to, body.Bytes())
+}
@@ -0,0 +1,198 @@
+package alerting
+
+import (
+	"bytes"
+	"clients"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Reload is the config read back from its file once validated, applied by Apply. It lets the
+// config be reloaded along with other settings, all of them being applied or none.
+type Reload struct {
+	// Changes describes the rules, receivers, route and silences which changed, it is empty
+	// when the config is unchanged
+	Changes    []string
+	m          *Manager
+	config     *Config
+	compiled   *compiledConfig
+	generation int
+}
+
+// PrepareReload reads the config file again and validates it as a whole, nothing being applied
+// until Apply is called
+func (m *Manager) PrepareReload() (*Reload, error) {
+	config, compiled, err := m.readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return &Reload{Changes: configChanges(m.config, config), m: m, config: config, compiled: compiled, generation: m.generation}, nil
+}
+
+// readConfig reads and compiles the config file
+func (m *Manager) readConfig() (*Config, *compiledConfig, error) {
+	config, err := loadConfig(m.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	compiled, err := compileConfig(config)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Invalid alerting config=%s", m.path)
+	}
+	for _, r := range config.Rules {
+		if err := m.checkSources(r); err != nil {
+			return nil, nil, errors.Wrapf(err, "Invalid alerting config=%s", m.path)
+		}
+	}
+	return config, compiled, nil
+}
+
+// setConfig replaces the config, which must have been saved, the lock must be held
+func (m *Manager) setConfig(config *Config) {
+	m.config = config
+	m.generation++
+}
+
+// Apply replaces the rules, receivers, routing tree and silences. The rules which did not
+// change keep their status, the alerts of the removed rules are resolved. When the config was
+// changed through the API since PrepareReload, the file, which holds that change as well, is
+// read again so that the change is not reverted, and Changes is updated.
+func (r *Reload) Apply() error {
+	m := r.m
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if r.generation != m.generation {
+		config, compiled, err := m.readConfig()
+		if err != nil {
+			return err
+		}
+		r.config, r.compiled, r.generation = config, compiled, m.generation
+		r.Changes = configChanges(m.config, config)
+		log.Printf("Read alerting config=%s again, it was changed since the reload was prepared", m.path)
+	}
+
+	now := time.Now().UTC()
+	for name, existing := range m.rules {
+		compiled, ok := r.compiled.rules[name]
+		switch {
+		case !ok:
+			delete(m.status, name)
+			for _, a := range m.alerts {
+				if a.Rule == name {
+					m.deactivate(a, now)
+				}
+			}
+		case sameJSON(existing.AlertRule, compiled.AlertRule):
+			// kept as is, so that an evaluation in progress still records its status
+			r.compiled.rules[name] = existing
+		default:
+			delete(m.status, name)
+		}
+	}
+
+	m.setConfig(r.config)
+	m.rules = r.compiled.rules
+	m.receivers = r.compiled.receivers
+	m.route = r.compiled.route
+	m.silences = r.compiled.silences
+	log.Printf("Reloaded alerting config=%s rules=%d receivers=%d", m.path, len(m.rules), len(m.receivers))
+
+	return nil
+}
+
+// checkSources checks that the SLO or the anomalies evaluated by the rule exist
+func (m *Manager) checkSources(r clients.AlertRule) error {
+	if _, ok := m.slos.SLOLabels(r.SLO); len(r.SLO) > 0 && !ok {
+		return errors.Wrapf(ErrInvalidConfig, "rule=%s: unknown slo=%s", r.Name, r.SLO)
+	}
+	if len(r.Anomaly) > 0 && (m.anomalies == nil || !m.anomalies.Watches(r.Anomaly)) {
+		return errors.Wrapf(ErrInvalidConfig, "rule=%s: anomalies of metric=%s are not detected", r.Name, r.Anomaly)
+	}
+	return nil
+}
+
+// configChanges lists what was added, removed or changed from previous to next
+func configChanges(previous, next *Config) []string {
+	changes := []string{}
+
+	rules := func(config *Config) map[string]interface{} {
+		result := map[string]interface{}{}
+		for _, r := range config.Rules {
+			result[r.Name] = r
+		}
+		return result
+	}
+	changes = append(changes, namedChanges("alert rule", rules(previous), rules(next))...)
+
+	receivers := func(config *Config) map[string]interface{} {
+		result := map[string]interface{}{}
+		for _, r := range config.Receivers {
+			result[r.Name] = r
+		}
+		return result
+	}
+	changes = append(changes, namedChanges("alert receiver", receivers(previous), receivers(next))...)
+
+	if !sameJSON(previous.Route, next.Route) {
+		changes = append(changes, "alert route changed")
+	}
+
+	silences := func(config *Config) map[string]interface{} {
+		result := map[string]interface{}{}
+		for _, s := range config.Silences {
+			result[s.ID] = s
+		}
+		return result
+	}
+	changes = append(changes, namedChanges("alert silence", silences(previous), silences(next))...)
+
+	return changes
+}
+
+// namedChanges lists the items added, removed or changed from previous to next, by name
+func namedChanges(kind string, previous, next map[string]interface{}) []string {
+	names := []string{}
+	for name := range previous {
+		names = append(names, name)
+	}
+	for name := range next {
+		if _, ok := previous[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []string{}
+	for _, name := range names {
+		before, hadBefore := previous[name]
+		after, hasAfter := next[name]
+		switch {
+		case !hadBefore:
+			changes = append(changes, fmt.Sprintf("%s=%s added", kind, name))
+		case !hasAfter:
+			changes = append(changes, fmt.Sprintf("%s=%s removed", kind, name))
+		case !sameJSON(before, after):
+			changes = append(changes, fmt.Sprintf("%s=%s changed", kind, name))
+		}
+	}
+	return changes
+}
+
+// sameJSON reports whether a and b are written to json the same, so that e.g. a nil and an
+// empty map of labels do not count as a change
+func sameJSON(a, b interface{}) bool {
+	aBytes, aErr := json.Marshal(a)
+	bBytes, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aBytes, bBytes)
+}
@@ -0,0 +1,85 @@
+package alerting
+
+import (
+	"clients"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"svc.orchestrator/storage"
+)
+
+type noSLOs struct{}
+
+func (noSLOs) SLOLabels(name string) (map[string]string, bool) {
+	return nil, false
+}
+
+func (noSLOs) BurnRate(name string, window time.Duration, now time.Time) (float64, bool, error) {
+	return 0, false, nil
+}
+
+func memRule(name string, threshold float64) clients.AlertRule {
+	return clients.AlertRule{Name: name, Metric: "mem", Condition: clients.AlertCondition{Op: ">", Threshold: threshold}}
+}
+
+func ruleNames(m *Manager) []string {
+	names := []string{}
+	for _, r := range m.Rules() {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// TestReloadKeepsAPIChanges checks that a rule saved through the API between PrepareReload and
+// Apply is not reverted by the reload
+func TestReloadKeepsAPIChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerting.json")
+	if err := saveConfig(path, &Config{Rules: []clients.AlertRule{memRule("high-mem", 90)}}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(storage.NewMemoryStore(storage.DefaultRollupTiers()), noSLOs{}, nil, path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is edited, then a rule is saved through the API while the reload is prepared
+	if err := saveConfig(path, &Config{Rules: []clients.AlertRule{memRule("high-mem", 80)}}); err != nil {
+		t.Fatal(err)
+	}
+	reload, err := m.PrepareReload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alert rule=high-mem changed"}; !reflect.DeepEqual(reload.Changes, want) {
+		t.Errorf("got changes=%v, want %v", reload.Changes, want)
+	}
+	if err := m.PutRule(memRule("low-mem", 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reload.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if names := ruleNames(m); !reflect.DeepEqual(names, []string{"high-mem", "low-mem"}) {
+		t.Errorf("got rules=%v, want the rule saved through the API kept", names)
+	}
+	if len(reload.Changes) != 0 {
+		t.Errorf("got changes=%v, want none since the file was saved along with the rule", reload.Changes)
+	}
+
+	// without changes in between, the prepared config is applied
+	if err := saveConfig(path, &Config{Rules: []clients.AlertRule{memRule("low-mem", 10)}}); err != nil {
+		t.Fatal(err)
+	}
+	if reload, err = m.PrepareReload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reload.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if names := ruleNames(m); !reflect.DeepEqual(names, []string{"low-mem"}) {
+		t.Errorf("got rules=%v, want [low-mem]", names)
+	}
+}
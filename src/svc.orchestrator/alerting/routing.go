@@ -0,0 +1,213 @@
+package alerting
+
+import (
+	"clients"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// matcher is a compiled label matcher
+type matcher struct {
+	clients.LabelMatcher
+	re *regexp.Regexp
+}
+
+// route is a compiled node of the routing tree, with the fields inherited from its parents
+// filled in. Path identifies the node, e.g. "root.0.1" for the second child of the first child.
+type route struct {
+	path           string
+	receiver       string
+	matchers       []matcher
+	groupBy        []string
+	groupInterval  time.Duration
+	repeatInterval time.Duration
+	cont           bool
+	inhibitRules   []inhibitRule
+	routes         []*route
+}
+
+type inhibitRule struct {
+	source []matcher
+	target []matcher
+	equal  []string
+}
+
+func compileMatchers(matchers []clients.LabelMatcher) ([]matcher, error) {
+	result := make([]matcher, 0, len(matchers))
+	for _, m := range matchers {
+		if len(m.Name) == 0 {
+			return nil, errors.Errorf("matcher name is missing")
+		}
+		compiled := matcher{LabelMatcher: m}
+		if m.IsRegex {
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, errors.Errorf("matcher=%s: invalid regex=%q", m.Name, m.Value)
+			}
+			compiled.re = re
+		}
+		result = append(result, compiled)
+	}
+	return result, nil
+}
+
+// matchesAll reports whether the labels match every matcher, a missing label being empty
+func matchesAll(matchers []matcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		value := labels[m.Name]
+		if m.re != nil {
+			if !m.re.MatchString(value) {
+				return false
+			}
+		} else if value != m.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// compileRoute validates a route and its children, parent is nil for the root route which
+// has no matchers and needs a receiver
+func compileRoute(r clients.AlertRoute, parent *route, path string, receivers map[string]*receiver) (*route, error) {
+	compiled := route{
+		path:           path,
+		receiver:       r.Receiver,
+		groupBy:        r.GroupBy,
+		groupInterval:  defaultGroupInterval,
+		repeatInterval: defaultRepeatInterval,
+		cont:           r.Continue,
+	}
+
+	if parent == nil {
+		if len(r.Matchers) > 0 || r.Continue {
+			return nil, errors.Wrapf(ErrInvalidConfig, "root route: matchers and continue are not allowed")
+		}
+		if len(r.Receiver) == 0 {
+			return nil, errors.Wrapf(ErrInvalidConfig, "root route: receiver is missing")
+		}
+	} else {
+		if len(compiled.receiver) == 0 {
+			compiled.receiver = parent.receiver
+		}
+		if len(r.GroupBy) == 0 {
+			compiled.groupBy = parent.groupBy
+		}
+		compiled.groupInterval, compiled.repeatInterval = parent.groupInterval, parent.repeatInterval
+	}
+
+	if _, ok := receivers[compiled.receiver]; !ok {
+		return nil, errors.Wrapf(ErrInvalidConfig, "route=%s: unknown receiver=%s", path, compiled.receiver)
+	}
+
+	var err error
+	if compiled.matchers, err = compileMatchers(r.Matchers); err != nil {
+		return nil, errors.Wrapf(ErrInvalidConfig, "route=%s: %s", path, err)
+	}
+
+	for _, interval := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"group_interval", r.GroupInterval, &compiled.groupInterval},
+		{"repeat_interval", r.RepeatInterval, &compiled.repeatInterval},
+	} {
+		if len(interval.value) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(interval.value)
+		if err != nil || d <= 0 {
+			return nil, errors.Wrapf(ErrInvalidConfig, "route=%s: %s=%q is not a valid duration", path, interval.name, interval.value)
+		}
+		*interval.d = d
+	}
+
+	for i, rule := range r.InhibitRules {
+		source, err := compileMatchers(rule.SourceMatchers)
+		if err == nil && len(source) == 0 {
+			err = errors.New("source matchers are missing")
+		}
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "route=%s: inhibit rule %d: %s", path, i, err)
+		}
+		target, err := compileMatchers(rule.TargetMatchers)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "route=%s: inhibit rule %d: %s", path, i, err)
+		}
+		compiled.inhibitRules = append(compiled.inhibitRules, inhibitRule{source: source, target: target, equal: rule.Equal})
+	}
+
+	for i, child := range r.Routes {
+		compiledChild, err := compileRoute(child, &compiled, path+"."+strconv.Itoa(i), receivers)
+		if err != nil {
+			return nil, err
+		}
+		compiled.routes = append(compiled.routes, compiledChild)
+	}
+
+	return &compiled, nil
+}
+
+// match returns the routes an alert is sent through, the route itself when none of its
+// children match
+func (r *route) match(labels map[string]string) []*route {
+	if !matchesAll(r.matchers, labels) {
+		return nil
+	}
+
+	var result []*route
+	for _, child := range r.routes {
+		matched := child.match(labels)
+		result = append(result, matched...)
+		if len(matched) > 0 && !child.cont {
+			break
+		}
+	}
+	if len(result) == 0 {
+		result = []*route{r}
+	}
+	return result
+}
+
+// inhibitRulesFor returns the inhibit rules of every route an alert with the labels passes
+// through, on its way to any of the routes it is sent through
+func (r *route) inhibitRulesFor(labels map[string]string) []inhibitRule {
+	if !matchesAll(r.matchers, labels) {
+		return nil
+	}
+
+	result := append([]inhibitRule{}, r.inhibitRules...)
+	for _, child := range r.routes {
+		result = append(result, child.inhibitRulesFor(labels)...)
+	}
+	return result
+}
+
+// usesReceiver reports whether the route or any of its children explicitly names the receiver
+func usesReceiver(r *clients.AlertRoute, name string) bool {
+	if r.Receiver == name {
+		return true
+	}
+	for i := range r.Routes {
+		if usesReceiver(&r.Routes[i], name) {
+			return true
+		}
+	}
+	return false
+}
+
+// inhibits reports whether the source alert inhibits the target alert
+func (i inhibitRule) inhibits(source, target map[string]string) bool {
+	if !matchesAll(i.source, source) || !matchesAll(i.target, target) {
+		return false
+	}
+	for _, name := range i.equal {
+		if source[name] != target[name] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+package alerting
+
+import (
+	"clients"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// expiredSilenceRetention is how long expired silences are kept before being purged
+const expiredSilenceRetention = 24 * time.Hour
+
+// silence is a compiled silence
+type silence struct {
+	clients.Silence
+	matchers []matcher
+}
+
+func compileSilence(s clients.Silence) (*silence, error) {
+	switch {
+	case len(s.Matchers) == 0:
+		return nil, errors.Wrapf(ErrInvalidConfig, "silence: at least one matcher is required")
+	case len(s.CreatedBy) == 0:
+		return nil, errors.Wrapf(ErrInvalidConfig, "silence: created_by is missing")
+	case len(s.Comment) == 0:
+		return nil, errors.Wrapf(ErrInvalidConfig, "silence: comment is missing")
+	case !s.StartsAt.Before(s.EndsAt):
+		return nil, errors.Wrapf(ErrInvalidConfig, "silence: starts_at must be before ends_at")
+	}
+
+	matchers, err := compileMatchers(s.Matchers)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidConfig, "silence: %s", err)
+	}
+
+	return &silence{Silence: s, matchers: matchers}, nil
+}
+
+func (s *silence) state(now time.Time) string {
+	switch {
+	case now.Before(s.StartsAt):
+		return clients.SilencePending
+	case now.Before(s.EndsAt):
+		return clients.SilenceActive
+	default:
+		return clients.SilenceExpired
+	}
+}
+
+// Silences returns the silences, the most recently ending first
+func (m *Manager) Silences() []clients.Silence {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	now := time.Now().UTC()
+	result := make([]clients.Silence, 0, len(m.silences))
+	for _, s := range m.silences {
+		silence := s.Silence
+		silence.State = s.state(now)
+		result = append(result, silence)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].EndsAt.After(result[j].EndsAt) })
+	return result
+}
+
+// PutSilence creates a silence, starting now unless StartsAt is set, or updates the silence
+// with the same ID unless it already expired
+func (m *Manager) PutSilence(s clients.Silence) (clients.Silence, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now().UTC()
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if !s.EndsAt.After(now) {
+		return s, errors.Wrapf(ErrInvalidConfig, "silence: ends_at must be in the future")
+	}
+
+	if len(s.ID) > 0 {
+		existing, ok := m.silences[s.ID]
+		if !ok {
+			return s, errors.Wrapf(ErrNotFound, "silence=%s", s.ID)
+		}
+		if existing.state(now) == clients.SilenceExpired {
+			return s, errors.Wrapf(ErrInvalidConfig, "silence=%s expired, create a new one", s.ID)
+		}
+	} else {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return s, err
+		}
+		s.ID = hex.EncodeToString(id)
+	}
+	s.State = ""
+
+	compiled, err := compileSilence(s)
+	if err != nil {
+		return s, err
+	}
+
+	silences := m.copySilences()
+	silences[s.ID] = compiled
+	if err := m.saveSilences(silences, now); err != nil {
+		return s, err
+	}
+	m.suppress(now)
+	log.Printf("Saved silence=%s by=%s until=%s", s.ID, s.CreatedBy, s.EndsAt.Format(time.RFC3339))
+
+	s.State = compiled.state(now)
+	return s, nil
+}
+
+// ExpireSilence ends a silence now, it is kept around as expired for a day
+func (m *Manager) ExpireSilence(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	existing, ok := m.silences[id]
+	if !ok {
+		return errors.Wrapf(ErrNotFound, "silence=%s", id)
+	}
+
+	now := time.Now().UTC()
+	if existing.state(now) == clients.SilenceExpired {
+		return nil
+	}
+
+	expired := *existing
+	if expired.StartsAt.After(now) {
+		expired.StartsAt = now
+	}
+	expired.EndsAt = now
+
+	silences := m.copySilences()
+	silences[id] = &expired
+	if err := m.saveSilences(silences, now); err != nil {
+		return err
+	}
+	m.suppress(now)
+	log.Printf("Expired silence=%s", id)
+
+	return nil
+}
+
+func (m *Manager) copySilences() map[string]*silence {
+	silences := make(map[string]*silence, len(m.silences)+1)
+	for id, s := range m.silences {
+		silences[id] = s
+	}
+	return silences
+}
+
+// saveSilences persists the silences, purging those which expired more than a day ago, and
+// applies them once saved
+func (m *Manager) saveSilences(silences map[string]*silence, now time.Time) error {
+	config := *m.config
+	config.Silences = make([]clients.Silence, 0, len(silences))
+	for id, s := range silences {
+		if now.Sub(s.EndsAt) > expiredSilenceRetention {
+			delete(silences, id)
+			continue
+		}
+		config.Silences = append(config.Silences, s.Silence)
+	}
+	sort.Slice(config.Silences, func(i, j int) bool { return config.Silences[i].ID < config.Silences[j].ID })
+
+	if err := saveConfig(m.path, &config); err != nil {
+		return err
+	}
+
+	m.setConfig(&config)
+	m.silences = silences
+	return nil
+}
+
+// suppress marks the alerts muted by an active silence, or inhibited by a firing alert
+// through an inhibit rule of a route they are sent through
+func (m *Manager) suppress(now time.Time) {
+	firing := make([]*alert, 0, len(m.alerts))
+	for _, a := range m.alerts {
+		if a.State == clients.AlertStateFiring {
+			firing = append(firing, a)
+		}
+	}
+
+	for _, a := range m.alerts {
+		a.SilencedBy, a.InhibitedBy = nil, nil
+
+		for id, s := range m.silences {
+			if s.state(now) == clients.SilenceActive && matchesAll(s.matchers, a.Labels) {
+				a.SilencedBy = append(a.SilencedBy, id)
+			}
+		}
+		sort.Strings(a.SilencedBy)
+
+		if m.route == nil {
+			continue
+		}
+		rules := m.route.inhibitRulesFor(a.Labels)
+		if len(rules) == 0 {
+			continue
+		}
+		for _, source := range firing {
+			if source == a {
+				continue
+			}
+			for _, rule := range rules {
+				if rule.inhibits(source.Labels, a.Labels) {
+					a.InhibitedBy = append(a.InhibitedBy, source.key)
+					break
+				}
+			}
+		}
+		sort.Strings(a.InhibitedBy)
+	}
+}
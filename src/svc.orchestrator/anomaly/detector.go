@@ -0,0 +1,339 @@
+package anomaly
+
+import (
+	"clients"
+	"fmt"
+	"log"
+	"math"
+	"metrics"
+	"sort"
+	"sync"
+	"time"
+
+	"svc.orchestrator/storage"
+)
+
+const (
+	// span is the number of windows the baseline mostly remembers, 4 hours of 5m windows
+	span  = 48
+	alpha = 2.0 / (span + 1)
+	// warmup is the number of windows a series needs before it is evaluated
+	warmup = 12
+	// history is how far back a metric is replayed into the baselines the first time it is seen
+	history = 24 * time.Hour
+	// minRelativeStdDev keeps flat series, whose deviation is close to 0, from flagging every
+	// small change
+	minRelativeStdDev = 0.01
+)
+
+var anomalies = metrics.NewCounterVec("orchestrator_anomalies", "Anomalies detected, by metric.", "metric")
+
+func init() {
+	metrics.Register(anomalies)
+}
+
+// Detector learns the baseline of every series of the watched metrics from the windows of a
+// rollup tier, as an exponentially weighted moving average and deviation, and flags the windows
+// which fall outside of the band of stdDevs deviations around it. The band of every evaluated
+// window is stored in every tier as the anomaly:<metric>:lower, anomaly:<metric>:upper and
+// anomaly:<metric>:score metrics, which the anomalies are read back from.
+type Detector struct {
+	store    storage.MetricsStore
+	tier     storage.RollupTier
+	metrics  map[string]bool
+	stdDevs  float64
+	baseline map[string]*baseline
+	// latest is the last window evaluated per metric
+	latest map[string]time.Time
+	seeded map[string]bool
+	lock   *sync.RWMutex
+}
+
+// baseline is the learned state of a series
+type baseline struct {
+	mean     float64
+	variance float64
+	windows  int
+	lastTS   time.Time
+	// last is the evaluation of the last window, nil during the warmup
+	last *clients.AnomalyEvent
+}
+
+// AnomalyQuery selects the events of a metric in [StartTS, EndTS), optionally of a single
+// service instance or of every instance of a service
+type AnomalyQuery struct {
+	MetricID    string
+	ServiceID   string
+	ServiceName string
+	StartTS     time.Time
+	EndTS       time.Time
+}
+
+// NewDetector watches the windows tier rolls up for metricIDs
+func NewDetector(store storage.MetricsStore, tier storage.RollupTier, metricIDs []string, stdDevs float64) *Detector {
+	d := Detector{
+		store:    store,
+		tier:     tier,
+		metrics:  map[string]bool{},
+		stdDevs:  stdDevs,
+		baseline: map[string]*baseline{},
+		latest:   map[string]time.Time{},
+		seeded:   map[string]bool{},
+		lock:     &sync.RWMutex{},
+	}
+	for _, metricID := range metricIDs {
+		d.metrics[metricID] = true
+	}
+
+	store.OnRollup(d.observe)
+	log.Printf("Detecting anomalies of metrics=%v on %s", metricIDs, tier.Table())
+
+	return &d
+}
+
+// observe evaluates, and then learns, the windows a rollup finalized
+func (d *Detector) observe(tier storage.RollupTier, metricID string, aggs []*clients.Aggregation) {
+	if tier.Table() != d.tier.Table() || !d.metrics[metricID] {
+		return
+	}
+
+	d.lock.Lock()
+	seeded := d.seeded[metricID]
+	d.seeded[metricID] = true
+	d.lock.Unlock()
+
+	if !seeded {
+		d.seed(metricID, aggs[0].TS)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	bands := map[string]*clients.Aggregation{}
+	for _, agg := range aggs {
+		event, anomalous := d.learn(*agg)
+		if event == nil {
+			continue
+		}
+		if event.TS.After(d.latest[metricID]) {
+			d.latest[metricID] = event.TS
+		}
+		for name, value := range map[string]float64{"lower": event.Lower, "upper": event.Upper, "score": event.Score} {
+			bandMetricID := bandMetric(metricID, name)
+			bands[bandMetricID+":"+agg.ServiceID] = &clients.Aggregation{
+				MetricID:  bandMetricID,
+				ServiceID: agg.ServiceID,
+				TS:        agg.TS,
+				Min:       value,
+				Max:       value,
+				Average:   value,
+				NumValues: 1,
+				Labels:    agg.Labels,
+			}
+		}
+		if anomalous {
+			anomalies.With(metricID).Inc()
+			log.Printf("Anomaly metric=%s service=%s ts=%s value=%g expected=[%g, %g]", metricID, agg.ServiceID,
+				agg.TS.Format(time.RFC3339), event.Value, event.Lower, event.Upper)
+		}
+	}
+
+	if len(bands) > 0 {
+		if err := d.store.InsertWindows(bands); err != nil {
+			log.Printf("Failed storing anomaly bands of metric=%s! err=%s", metricID, err.Error())
+		}
+	}
+}
+
+// seed replays the history of a metric preceding the first window seen into the baselines
+func (d *Detector) seed(metricID string, before time.Time) {
+	resp, err := d.store.GetStats(&storage.StatsQuery{
+		MetricID:   metricID,
+		Resolution: d.tier.Resolution.Duration().String(),
+		StartTS:    before.Add(-history),
+		EndTS:      before,
+	})
+	if err != nil {
+		log.Printf("Failed reading the history of metric=%s! err=%s", metricID, err.Error())
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, row := range resp.Aggregations {
+		d.learn(row)
+	}
+	log.Printf("Seeded the anomaly baselines of metric=%s with windows=%d", metricID, len(resp.Aggregations))
+}
+
+// learn evaluates the window against the baseline of its series, once out of the warmup, and
+// then updates the baseline. Windows older than the last one learned are skipped.
+func (d *Detector) learn(row clients.Aggregation) (*clients.AnomalyEvent, bool) {
+	key := row.MetricID + ":" + row.ServiceID
+	b, ok := d.baseline[key]
+	if !ok {
+		b = &baseline{}
+		d.baseline[key] = b
+	}
+	if b.windows > 0 && !row.TS.After(b.lastTS) {
+		return nil, false
+	}
+
+	var event *clients.AnomalyEvent
+	anomalous := false
+	if b.windows >= warmup {
+		stdDev := math.Max(math.Sqrt(b.variance), math.Max(minRelativeStdDev*math.Abs(b.mean), 1e-9))
+		event = &clients.AnomalyEvent{
+			MetricID:  row.MetricID,
+			ServiceID: row.ServiceID,
+			Labels:    row.Labels,
+			TS:        row.TS,
+			Value:     row.Average,
+			Expected:  b.mean,
+			Lower:     b.mean - d.stdDevs*stdDev,
+			Upper:     b.mean + d.stdDevs*stdDev,
+			Score:     (row.Average - b.mean) / stdDev,
+		}
+		anomalous = math.Abs(event.Score) > d.stdDevs
+	}
+	b.last = event
+
+	if b.windows == 0 {
+		b.mean = row.Average
+	} else {
+		diff := row.Average - b.mean
+		increment := alpha * diff
+		b.mean += increment
+		b.variance = (1 - alpha) * (b.variance + diff*increment)
+	}
+	b.windows++
+	b.lastTS = row.TS
+
+	return event, anomalous
+}
+
+// Anomalies returns the events selected by query, ordered by time. An event is a window of the
+// tier whose stored score is outside of the band.
+func (d *Detector) Anomalies(query AnomalyQuery) ([]clients.AnomalyEvent, error) {
+	metricIDs := []string{query.MetricID}
+	if len(query.MetricID) == 0 {
+		metricIDs = make([]string, 0, len(d.metrics))
+		for metricID := range d.metrics {
+			metricIDs = append(metricIDs, metricID)
+		}
+		sort.Strings(metricIDs)
+	}
+
+	result := make([]clients.AnomalyEvent, 0)
+	for _, metricID := range metricIDs {
+		if !d.metrics[metricID] {
+			continue
+		}
+		events, err := d.readEvents(metricID, query)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, events...)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].TS.Before(result[j].TS) })
+	return result, nil
+}
+
+// readEvents reads the anomalous windows of metricID from its score band, and then their value
+// and band
+func (d *Detector) readEvents(metricID string, query AnomalyQuery) ([]clients.AnomalyEvent, error) {
+	read := func(metricID string, startTS, endTS time.Time) ([]clients.Aggregation, error) {
+		resp, err := d.store.GetStats(&storage.StatsQuery{
+			MetricID:    metricID,
+			ServiceID:   query.ServiceID,
+			ServiceName: query.ServiceName,
+			Resolution:  d.tier.Resolution.Duration().String(),
+			StartTS:     startTS,
+			EndTS:       endTS,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Aggregations, nil
+	}
+
+	scores, err := read(bandMetric(metricID, "score"), query.StartTS, query.EndTS)
+	if err != nil {
+		return nil, err
+	}
+	anomalous := []clients.Aggregation{}
+	for _, score := range scores {
+		if math.Abs(score.Average) > d.stdDevs {
+			anomalous = append(anomalous, score)
+		}
+	}
+	if len(anomalous) == 0 {
+		return nil, nil
+	}
+
+	startTS, endTS := anomalous[0].TS, anomalous[len(anomalous)-1].TS.Add(d.tier.Resolution.Duration())
+	rows := map[string]map[string]clients.Aggregation{}
+	for _, name := range []string{metricID, bandMetric(metricID, "lower"), bandMetric(metricID, "upper")} {
+		aggs, err := read(name, startTS, endTS)
+		if err != nil {
+			return nil, err
+		}
+		rows[name] = map[string]clients.Aggregation{}
+		for _, agg := range aggs {
+			rows[name][eventKey(agg)] = agg
+		}
+	}
+
+	events := make([]clients.AnomalyEvent, 0, len(anomalous))
+	for _, score := range anomalous {
+		key := eventKey(score)
+		lower, upper := rows[bandMetric(metricID, "lower")][key].Average, rows[bandMetric(metricID, "upper")][key].Average
+		events = append(events, clients.AnomalyEvent{
+			MetricID:  metricID,
+			ServiceID: score.ServiceID,
+			Labels:    score.Labels,
+			TS:        score.TS,
+			Value:     rows[metricID][key].Average,
+			Expected:  (lower + upper) / 2,
+			Lower:     lower,
+			Upper:     upper,
+			Score:     score.Average,
+		})
+	}
+	return events, nil
+}
+
+// bandMetric returns the metric the band named name of metricID is stored as
+func bandMetric(metricID, name string) string {
+	return "anomaly:" + metricID + ":" + name
+}
+
+func eventKey(agg clients.Aggregation) string {
+	return fmt.Sprintf("%d:%s", agg.TS.Unix(), agg.ServiceID)
+}
+
+// Watches reports whether the anomalies of the metric are detected
+func (d *Detector) Watches(metricID string) bool {
+	return d.metrics[metricID]
+}
+
+// Latest returns the evaluation of the last window of every series of the metric, optionally
+// of a single service, which was out of the warmup. Series missing from the last window are left out.
+func (d *Detector) Latest(metricID, serviceName string) []clients.AnomalyEvent {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	result := make([]clients.AnomalyEvent, 0)
+	for _, b := range d.baseline {
+		if b.last == nil || b.last.MetricID != metricID || !b.last.TS.Equal(d.latest[metricID]) {
+			continue
+		}
+		if len(serviceName) > 0 && b.last.Labels[clients.LabelService] != serviceName {
+			continue
+		}
+		result = append(result, *b.last)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ServiceID < result[j].ServiceID })
+	return result
+}
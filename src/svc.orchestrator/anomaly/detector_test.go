@@ -0,0 +1,84 @@
+package anomaly
+
+import (
+	"clients"
+	"testing"
+	"time"
+
+	"svc.orchestrator/storage"
+)
+
+func TestAnomaliesAreReadFromTheStore(t *testing.T) {
+	store := storage.NewMemoryStore(storage.DefaultRollupTiers())
+	tier, _ := storage.DefaultRollupTiers().Get("rollups300")
+
+	// a steady series whose last window jumps
+	startTS := time.Now().Add(-4 * time.Hour).Truncate(2 * time.Hour)
+	rows := []clients.Aggregation{}
+	for i := 0; i < 20; i++ {
+		value := 50.0 + float64(i%2)*2
+		if i == 19 {
+			value = 90
+		}
+		rows = append(rows, clients.Aggregation{
+			MetricID:  "mem",
+			ServiceID: "echohost-1",
+			TS:        startTS.Add(time.Duration(i) * 5 * time.Minute),
+			Min:       value,
+			Max:       value,
+			Average:   value,
+			NumValues: 1,
+			Labels:    map[string]string{clients.LabelService: "echo"},
+		})
+	}
+	if _, err := store.Import(tier.Table(), rows); err != nil {
+		t.Fatal(err)
+	}
+	windows := []*clients.Aggregation{}
+	for i := range rows {
+		windows = append(windows, &rows[i])
+	}
+	NewDetector(store, tier, []string{"mem"}, 3).observe(tier, "mem", windows)
+
+	// the events outlive the detector which found them
+	d := NewDetector(store, tier, []string{"mem"}, 3)
+	query := AnomalyQuery{StartTS: startTS, EndTS: time.Now()}
+	events, err := d.Anomalies(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d anomalies, want 1: %+v", len(events), events)
+	}
+	event := events[0]
+	if event.MetricID != "mem" || event.ServiceID != "echohost-1" || !event.TS.Equal(rows[19].TS) || event.Value != 90 ||
+		event.Score <= 3 || event.Upper >= 90 || event.Lower >= event.Upper || event.Labels[clients.LabelService] != "echo" {
+		t.Errorf("got anomaly=%+v", event)
+	}
+
+	for _, q := range []AnomalyQuery{
+		{MetricID: "cpu", StartTS: query.StartTS, EndTS: query.EndTS},
+		{ServiceName: "other", StartTS: query.StartTS, EndTS: query.EndTS},
+		{StartTS: query.StartTS, EndTS: rows[19].TS},
+	} {
+		if events, err := d.Anomalies(q); err != nil || len(events) != 0 {
+			t.Errorf("query=%+v: got anomalies=%+v err=%v, want none", q, events, err)
+		}
+	}
+
+	// the bands are in every tier
+	for _, resolution := range []string{"5m", "2h", "24h"} {
+		resp, err := store.GetStats(&storage.StatsQuery{
+			MetricID:   bandMetric("mem", "score"),
+			Resolution: resolution,
+			StartTS:    startTS.Add(-24 * time.Hour),
+			EndTS:      time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Aggregations) == 0 {
+			t.Errorf("resolution=%s: no anomaly scores", resolution)
+		}
+	}
+}
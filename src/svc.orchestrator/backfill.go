@@ -0,0 +1,113 @@
+package main
+
+import (
+	"clients"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// backfillPollInterval is how often the progress of the backfill is polled
+const backfillPollInterval = time.Second
+
+// runBackfill implements the "orchestrator backfill" subcommand, which asks the orchestrator
+// listening on the address of the config to recompute a rollup tier and waits for the backfill
+// to finish
+func runBackfill(args []string) {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	tier := fs.String("tier", "", "Rollup tier to recompute, e.g. rollups300")
+	metricID := fs.String("metric", "", "Metric to recompute")
+	serviceID := fs.String("service", "", "Service to recompute, every service when empty")
+	start := fs.String("start", "", "Start of the time range, RFC3339 or unix timestamp, required")
+	end := fs.String("end", "", "End of the time range, RFC3339 or unix timestamp, defaults to now")
+	dryRun := fs.Bool("dry-run", false, "Print the differences with the stored rows without writing them")
+	cfg, _, err := loadConfig(fs, args)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	startTS, endTS, err := parseBackfillRange(*start, *end, time.Now().UTC())
+	if err != nil {
+		fmt.Fprintf(fs.Output(), "%v\n", err)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client := clients.NewOrchestratorClient(cfg.apiAddress())
+	job, err := client.Backfill(context.Background(), &clients.BackfillRequest{
+		Tier:      *tier,
+		MetricID:  *metricID,
+		ServiceID: *serviceID,
+		StartTS:   startTS,
+		EndTS:     endTS,
+		DryRun:    *dryRun,
+	})
+	if err != nil {
+		log.Fatalf("Error running backfill: %+v", err)
+	}
+	log.Printf("Started backfill=%s of %d windows", job.ID, job.Windows)
+
+	ticker := time.NewTicker(backfillPollInterval)
+	defer ticker.Stop()
+	for job.Status == clients.BackfillRunning {
+		<-ticker.C
+		if job, err = client.GetBackfill(context.Background(), job.ID); err != nil {
+			log.Fatalf("Error getting backfill: %+v", err)
+		}
+		log.Printf("Backfill=%s %s windows=%d/%d", job.ID, job.Status, job.WindowsDone, job.Windows)
+	}
+	if job.Status == clients.BackfillFailed {
+		log.Fatalf("Backfill=%s failed: %s", job.ID, job.Error)
+	}
+
+	resp := job.Result
+	for _, change := range resp.Changes {
+		r := change.Recomputed
+		if change.Stored == nil {
+			fmt.Printf("%-7s %s service=%s min=%g max=%g avg=%g count=%d\n", change.Action,
+				r.TS.Format(time.RFC3339), r.ServiceID, r.Min, r.Max, r.Average, r.NumValues)
+			continue
+		}
+		s := change.Stored
+		fmt.Printf("%-7s %s service=%s min=%g->%g max=%g->%g avg=%g->%g count=%d->%d\n", change.Action,
+			r.TS.Format(time.RFC3339), r.ServiceID, s.Min, r.Min, s.Max, r.Max, s.Average, r.Average, s.NumValues, r.NumValues)
+	}
+	if resp.Truncated {
+		fmt.Printf("... only the first %d changes are listed\n", len(resp.Changes))
+	}
+
+	fmt.Printf("%s metric=%s [%s, %s) inserted=%d updated=%d unchanged=%d dry-run=%t\n", resp.Tier, resp.MetricID,
+		resp.StartTS.Format(time.RFC3339), resp.EndTS.Format(time.RFC3339), resp.Inserted, resp.Updated, resp.Unchanged, resp.DryRun)
+}
+
+// parseTime parses an RFC3339 time or a unix timestamp, returning def for an empty value
+// parseBackfillRange parses the -start and -end flags, start being required and end defaulting
+// to now
+func parseBackfillRange(start, end string, now time.Time) (time.Time, time.Time, error) {
+	if len(start) == 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("-start is required")
+	}
+	startTS, err := parseTime(start, time.Time{})
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid -start=%s: %v", start, err)
+	}
+	endTS, err := parseTime(end, now)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid -end=%s: %v", end, err)
+	}
+	return startTS, endTS, nil
+}
+
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return def, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
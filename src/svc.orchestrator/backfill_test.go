@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBackfillRange(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	startTS, endTS, err := parseBackfillRange("2024-01-01T00:00:00Z", "", now)
+	if err != nil || !startTS.Equal(now.Add(-24*time.Hour)) || !endTS.Equal(now) {
+		t.Errorf("got start=%s end=%s err=%v, want the start and now", startTS, endTS, err)
+	}
+	if startTS, endTS, err = parseBackfillRange("1704067200", "1704070800", now); err != nil || endTS.Sub(startTS) != time.Hour {
+		t.Errorf("got start=%s end=%s err=%v, want an hour", startTS, endTS, err)
+	}
+
+	for _, test := range []struct {
+		start, end, err string
+	}{
+		{"", "", "-start is required"},
+		{"yesterday", "", "invalid -start=yesterday"},
+		{"1704067200", "2024-01-02", "invalid -end=2024-01-02"},
+	} {
+		if _, _, err := parseBackfillRange(test.start, test.end, now); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("start=%q end=%q: got err=%v, want %q", test.start, test.end, err, test.err)
+		}
+	}
+}
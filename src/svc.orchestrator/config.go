@@ -0,0 +1,194 @@
+package main
+
+import (
+	"config"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"svc.orchestrator/registry"
+	"svc.orchestrator/storage"
+)
+
+// envPrefix prefixes the environment variables of the orchestrator config, e.g.
+// ORCHESTRATOR_LISTEN_ADDRESS
+const envPrefix = "ORCHESTRATOR_"
+
+// orchestratorConfig is read from the json or yaml file of -config, then overridden by the
+// environment variables and then by the flags
+type orchestratorConfig struct {
+	ListenAddress   string            `json:"listen_address" env:"LISTEN_ADDRESS" flag:"listen" usage:"Address the api is served on"`
+	ShutdownTimeout config.Duration   `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"Time given to the components to stop, flushing what they hold, before exiting"`
+	Storage         storageConfig     `json:"storage"`
+	Aggregator      aggregatorConfig  `json:"aggregator"`
+	HealthCheck     healthCheckConfig `json:"health_check"`
+	Alerting        alertingConfig    `json:"alerting"`
+	SLO             slosConfig        `json:"slo"`
+	Anomaly         anomalyConfig     `json:"anomaly"`
+}
+
+type storageConfig struct {
+	Backend      string          `json:"backend" env:"STORAGE" flag:"storage" usage:"Storage backend: cassandra, memory or segment"`
+	DataDir      string          `json:"data_dir" env:"DATA_DIR" flag:"data-dir" usage:"Data directory of the segment storage backend"`
+	RollupConfig string          `json:"rollup_config" env:"ROLLUP_CONFIG" flag:"rollup-config" usage:"JSON file declaring the rollup tiers, the built-in tiers are used when empty"`
+	Cassandra    cassandraConfig `json:"cassandra"`
+}
+
+type cassandraConfig struct {
+	Seeds          []string        `json:"seeds" env:"CASSANDRA_SEEDS" flag:"cassandra-seeds" usage:"Comma separated list of Cassandra seeds"`
+	Keyspace       string          `json:"keyspace" env:"CASSANDRA_KEYSPACE" flag:"cassandra-keyspace" usage:"Cassandra keyspace the metrics are stored in, created and migrated at startup"`
+	NumConns       int             `json:"num_conns" env:"CASSANDRA_NUM_CONNS" flag:"cassandra-num-conns" usage:"Connections to every Cassandra host"`
+	ConnectTimeout config.Duration `json:"connect_timeout" env:"CASSANDRA_CONNECT_TIMEOUT" flag:"cassandra-connect-timeout" usage:"Timeout of the connections to Cassandra"`
+}
+
+type aggregatorConfig struct {
+	FlushInterval config.Duration `json:"flush_interval" env:"AGGREGATOR_FLUSH_INTERVAL" flag:"aggregator-flush-interval" usage:"Interval between flushes of the aggregated data points to the storage"`
+}
+
+type healthCheckConfig struct {
+	Interval config.Duration `json:"interval" env:"HEALTH_CHECK_INTERVAL" flag:"health-check-interval" usage:"Interval between heartbeats of the sidecars"`
+	Timeout  config.Duration `json:"timeout" env:"HEALTH_CHECK_TIMEOUT" flag:"health-check-timeout" usage:"Timeout of a heartbeat"`
+	Failures int             `json:"failures" env:"HEALTH_CHECK_FAILURES" flag:"health-check-failures" usage:"Consecutive failed heartbeats deregistering a sidecar"`
+}
+
+type alertingConfig struct {
+	Rules    string          `json:"rules" env:"ALERT_RULES" flag:"alert-rules" usage:"JSON file persisting the alert rules and receivers"`
+	Interval config.Duration `json:"interval" env:"ALERT_INTERVAL" flag:"alert-interval" usage:"Interval between evaluations of the alert rules"`
+}
+
+type slosConfig struct {
+	Config string `json:"config" env:"SLO_CONFIG" flag:"slo-config" usage:"JSON file declaring the SLOs of the services"`
+}
+
+type anomalyConfig struct {
+	Enabled bool    `json:"enabled" env:"ANOMALY_DETECTION" flag:"anomaly-detection" usage:"Detect anomalies of the resource metrics after every rollup"`
+	Tier    string  `json:"tier" env:"ANOMALY_TIER" flag:"anomaly-tier" usage:"Resolution of the rollup tier the anomaly baselines are learned from"`
+	StdDevs float64 `json:"stddevs" env:"ANOMALY_STDDEVS" flag:"anomaly-stddevs" usage:"Width in standard deviations of the band around the anomaly baselines"`
+}
+
+func defaultOrchestratorConfig() orchestratorConfig {
+	policy := registry.DefaultHealthCheckPolicy()
+
+	return orchestratorConfig{
+		ListenAddress:   ":8500",
+		ShutdownTimeout: config.Duration(30 * time.Second),
+		Storage: storageConfig{
+			Backend: storage.StorageCassandra,
+			DataDir: "./segments",
+			Cassandra: cassandraConfig{
+				Seeds:          []string{"127.0.0.1"},
+				Keyspace:       storage.DefaultKeyspace,
+				NumConns:       storage.DefaultNumConns,
+				ConnectTimeout: config.Duration(storage.DefaultConnectTimeout),
+			},
+		},
+		Aggregator: aggregatorConfig{FlushInterval: config.Duration(time.Minute)},
+		HealthCheck: healthCheckConfig{
+			Interval: config.Duration(policy.Interval),
+			Timeout:  config.Duration(policy.Timeout),
+			Failures: policy.Failures,
+		},
+		Alerting: alertingConfig{Rules: "./alerts.json", Interval: config.Duration(time.Minute)},
+		SLO:      slosConfig{Config: "./slos.json"},
+		Anomaly:  anomalyConfig{Tier: "5m", StdDevs: 3},
+	}
+}
+
+// loadConfig parses args with fs, along with the flags of the config, and returns the effective
+// config along with the path of its file, -config naming the file to read, or else
+// ORCHESTRATOR_CONFIG. The subcommands load the config the same way, with their own flag set.
+func loadConfig(fs *flag.FlagSet, args []string) (*orchestratorConfig, string, error) {
+	cfg := defaultOrchestratorConfig()
+	path := fs.String("config", "", "JSON or YAML config file, overridden by the "+envPrefix+"* environment variables and the flags")
+	config.Bind(fs, &cfg)
+	fs.Parse(args)
+
+	if len(*path) == 0 {
+		*path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if err := config.Load(&cfg, *path, envPrefix, fs); err != nil {
+		return nil, "", err
+	}
+	return &cfg, *path, nil
+}
+
+// readConfig reads the effective config again once the command line is parsed, for reloads
+func readConfig(path string) (*orchestratorConfig, error) {
+	cfg := defaultOrchestratorConfig()
+	if err := config.Load(&cfg, path, envPrefix, flag.CommandLine); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *orchestratorConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		return fmt.Errorf("listen_address=%s must be a host:port address, e.g. :8500", c.ListenAddress)
+	}
+
+	switch c.Storage.Backend {
+	case storage.StorageCassandra:
+		if len(c.Storage.Cassandra.Seeds) == 0 {
+			return fmt.Errorf("storage.cassandra.seeds must not be empty")
+		}
+		if err := storage.ValidateKeyspace(c.Storage.Cassandra.Keyspace); err != nil {
+			return fmt.Errorf("storage.cassandra.keyspace: %s", err.Error())
+		}
+		if c.Storage.Cassandra.NumConns < 1 {
+			return fmt.Errorf("storage.cassandra.num_conns=%d must be at least 1", c.Storage.Cassandra.NumConns)
+		}
+	case storage.StorageSegment:
+		if len(c.Storage.DataDir) == 0 {
+			return fmt.Errorf("storage.data_dir must be set for the segment backend")
+		}
+	case storage.StorageMemory:
+	default:
+		return fmt.Errorf("storage.backend=%s must be one of cassandra, memory or segment", c.Storage.Backend)
+	}
+
+	durations := []struct {
+		name  string
+		value config.Duration
+	}{
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"storage.cassandra.connect_timeout", c.Storage.Cassandra.ConnectTimeout},
+		{"aggregator.flush_interval", c.Aggregator.FlushInterval},
+		{"health_check.interval", c.HealthCheck.Interval},
+		{"health_check.timeout", c.HealthCheck.Timeout},
+		{"alerting.interval", c.Alerting.Interval},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			return fmt.Errorf("%s=%s must be positive", d.name, d.value)
+		}
+	}
+
+	if c.HealthCheck.Failures < 1 {
+		return fmt.Errorf("health_check.failures=%d must be at least 1", c.HealthCheck.Failures)
+	}
+	if c.Anomaly.StdDevs <= 0 {
+		return fmt.Errorf("anomaly.stddevs=%g must be positive", c.Anomaly.StdDevs)
+	}
+	return nil
+}
+
+// healthCheckPolicy returns the policy of the health checkers of the registry
+func (c *orchestratorConfig) healthCheckPolicy() registry.HealthCheckPolicy {
+	return registry.HealthCheckPolicy{
+		Interval: c.HealthCheck.Interval.Duration(),
+		Timeout:  c.HealthCheck.Timeout.Duration(),
+		Failures: c.HealthCheck.Failures,
+	}
+}
+
+// apiAddress returns the url of the api of an orchestrator listening on the address of the
+// config, on the local host when the address has no host
+func (c *orchestratorConfig) apiAddress() string {
+	host, port, _ := net.SplitHostPort(c.ListenAddress)
+	if len(host) == 0 || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestSubcommandsLoadTheConfig checks that a subcommand reads the config file, environment and
+// flags of the orchestrator along with its own flags
+func TestSubcommandsLoadTheConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orchestrator.yaml")
+	content := "listen_address: :9000\nstorage:\n  cassandra:\n    seeds: [10.0.0.1, 10.0.0.2]\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	tier := fs.String("tier", "", "")
+	cfg, configPath, err := loadConfig(fs, []string{"-config=" + path, "-tier=rollups300", "-cassandra-num-conns=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if configPath != path || *tier != "rollups300" {
+		t.Errorf("got config=%s tier=%s", configPath, *tier)
+	}
+	if seeds := cfg.Storage.Cassandra.Seeds; !reflect.DeepEqual(seeds, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("got seeds=%v", seeds)
+	}
+	if cfg.Storage.Cassandra.NumConns != 2 {
+		t.Errorf("got num_conns=%d, want 2", cfg.Storage.Cassandra.NumConns)
+	}
+	if address := cfg.apiAddress(); address != "http://localhost:9000" {
+		t.Errorf("got address=%s, want http://localhost:9000", address)
+	}
+}
+
+func TestAPIAddress(t *testing.T) {
+	for listen, want := range map[string]string{
+		":8500":          "http://localhost:8500",
+		"0.0.0.0:8500":   "http://localhost:8500",
+		"[::]:8500":      "http://localhost:8500",
+		"10.0.0.1:8500":  "http://10.0.0.1:8500",
+		"[fe80::1]:8500": "http://[fe80::1]:8500",
+	} {
+		cfg := orchestratorConfig{ListenAddress: listen}
+		if got := cfg.apiAddress(); got != want {
+			t.Errorf("listen_address=%s: got %s, want %s", listen, got, want)
+		}
+	}
+}
+
+func TestInvalidKeyspace(t *testing.T) {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	_, _, err := loadConfig(fs, []string{"-cassandra-keyspace=stats-staging"})
+	if err == nil || !strings.Contains(err.Error(), "storage.cassandra.keyspace") {
+		t.Errorf("got err=%v, want an invalid storage.cassandra.keyspace", err)
+	}
+}
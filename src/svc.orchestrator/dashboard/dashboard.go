@@ -0,0 +1,32 @@
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// URL is the path the dashboard is served under
+const URL = "/ui/"
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the files of the dashboard, which reads the services and stats from the api
+// and follows the instance events to update live
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix(URL, http.FileServer(http.FS(files)))
+}
+
+// Redirect sends the requests of the root path to the dashboard and answers 404 to the others
+func Redirect(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	http.Redirect(w, req, URL, http.StatusFound)
+}
@@ -0,0 +1,355 @@
+// Dashboard of the orchestrator: lists the services and their instances, charts the resource
+// metrics of the selected instance and follows the instance events of /v1/events and the data
+// points of /v1/stats/live to update live.
+"use strict";
+
+const API = "/v1";
+const METRICS = [
+  { id: "cpu", title: "CPU" },
+  { id: "mem", title: "Memory", format: bytes },
+  { id: "threads", title: "Threads" },
+  { id: "num_goroutines", title: "Goroutines" },
+];
+const CHART_POINTS = 120;
+const MAX_EVENTS = 100;
+
+const state = {
+  services: [],
+  selected: null, // control address of the selected instance
+  charts: {}, // points of the selected instance by metric id
+  live: null, // event source of the data points of the selected instance
+};
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    if (name === "onclick") {
+      node.addEventListener("click", value);
+    } else {
+      node.setAttribute(name, value);
+    }
+  }
+  for (const child of children) {
+    node.append(child instanceof Node ? child : document.createTextNode(String(child)));
+  }
+  return node;
+}
+
+function svgEl(tag, attrs) {
+  const node = document.createElementNS("http://www.w3.org/2000/svg", tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    node.setAttribute(name, value);
+  }
+  return node;
+}
+
+async function getJSON(path) {
+  const resp = await fetch(API + path);
+  const body = await resp.json();
+  if (!resp.ok) {
+    throw new Error(body.error ? body.error.message : resp.statusText);
+  }
+  return body;
+}
+
+function bytes(value) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (Math.abs(value) >= 1024 && i < units.length - 1) {
+    value /= 1024;
+    i++;
+  }
+  return value.toFixed(1) + " " + units[i];
+}
+
+function number(value) {
+  return Number.isInteger(value) ? String(value) : value.toFixed(2);
+}
+
+function age(ts) {
+  if (!ts) {
+    return "never";
+  }
+  const seconds = Math.max(0, Math.round((Date.now() - new Date(ts).getTime()) / 1000));
+  if (seconds < 60) {
+    return seconds + "s ago";
+  }
+  if (seconds < 3600) {
+    return Math.round(seconds / 60) + "m ago";
+  }
+  return Math.round(seconds / 3600) + "h ago";
+}
+
+function healthOf(registrant) {
+  return registrant.draining ? "draining" : registrant.health || "pending";
+}
+
+function findInstance(controlAddress) {
+  for (const service of state.services) {
+    for (const registrant of service.registrants || []) {
+      if (registrant.control_address === controlAddress) {
+        return registrant;
+      }
+    }
+  }
+  return null;
+}
+
+async function loadServices() {
+  const resp = await getJSON("/services");
+  state.services = (resp.services || []).sort((a, b) => a.service_name.localeCompare(b.service_name));
+  for (const service of state.services) {
+    (service.registrants || []).sort((a, b) => a.control_address.localeCompare(b.control_address));
+  }
+  renderServices();
+}
+
+function renderServices() {
+  const container = document.getElementById("services");
+  container.replaceChildren();
+
+  if (state.services.length === 0) {
+    container.append(el("p", { class: "empty" }, "No registered services."));
+  }
+
+  for (const service of state.services) {
+    const rows = (service.registrants || []).map((registrant) => {
+      const row = el("tr", { onclick: () => selectInstance(registrant.control_address) },
+        el("td", {}, registrant.control_address),
+        el("td", {}, registrant.service_id || "-"),
+        el("td", {}, el("span", { class: "badge " + healthOf(registrant) }, healthOf(registrant))),
+        el("td", { "data-heartbeat": registrant.last_heartbeat || "" }, age(registrant.last_heartbeat)));
+      if (registrant.control_address === state.selected) {
+        row.classList.add("selected");
+      }
+      return row;
+    });
+
+    container.append(el("table", {},
+      el("caption", {}, service.service_name + " (" + rows.length + ")"),
+      el("thead", {}, el("tr", {}, el("th", {}, "Instance"), el("th", {}, "Service ID"), el("th", {}, "Health"), el("th", {}, "Last heartbeat"))),
+      el("tbody", {}, ...rows)));
+  }
+
+  if (state.selected && !findInstance(state.selected)) {
+    document.getElementById("instance-title").textContent = state.selected + " (deregistered)";
+  }
+}
+
+function selectInstance(controlAddress) {
+  state.selected = controlAddress;
+  document.getElementById("instance-panel").hidden = false;
+  renderServices();
+  loadCharts();
+}
+
+function rangeMs() {
+  return Number(document.getElementById("range").value) * 1000;
+}
+
+async function loadCharts() {
+  closeLive();
+  state.charts = {};
+  const registrant = findInstance(state.selected);
+  if (!registrant) {
+    return;
+  }
+
+  document.getElementById("instance-title").textContent = registrant.service_name + " " + registrant.control_address;
+  const charts = document.getElementById("charts");
+  if (!registrant.service_id) {
+    charts.replaceChildren(el("p", { class: "empty" }, "Waiting for the first heartbeat."));
+    return;
+  }
+
+  // subscribing first keeps the points ingested while the history loads
+  const pending = [];
+  const live = connectLive(registrant.service_id, pending);
+  const startTS = Math.floor((Date.now() - rangeMs()) / 1000);
+
+  const results = await Promise.all(METRICS.map((metric) => {
+    const params = new URLSearchParams({
+      metricID: metric.id,
+      serviceID: registrant.service_id,
+      startTS: String(startTS),
+      points: String(CHART_POINTS),
+    });
+    return getJSON("/stats?" + params).catch((err) => ({ error: err.message }));
+  }));
+
+  if (state.live !== live) {
+    // another instance or range was selected meanwhile
+    return;
+  }
+  state.charts = {};
+  METRICS.forEach((metric, i) => {
+    const points = [];
+    for (const series of results[i].series || []) {
+      for (const point of series.points) {
+        if (point.value !== null) {
+          points.push({ ts: new Date(point.time).getTime(), value: point.value });
+        }
+      }
+    }
+    state.charts[metric.id] = { metric, points, error: results[i].error };
+  });
+  for (const dp of pending.splice(0)) {
+    addPoint(dp);
+  }
+
+  charts.replaceChildren(...METRICS.map((metric) => renderChart(state.charts[metric.id])));
+}
+
+function connectLive(serviceID, pending) {
+  const params = new URLSearchParams({ serviceID });
+  for (const metric of METRICS) {
+    params.append("metricID", metric.id);
+  }
+
+  const source = new EventSource(API + "/stats/live?" + params);
+  state.live = source;
+  source.addEventListener("datapoint", (msg) => {
+    const dp = JSON.parse(msg.data);
+    const node = document.getElementById("chart-" + dp.metric_id);
+    if (state.charts[dp.metric_id] && node) {
+      addPoint(dp);
+      node.replaceWith(renderChart(state.charts[dp.metric_id]));
+    } else {
+      pending.push(dp);
+    }
+  });
+  source.addEventListener("dropped", () => {
+    // points were missed, reloading the charts fetches them from the stats
+    loadCharts().catch(showError);
+  });
+  return source;
+}
+
+function closeLive() {
+  if (state.live) {
+    state.live.close();
+    state.live = null;
+  }
+}
+
+// addPoint appends a live data point to its chart, forgetting the points out of the range
+function addPoint(dp) {
+  const chart = state.charts[dp.metric_id];
+  const ts = new Date(dp.time).getTime();
+  const last = chart.points[chart.points.length - 1];
+  if (last && last.ts >= ts) {
+    return;
+  }
+  chart.points.push({ ts, value: dp.value });
+  const minTS = Date.now() - rangeMs();
+  while (chart.points.length > 0 && chart.points[0].ts < minTS) {
+    chart.points.shift();
+  }
+}
+
+function renderChart({ metric, points, error }) {
+  const format = metric.format || number;
+  const title = el("h3", {}, metric.title);
+  const chart = el("div", { class: "chart", id: "chart-" + metric.id }, title);
+  if (error) {
+    chart.append(el("p", { class: "empty" }, error));
+    return chart;
+  }
+  if (points.length === 0) {
+    chart.append(el("p", { class: "empty" }, "No data in the range."));
+    return chart;
+  }
+
+  title.append(el("span", { class: "value" }, format(points[points.length - 1].value)));
+
+  const maxTS = Date.now();
+  const minTS = maxTS - rangeMs();
+  let min = Math.min(...points.map((p) => p.value));
+  let max = Math.max(...points.map((p) => p.value));
+  if (min === max) {
+    min -= 1;
+    max += 1;
+  }
+
+  const svg = svgEl("svg", { viewBox: "0 0 1000 100", preserveAspectRatio: "none" });
+  const coords = points.map((p) => {
+    const x = ((p.ts - minTS) / Math.max(1, maxTS - minTS)) * 1000;
+    const y = 95 - ((p.value - min) / (max - min)) * 90;
+    return x.toFixed(1) + "," + y.toFixed(1);
+  });
+  svg.append(svgEl("polyline", { points: coords.join(" ") }));
+  const tooltip = svgEl("title", {});
+  tooltip.textContent = "min " + format(min) + ", max " + format(max);
+  svg.append(tooltip);
+  chart.append(svg);
+  return chart;
+}
+
+function logEvent(event) {
+  const list = document.getElementById("events");
+  const registrant = event.registrant;
+  let text = new Date(event.time).toLocaleTimeString() + "  " + event.type.padEnd(13) + registrant.service_name + " " + registrant.control_address;
+  if (event.error) {
+    text += "  " + event.error;
+  }
+  list.prepend(el("li", {}, text));
+  while (list.children.length > MAX_EVENTS) {
+    list.lastChild.remove();
+  }
+}
+
+function onInstanceEvent(event) {
+  if (event.type !== "heartbeat") {
+    logEvent(event);
+  }
+
+  const registrant = findInstance(event.registrant.control_address);
+  if (event.type === "heartbeat" && registrant) {
+    Object.assign(registrant, event.registrant);
+    renderServices();
+  } else {
+    loadServices().catch(showError);
+  }
+
+  // the charts of an instance selected before its first heartbeat start with its service id
+  if (event.registrant.control_address === state.selected && !state.live && event.registrant.service_id) {
+    loadCharts().catch(showError);
+  }
+}
+
+function connect() {
+  const live = document.getElementById("live");
+  const source = new EventSource(API + "/events");
+
+  source.onopen = () => {
+    live.className = "badge live";
+    live.textContent = "live";
+    // events may have been missed while disconnected
+    loadServices().catch(showError);
+  };
+  source.onerror = () => {
+    live.className = "badge down";
+    live.textContent = "reconnecting";
+  };
+  source.addEventListener("instance", (msg) => onInstanceEvent(JSON.parse(msg.data)));
+  source.addEventListener("dropped", () => {
+    // the stream fell behind, reconnecting reloads the services
+    source.close();
+    setTimeout(connect, 1000);
+  });
+}
+
+function showError(err) {
+  console.error(err);
+}
+
+function tick() {
+  for (const cell of document.querySelectorAll("[data-heartbeat]")) {
+    cell.textContent = age(cell.dataset.heartbeat);
+  }
+}
+
+document.getElementById("range").addEventListener("change", () => loadCharts().catch(showError));
+setInterval(tick, 1000);
+loadServices().catch(showError);
+connect();
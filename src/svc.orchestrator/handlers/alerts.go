@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"clients"
+	"encoding/json"
+	"log"
+	"net/http"
+	"svc.orchestrator/alerting"
+
+	"github.com/pkg/errors"
+)
+
+func (m *APIManager) handleGetAlerts(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling get alerts!")
+
+	writeJSON(w, clients.AlertsResponse{Alerts: m.alerts.Alerts()})
+}
+
+// handleAlertRules lists the rules on GET, adds or replaces the posted rule on POST and
+// deletes the rule named by the name parameter on DELETE
+func (m *APIManager) handleAlertRules(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling alert rules!")
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, clients.AlertRulesResponse{Rules: m.alerts.Rules()})
+	case http.MethodPost:
+		rule := clients.AlertRule{}
+		if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := m.alerts.PutRule(rule); err != nil {
+			writeAlertingError(w, err)
+			return
+		}
+		writeJSON(w, rule)
+	case http.MethodDelete:
+		if err := m.alerts.DeleteRule(queryParams(req).Get("name")); err != nil {
+			writeAlertingError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAlertReceivers lists the receivers on GET, adds or replaces the posted receiver on
+// POST and deletes the receiver named by the name parameter on DELETE
+func (m *APIManager) handleAlertReceivers(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling alert receivers!")
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, clients.AlertReceiversResponse{Receivers: m.alerts.Receivers()})
+	case http.MethodPost:
+		receiver := clients.AlertReceiver{}
+		if err := json.NewDecoder(req.Body).Decode(&receiver); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := m.alerts.PutReceiver(receiver); err != nil {
+			writeAlertingError(w, err)
+			return
+		}
+		writeJSON(w, receiver)
+	case http.MethodDelete:
+		if err := m.alerts.DeleteReceiver(queryParams(req).Get("name")); err != nil {
+			writeAlertingError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAlertRoute returns the routing tree on GET and replaces it with the posted one on POST
+func (m *APIManager) handleAlertRoute(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling alert route!")
+
+	switch req.Method {
+	case http.MethodGet:
+		route := m.alerts.Route()
+		if route == nil {
+			writeError(w, http.StatusNotFound, "no routing tree is set")
+			return
+		}
+		writeJSON(w, route)
+	case http.MethodPost:
+		route := clients.AlertRoute{}
+		if err := json.NewDecoder(req.Body).Decode(&route); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := m.alerts.PutRoute(route); err != nil {
+			writeAlertingError(w, err)
+			return
+		}
+		writeJSON(w, route)
+	}
+}
+
+// handleSilences lists the silences on GET, creates the posted silence, or updates it when it
+// has an id, on POST and expires the silence with the id parameter on DELETE
+func (m *APIManager) handleSilences(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling silences!")
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, clients.SilencesResponse{Silences: m.alerts.Silences()})
+	case http.MethodPost:
+		silence := clients.Silence{}
+		if err := json.NewDecoder(req.Body).Decode(&silence); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		silence, err := m.alerts.PutSilence(silence)
+		if err != nil {
+			writeAlertingError(w, err)
+			return
+		}
+		writeJSON(w, silence)
+	case http.MethodDelete:
+		if err := m.alerts.ExpireSilence(queryParams(req).Get("id")); err != nil {
+			writeAlertingError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeAlertingError(w http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case alerting.ErrInvalidConfig:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case alerting.ErrNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	respBytes, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(respBytes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"clients"
+	"log"
+	"net/http"
+	"strconv"
+	"svc.orchestrator/anomaly"
+	"svc.orchestrator/storage"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// handleGetAnomalies returns the anomalies detected in [startTS, endTS), optionally of a
+// single metric, service instance or service
+func (m *APIManager) handleGetAnomalies(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling get anomalies!")
+
+	if m.anomalies == nil {
+		writeError(w, http.StatusNotFound, "anomaly detection is disabled")
+		return
+	}
+
+	params := queryParams(req)
+
+	query := anomaly.AnomalyQuery{
+		MetricID:    params.Get("metricID"),
+		ServiceID:   params.Get("serviceID"),
+		ServiceName: params.Get("service"),
+		StartTS:     time.Unix(0, 0).UTC(),
+		EndTS:       time.Now().UTC(),
+	}
+
+	for _, p := range []struct {
+		name  string
+		value string
+		ts    *time.Time
+	}{
+		{"startTS", params.Get("startTS"), &query.StartTS},
+		{"endTS", params.Get("endTS"), &query.EndTS},
+	} {
+		if len(p.value) == 0 {
+			continue
+		}
+		unixTS, err := strconv.ParseInt(p.value, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, p.name+" is not a valid unix timestamp")
+			return
+		}
+		*p.ts = time.Unix(unixTS, 0).UTC()
+	}
+
+	events, err := m.anomalies.Anomalies(query)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrInvalidQuery {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Failed reading anomalies! err=%s", err.Error())
+		writeError(w, http.StatusInternalServerError, "failed reading anomalies")
+		return
+	}
+
+	writeJSON(w, clients.AnomaliesResponse{Anomalies: events})
+}
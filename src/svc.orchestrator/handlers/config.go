@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"clients"
+	"log"
+	"net/http"
+)
+
+// handleConfigReload reloads the config, answering with the event of the reload whether it
+// was applied or rejected
+func (m *APIManager) handleConfigReload(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling config reload!")
+
+	writeJSON(w, m.reloader.Reload("api"))
+}
+
+func (m *APIManager) handleConfigEvents(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling get config events!")
+
+	writeJSON(w, clients.ConfigEventsResponse{Events: m.reloader.Events()})
+}
@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"bytes"
+	"clients"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"svc.orchestrator/alerting"
+	"svc.orchestrator/registry"
+	"svc.orchestrator/slo"
+	"svc.orchestrator/storage"
+	"svc.orchestrator/stream"
+)
+
+// testReloader applies every reload
+type testReloader struct{}
+
+func (testReloader) Reload(trigger string) clients.ConfigEvent {
+	return clients.ConfigEvent{TS: time.Now().UTC(), Trigger: trigger, Result: clients.ConfigUnchanged}
+}
+
+func (testReloader) Events() []clients.ConfigEvent {
+	return []clients.ConfigEvent{}
+}
+
+// newTestServer serves the routes of an api backed by a memory store, without anomaly
+// detection, the sidecars being health checked once an hour so that none is dropped
+func newTestServer(t *testing.T) (*httptest.Server, *APIManager) {
+	return newTestServerWithStore(t, storage.NewMemoryStore(storage.DefaultRollupTiers()))
+}
+
+func newTestServerWithStore(t *testing.T, store storage.MetricsStore) (*httptest.Server, *APIManager) {
+	tiers := storage.DefaultRollupTiers()
+	dataPoints := stream.NewBroker("datapoints")
+	aggregator := registry.NewMetricsAggregator(store, dataPoints, time.Second)
+
+	dir := t.TempDir()
+	slos, err := slo.NewManager(store, aggregator, tiers, filepath.Join(dir, "slo.json"))
+	if err != nil {
+		t.Fatalf("Failed creating the slo manager: %+v", err)
+	}
+	alerts, err := alerting.NewManager(store, slos, nil, filepath.Join(dir, "alerting.json"), time.Minute)
+	if err != nil {
+		t.Fatalf("Failed creating the alert manager: %+v", err)
+	}
+
+	policy := registry.HealthCheckPolicy{Interval: time.Hour, Timeout: time.Second, Failures: 1}
+	svcRegistry := registry.NewServiceRegistry(aggregator, slos, stream.NewBroker("instances"), policy)
+	svcRegistry.Start()
+	t.Cleanup(svcRegistry.Stop)
+
+	m := NewAPIManager(svcRegistry, store, aggregator, alerts, slos, nil, stream.NewBroker("instances"), dataPoints,
+		testReloader{})
+	mux := http.NewServeMux()
+	m.RegisterRoutes(mux)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, m
+}
+
+// checkError checks that resp has status and a clients.ErrorResponse of its code
+func checkError(t *testing.T, resp *http.Response, status int) clients.ErrorResponse {
+	t.Helper()
+
+	errResp := clients.ErrorResponse{}
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: got status=%d, want %d", resp.Request.Method, resp.Request.URL, resp.StatusCode, status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		t.Fatalf("%s %s: got Content-Type=%s, want application/json", resp.Request.Method, resp.Request.URL, contentType)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+		t.Fatalf("%s %s: the body is not an error response: %v", resp.Request.Method, resp.Request.URL, err)
+	}
+	if errResp.Error.Code != clients.ErrorCode(status) || len(errResp.Error.Message) == 0 {
+		t.Fatalf("%s %s: got error=%+v, want code=%s and a message", resp.Request.Method, resp.Request.URL,
+			errResp.Error, clients.ErrorCode(status))
+	}
+	return errResp
+}
+
+func doRequest(t *testing.T, method, url string, body interface{}) *http.Response {
+	t.Helper()
+
+	var reader *bytes.Reader
+	switch b := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(b))
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// TestRoutesAllowTheirMethods checks that every route answers 405 with the allowed methods to
+// the methods of none of its operations
+func TestRoutesAllowTheirMethods(t *testing.T) {
+	server, m := newTestServer(t)
+
+	for _, r := range m.routes() {
+		resp := doRequest(t, http.MethodPatch, server.URL+clients.APIPrefix+r.path, nil)
+		errResp := checkError(t, resp, http.StatusMethodNotAllowed)
+
+		allowed := []string{}
+		for _, op := range r.operations {
+			allowed = append(allowed, op.method)
+		}
+		if header := resp.Header.Get("Allow"); header != strings.Join(allowed, ", ") {
+			t.Errorf("PATCH %s: got Allow=%s, want %s", r.path, header, strings.Join(allowed, ", "))
+		}
+		if details := fmt.Sprint(errResp.Error.Details["allowed"]); details != fmt.Sprint(allowed) {
+			t.Errorf("PATCH %s: got allowed=%s, want %s", r.path, details, fmt.Sprint(allowed))
+		}
+	}
+}
+
+func TestUnknownRoute(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	checkError(t, doRequest(t, http.MethodGet, server.URL+clients.APIPrefix+"/nope", nil), http.StatusNotFound)
+}
+
+// TestRouteStatuses checks the status of the successful and failed requests of every route
+func TestRouteStatuses(t *testing.T) {
+	server, _ := newTestServer(t)
+	sidecar := clients.RegisterRequest{ControlAddress: "http://127.0.0.1:1", ServiceName: "echo", DataAddress: "http://127.0.0.1:2"}
+	unknown := clients.RegisterRequest{ControlAddress: "http://127.0.0.1:3", ServiceName: "echo", DataAddress: "http://127.0.0.1:4"}
+	startTS := time.Now().Add(-time.Hour).Unix()
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{http.MethodPost, clients.RegisterURL, "{", http.StatusBadRequest},
+		{http.MethodPost, clients.RegisterURL, clients.RegisterRequest{ServiceName: "echo"}, http.StatusBadRequest},
+		{http.MethodPost, clients.RegisterURL, sidecar, http.StatusOK},
+		{http.MethodPost, clients.RegisterURL, sidecar, http.StatusConflict},
+		{http.MethodDelete, clients.RegisterURL, unknown, http.StatusNotFound},
+		{http.MethodPost, clients.DrainURL, sidecar, http.StatusNoContent},
+		{http.MethodPost, clients.DrainURL, unknown, http.StatusNotFound},
+		{http.MethodDelete, clients.DrainURL, sidecar, http.StatusNoContent},
+		{http.MethodDelete, clients.RegisterURL, sidecar, http.StatusNoContent},
+		{http.MethodGet, clients.EventsURL + "?buffer=x", nil, http.StatusBadRequest},
+		{http.MethodGet, clients.LiveStatsURL + "?buffer=x", nil, http.StatusBadRequest},
+		{http.MethodGet, clients.ServicesURL, nil, http.StatusOK},
+		{http.MethodGet, clients.StatsURL, nil, http.StatusBadRequest},
+		{http.MethodGet, clients.StatsURL + "?metricID=cpu", nil, http.StatusBadRequest},
+		{http.MethodGet, clients.StatsURL + fmt.Sprintf("?metricID=cpu&startTS=%d&resolution=7s", startTS), nil, http.StatusBadRequest},
+		{http.MethodGet, clients.StatsURL + fmt.Sprintf("?metricID=cpu&startTS=%d&fn=max", startTS), nil, http.StatusBadRequest},
+		{http.MethodGet, clients.StatsURL + fmt.Sprintf("?metricID=cpu&startTS=%d&fill=linear", startTS), nil, http.StatusBadRequest},
+		{http.MethodGet, clients.StatsURL + fmt.Sprintf("?metricID=cpu&startTS=%d&fn=max&apply=rate", startTS), nil, http.StatusOK},
+		{http.MethodGet, clients.StatsURL + fmt.Sprintf("?metricID=cpu&startTS=%d", startTS), nil, http.StatusOK},
+		{http.MethodGet, clients.QueryURL, nil, http.StatusBadRequest},
+		{http.MethodGet, clients.QueryURL + fmt.Sprintf("?q=rate(&start=%d", startTS), nil, http.StatusBadRequest},
+		{http.MethodGet, clients.QueryURL + fmt.Sprintf("?q=cpu&start=%d", startTS), nil, http.StatusOK},
+		{http.MethodPost, clients.BackfillURL, "{", http.StatusBadRequest},
+		{http.MethodPost, clients.BackfillURL, clients.BackfillRequest{Tier: "rollups300"}, http.StatusBadRequest},
+		{http.MethodPost, clients.BackfillURL, clients.BackfillRequest{Tier: "rollups300", MetricID: "cpu",
+			StartTS: time.Unix(startTS, 0), EndTS: time.Unix(startTS, 0).Add(time.Hour)}, http.StatusAccepted},
+		{http.MethodGet, clients.BackfillURL + "?id=nope", nil, http.StatusNotFound},
+		{http.MethodGet, clients.ExportURL + "?metricID=cpu&startTS=x", nil, http.StatusBadRequest},
+		{http.MethodGet, clients.ExportURL + fmt.Sprintf("?metricID=cpu&startTS=%d&tier=7s", startTS), nil, http.StatusBadRequest},
+		{http.MethodGet, clients.ExportURL + fmt.Sprintf("?metricID=cpu&startTS=%d", startTS), nil, http.StatusOK},
+		{http.MethodPost, clients.ImportURL, "", http.StatusBadRequest},
+		{http.MethodPost, clients.ImportURL + "?tier=raw", "{", http.StatusBadRequest},
+		{http.MethodGet, clients.AlertsURL, nil, http.StatusOK},
+		{http.MethodGet, clients.AlertRulesURL, nil, http.StatusOK},
+		{http.MethodPost, clients.AlertRulesURL, clients.AlertRule{Name: "cpu"}, http.StatusBadRequest},
+		{http.MethodDelete, clients.AlertRulesURL + "?name=cpu", nil, http.StatusNotFound},
+		{http.MethodGet, clients.AlertReceiversURL, nil, http.StatusOK},
+		{http.MethodPost, clients.AlertReceiversURL, clients.AlertReceiver{}, http.StatusBadRequest},
+		{http.MethodDelete, clients.AlertReceiversURL + "?name=ops", nil, http.StatusNotFound},
+		{http.MethodGet, clients.AlertRouteURL, nil, http.StatusNotFound},
+		{http.MethodPost, clients.AlertRouteURL, "{", http.StatusBadRequest},
+		{http.MethodGet, clients.AlertSilencesURL, nil, http.StatusOK},
+		{http.MethodPost, clients.AlertSilencesURL, clients.Silence{}, http.StatusBadRequest},
+		{http.MethodDelete, clients.AlertSilencesURL + "?id=nope", nil, http.StatusNotFound},
+		{http.MethodGet, clients.SLOURL, nil, http.StatusOK},
+		{http.MethodGet, clients.SLOURL + "?name=nope", nil, http.StatusNotFound},
+		{http.MethodGet, clients.AnomaliesURL, nil, http.StatusNotFound},
+		{http.MethodPost, clients.ConfigReloadURL, nil, http.StatusOK},
+		{http.MethodGet, clients.ConfigEventsURL, nil, http.StatusOK},
+		{http.MethodGet, clients.OpenAPIURL, nil, http.StatusOK},
+	} {
+		resp := doRequest(t, tc.method, server.URL+clients.APIPrefix+tc.path, tc.body)
+		if tc.status >= http.StatusBadRequest {
+			checkError(t, resp, tc.status)
+		} else if resp.StatusCode != tc.status {
+			t.Errorf("%s %s: got status=%d, want %d", tc.method, tc.path, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+// TestClientErrors checks that the client methods return the APIError of the failed requests
+func TestClientErrors(t *testing.T) {
+	server, _ := newTestServer(t)
+	client := clients.NewOrchestratorClient(server.URL)
+	ctx := context.Background()
+	sidecar := &clients.RegisterRequest{ControlAddress: "http://127.0.0.1:1", ServiceName: "echo", DataAddress: "http://127.0.0.1:2"}
+
+	if _, err := client.RegisterSidecar(ctx, sidecar); err != nil {
+		t.Fatalf("Failed registering: %+v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		call   func() error
+		status int
+		cause  error
+	}{
+		{"RegisterSidecar", func() error {
+			_, err := client.RegisterSidecar(ctx, sidecar)
+			return err
+		}, http.StatusConflict, clients.ErrConflict},
+		{"RegisterSidecar", func() error {
+			_, err := client.RegisterSidecar(ctx, &clients.RegisterRequest{})
+			return err
+		}, http.StatusBadRequest, clients.ErrInvalidRequest},
+		{"DrainSidecar", func() error {
+			return client.DrainSidecar(ctx, &clients.RegisterRequest{ControlAddress: "http://127.0.0.1:3", ServiceName: "echo"})
+		}, http.StatusNotFound, clients.ErrNotFound},
+		{"GetStats", func() error {
+			_, err := client.GetStats(ctx, &clients.StatsRequest{})
+			return err
+		}, http.StatusBadRequest, clients.ErrInvalidRequest},
+		{"DeleteAlertRule", func() error {
+			return client.DeleteAlertRule(ctx, "nope")
+		}, http.StatusNotFound, clients.ErrNotFound},
+		{"GetAnomalies", func() error {
+			_, err := client.GetAnomalies(ctx, &clients.AnomaliesRequest{})
+			return err
+		}, http.StatusNotFound, clients.ErrNotFound},
+	} {
+		err := tc.call()
+		apiErr, ok := err.(*clients.APIError)
+		if !ok {
+			t.Errorf("%s: got err=%v, want an APIError", tc.name, err)
+			continue
+		}
+		if apiErr.StatusCode != tc.status || apiErr.Code != clients.ErrorCode(tc.status) || errors.Cause(err) != tc.cause {
+			t.Errorf("%s: got err=%+v, want status=%d cause=%v", tc.name, apiErr, tc.status, tc.cause)
+		}
+	}
+}
+
+// rollupRecorder records the metrics registered to be rolled up
+type rollupRecorder struct {
+	*storage.MemoryStore
+	metricIDs []string
+}
+
+func (r *rollupRecorder) AddRollupMetrics(metricIDs ...string) {
+	r.metricIDs = append(r.metricIDs, metricIDs...)
+	r.MemoryStore.AddRollupMetrics(metricIDs...)
+}
+
+// protoField encodes a length-delimited protobuf field of at most 127 bytes
+func protoField(number int, data ...[]byte) []byte {
+	value := bytes.Join(data, nil)
+	return append([]byte{byte(number<<3 | 2), byte(len(value))}, value...)
+}
+
+// TestRemoteWriteRollsUpMetrics checks that the metrics of remote-written series are registered
+// to be rolled up, once per payload
+func TestRemoteWriteRollsUpMetrics(t *testing.T) {
+	store := &rollupRecorder{MemoryStore: storage.NewMemoryStore(storage.DefaultRollupTiers())}
+	server, _ := newTestServerWithStore(t, store)
+
+	// a sample of value 1, the timestamp field being left out
+	sample := protoField(2, []byte{1<<3 | 1, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f})
+	series := func(name, instance string) []byte {
+		return protoField(1,
+			protoField(1, protoField(1, []byte("__name__")), protoField(2, []byte(name))),
+			protoField(1, protoField(1, []byte("instance")), protoField(2, []byte(instance))),
+			sample)
+	}
+	body := snappy.Encode(nil, bytes.Join([][]byte{
+		series("jobs_total", "batch-1"), series("jobs_total", "batch-2"), series("queue_depth", "batch-1"),
+	}, nil))
+
+	resp, err := http.Post(server.URL+clients.RemoteWriteURL, "application/x-protobuf", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status=%d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if want := []string{"jobs_total", "queue_depth"}; strings.Join(store.metricIDs, ",") != strings.Join(want, ",") {
+		t.Errorf("got rolled up metrics=%v, want %v", store.metricIDs, want)
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"clients"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// writeError answers with status and a clients.ErrorResponse holding message
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorDetails(w, status, message, nil)
+}
+
+// writeErrorDetails answers with status and a clients.ErrorResponse holding message and the
+// details of what the error applies to
+func writeErrorDetails(w http.ResponseWriter, status int, message string, details map[string]interface{}) {
+	errResp := clients.ErrorResponse{
+		Error: clients.APIError{
+			Code:    clients.ErrorCode(status),
+			Message: message,
+			Details: details,
+		},
+	}
+
+	respBytes, err := json.Marshal(errResp)
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, err := w.Write(respBytes); err != nil {
+		log.Printf("Failed writing error response! err=%s", err.Error())
+	}
+}
+
+// handleNotFound answers the requests of paths under the api prefix which match no route
+func handleNotFound(w http.ResponseWriter, req *http.Request) {
+	writeErrorDetails(w, http.StatusNotFound, "no route matches the path", map[string]interface{}{
+		"path": req.URL.Path,
+	})
+}
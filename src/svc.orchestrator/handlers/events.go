@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"clients"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"svc.orchestrator/stream"
+	"time"
+)
+
+const (
+	// sseKeepAlive is the interval of the comments sent to keep idle streams open through proxies
+	sseKeepAlive = 15 * time.Second
+	// maxStreamBuffer bounds the buffer a subscriber can ask for
+	maxStreamBuffer = 10000
+
+	contentTypeEventStream = "text/event-stream"
+)
+
+// handleEvents streams the changes of the registered sidecars as server-sent events, optionally
+// of a single service
+func (m *APIManager) handleEvents(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling events!")
+
+	params := queryParams(req)
+	serviceName := params.Get("service")
+
+	m.serveStream(w, req, m.events, "instance", func(event interface{}) bool {
+		e, ok := event.(clients.InstanceEvent)
+		return ok && (len(serviceName) == 0 || e.Registrant.ServiceName == serviceName)
+	})
+}
+
+// handleLiveStats streams the data points as the aggregator ingests them, as server-sent events,
+// optionally of some metrics and of a service or a service instance
+func (m *APIManager) handleLiveStats(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling live stats!")
+
+	params := queryParams(req)
+	metricIDs := map[string]bool{}
+	for _, metricID := range params.Values("metricID") {
+		metricIDs[metricID] = true
+	}
+	serviceName := params.Get("service")
+	serviceID := params.Get("serviceID")
+
+	m.serveStream(w, req, m.dataPoints, "datapoint", func(event interface{}) bool {
+		dp, ok := event.(clients.DataPoint)
+		return ok &&
+			(len(metricIDs) == 0 || metricIDs[dp.MetricID]) &&
+			(len(serviceName) == 0 || dp.Labels[clients.LabelService] == serviceName) &&
+			(len(serviceID) == 0 || dp.ServiceID == serviceID)
+	})
+}
+
+// serveStream subscribes to the broker with the buffer parameter and writes the events matching
+// filter as server-sent events of type name, until the client goes away. A subscriber dropped
+// for falling behind gets a last event of type dropped before the stream ends, so that it can
+// reconnect knowing it missed events.
+func (m *APIManager) serveStream(w http.ResponseWriter, req *http.Request, broker *stream.Broker, name string, filter stream.Filter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	buffer := 0
+	if value := queryParams(req).Get("buffer"); len(value) > 0 {
+		var err error
+		if buffer, err = strconv.Atoi(value); err != nil || buffer < 1 || buffer > maxStreamBuffer {
+			writeErrorDetails(w, http.StatusBadRequest, "buffer is not a valid number", map[string]interface{}{
+				"param": "buffer",
+				"max":   maxStreamBuffer,
+			})
+			return
+		}
+	}
+
+	sub := broker.Subscribe(buffer, filter)
+	defer broker.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", contentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		case event, ok := <-sub.Events():
+			if !ok {
+				if sub.Dropped() {
+					log.Printf("Ending stream of %s events to a slow subscriber", name)
+					fmt.Fprintf(w, "event: dropped\ndata: {\"message\": \"the subscriber fell behind\"}\n\n")
+					flusher.Flush()
+				}
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed marshalling %s event! err=%s", name, err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+		}
+		flusher.Flush()
+	}
+}
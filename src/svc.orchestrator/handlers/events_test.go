@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"clients"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"svc.orchestrator/stream"
+)
+
+var errStreamDone = errors.New("stream done")
+
+// waitSubscribers waits for the stream handlers to subscribe to broker
+func waitSubscribers(t *testing.T, broker *stream.Broker, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); broker.Subscribers() < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got subscribers=%d, want %d", broker.Subscribers(), n)
+		}
+	}
+}
+
+func liveDataPoint(metricID, serviceID, service string, value float64) clients.DataPoint {
+	return clients.DataPoint{MetricID: metricID, ServiceID: serviceID, TS: time.Unix(1704067200, 0).UTC(), Value: value,
+		Labels: map[string]string{clients.LabelService: service}}
+}
+
+// TestLiveStatsFilters checks that the live stats only stream the data points of the requested
+// metrics and service
+func TestLiveStatsFilters(t *testing.T) {
+	server, m := newTestServer(t)
+	client := clients.NewOrchestratorClient(server.URL)
+
+	received := []clients.DataPoint{}
+	errs := make(chan error, 1)
+	go func() {
+		req := &clients.LiveStatsRequest{MetricIDs: []string{"cpu", "disk"}, ServiceName: "echo"}
+		errs <- client.StreamDataPoints(context.Background(), req, func(dp clients.DataPoint) error {
+			received = append(received, dp)
+			if len(received) == 2 {
+				return errStreamDone
+			}
+			return nil
+		})
+	}()
+	waitSubscribers(t, m.dataPoints, 1)
+
+	for _, dp := range []clients.DataPoint{
+		liveDataPoint("cpu", "echo-1", "echo", 1),
+		liveDataPoint("mem", "echo-1", "echo", 2),
+		liveDataPoint("cpu", "db-1", "db", 3),
+		liveDataPoint("disk", "echo-2", "echo", 4),
+	} {
+		m.dataPoints.Publish(dp)
+	}
+
+	if err := <-errs; err != errStreamDone {
+		t.Fatalf("got err=%v, want the stream to end with the second data point", err)
+	}
+	want := []clients.DataPoint{liveDataPoint("cpu", "echo-1", "echo", 1), liveDataPoint("disk", "echo-2", "echo", 4)}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("got data points=%+v, want %+v", received, want)
+	}
+	waitSubscribers(t, m.dataPoints, 0)
+}
+
+// TestLiveStatsDropsSlowSubscribers checks that a client which does not keep up is sent the
+// dropped event, which the client returns as ErrStreamDropped, rather than holding back the
+// publisher
+func TestLiveStatsDropsSlowSubscribers(t *testing.T) {
+	server, m := newTestServer(t)
+	client := clients.NewOrchestratorClient(server.URL)
+
+	published := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.StreamDataPoints(context.Background(), &clients.LiveStatsRequest{Buffer: 1}, func(dp clients.DataPoint) error {
+			<-published
+			return nil
+		})
+	}()
+	waitSubscribers(t, m.dataPoints, 1)
+
+	// the client stops reading until every data point was published, filling the connection
+	for i := 0; i < 200000 && m.dataPoints.Subscribers() > 0; i++ {
+		m.dataPoints.Publish(liveDataPoint("cpu", "echo-1", "echo", float64(i)))
+	}
+	close(published)
+
+	if err := <-errs; errors.Cause(err) != clients.ErrStreamDropped {
+		t.Errorf("got err=%v, want ErrStreamDropped", err)
+	}
+}
@@ -1,165 +1,562 @@
 package handlers
 
 import (
+	"bufio"
 	"clients"
 	"context"
 	"encoding/json"
-	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"metrics"
 	"net/http"
 	"strconv"
+	"strings"
+	"svc.orchestrator/alerting"
+	"svc.orchestrator/anomaly"
+	"svc.orchestrator/dashboard"
+	"svc.orchestrator/query"
+	"svc.orchestrator/remotewrite"
+	"svc.orchestrator/series"
+	"svc.orchestrator/slo"
 	"svc.orchestrator/storage"
+	"svc.orchestrator/stream"
+	"svc.orchestrator/transfer"
 	"svc.orchestrator/types"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// defaultQueryPoints is the number of points per series of queries without a step
+const defaultQueryPoints = 250
+
 type APIManager struct {
-	registry  types.ServiceRegistry
-	dataStore *storage.DataStore
+	registry    types.ServiceRegistry
+	dataStore   storage.MetricsStore
+	aggregator  types.DataPointSink
+	queryEngine *query.Engine
+	alerts      *alerting.Manager
+	slos        *slo.Manager
+	anomalies   *anomaly.Detector
+	events      *stream.Broker
+	dataPoints  *stream.Broker
+	reloader    types.ConfigReloader
 }
 
-func NewAPIManager(registry types.ServiceRegistry, dataStore *storage.DataStore) *APIManager {
+// NewAPIManager creates the handlers of the orchestrator api, anomalies is nil when anomaly
+// detection is disabled. Events are the instance events of the registry, data points those
+// ingested by the aggregator. Reloader reloads the config on POST /config/reload.
+func NewAPIManager(registry types.ServiceRegistry, dataStore storage.MetricsStore, aggregator types.DataPointSink,
+	alerts *alerting.Manager, slos *slo.Manager, anomalies *anomaly.Detector, events, dataPoints *stream.Broker,
+	reloader types.ConfigReloader) *APIManager {
 	m := APIManager{
-		registry:  registry,
-		dataStore: dataStore,
+		registry:    registry,
+		dataStore:   dataStore,
+		aggregator:  aggregator,
+		queryEngine: query.NewEngine(dataStore),
+		alerts:      alerts,
+		slos:        slos,
+		anomalies:   anomalies,
+		events:      events,
+		dataPoints:  dataPoints,
+		reloader:    reloader,
 	}
 
 	return &m
 }
 
-func (m *APIManager) RegisterRoutes() {
-	http.HandleFunc(clients.RegisterURL, m.handleRegister)
-	http.HandleFunc(clients.ServicesURL, m.handleGetServices)
-	http.HandleFunc(clients.StatsURL, m.handleGetStats)
+// RegisterRoutes registers the routes under clients.APIPrefix, except for the metrics and the
+// remote-write endpoints whose paths are set by Prometheus, and the dashboard, on mux
+func (m *APIManager) RegisterRoutes(mux *http.ServeMux) {
+	for _, r := range m.routes() {
+		mux.HandleFunc(clients.APIPrefix+r.path, allowMethods(r))
+	}
+	mux.HandleFunc(clients.APIPrefix+"/", handleNotFound)
+
+	mux.Handle(clients.MetricsURL, metrics.DefaultRegistry)
+	mux.HandleFunc(clients.RemoteWriteURL, allowMethods(route{clients.RemoteWriteURL, m.handleRemoteWrite, []operation{
+		{method: http.MethodPost},
+	}}))
+
+	mux.Handle(dashboard.URL, dashboard.Handler())
+	mux.HandleFunc("/", dashboard.Redirect)
 }
 
+// handleRegister registers the sidecar on POST and unregisters it on DELETE
 func (m *APIManager) handleRegister(w http.ResponseWriter, req *http.Request) {
 	log.Printf("Handling register!")
 
-	if req.Method != http.MethodPost {
-		log.Printf("Got unsupported method=%s", req.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	registerReq := clients.RegisterRequest{}
 	decoder := json.NewDecoder(req.Body)
 	if err := decoder.Decode(&registerReq); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		if _, err := m.registry.Unregister(context.Background(), &registerReq); err != nil {
+			if errors.Cause(err) == types.ErrRegistrantNotFound {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
 	registerResp, err := m.registry.Register(context.Background(), &registerReq)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		switch errors.Cause(err) {
+		case types.ErrInvalidRegistrant:
+			writeError(w, http.StatusBadRequest, err.Error())
+		case types.ErrRegistrantExists:
+			writeError(w, http.StatusConflict, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
 	respBytes, err := json.Marshal(registerResp)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	_, err = w.Write(respBytes)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 	}
 }
 
-func (m *APIManager) handleGetServices(w http.ResponseWriter, req *http.Request) {
-	log.Printf("Handling get services!")
+// handleDrain marks the sidecar as draining on POST and as no longer draining on DELETE
+func (m *APIManager) handleDrain(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling drain!")
 
-	if req.Method != http.MethodGet {
-		log.Printf("Got unsupported method=%s", req.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	drainReq := clients.RegisterRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&drainReq); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := m.registry.Drain(context.Background(), &drainReq, req.Method == http.MethodPost); err != nil {
+		if errors.Cause(err) == types.ErrRegistrantNotFound {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *APIManager) handleGetServices(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling get services!")
+
 	services, err := m.registry.GetServices()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	servicesResp := types.ServiceInfos{}
+	servicesResp := clients.ServicesResponse{}
 
 	for serviceName, sidecars := range services {
-		si := types.ServiceInfo{
+		si := clients.ServiceInfo{
 			ServiceName: serviceName,
-			Registrants: sidecars,
+		}
+		for _, sidecar := range sidecars {
+			si.Registrants = append(si.Registrants, clients.Registrant(sidecar))
 		}
 		servicesResp.Services = append(servicesResp.Services, si)
 	}
 
 	respBytes, err := json.Marshal(servicesResp)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	_, err = w.Write(respBytes)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 	}
 }
 
 func (m *APIManager) handleGetStats(w http.ResponseWriter, req *http.Request) {
 	log.Printf("Handling get stats!")
 
-	if req.Method != http.MethodGet {
-		log.Printf("Got unsupported method=%s", req.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	params := queryParams(req)
+
+	metricID := params.Get("metricID")
+	if len(metricID) < 1 {
+		writeError(w, http.StatusBadRequest, "metricID is missing")
 		return
 	}
 
-	metricID, ok := req.URL.Query()["metricID"]
-	if !ok || len(metricID[0]) < 1 {
-		http.Error(w, "metricID is missing", http.StatusBadRequest)
+	startTS := params.Get("startTS")
+	if len(startTS) < 1 {
+		writeError(w, http.StatusBadRequest, "startTS is missing")
 		return
 	}
 
-	startTS, ok := req.URL.Query()["startTS"]
-	if !ok || len(startTS[0]) < 1 {
-		http.Error(w, "startTS is missing", http.StatusBadRequest)
+	sts, err := strconv.ParseInt(startTS, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "startTS is not a valid unix timestamp")
 		return
 	}
 
-	fmt.Println(startTS[0])
+	ets := time.Now().UTC()
+	if endTS := params.Get("endTS"); len(endTS) > 0 {
+		unixEndTS, err := strconv.ParseInt(endTS, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "endTS is not a valid unix timestamp")
+			return
+		}
+		ets = time.Unix(unixEndTS, 0).UTC()
+	}
 
-	sts, err := strconv.ParseInt(startTS[0], 10, 64)
+	downsample, err := parseDownsampleOptions(params, time.Unix(sts, 0).UTC(), ets)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "startTS is not a valid unix timestamp", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	ets := time.Now().UTC()
-
-	endTS, ok := req.URL.Query()["endTS"]
-	if ok && len(endTS[0]) > 0 {
-		unixEndTS, err := strconv.ParseInt(endTS[0], 64, 10)
+	var pipeline *series.Pipeline
+	if apply := params.Get("apply"); len(apply) > 0 {
+		pipeline, err = series.ParsePipeline(apply)
 		if err != nil {
-			http.Error(w, "endTS is not a valid unix timestamp", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if downsample.Step == 0 && pipeline == nil && (len(downsample.Function) > 0 || len(downsample.Fill) > 0) {
+		writeError(w, http.StatusBadRequest, "fn and fill need step, points or apply")
+		return
+	}
+
+	statsQuery := storage.StatsQuery{
+		MetricID:    metricID,
+		ServiceID:   params.Get("serviceID"),
+		ServiceName: params.Get("service"),
+		Resolution:  params.Get("resolution"),
+		Step:        downsample.Step,
+		StartTS:     time.Unix(sts, 0).UTC(),
+		EndTS:       ets,
+		PageToken:   params.Get("page_token"),
+	}
+
+	if pageSize := params.Get("page_size"); len(pageSize) > 0 {
+		if statsQuery.PageSize, err = strconv.Atoi(pageSize); err != nil || statsQuery.PageSize < 1 {
+			writeError(w, http.StatusBadRequest, "page_size is not a valid number")
 			return
 		}
-		ets = time.Unix(unixEndTS, 0)
+	} else if len(statsQuery.PageToken) > 0 {
+		writeError(w, http.StatusBadRequest, "page_size is missing")
+		return
+	}
+
+	paged := statsQuery.PageSize > 0
+	stream := params.Get("format") == transfer.FormatNDJSON || strings.Contains(req.Header.Get("Accept"), "application/x-ndjson")
+	if (paged || stream) && (downsample.Step > 0 || pipeline != nil) {
+		writeError(w, http.StatusBadRequest, "pages and streams hold the stored rows, they can not be combined with step, points or apply")
+		return
+	}
+	if paged && stream {
+		writeError(w, http.StatusBadRequest, "streams hold every row, they can not be combined with page_size")
+		return
+	}
+	if stream {
+		m.streamStats(w, &statsQuery)
+		return
 	}
 
-	stats, err := m.dataStore.GetStats(metricID[0], time.Unix(sts, 0), ets)
+	stats, err := m.dataStore.GetStats(&statsQuery)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if errors.Cause(err) == storage.ErrInvalidQuery {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	// functions need evenly spaced points, by default one per row of the tier
+	if downsample.Step == 0 && pipeline != nil {
+		downsample.Step = time.Duration(stats.Resolution) * time.Second
+		if err := downsample.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if downsample.Step > 0 {
+		stats.Series, err = series.Downsample(stats.Aggregations, *downsample)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		stats.Step = int64(downsample.Step / time.Second)
+		stats.Function = downsample.Function
+		stats.Aggregations = nil
+	}
+
+	if pipeline != nil {
+		stats.Series, err = pipeline.Apply(stats.Series, downsample.Step)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		stats.Pipeline = pipeline.String()
+	}
+
 	respBytes, err := json.Marshal(stats)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	_, err = w.Write(respBytes)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// streamStats writes the rows of a stats query as NDJSON as they are read from the store, the
+// tier and its resolution being sent as the X-Stats-Tier and X-Stats-Resolution headers. An
+// error after the first row was sent aborts the response, so that clients do not mistake a
+// truncated stream for a complete one.
+func (m *APIManager) streamStats(w http.ResponseWriter, statsQuery *storage.StatsQuery) {
+	tracker := &responseTracker{ResponseWriter: w}
+	buf := bufio.NewWriter(tracker)
+	writer, _ := transfer.NewWriter(transfer.FormatNDJSON, buf, statsQuery.MetricID)
+
+	rows := 0
+	err := m.dataStore.StreamStats(statsQuery, func(stats *clients.StatsResponse) error {
+		w.Header().Set("Content-Type", transfer.ContentType(transfer.FormatNDJSON))
+		w.Header().Set("X-Stats-Tier", stats.Tier)
+		w.Header().Set("X-Stats-Resolution", strconv.FormatInt(stats.Resolution, 10))
+		return nil
+	}, func(row clients.Aggregation) error {
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		return tracker.err
+	})
+	if err == nil {
+		err = buf.Flush()
+	}
+
+	if err != nil {
+		if !tracker.written {
+			w.Header().Del("X-Stats-Tier")
+			w.Header().Del("X-Stats-Resolution")
+			if errors.Cause(err) == storage.ErrInvalidQuery {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Aborting stats stream of metric=%s after %d rows! err=%s", statsQuery.MetricID, rows, err.Error())
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// parseDownsampleOptions reads the step, or points, fn and fill parameters of /stats. A zero
+// step means the stored rows are returned as they are.
+func parseDownsampleOptions(params queryValues, startTS, endTS time.Time) (*series.DownsampleOptions, error) {
+	opts := series.DownsampleOptions{
+		StartTS:  startTS,
+		EndTS:    endTS,
+		Function: params.Get("fn"),
+		Fill:     params.Get("fill"),
 	}
+
+	if step := params.Get("step"); len(step) > 0 {
+		if seconds, err := strconv.ParseInt(step, 10, 64); err == nil {
+			opts.Step = time.Duration(seconds) * time.Second
+		} else if opts.Step, err = time.ParseDuration(step); err != nil {
+			return nil, errors.New("step is not a valid duration")
+		}
+	} else if points := params.Get("points"); len(points) > 0 {
+		n, err := strconv.Atoi(points)
+		if err != nil {
+			return nil, errors.New("points is not a valid number")
+		}
+		if opts.Step, err = series.StepForPoints(startTS, endTS, n); err != nil {
+			return nil, err
+		}
+	} else {
+		return &opts, nil
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &opts, nil
+}
+
+// handleBackfill starts a backfill on POST, answering 202 with the job, and returns the status
+// of a job on GET
+func (m *APIManager) handleBackfill(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling backfill!")
+
+	if req.Method == http.MethodGet {
+		job, err := m.dataStore.BackfillJob(queryParams(req).Get("id"))
+		if err != nil {
+			if errors.Cause(err) == storage.ErrBackfillNotFound {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, job)
+		return
+	}
+
+	backfillReq := clients.BackfillRequest{}
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&backfillReq); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job, err := m.dataStore.StartBackfill(&backfillReq)
+	if err != nil {
+		switch errors.Cause(err) {
+		case storage.ErrInvalidBackfill:
+			writeError(w, http.StatusBadRequest, err.Error())
+		case storage.ErrBackfillRunning:
+			writeError(w, http.StatusConflict, err.Error())
+		case storage.ErrBackfillStopped:
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Location", clients.APIPrefix+clients.BackfillURL+"?id="+job.ID)
+	writeJSONStatus(w, http.StatusAccepted, job)
+}
+
+func (m *APIManager) handleQuery(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling query!")
+
+	params := queryParams(req)
+
+	q := params.Get("q")
+	if len(q) < 1 {
+		writeError(w, http.StatusBadRequest, "q is missing")
+		return
+	}
+
+	start := params.Get("start")
+	if len(start) < 1 {
+		writeError(w, http.StatusBadRequest, "start is missing")
+		return
+	}
+
+	sts, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "start is not a valid unix timestamp")
+		return
+	}
+
+	ets := time.Now().UTC()
+	if end := params.Get("end"); len(end) > 0 {
+		unixEnd, err := strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "end is not a valid unix timestamp")
+			return
+		}
+		ets = time.Unix(unixEnd, 0).UTC()
+	}
+
+	r := query.Range{StartTS: time.Unix(sts, 0).UTC(), EndTS: ets}
+	if step := params.Get("step"); len(step) > 0 {
+		if seconds, err := strconv.ParseInt(step, 10, 64); err == nil {
+			r.Step = time.Duration(seconds) * time.Second
+		} else if r.Step, err = time.ParseDuration(step); err != nil {
+			writeError(w, http.StatusBadRequest, "step is not a valid duration")
+			return
+		}
+	} else if r.Step, err = series.StepForPoints(r.StartTS, r.EndTS, defaultQueryPoints); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	queryResp, err := m.queryEngine.Query(q, r)
+	if err != nil {
+		if _, ok := err.(*query.Error); ok || errors.Cause(err) == query.ErrInvalidRange {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respBytes, err := json.Marshal(queryResp)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, err = w.Write(respBytes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// handleRemoteWrite receives Prometheus remote-write payloads, feeds their samples to the
+// aggregator and registers their metrics to be rolled up. Payloads which can not be decoded
+// get a 400 so that they are not retried.
+func (m *APIManager) handleRemoteWrite(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, remotewrite.MaxPayloadSize+1))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(body) > remotewrite.MaxPayloadSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "payload too large")
+		return
+	}
+
+	writeReq, err := remotewrite.Decode(body)
+	if err != nil {
+		log.Printf("Rejecting remote-write payload! err=%s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the metrics are rolled up once registered, which is a no-op for those already known
+	dataPoints, dropped := remotewrite.DataPoints(writeReq)
+	metricIDs := map[string]bool{}
+	for _, dp := range dataPoints {
+		if !metricIDs[dp.MetricID] {
+			metricIDs[dp.MetricID] = true
+			m.dataStore.AddRollupMetrics(dp.MetricID)
+		}
+		m.aggregator.AddDataPoint(dp)
+	}
+
+	log.Printf("Received remote-write series=%d samples=%d dropped=%d", len(writeReq.Timeseries), len(dataPoints), dropped)
+
+	w.WriteHeader(http.StatusNoContent)
 }
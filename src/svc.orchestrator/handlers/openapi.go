@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"clients"
+	"log"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const openAPIVersion = "3.0.3"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// handleOpenAPI returns the OpenAPI document of the route table
+func (m *APIManager) handleOpenAPI(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling openapi!")
+
+	writeJSON(w, m.openAPI())
+}
+
+// openAPI builds the OpenAPI document of the routes, the schemas of the bodies are reflected
+// from the types of their values
+func (m *APIManager) openAPI() map[string]interface{} {
+	schemas := newSchemaGenerator()
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(clients.ErrorResponse{}))},
+		},
+	}
+
+	paths := map[string]interface{}{}
+	for _, r := range m.routes() {
+		item := map[string]interface{}{}
+		for _, op := range r.operations {
+			item[strings.ToLower(op.method)] = openAPIOperation(r, op, schemas, errorResponse)
+		}
+		paths[r.path] = item
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "Orchestrator API",
+			"version": strings.TrimPrefix(clients.APIPrefix, "/"),
+		},
+		"servers":    []interface{}{map[string]interface{}{"url": clients.APIPrefix}},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas.components},
+	}
+}
+
+func openAPIOperation(r route, op operation, schemas *schemaGenerator, errorResponse map[string]interface{}) map[string]interface{} {
+	operation := map[string]interface{}{
+		"operationId": strings.ToLower(op.method) + operationName(r.path),
+		"summary":     op.summary,
+	}
+
+	if len(op.params) > 0 {
+		params := make([]interface{}, 0, len(op.params))
+		for _, p := range op.params {
+			params = append(params, map[string]interface{}{
+				"name":        p.name,
+				"in":          "query",
+				"required":    p.required,
+				"description": p.description,
+				"schema":      map[string]interface{}{"type": p.typ},
+			})
+		}
+		operation["parameters"] = params
+	}
+
+	if op.request != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  openAPIContent(op.request, op.requestTypes, schemas),
+		}
+	}
+
+	content := map[string]interface{}{}
+	if op.response != nil {
+		content = openAPIContent(op.response, nil, schemas)
+	}
+	if op.rows != nil {
+		for contentType, media := range openAPIContent(op.rows, op.responseTypes, schemas) {
+			content[contentType] = media
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := map[string]interface{}{"description": http.StatusText(status)}
+	if len(content) > 0 {
+		response["content"] = content
+	}
+	operation["responses"] = map[string]interface{}{
+		strconv.Itoa(status): response,
+		"default":            errorResponse,
+	}
+
+	return operation
+}
+
+// openAPIContent maps the content types, application/json by default, to the schema of the
+// body, which for streamed content types is the schema of a row
+func openAPIContent(body interface{}, contentTypes []string, schemas *schemaGenerator) map[string]interface{} {
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/json"}
+	}
+
+	schema := schemas.schema(reflect.TypeOf(body))
+	content := map[string]interface{}{}
+	for _, contentType := range contentTypes {
+		content[strings.Split(contentType, ";")[0]] = map[string]interface{}{"schema": schema}
+	}
+	return content
+}
+
+// operationName turns /alerts/rules into AlertsRules
+func operationName(p string) string {
+	name := ""
+	for _, part := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '.' || r == '_' }) {
+		name += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return name
+}
+
+// schemaGenerator reflects json schemas of go types, named structs are added to the
+// components and referenced
+type schemaGenerator struct {
+	components map[string]interface{}
+	names      map[reflect.Type]string
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{
+		components: map[string]interface{}{},
+		names:      map[reflect.Type]string{},
+	}
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := g.schema(t.Elem())
+		if _, ok := schema["$ref"]; ok {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + g.component(t)}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// component adds the schema of a named struct to the components once, the name is qualified
+// by the package when another package has a struct of the same name
+func (g *schemaGenerator) component(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+
+	name := t.Name()
+	if _, ok := g.components[name]; ok {
+		name = path.Base(t.PkgPath()) + "." + name
+	}
+	g.names[t] = name
+	// set before reflecting the fields so that recursive types refer to themselves
+	g.components[name] = map[string]interface{}{}
+	g.components[name] = g.object(t)
+
+	return name
+}
+
+// object reflects the json fields of a struct, the fields of embedded structs are inlined and
+// those without omitempty are required
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	g.fields(t, properties, &required)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || len(field.PkgPath) > 0 && !field.Anonymous {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		if field.Anonymous && len(name) == 0 && field.Type.Kind() == reflect.Struct {
+			g.fields(field.Type, properties, required)
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		properties[name] = g.schema(field.Type)
+		omitEmpty := false
+		for _, opt := range opts[1:] {
+			omitEmpty = omitEmpty || opt == "omitempty"
+		}
+		if !omitEmpty {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"clients"
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"svc.orchestrator/transfer"
+)
+
+// route is an endpoint of the api, relative to clients.APIPrefix, along with the operations it
+// serves. The route table registers the handlers, answers 405 to the methods of no operation
+// and is the source of the OpenAPI document, so that the document can not drift from the api.
+type route struct {
+	path       string
+	handler    http.HandlerFunc
+	operations []operation
+}
+
+// operation is a method of a route. Request and response are values of the json bodies, nil
+// when there is none. Streamed bodies have the types of rows, one per line or record, in the
+// requestTypes and responseTypes content types.
+type operation struct {
+	method        string
+	summary       string
+	params        []param
+	request       interface{}
+	requestTypes  []string
+	response      interface{}
+	rows          interface{}
+	responseTypes []string
+	status        int
+}
+
+// param is a query parameter, typ is its OpenAPI type
+type param struct {
+	name        string
+	typ         string
+	required    bool
+	description string
+}
+
+// queryValues are the query parameters of a request, which handlers read through the params of
+// the operation serving it so that every parameter they read is in the OpenAPI document
+type queryValues struct {
+	values url.Values
+	path   string
+	params []param
+}
+
+// servedOperationKey is the context key of the route path and the operation serving a request
+type servedOperationKey struct{}
+
+type servedOperation struct {
+	path string
+	op   operation
+}
+
+// queryParams returns the query parameters of req
+func queryParams(req *http.Request) queryValues {
+	served, _ := req.Context().Value(servedOperationKey{}).(servedOperation)
+	return queryValues{values: req.URL.Query(), path: served.path, params: served.op.params}
+}
+
+// Get returns the first value of the parameter name, empty when it is missing
+func (q queryValues) Get(name string) string {
+	if values := q.Values(name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns the values of the parameter name. A parameter the operation does not declare
+// has none, whatever the request holds.
+func (q queryValues) Values(name string) []string {
+	for _, p := range q.params {
+		if p.name == name {
+			return q.values[name]
+		}
+	}
+	log.Printf("Ignoring param=%s of path=%s, it is not declared by the route!", name, q.path)
+	return nil
+}
+
+var (
+	statsTypes  = []string{transfer.ContentType(transfer.FormatNDJSON)}
+	exportTypes = []string{
+		transfer.ContentType(transfer.FormatNDJSON),
+		transfer.ContentType(transfer.FormatCSV),
+		transfer.ContentType(transfer.FormatOpenMetrics),
+	}
+	importTypes = []string{transfer.ContentType(transfer.FormatNDJSON), transfer.ContentType(transfer.FormatCSV)}
+)
+
+func (m *APIManager) routes() []route {
+	return []route{
+		{clients.RegisterURL, m.handleRegister, []operation{
+			{method: http.MethodPost, summary: "Register a sidecar, 409 when it is already registered",
+				request: clients.RegisterRequest{}, response: clients.RegisterResponse{}},
+			{method: http.MethodDelete, summary: "Unregister a sidecar and stop its health checks",
+				request: clients.RegisterRequest{}, status: http.StatusNoContent},
+		}},
+		{clients.DrainURL, m.handleDrain, []operation{
+			{method: http.MethodPost, summary: "Mark a sidecar as draining, it is told on its next heartbeat",
+				request: clients.RegisterRequest{}, status: http.StatusNoContent},
+			{method: http.MethodDelete, summary: "Mark a sidecar as no longer draining",
+				request: clients.RegisterRequest{}, status: http.StatusNoContent},
+		}},
+		{clients.EventsURL, m.handleEvents, []operation{
+			{method: http.MethodGet, summary: "Stream the changes of the registered sidecars as server-sent events",
+				params: []param{
+					{"service", "string", false, "Only stream the changes of the sidecars of this service"},
+					{"buffer", "integer", false, "Events buffered for the subscriber, which is dropped once it is full"},
+				},
+				rows: clients.InstanceEvent{}, responseTypes: []string{contentTypeEventStream}},
+		}},
+		{clients.LiveStatsURL, m.handleLiveStats, []operation{
+			{method: http.MethodGet, summary: "Stream the data points as they are ingested, as server-sent events",
+				params: []param{
+					{"metricID", "string", false, "Only stream the data points of this metric, repeated for several"},
+					{"service", "string", false, "Only stream the data points of the instances of this service"},
+					{"serviceID", "string", false, "Only stream the data points of this service instance"},
+					{"buffer", "integer", false, "Data points buffered for the subscriber, which is dropped once it is full"},
+				},
+				rows: clients.DataPoint{}, responseTypes: []string{contentTypeEventStream}},
+		}},
+		{clients.ServicesURL, m.handleGetServices, []operation{
+			{method: http.MethodGet, summary: "List the services and their registered sidecars",
+				response: clients.ServicesResponse{}},
+		}},
+		{clients.StatsURL, m.handleGetStats, []operation{
+			{method: http.MethodGet, summary: "Read the rows of a metric, downsampled, paged or streamed as NDJSON",
+				params: []param{
+					{"metricID", "string", true, "Metric to read"},
+					{"startTS", "integer", true, "Start of the range, unix seconds"},
+					{"endTS", "integer", false, "End of the range, unix seconds, now by default"},
+					{"serviceID", "string", false, "Service instance to read"},
+					{"service", "string", false, "Service whose instances are read"},
+					{"resolution", "string", false, "Rollup tier to read, picked from the range by default"},
+					{"step", "string", false, "Step of the downsampled series, seconds or a duration"},
+					{"points", "integer", false, "Maximum number of points of the downsampled series, instead of step"},
+					{"fn", "string", false, "Downsampling function"},
+					{"fill", "string", false, "Fill policy of the empty steps"},
+					{"apply", "string", false, "Pipeline of functions applied to the series"},
+					{"page_size", "integer", false, "Rows per page"},
+					{"page_token", "string", false, "Token of the next page"},
+					{"format", "string", false, "ndjson to stream the rows"},
+				},
+				response: clients.StatsResponse{}, rows: clients.Aggregation{}, responseTypes: statsTypes},
+		}},
+		{clients.QueryURL, m.handleQuery, []operation{
+			{method: http.MethodGet, summary: "Evaluate a query over a range",
+				params: []param{
+					{"q", "string", true, "Query"},
+					{"start", "integer", true, "Start of the range, unix seconds"},
+					{"end", "integer", false, "End of the range, unix seconds, now by default"},
+					{"step", "string", false, "Step of the range, seconds or a duration"},
+				},
+				response: clients.QueryResponse{}},
+		}},
+		{clients.BackfillURL, m.handleBackfill, []operation{
+			{method: http.MethodPost, summary: "Start recomputing the rollups of a range in the background, 409 while another backfill runs",
+				request: clients.BackfillRequest{}, response: clients.BackfillJob{}, status: http.StatusAccepted},
+			{method: http.MethodGet, summary: "Get the status and progress of a backfill, one of the last ones started",
+				params:   []param{{"id", "string", true, "Id of the backfill"}},
+				response: clients.BackfillJob{}},
+		}},
+		{clients.ExportURL, m.handleExport, []operation{
+			{method: http.MethodGet, summary: "Stream the rows of a metric from a tier",
+				params: []param{
+					{"metricID", "string", true, "Metric to export"},
+					{"startTS", "integer", true, "Start of the range, unix seconds"},
+					{"endTS", "integer", false, "End of the range, unix seconds, now by default"},
+					{"tier", "string", false, "Tier to export, raw by default"},
+					{"serviceID", "string", false, "Service instance to export"},
+					{"service", "string", false, "Service whose instances are exported"},
+					{"format", "string", false, "ndjson, csv or openmetrics, ndjson by default"},
+				},
+				rows: clients.Aggregation{}, responseTypes: exportTypes},
+		}},
+		{clients.ImportURL, m.handleImport, []operation{
+			{method: http.MethodPost, summary: "Upsert CSV or NDJSON rows into a tier",
+				params: []param{
+					{"tier", "string", true, "Tier the rows are written to"},
+					{"format", "string", false, "ndjson or csv, from the Content-Type by default"},
+				},
+				request: clients.Aggregation{}, requestTypes: importTypes, response: clients.ImportResponse{}},
+		}},
+		{clients.AlertsURL, m.handleGetAlerts, []operation{
+			{method: http.MethodGet, summary: "List the pending, firing and recently resolved alerts",
+				response: clients.AlertsResponse{}},
+		}},
+		{clients.AlertRulesURL, m.handleAlertRules, []operation{
+			{method: http.MethodGet, summary: "List the alert rules and their health",
+				response: clients.AlertRulesResponse{}},
+			{method: http.MethodPost, summary: "Add or replace an alert rule",
+				request: clients.AlertRule{}, response: clients.AlertRule{}},
+			{method: http.MethodDelete, summary: "Delete an alert rule",
+				params: []param{{"name", "string", true, "Name of the rule"}}, status: http.StatusNoContent},
+		}},
+		{clients.AlertReceiversURL, m.handleAlertReceivers, []operation{
+			{method: http.MethodGet, summary: "List the alert receivers",
+				response: clients.AlertReceiversResponse{}},
+			{method: http.MethodPost, summary: "Add or replace an alert receiver",
+				request: clients.AlertReceiver{}, response: clients.AlertReceiver{}},
+			{method: http.MethodDelete, summary: "Delete an alert receiver",
+				params: []param{{"name", "string", true, "Name of the receiver"}}, status: http.StatusNoContent},
+		}},
+		{clients.AlertRouteURL, m.handleAlertRoute, []operation{
+			{method: http.MethodGet, summary: "Get the routing tree, 404 when none is set",
+				response: clients.AlertRoute{}},
+			{method: http.MethodPost, summary: "Replace the routing tree",
+				request: clients.AlertRoute{}, response: clients.AlertRoute{}},
+		}},
+		{clients.AlertSilencesURL, m.handleSilences, []operation{
+			{method: http.MethodGet, summary: "List the silences",
+				response: clients.SilencesResponse{}},
+			{method: http.MethodPost, summary: "Create a silence, or update the one with the id",
+				request: clients.Silence{}, response: clients.Silence{}},
+			{method: http.MethodDelete, summary: "Expire a silence",
+				params: []param{{"id", "string", true, "Id of the silence"}}, status: http.StatusNoContent},
+		}},
+		{clients.SLOURL, m.handleGetSLOs, []operation{
+			{method: http.MethodGet, summary: "Get the error budgets and burn rates of the SLOs",
+				params:   []param{{"name", "string", false, "Name of the SLO, every SLO by default"}},
+				response: clients.SLOResponse{}},
+		}},
+		{clients.AnomaliesURL, m.handleGetAnomalies, []operation{
+			{method: http.MethodGet, summary: "List the detected anomalies, 404 when anomaly detection is disabled",
+				params: []param{
+					{"metricID", "string", false, "Metric of the anomalies"},
+					{"serviceID", "string", false, "Service instance of the anomalies"},
+					{"service", "string", false, "Service of the anomalies"},
+					{"startTS", "integer", false, "Start of the range, unix seconds"},
+					{"endTS", "integer", false, "End of the range, unix seconds, now by default"},
+				},
+				response: clients.AnomaliesResponse{}},
+		}},
+		{clients.ConfigReloadURL, m.handleConfigReload, []operation{
+			{method: http.MethodPost, summary: "Reload the config and the files it names, the event telling whether it was applied or rejected",
+				response: clients.ConfigEvent{}},
+		}},
+		{clients.ConfigEventsURL, m.handleConfigEvents, []operation{
+			{method: http.MethodGet, summary: "List the last reloads of the config, oldest first",
+				response: clients.ConfigEventsResponse{}},
+		}},
+		{clients.OpenAPIURL, m.handleOpenAPI, []operation{
+			{method: http.MethodGet, summary: "Get this OpenAPI document",
+				response: map[string]interface{}{}},
+		}},
+	}
+}
+
+// allowMethods answers 405, with the Allow header and the allowed methods as details, to the
+// requests whose method is not one of the operations of the route
+func allowMethods(r route) http.HandlerFunc {
+	allowed := make([]string, 0, len(r.operations))
+	for _, op := range r.operations {
+		allowed = append(allowed, op.method)
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, op := range r.operations {
+			if req.Method == op.method {
+				ctx := context.WithValue(req.Context(), servedOperationKey{}, servedOperation{path: r.path, op: op})
+				r.handler(w, req.WithContext(ctx))
+				return
+			}
+		}
+
+		log.Printf("Got unsupported method=%s path=%s", req.Method, req.URL.Path)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeErrorDetails(w, http.StatusMethodNotAllowed, "Method not allowed", map[string]interface{}{
+			"allowed": allowed,
+		})
+	}
+}
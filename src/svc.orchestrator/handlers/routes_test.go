@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"clients"
+	"encoding/json"
+	"go/ast"
+	"go/constant"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPIDocumentsEveryRoute checks that the served OpenAPI document has every operation of
+// every route, along with its params
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	server, m := newTestServer(t)
+
+	resp := doRequest(t, http.MethodGet, server.URL+clients.APIPrefix+clients.OpenAPIURL, nil)
+	doc := struct {
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name     string `json:"name"`
+				Required bool   `json:"required"`
+			} `json:"parameters"`
+		} `json:"paths"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("Failed decoding the OpenAPI document: %v", err)
+	}
+
+	for _, r := range m.routes() {
+		item, ok := doc.Paths[r.path]
+		if !ok {
+			t.Errorf("path=%s is not in the OpenAPI document", r.path)
+			continue
+		}
+		if len(item) != len(r.operations) {
+			t.Errorf("path=%s: got %d operations in the OpenAPI document, want %d", r.path, len(item), len(r.operations))
+		}
+		for _, op := range r.operations {
+			documented, ok := item[strings.ToLower(op.method)]
+			if !ok {
+				t.Errorf("%s %s is not in the OpenAPI document", op.method, r.path)
+				continue
+			}
+			if len(documented.Parameters) != len(op.params) {
+				t.Errorf("%s %s: got %d params in the OpenAPI document, want %d", op.method, r.path,
+					len(documented.Parameters), len(op.params))
+				continue
+			}
+			for i, p := range op.params {
+				if documented.Parameters[i].Name != p.name || documented.Parameters[i].Required != p.required {
+					t.Errorf("%s %s: got param=%+v in the OpenAPI document, want %+v", op.method, r.path,
+						documented.Parameters[i], p)
+				}
+			}
+		}
+	}
+}
+
+// TestHandlersReadDeclaredParams checks that the handlers, and the functions they call, read
+// the query only through queryValues, with constant names their route declares. Handlers are
+// followed through their calls, not through the method values they reference.
+func TestHandlersReadDeclaredParams(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []*ast.File{}
+	for _, f := range pkgs["handlers"].Files {
+		files = append(files, f)
+	}
+
+	info := &types.Info{
+		Types: map[ast.Expr]types.TypeAndValue{},
+		Uses:  map[*ast.Ident]types.Object{},
+		Defs:  map[*ast.Ident]types.Object{},
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("svc.orchestrator/handlers", fset, files, info)
+	if err != nil {
+		t.Fatalf("Failed type checking the handlers: %v", err)
+	}
+
+	// the params read by each function, and the functions of the package it calls
+	reads := map[types.Object][]string{}
+	uses := map[types.Object][]types.Object{}
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil {
+				continue
+			}
+			obj := info.Defs[fn.Name]
+			if sig := obj.Type().(*types.Signature); sig.Recv() != nil && sig.Recv().Type().String() == "svc.orchestrator/handlers.queryValues" {
+				continue
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.SelectorExpr:
+					if n.Sel.Name == "Query" && fn.Name.Name != "queryParams" {
+						if ptr, ok := info.Types[n.X].Type.(*types.Pointer); ok && ptr.String() == "*net/url.URL" {
+							t.Errorf("%s: %s reads the query, it must use queryParams", fset.Position(n.Pos()), fn.Name.Name)
+						}
+					}
+				case *ast.CallExpr:
+					callee := (*ast.Ident)(nil)
+					switch fun := n.Fun.(type) {
+					case *ast.Ident:
+						callee = fun
+					case *ast.SelectorExpr:
+						callee = fun.Sel
+					}
+					if used, ok := info.Uses[callee].(*types.Func); ok && used.Pkg() == pkg {
+						uses[obj] = append(uses[obj], used)
+					}
+
+					sel, ok := n.Fun.(*ast.SelectorExpr)
+					if !ok || (sel.Sel.Name != "Get" && sel.Sel.Name != "Values") || len(n.Args) != 1 {
+						return true
+					}
+					if recv := info.Types[sel.X].Type; recv == nil || recv.String() != "svc.orchestrator/handlers.queryValues" {
+						return true
+					}
+					value := info.Types[n.Args[0]].Value
+					if value == nil || value.Kind() != constant.String {
+						t.Errorf("%s: %s reads a param whose name is not a constant", fset.Position(n.Pos()), fn.Name.Name)
+						return true
+					}
+					reads[obj] = append(reads[obj], constant.StringVal(value))
+				}
+				return true
+			})
+		}
+	}
+
+	server, m := newTestServer(t)
+	server.Close()
+	for _, r := range m.routes() {
+		declared := map[string]bool{}
+		for _, op := range r.operations {
+			for _, p := range op.params {
+				declared[p.name] = true
+			}
+		}
+
+		name := runtime.FuncForPC(reflect.ValueOf(r.handler).Pointer()).Name()
+		name = strings.TrimSuffix(name[strings.LastIndex(name, ".")+1:], "-fm")
+		handler := lookupMethod(pkg, name)
+		if handler == nil {
+			t.Errorf("path=%s: handler=%s not found", r.path, name)
+			continue
+		}
+
+		undeclared := map[string]bool{}
+		seen := map[types.Object]bool{}
+		pending := []types.Object{handler}
+		for len(pending) > 0 {
+			obj := pending[0]
+			pending = pending[1:]
+			if seen[obj] {
+				continue
+			}
+			seen[obj] = true
+			for _, p := range reads[obj] {
+				if !declared[p] {
+					undeclared[p] = true
+				}
+			}
+			pending = append(pending, uses[obj]...)
+		}
+
+		names := []string{}
+		for p := range undeclared {
+			names = append(names, p)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			t.Errorf("path=%s: %s reads params=%v which the route does not declare", r.path, name, names)
+		}
+	}
+}
+
+// lookupMethod returns the method name of APIManager, or the function name of the package
+func lookupMethod(pkg *types.Package, name string) types.Object {
+	manager := pkg.Scope().Lookup("APIManager").Type()
+	if obj, _, _ := types.LookupFieldOrMethod(types.NewPointer(manager), true, pkg, name); obj != nil {
+		return obj
+	}
+	return pkg.Scope().Lookup(name)
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"clients"
+	"log"
+	"net/http"
+	"svc.orchestrator/slo"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// handleGetSLOs returns the error budgets and burn rates of every SLO, or of the one named by
+// the name parameter
+func (m *APIManager) handleGetSLOs(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling get slos!")
+
+	slos, err := m.slos.Status(queryParams(req).Get("name"), time.Now().UTC())
+	if err != nil {
+		if errors.Cause(err) == slo.ErrNotFound {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("Failed computing slos! err=%s", err.Error())
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, clients.SLOResponse{SLOs: slos})
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bufio"
+	"clients"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"svc.orchestrator/storage"
+	"svc.orchestrator/transfer"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// exportFlushRows is the number of rows after which an export is flushed to the client
+const exportFlushRows = 1000
+
+// responseTracker remembers whether anything reached the client, after which errors can no
+// longer be reported with a status code, and the first write error
+type responseTracker struct {
+	http.ResponseWriter
+	written bool
+	err     error
+}
+
+func (t *responseTracker) Write(b []byte) (int, error) {
+	t.written = true
+	n, err := t.ResponseWriter.Write(b)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// handleExport streams the rows of a metric as they are read from the store. An error after
+// the first bytes were sent aborts the response, so that clients do not mistake a truncated
+// export for a complete one.
+func (m *APIManager) handleExport(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling export!")
+
+	params := queryParams(req)
+
+	query := storage.ExportQuery{
+		Tier:        params.Get("tier"),
+		MetricID:    params.Get("metricID"),
+		ServiceID:   params.Get("serviceID"),
+		ServiceName: params.Get("service"),
+		EndTS:       time.Now().UTC(),
+	}
+
+	startTS, err := strconv.ParseInt(params.Get("startTS"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "startTS is not a valid unix timestamp")
+		return
+	}
+	query.StartTS = time.Unix(startTS, 0).UTC()
+
+	if endTS := params.Get("endTS"); len(endTS) > 0 {
+		unixEndTS, err := strconv.ParseInt(endTS, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "endTS is not a valid unix timestamp")
+			return
+		}
+		query.EndTS = time.Unix(unixEndTS, 0).UTC()
+	}
+
+	format := params.Get("format")
+	if len(format) == 0 {
+		format = transfer.FormatNDJSON
+	}
+
+	tracker := &responseTracker{ResponseWriter: w}
+	buf := bufio.NewWriter(tracker)
+	writer, err := transfer.NewWriter(format, buf, query.MetricID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tier := query.Tier
+	if len(tier) == 0 {
+		tier = "raw"
+	}
+	w.Header().Set("Content-Type", transfer.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-%s.%s", query.MetricID, tier, format)))
+
+	rows := 0
+	err = m.dataStore.Export(&query, func(row clients.Aggregation) error {
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		return tracker.err
+	})
+	if err == nil {
+		if err = writer.Close(); err == nil {
+			err = buf.Flush()
+		}
+	}
+
+	if err != nil {
+		if !tracker.written {
+			w.Header().Del("Content-Disposition")
+			if errors.Cause(err) == storage.ErrInvalidTransfer {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Aborting export of metric=%s after %d rows! err=%s", query.MetricID, rows, err.Error())
+		panic(http.ErrAbortHandler)
+	}
+
+	log.Printf("Exported %d rows of metric=%s from tier=%s", rows, query.MetricID, tier)
+}
+
+// handleImport reads CSV or NDJSON rows and upserts them into a tier in batches. Each batch is
+// validated before it is written; on an invalid row the import stops, the previous batches
+// remain written, and since upserts are idempotent the corrected input can be imported again.
+func (m *APIManager) handleImport(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Handling import!")
+
+	params := queryParams(req)
+
+	tier := params.Get("tier")
+	if len(tier) < 1 {
+		writeError(w, http.StatusBadRequest, "tier is missing")
+		return
+	}
+
+	format := params.Get("format")
+	if len(format) == 0 {
+		format = transfer.FormatNDJSON
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "text/csv") {
+			format = transfer.FormatCSV
+		}
+	}
+
+	reader, err := transfer.NewReader(format, req.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := clients.ImportResponse{Tier: tier}
+
+	batch := make([]clients.Aggregation, 0, storage.ImportBatchRows)
+	lines := make([]int, 0, storage.ImportBatchRows)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		imported, err := m.dataStore.Import(tier, batch)
+		resp.Imported += imported
+		if err != nil {
+			if rowErr, ok := err.(*storage.ImportRowError); ok {
+				return errors.Wrapf(storage.ErrInvalidTransfer, "line %d: %s", lines[rowErr.Index], rowErr.Msg)
+			}
+			return err
+		}
+		resp.Expired += len(batch) - imported
+		resp.Batches++
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+
+	for err == nil {
+		var row clients.Aggregation
+		if row, err = reader.Read(); err != nil {
+			break
+		}
+		batch = append(batch, row)
+		lines = append(lines, reader.Line())
+		if len(batch) == storage.ImportBatchRows {
+			err = flush()
+		}
+	}
+	if err == io.EOF {
+		err = flush()
+	}
+
+	if err != nil {
+		log.Printf("Import into tier=%s stopped after %d rows! err=%s", tier, resp.Imported, err.Error())
+		msg := fmt.Sprintf("%s (%d rows were imported before, importing them again is safe)", err.Error(), resp.Imported)
+		switch errors.Cause(err) {
+		case storage.ErrInvalidTransfer, transfer.ErrInvalidFormat:
+			writeError(w, http.StatusBadRequest, msg)
+		default:
+			writeError(w, http.StatusInternalServerError, msg)
+		}
+		return
+	}
+
+	log.Printf("Imported %d rows into tier=%s, skipped %d expired rows", resp.Imported, tier, resp.Expired)
+
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, err = w.Write(respBytes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
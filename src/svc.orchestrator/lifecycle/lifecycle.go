@@ -0,0 +1,83 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// component is started and stopped by a Lifecycle, stop returning once the component released
+// what it holds, e.g. once its pending writes are flushed
+type component struct {
+	name  string
+	start func() error
+	stop  func(ctx context.Context) error
+}
+
+// Lifecycle starts components in the order they were added and stops them in the reverse
+// order, so that a component is only stopped once those depending on it are
+type Lifecycle struct {
+	components []component
+	started    []component
+}
+
+// NewLifecycle creates a lifecycle without components
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{}
+}
+
+// Add appends a component, start and stop being nil when there is nothing to do
+func (l *Lifecycle) Add(name string, start func() error, stop func(ctx context.Context) error) {
+	l.components = append(l.components, component{name: name, start: start, stop: stop})
+}
+
+// Start starts the components in order until one fails, Stop then stopping those which started
+func (l *Lifecycle) Start() error {
+	for _, c := range l.components {
+		if c.start != nil {
+			log.Printf("Starting component=%s", c.name)
+			if err := c.start(); err != nil {
+				return errors.Wrapf(err, "Failed starting component=%s", c.name)
+			}
+		}
+		l.started = append(l.started, c)
+	}
+	return nil
+}
+
+// Stop stops the started components in the reverse order. Once ctx is done the remaining
+// components are abandoned, an error naming them being returned.
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	for len(l.started) > 0 {
+		c := l.started[len(l.started)-1]
+		l.started = l.started[:len(l.started)-1]
+		if c.stop == nil {
+			continue
+		}
+
+		log.Printf("Stopping component=%s", c.name)
+		start := time.Now()
+		done := make(chan error, 1)
+		go func() { done <- c.stop(ctx) }()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("Failed stopping component=%s! err=%s", c.name, err.Error())
+			} else {
+				log.Printf("Stopped component=%s in %s", c.name, time.Since(start).Round(time.Millisecond))
+			}
+		case <-ctx.Done():
+			names := []string{c.name}
+			for i := len(l.started) - 1; i >= 0; i-- {
+				names = append(names, l.started[i].name)
+			}
+			l.started = nil
+			return fmt.Errorf("shutdown timed out stopping components=%v", names)
+		}
+	}
+	return nil
+}
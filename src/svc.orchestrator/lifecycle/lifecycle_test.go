@@ -0,0 +1,105 @@
+package lifecycle
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// recorder records the starts and stops of components
+type recorder struct {
+	calls []string
+}
+
+func (r *recorder) add(l *Lifecycle, name string, startErr error) {
+	l.Add(name, func() error {
+		r.calls = append(r.calls, "start "+name)
+		return startErr
+	}, func(ctx context.Context) error {
+		r.calls = append(r.calls, "stop "+name)
+		return nil
+	})
+}
+
+func TestStartAndStopInOrder(t *testing.T) {
+	r := &recorder{}
+	l := NewLifecycle()
+	r.add(l, "storage", nil)
+	l.Add("metrics", nil, nil)
+	r.add(l, "aggregator", nil)
+	r.add(l, "api", nil)
+
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// stopping again is a no-op
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"start storage", "start aggregator", "start api", "stop api", "stop aggregator", "stop storage"}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("got calls=%v, want %v", r.calls, want)
+	}
+}
+
+// TestStartFailure checks that only the components started before the failed one are stopped
+func TestStartFailure(t *testing.T) {
+	r := &recorder{}
+	l := NewLifecycle()
+	r.add(l, "storage", nil)
+	errListen := errors.New("address already in use")
+	r.add(l, "api", errListen)
+	r.add(l, "alerting", nil)
+
+	if err := l.Start(); errors.Cause(err) != errListen || !strings.Contains(err.Error(), "component=api") {
+		t.Fatalf("got err=%v, want the error of the api", err)
+	}
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"start storage", "start api", "stop storage"}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("got calls=%v, want %v", r.calls, want)
+	}
+}
+
+// TestStopTimeout checks that the components left once the shutdown timed out are abandoned
+// and named in the error, while a failed stop does not prevent the others from stopping
+func TestStopTimeout(t *testing.T) {
+	stopped := []string{}
+	l := NewLifecycle()
+	l.Add("storage", nil, func(ctx context.Context) error {
+		stopped = append(stopped, "storage")
+		return nil
+	})
+	l.Add("aggregator", nil, func(ctx context.Context) error {
+		select {}
+	})
+	l.Add("alerting", nil, func(ctx context.Context) error {
+		stopped = append(stopped, "alerting")
+		return errors.New("failed")
+	})
+
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := l.Stop(ctx)
+	if err == nil || !strings.Contains(err.Error(), "components=[aggregator storage]") {
+		t.Errorf("got err=%v, want the aggregator and storage abandoned", err)
+	}
+	if want := []string{"alerting"}; !reflect.DeepEqual(stopped, want) {
+		t.Errorf("got stopped=%v, want %v", stopped, want)
+	}
+}
@@ -1,33 +1,187 @@
 package main
 
 import (
+	"config"
+	"context"
+	"flag"
 	"log"
+	"metrics"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"svc.orchestrator/alerting"
+	"svc.orchestrator/anomaly"
 	"svc.orchestrator/handlers"
+	"svc.orchestrator/lifecycle"
 	"svc.orchestrator/registry"
+	"svc.orchestrator/slo"
 	"svc.orchestrator/storage"
+	"svc.orchestrator/stream"
 )
 
 func main() {
-	session := storage.NewSession([]string{"127.0.0.1"})
-	datastore := storage.NewDataStore(session)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "backfill":
+			runBackfill(os.Args[2:])
+			return
+		}
+	}
 
-	datastore.StartRollup()
-	defer datastore.StopRollup()
+	cfg, configPath, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	config.Print("orchestrator", cfg)
 
-	aggregator := registry.NewMetricsAggregator(datastore)
-	aggregator.Start()
-	defer aggregator.Stop()
+	tiers, err := loadRollupTiers(cfg.Storage.RollupConfig)
+	if err != nil {
+		log.Fatalf("Error loading rollup tiers: %+v", err)
+	}
 
-	svcRegistry := registry.NewServiceRegistry(aggregator)
-	apiManager := handlers.NewAPIManager(svcRegistry, datastore)
+	datastore, err := storage.NewMetricsStore(storage.StoreOptions{
+		Backend:        cfg.Storage.Backend,
+		Seeds:          cfg.Storage.Cassandra.Seeds,
+		Keyspace:       cfg.Storage.Cassandra.Keyspace,
+		NumConns:       cfg.Storage.Cassandra.NumConns,
+		ConnectTimeout: cfg.Storage.Cassandra.ConnectTimeout.Duration(),
+		DataDir:        cfg.Storage.DataDir,
+		Tiers:          tiers,
+	})
+	if err != nil {
+		log.Fatalf("Error creating storage: %+v", err)
+	}
 
-	apiManager.RegisterRoutes()
-	svcRegistry.Start()
+	dataPoints := stream.NewBroker("datapoints")
+	aggregator := registry.NewMetricsAggregator(datastore, dataPoints, cfg.Aggregator.FlushInterval.Duration())
 
-	err := http.ListenAndServe(":8500", nil)
+	sloManager, err := slo.NewManager(datastore, aggregator, tiers, cfg.SLO.Config)
 	if err != nil {
-		log.Fatalf("Error starting server: %+v", err)
+		log.Fatalf("Error loading slos: %+v", err)
+	}
+
+	var detector *anomaly.Detector
+	var anomalies alerting.AnomalySource
+	if cfg.Anomaly.Enabled {
+		tier, err := tiers.ForResolution(cfg.Anomaly.Tier)
+		if err != nil || tier.IsRaw() {
+			log.Fatalf("Error starting anomaly detection: anomaly.tier=%s is not a rollup tier", cfg.Anomaly.Tier)
+		}
+		detector = anomaly.NewDetector(datastore, tier, storage.ResourceMetrics(), cfg.Anomaly.StdDevs)
+		anomalies = detector
+	}
+
+	alertManager, err := alerting.NewManager(datastore, sloManager, anomalies, cfg.Alerting.Rules, cfg.Alerting.Interval.Duration())
+	if err != nil {
+		log.Fatalf("Error loading alert rules: %+v", err)
+	}
+
+	instanceEvents := stream.NewBroker("instances")
+	svcRegistry := registry.NewServiceRegistry(aggregator, sloManager, instanceEvents, cfg.healthCheckPolicy())
+	reloads := newConfigReloads(configPath, cfg, tiers, svcRegistry, datastore, alertManager)
+	reloader := config.NewReloader(reloads.reload, reloads.paths, reloadPollInterval)
+	apiManager := handlers.NewAPIManager(svcRegistry, datastore, aggregator, alertManager, sloManager, detector, instanceEvents,
+		dataPoints, reloader)
+
+	metrics.Register(metrics.NewRuntimeCollector(), aggregator, svcRegistry, alertManager)
+
+	mux := http.NewServeMux()
+	apiManager.RegisterRoutes(mux)
+
+	// the streams of server-sent events never go idle, they are ended on shutdown
+	streams, endStreams := context.WithCancel(context.Background())
+	server := &http.Server{Addr: cfg.ListenAddress, Handler: mux, BaseContext: func(net.Listener) context.Context { return streams }}
+	server.RegisterOnShutdown(endStreams)
+	serveErr := make(chan error, 1)
+
+	// stopped in the reverse order: the config stops being reloaded, the api stops taking data
+	// before the sidecars stop being health checked, and the aggregations are flushed before the
+	// storage is closed
+	components := lifecycle.NewLifecycle()
+	components.Add("storage", func() error {
+		datastore.StartRollup()
+		return nil
+	}, func(ctx context.Context) error {
+		datastore.StopRollup()
+		return datastore.Close()
+	})
+	components.Add("aggregator", func() error {
+		aggregator.Start()
+		return nil
+	}, func(ctx context.Context) error {
+		aggregator.Stop()
+		return nil
+	})
+	components.Add("alerting", func() error {
+		alertManager.Start()
+		return nil
+	}, func(ctx context.Context) error {
+		alertManager.Stop()
+		return nil
+	})
+	components.Add("registry", func() error {
+		svcRegistry.Start()
+		return nil
+	}, func(ctx context.Context) error {
+		svcRegistry.Stop()
+		return nil
+	})
+	components.Add("api", func() error {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Serving the api on address=%s", listener.Addr())
+		go func() { serveErr <- server.Serve(listener) }()
+		return nil
+	}, server.Shutdown)
+	components.Add("reloader", func() error {
+		reloader.Start()
+		return nil
+	}, func(ctx context.Context) error {
+		reloader.Stop()
+		return nil
+	})
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	exitCode := 0
+	if err := components.Start(); err != nil {
+		log.Printf("Error starting orchestrator: %+v", err)
+		exitCode = 1
+	} else {
+		select {
+		case <-signals.Done():
+			log.Printf("Received signal, shutting down")
+		case err := <-serveErr:
+			log.Printf("Failed serving the api, shutting down! err=%s", err.Error())
+			exitCode = 1
+		}
+	}
+	// a second signal kills the orchestrator right away
+	stopSignals()
+
+	ctx, cancel := context.WithTimeout(context.Background(), reloads.config().ShutdownTimeout.Duration())
+	defer cancel()
+	if err := components.Stop(ctx); err != nil {
+		log.Printf("Error stopping orchestrator: %s", err.Error())
+		exitCode = 1
+	}
+
+	log.Printf("Orchestrator stopped")
+	os.Exit(exitCode)
+}
+
+func loadRollupTiers(path string) (storage.RollupTiers, error) {
+	if len(path) == 0 {
+		return storage.DefaultRollupTiers(), nil
 	}
+	return storage.LoadRollupTiers(path)
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"svc.orchestrator/storage"
+)
+
+// runMigrate implements the "orchestrator migrate" subcommand, which migrates the Cassandra
+// keyspace of the orchestrator config
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Print the pending statements without applying them")
+	cfg, _, err := loadConfig(fs, args)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if cfg.Storage.Backend != storage.StorageCassandra {
+		log.Fatalf("Error migrating: storage.backend=%s has no schema to migrate", cfg.Storage.Backend)
+	}
+
+	tiers, err := loadRollupTiers(cfg.Storage.RollupConfig)
+	if err != nil {
+		log.Fatalf("Error loading rollup tiers: %+v", err)
+	}
+
+	keyspace := cfg.Storage.Cassandra.Keyspace
+	migrator, err := storage.NewMigrator(cfg.Storage.Cassandra.Seeds, keyspace)
+	if err != nil {
+		log.Fatalf("Error creating migrator: %+v", err)
+	}
+	defer migrator.Close()
+
+	if err := migrator.Migrate(tiers, *dryRun, os.Stdout); err != nil {
+		log.Fatalf("Error migrating keyspace=%s: %+v", keyspace, err)
+	}
+}
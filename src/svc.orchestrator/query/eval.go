@@ -0,0 +1,602 @@
+package query
+
+import (
+	"clients"
+	"math"
+	"sort"
+	"strings"
+	"svc.orchestrator/series"
+	"svc.orchestrator/storage"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ResultScalar = "scalar"
+	ResultVector = "vector"
+
+	// labelServiceID exposes the service instance of the rows as a label
+	labelServiceID = "service_id"
+)
+
+// ErrInvalidRange is returned for evaluation ranges which can not be served
+var ErrInvalidRange = errors.New("invalid query range")
+
+// Storage is the part of the metrics store queries are evaluated against
+type Storage interface {
+	GetStats(query *storage.StatsQuery) (*clients.StatsResponse, error)
+}
+
+// Range is the evaluation range of a query, every result has a point per step in [StartTS, EndTS)
+type Range struct {
+	StartTS time.Time
+	EndTS   time.Time
+	Step    time.Duration
+}
+
+// Engine evaluates queries against the metrics store
+type Engine struct {
+	store Storage
+}
+
+func NewEngine(store Storage) *Engine {
+	e := Engine{
+		store: store,
+	}
+
+	return &e
+}
+
+// timeSeries is a series being evaluated, its values are aligned with the evaluation steps
+type timeSeries struct {
+	labels map[string]string
+	values []*float64
+}
+
+type vector []timeSeries
+
+type scalar float64
+
+type evaluator struct {
+	store  Storage
+	r      Range
+	points int
+}
+
+// Query parses and evaluates a query over the range
+func (e *Engine) Query(q string, r Range) (*clients.QueryResponse, error) {
+	if r.Step < time.Second {
+		return nil, errors.Wrapf(ErrInvalidRange, "step must be at least 1s")
+	}
+	if !r.StartTS.Before(r.EndTS) {
+		return nil, errors.Wrapf(ErrInvalidRange, "start must be before end")
+	}
+	if r.EndTS.Sub(r.StartTS)/r.Step > series.MaxPoints {
+		return nil, errors.Wrapf(ErrInvalidRange, "step=%s yields more than %d points", r.Step, series.MaxPoints)
+	}
+
+	expr, err := Parse(q)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := evaluator{
+		store:  e.store,
+		r:      r,
+		points: int((r.EndTS.Sub(r.StartTS) + r.Step - 1) / r.Step),
+	}
+	value, err := ev.eval(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := clients.QueryResponse{
+		Query:   q,
+		StartTS: r.StartTS,
+		EndTS:   r.EndTS,
+		Step:    int64(r.Step / time.Second),
+	}
+
+	switch v := value.(type) {
+	case scalar:
+		resp.ResultType = ResultScalar
+		resp.Series = []clients.Series{ev.toSeries(ev.constant(float64(v)))}
+	case vector:
+		resp.ResultType = ResultVector
+		sort.Slice(v, func(i, j int) bool { return labelsKey(v[i].labels) < labelsKey(v[j].labels) })
+		resp.Series = make([]clients.Series, 0, len(v))
+		for _, s := range v {
+			resp.Series = append(resp.Series, ev.toSeries(s))
+		}
+	}
+
+	return &resp, nil
+}
+
+func (ev *evaluator) eval(expr Expr) (interface{}, error) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return scalar(e.Value), nil
+	case *Selector:
+		if e.Range > 0 {
+			return nil, errorf(e.pos, "range selectors can only be passed to functions such as rate(%s[%s])", e.MetricID, e.rangeText)
+		}
+		return ev.selectSeries(e, 0)
+	case *Unary:
+		return ev.evalUnary(e)
+	case *Call:
+		return ev.evalCall(e)
+	case *Aggregate:
+		return ev.evalAggregate(e)
+	case *Binary:
+		return ev.evalBinary(e)
+	default:
+		return nil, errorf(expr.Pos(), "unsupported expression")
+	}
+}
+
+func (ev *evaluator) evalVector(expr Expr, context string) (vector, error) {
+	value, err := ev.eval(expr)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := value.(vector)
+	if !ok {
+		return nil, errorf(expr.Pos(), "%s expects series, got a scalar", context)
+	}
+	return v, nil
+}
+
+// selectSeries fetches the series of a selector with extra points before the evaluation range.
+// Equality matchers on the service and service_id labels are pushed down to the store.
+func (ev *evaluator) selectSeries(s *Selector, extra int) (vector, error) {
+	startTS := ev.r.StartTS.Add(-time.Duration(extra) * ev.r.Step)
+	statsQuery := storage.StatsQuery{
+		MetricID: s.MetricID,
+		Step:     ev.r.Step,
+		StartTS:  startTS,
+		EndTS:    ev.r.EndTS,
+	}
+	for _, m := range s.Matchers {
+		if m.Op != MatchEqual {
+			continue
+		}
+		switch m.Label {
+		case clients.LabelService:
+			statsQuery.ServiceName = m.Value
+		case labelServiceID:
+			statsQuery.ServiceID = m.Value
+		}
+	}
+
+	stats, err := ev.store.GetStats(&statsQuery)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrInvalidQuery {
+			return nil, errorf(s.pos, "%s", err)
+		}
+		return nil, err
+	}
+
+	rows, err := series.Downsample(stats.Aggregations, series.DownsampleOptions{
+		StartTS:  startTS,
+		EndTS:    ev.r.EndTS,
+		Step:     ev.r.Step,
+		Function: series.FuncAvg,
+		Fill:     series.FillNull,
+	})
+	if err != nil {
+		return nil, errorf(s.pos, "%s", err)
+	}
+
+	result := vector{}
+	for _, row := range rows {
+		labels := map[string]string{labelServiceID: row.ServiceID}
+		for k, v := range row.Labels {
+			labels[k] = v
+		}
+
+		matches := true
+		for _, m := range s.Matchers {
+			matches = matches && m.Matches(labels[m.Label])
+		}
+		if !matches {
+			continue
+		}
+
+		values := make([]*float64, extra+ev.points)
+		for i := range values {
+			if i < len(row.Points) {
+				values[i] = row.Points[i].Value
+			}
+		}
+		result = append(result, timeSeries{labels: labels, values: values})
+	}
+
+	return result, nil
+}
+
+func (ev *evaluator) evalUnary(e *Unary) (interface{}, error) {
+	value, err := ev.eval(e.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return mapValue(value, func(v float64) float64 { return -v }), nil
+}
+
+func (ev *evaluator) evalCall(e *Call) (interface{}, error) {
+	if e.Func == "abs" {
+		value, err := ev.eval(e.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return mapValue(value, math.Abs), nil
+	}
+
+	// the parser only accepts range selectors as argument of the other functions
+	selector := e.Args[0].(*Selector)
+	extra := int((selector.Range + ev.r.Step - 1) / ev.r.Step)
+	if selector.Range < ev.r.Step {
+		return nil, errorf(selector.pos, "range %s is shorter than the step %s", selector.rangeText, ev.r.Step)
+	}
+
+	matrix, err := ev.selectSeries(selector, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(vector, 0, len(matrix))
+	for _, s := range matrix {
+		values := make([]*float64, ev.points)
+		for i := range values {
+			// the window of the point i ends at its index in the matrix, i+extra
+			values[i] = overWindow(e.Func, s.values[i:i+extra+1], selector.Range)
+		}
+		result = append(result, timeSeries{labels: s.labels, values: values})
+	}
+
+	return result, nil
+}
+
+// overWindow applies a range function to the points of a window. Rate and delta compare the
+// window with the point preceding it, the _over_time functions only use the window itself.
+func overWindow(function string, points []*float64, window time.Duration) *float64 {
+	values := []float64{}
+	for i, p := range points {
+		if p == nil || (i == 0 && strings.HasSuffix(function, "_over_time")) {
+			continue
+		}
+		values = append(values, *p)
+	}
+
+	var v float64
+	switch function {
+	case "rate", "delta":
+		if len(values) < 2 {
+			return nil
+		}
+		if function == "delta" {
+			v = values[len(values)-1] - values[0]
+			break
+		}
+		// a decrease is a counter reset
+		for i := 1; i < len(values); i++ {
+			if values[i] < values[i-1] {
+				v += values[i]
+			} else {
+				v += values[i] - values[i-1]
+			}
+		}
+		v /= window.Seconds()
+	default:
+		if len(values) == 0 {
+			return nil
+		}
+		v = reduce(strings.TrimSuffix(function, "_over_time"), values)
+	}
+
+	return &v
+}
+
+func (ev *evaluator) evalAggregate(e *Aggregate) (interface{}, error) {
+	v, err := ev.evalVector(e.Expr, e.Op)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]timeSeries{}
+	groupLabels := map[string]map[string]string{}
+	for _, s := range v {
+		labels := groupingLabels(s.labels, e.Labels, e.Without)
+		key := labelsKey(labels)
+		groups[key] = append(groups[key], s)
+		groupLabels[key] = labels
+	}
+
+	result := vector{}
+	for key, group := range groups {
+		if e.Op == "topk" || e.Op == "bottomk" {
+			k := int(e.Param.(*NumberLiteral).Value)
+			if k < 1 {
+				return nil, errorf(e.Param.Pos(), "%s expects a positive number of series", e.Op)
+			}
+			result = append(result, selectK(group, k, e.Op == "topk")...)
+			continue
+		}
+
+		values := make([]*float64, ev.points)
+		for i := range values {
+			points := []float64{}
+			for _, s := range group {
+				if s.values[i] != nil {
+					points = append(points, *s.values[i])
+				}
+			}
+			if len(points) > 0 {
+				v := reduce(e.Op, points)
+				values[i] = &v
+			}
+		}
+		result = append(result, timeSeries{labels: groupLabels[key], values: values})
+	}
+
+	return result, nil
+}
+
+// selectK returns the k series with the highest, or lowest, mean over the evaluation range
+func selectK(group []timeSeries, k int, highest bool) []timeSeries {
+	means := make(map[int]float64, len(group))
+	indexes := make([]int, len(group))
+	for i, s := range group {
+		indexes[i] = i
+		means[i] = math.NaN()
+
+		values := []float64{}
+		for _, v := range s.values {
+			if v != nil {
+				values = append(values, *v)
+			}
+		}
+		if len(values) > 0 {
+			means[i] = reduce("avg", values)
+		}
+	}
+
+	sort.SliceStable(indexes, func(i, j int) bool {
+		a, b := means[indexes[i]], means[indexes[j]]
+		if math.IsNaN(a) || math.IsNaN(b) {
+			return !math.IsNaN(a)
+		}
+		if highest {
+			return a > b
+		}
+		return a < b
+	})
+
+	if k > len(indexes) {
+		k = len(indexes)
+	}
+	result := make([]timeSeries, 0, k)
+	for _, i := range indexes[:k] {
+		result = append(result, group[i])
+	}
+	return result
+}
+
+func (ev *evaluator) evalBinary(e *Binary) (interface{}, error) {
+	lhs, err := ev.eval(e.LHS)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(e.RHS)
+	if err != nil {
+		return nil, err
+	}
+
+	op := arithmetic(e.Op)
+
+	l, lok := lhs.(scalar)
+	r, rok := rhs.(scalar)
+	switch {
+	case lok && rok:
+		return scalar(op(float64(l), float64(r))), nil
+	case lok:
+		return mapValue(rhs, func(v float64) float64 { return op(float64(l), v) }), nil
+	case rok:
+		return mapValue(lhs, func(v float64) float64 { return op(v, float64(r)) }), nil
+	}
+
+	// both sides are series, matched on their labels or the subset given by on / ignoring, one to
+	// one or, with group_left / group_right, many to one
+	signature := func(labels map[string]string) map[string]string {
+		if !e.On && !e.Ignoring {
+			return labels
+		}
+		return groupingLabels(labels, e.Labels, e.Ignoring)
+	}
+
+	many, one := lhs.(vector), rhs.(vector)
+	manySide, oneSide := "left", "right"
+	if e.Group == "right" {
+		many, one = one, many
+		manySide, oneSide = oneSide, manySide
+	}
+
+	ones := map[string]timeSeries{}
+	for _, s := range one {
+		key := labelsKey(signature(s.labels))
+		if _, ok := ones[key]; ok {
+			if len(e.Group) > 0 {
+				return nil, errorf(e.pos, "several series on the %s side of %q share the labels %s, group_%s needs one", oneSide, e.Op, key, e.Group)
+			}
+			return nil, errorf(e.pos, "several series on the %s side of %q share the labels %s, use on() or ignoring() to match one to one, or group_left / group_right to match many to one", oneSide, e.Op, key)
+		}
+		ones[key] = s
+	}
+
+	result := vector{}
+	seen := map[string]bool{}
+	for _, s := range many {
+		labels := signature(s.labels)
+		other, ok := ones[labelsKey(labels)]
+		if len(e.Group) > 0 {
+			// the series of the many side keep their labels, along with those included from the one side
+			labels = groupingLabels(s.labels, nil, true)
+			for _, name := range e.Include {
+				if v, ok := other.labels[name]; ok {
+					labels[name] = v
+				}
+			}
+		}
+
+		// the series without a match are dropped, only those with one must have distinct labels
+		if !ok {
+			continue
+		}
+		key := labelsKey(labels)
+		if seen[key] {
+			return nil, errorf(e.pos, "several series on the %s side of %q share the labels %s, use on() or ignoring() to match one to one, or group_left / group_right to match many to one", manySide, e.Op, key)
+		}
+		seen[key] = true
+
+		left, right := s, other
+		if e.Group == "right" {
+			left, right = other, s
+		}
+		values := make([]*float64, ev.points)
+		for i := range values {
+			if left.values[i] != nil && right.values[i] != nil {
+				v := op(*left.values[i], *right.values[i])
+				values[i] = &v
+			}
+		}
+		result = append(result, timeSeries{labels: labels, values: values})
+	}
+
+	return result, nil
+}
+
+func arithmetic(op string) func(a, b float64) float64 {
+	switch op {
+	case "+":
+		return func(a, b float64) float64 { return a + b }
+	case "-":
+		return func(a, b float64) float64 { return a - b }
+	case "*":
+		return func(a, b float64) float64 { return a * b }
+	default:
+		return func(a, b float64) float64 { return a / b }
+	}
+}
+
+// mapValue applies f to a scalar or to every point of a vector
+func mapValue(value interface{}, f func(float64) float64) interface{} {
+	if s, ok := value.(scalar); ok {
+		return scalar(f(float64(s)))
+	}
+
+	result := vector{}
+	for _, s := range value.(vector) {
+		values := make([]*float64, len(s.values))
+		for i, v := range s.values {
+			if v != nil {
+				mapped := f(*v)
+				values[i] = &mapped
+			}
+		}
+		result = append(result, timeSeries{labels: s.labels, values: values})
+	}
+	return result
+}
+
+func reduce(op string, values []float64) float64 {
+	v := values[0]
+	switch op {
+	case "min":
+		for _, value := range values[1:] {
+			v = math.Min(v, value)
+		}
+	case "max":
+		for _, value := range values[1:] {
+			v = math.Max(v, value)
+		}
+	case "count":
+		v = float64(len(values))
+	default:
+		for _, value := range values[1:] {
+			v += value
+		}
+		if op == "avg" {
+			v /= float64(len(values))
+		}
+	}
+	return v
+}
+
+// groupingLabels returns the given labels of a series, or all but the given ones
+func groupingLabels(labels map[string]string, names []string, without bool) map[string]string {
+	result := map[string]string{}
+	if without {
+		for k, v := range labels {
+			result[k] = v
+		}
+		for _, name := range names {
+			delete(result, name)
+		}
+		return result
+	}
+
+	for _, name := range names {
+		if v, ok := labels[name]; ok {
+			result[name] = v
+		}
+	}
+	return result
+}
+
+// labelsKey formats labels as {a="1", b="2"}, sorted by name
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"=\""+labels[name]+"\"")
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func (ev *evaluator) constant(v float64) timeSeries {
+	values := make([]*float64, ev.points)
+	for i := range values {
+		values[i] = &v
+	}
+	return timeSeries{values: values}
+}
+
+// toSeries converts an evaluated series, values which can not be represented in JSON such as
+// the result of a division by zero are returned as null
+func (ev *evaluator) toSeries(s timeSeries) clients.Series {
+	result := clients.Series{ServiceID: s.labels[labelServiceID]}
+	for k, v := range s.labels {
+		if k == labelServiceID {
+			continue
+		}
+		if result.Labels == nil {
+			result.Labels = map[string]string{}
+		}
+		result.Labels[k] = v
+	}
+
+	result.Points = make([]clients.Point, len(s.values))
+	for i, v := range s.values {
+		result.Points[i].TS = ev.r.StartTS.Add(time.Duration(i) * ev.r.Step)
+		if v != nil && !math.IsNaN(*v) && !math.IsInf(*v, 0) {
+			result.Points[i].Value = v
+		}
+	}
+	return result
+}
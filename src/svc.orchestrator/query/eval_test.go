@@ -0,0 +1,115 @@
+package query
+
+import (
+	"clients"
+	"strings"
+	"testing"
+	"time"
+
+	"svc.orchestrator/storage"
+)
+
+func TestVectorMatching(t *testing.T) {
+	store := storage.NewMemoryStore(storage.DefaultRollupTiers())
+	r := Range{StartTS: time.Now().Add(-10 * time.Minute).Truncate(time.Minute), Step: time.Minute}
+	r.EndTS = r.StartTS.Add(2 * time.Minute)
+
+	aggs := map[string]*clients.Aggregation{}
+	for _, row := range []clients.Aggregation{
+		{MetricID: "mem", ServiceID: "echo-1", Average: 10, Labels: map[string]string{"service": "echo"}},
+		{MetricID: "mem", ServiceID: "echo-2", Average: 20, Labels: map[string]string{"service": "echo"}},
+		{MetricID: "requests", ServiceID: "echo-lb", Average: 5, Labels: map[string]string{"service": "echo", "region": "eu"}},
+		{MetricID: "cpu", ServiceID: "echo-1", Average: 15, Labels: map[string]string{"service": "echo"}},
+		{MetricID: "cpu", ServiceID: "db-1", Average: 1, Labels: map[string]string{"service": "db"}},
+		{MetricID: "cpu", ServiceID: "db-2", Average: 2, Labels: map[string]string{"service": "db"}},
+	} {
+		for i := 0; i < 2; i++ {
+			row.TS = r.StartTS.Add(time.Duration(i) * time.Minute)
+			row.Min, row.Max, row.NumValues = row.Average, row.Average, 1
+			agg := row
+			aggs[row.MetricID+row.ServiceID+row.TS.String()] = &agg
+		}
+	}
+	if err := store.InsertAggregations(aggs); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		q    string
+		want map[string]float64
+		err  string
+	}{
+		{
+			q:    "mem / on(service) group_left requests",
+			want: map[string]float64{`{service="echo"}echo-1`: 2, `{service="echo"}echo-2`: 4},
+		},
+		{
+			q:    "requests / on(service) group_right mem",
+			want: map[string]float64{`{service="echo"}echo-1`: 0.5, `{service="echo"}echo-2`: 0.25},
+		},
+		{
+			q:    "mem - ignoring(service_id, region) group_left(region) requests",
+			want: map[string]float64{`{region="eu", service="echo"}echo-1`: 5, `{region="eu", service="echo"}echo-2`: 15},
+		},
+		{
+			q:    "sum by (service) (mem) / on(service) sum by (service) (requests)",
+			want: map[string]float64{`{service="echo"}`: 6},
+		},
+		{
+			// the db series share their labels but match nothing, so they are dropped
+			q:    "cpu / on(service) requests",
+			want: map[string]float64{`{service="echo"}`: 3},
+		},
+		{
+			q:    "cpu / on(service) group_left requests",
+			want: map[string]float64{`{service="echo"}echo-1`: 3},
+		},
+		{
+			q:   "mem / on(service) requests",
+			err: `several series on the left side of "/" share the labels {service="echo"}`,
+		},
+		{
+			q:   "requests / on(service) group_left mem",
+			err: `several series on the right side of "/" share the labels {service="echo"}, group_left needs one`,
+		},
+		{
+			q:   "mem / on(service) group_left(region requests",
+			err: `expected ")"`,
+		},
+	}
+
+	for _, test := range tests {
+		resp, err := NewEngine(store).Query(test.q, r)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got err=%v, want %q", test.q, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.q, err)
+			continue
+		}
+
+		got := map[string]float64{}
+		for _, s := range resp.Series {
+			for _, p := range s.Points {
+				if p.Value == nil {
+					t.Errorf("%s: series=%s has a null point at %s", test.q, s.ServiceID, p.TS)
+					continue
+				}
+				got[labelsKey(s.Labels)+s.ServiceID] = *p.Value
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got series=%v, want %v", test.q, got, test.want)
+			continue
+		}
+		for key, value := range test.want {
+			if got[key] != value {
+				t.Errorf("%s: got series=%v, want %v", test.q, got, test.want)
+				break
+			}
+		}
+	}
+}
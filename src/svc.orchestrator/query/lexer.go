@@ -0,0 +1,227 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenNumber
+	tokenDuration
+	tokenString
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBrace
+	tokenRightBrace
+	tokenLeftBracket
+	tokenRightBracket
+	tokenComma
+	tokenAdd
+	tokenSub
+	tokenMul
+	tokenDiv
+	tokenEq
+	tokenNotEq
+	tokenRegexMatch
+	tokenRegexNoMatch
+)
+
+var tokenNames = map[tokenType]string{
+	tokenEOF:          "end of query",
+	tokenIdent:        "identifier",
+	tokenNumber:       "number",
+	tokenDuration:     "duration",
+	tokenString:       "string",
+	tokenLeftParen:    "\"(\"",
+	tokenRightParen:   "\")\"",
+	tokenLeftBrace:    "\"{\"",
+	tokenRightBrace:   "\"}\"",
+	tokenLeftBracket:  "\"[\"",
+	tokenRightBracket: "\"]\"",
+	tokenComma:        "\",\"",
+	tokenAdd:          "\"+\"",
+	tokenSub:          "\"-\"",
+	tokenMul:          "\"*\"",
+	tokenDiv:          "\"/\"",
+	tokenEq:           "\"=\"",
+	tokenNotEq:        "\"!=\"",
+	tokenRegexMatch:   "\"=~\"",
+	tokenRegexNoMatch: "\"!~\"",
+}
+
+func (t tokenType) String() string {
+	return tokenNames[t]
+}
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokenEOF:
+		return t.typ.String()
+	case tokenIdent, tokenNumber, tokenDuration:
+		return fmt.Sprintf("%s %q", t.typ, t.val)
+	default:
+		return t.typ.String()
+	}
+}
+
+// Error is a query error along with the position, counted in characters from 1, where it was found
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("error at char %d: %s", e.Pos+1, e.Msg)
+}
+
+func errorf(pos int, format string, args ...interface{}) *Error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// lex splits the query into tokens, always ending with a tokenEOF
+func lex(input string) ([]token, error) {
+	runes := []rune(input)
+	tokens := []token{}
+
+	for pos := 0; pos < len(runes); {
+		r := runes[pos]
+		start := pos
+
+		switch {
+		case unicode.IsSpace(r):
+			pos++
+			continue
+		case isIdentStart(r):
+			for pos < len(runes) && isIdentChar(runes[pos]) {
+				pos++
+			}
+			tokens = append(tokens, token{typ: tokenIdent, val: string(runes[start:pos]), pos: start})
+			continue
+		case unicode.IsDigit(r) || (r == '.' && pos+1 < len(runes) && unicode.IsDigit(runes[pos+1])):
+			for pos < len(runes) && (unicode.IsDigit(runes[pos]) || runes[pos] == '.') {
+				pos++
+			}
+			if pos < len(runes) && (runes[pos] == 'e' || runes[pos] == 'E') && pos+1 < len(runes) &&
+				(unicode.IsDigit(runes[pos+1]) || runes[pos+1] == '-' || runes[pos+1] == '+') {
+				pos += 2
+				for pos < len(runes) && unicode.IsDigit(runes[pos]) {
+					pos++
+				}
+			}
+			typ := tokenNumber
+			if pos < len(runes) && unicode.IsLetter(runes[pos]) {
+				// durations are numbers immediately followed by their units, e.g. 1h30m
+				typ = tokenDuration
+				for pos < len(runes) && (unicode.IsLetter(runes[pos]) || unicode.IsDigit(runes[pos])) {
+					pos++
+				}
+			}
+			tokens = append(tokens, token{typ: typ, val: string(runes[start:pos]), pos: start})
+			continue
+		case r == '"' || r == '\'':
+			val, end, err := lexString(runes, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{typ: tokenString, val: val, pos: start})
+			pos = end
+			continue
+		}
+
+		typ := tokenEOF
+		next := func(r rune) bool { return pos+1 < len(runes) && runes[pos+1] == r }
+		switch r {
+		case '(':
+			typ = tokenLeftParen
+		case ')':
+			typ = tokenRightParen
+		case '{':
+			typ = tokenLeftBrace
+		case '}':
+			typ = tokenRightBrace
+		case '[':
+			typ = tokenLeftBracket
+		case ']':
+			typ = tokenRightBracket
+		case ',':
+			typ = tokenComma
+		case '+':
+			typ = tokenAdd
+		case '-':
+			typ = tokenSub
+		case '*':
+			typ = tokenMul
+		case '/':
+			typ = tokenDiv
+		case '=':
+			typ = tokenEq
+			if next('~') {
+				typ = tokenRegexMatch
+				pos++
+			}
+		case '!':
+			if next('=') {
+				typ = tokenNotEq
+			} else if next('~') {
+				typ = tokenRegexNoMatch
+			} else {
+				return nil, errorf(start, "unexpected character %q", r)
+			}
+			pos++
+		default:
+			return nil, errorf(start, "unexpected character %q", r)
+		}
+		pos++
+		tokens = append(tokens, token{typ: typ, val: string(runes[start:pos]), pos: start})
+	}
+
+	return append(tokens, token{typ: tokenEOF, pos: len(runes)}), nil
+}
+
+func lexString(runes []rune, pos int) (string, int, error) {
+	quote := runes[pos]
+	sb := strings.Builder{}
+
+	for i := pos + 1; i < len(runes); i++ {
+		switch runes[i] {
+		case quote:
+			return sb.String(), i + 1, nil
+		case '\\':
+			if i+1 >= len(runes) {
+				return "", 0, errorf(i, "unterminated escape sequence")
+			}
+			i++
+			switch runes[i] {
+			case 'n':
+				sb.WriteRune('\n')
+			case 't':
+				sb.WriteRune('\t')
+			default:
+				sb.WriteRune(runes[i])
+			}
+		default:
+			sb.WriteRune(runes[i])
+		}
+	}
+
+	return "", 0, errorf(pos, "unterminated string")
+}
+
+func isIdentStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
+
+func isIdentChar(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r) || r == ':'
+}
@@ -0,0 +1,464 @@
+package query
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expr is a node of a parsed query
+type Expr interface {
+	Pos() int
+}
+
+// NumberLiteral is a scalar constant, e.g. 1024
+type NumberLiteral struct {
+	pos   int
+	Value float64
+}
+
+// Selector selects the series of a metric, e.g. mem{service="echo"}[5m]. Range is zero for
+// instant selectors.
+type Selector struct {
+	pos      int
+	MetricID string
+	Matchers []*Matcher
+	Range    time.Duration
+	// rangeText is the range as written in the query
+	rangeText string
+}
+
+// Matcher restricts the series of a selector by the value of one of their labels
+type Matcher struct {
+	Label string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// Call is a function call, e.g. rate(requests[5m])
+type Call struct {
+	pos  int
+	Func string
+	Args []Expr
+}
+
+// Aggregate combines series, e.g. sum by (service) (mem) or topk(3, mem)
+type Aggregate struct {
+	pos     int
+	Op      string
+	Param   Expr
+	Expr    Expr
+	Without bool
+	Labels  []string
+}
+
+// Binary is an arithmetic operation, e.g. mem / on(service) group_left sum by (service) (requests)
+type Binary struct {
+	pos      int
+	Op       string
+	LHS      Expr
+	RHS      Expr
+	On       bool
+	Ignoring bool
+	Labels   []string
+	// Group is "left" when many series of the left side match one of the right side, "right"
+	// for the reverse and empty to match one to one. Include are the labels copied from the one side.
+	Group   string
+	Include []string
+}
+
+// Unary is a negation
+type Unary struct {
+	pos  int
+	Expr Expr
+}
+
+func (e *NumberLiteral) Pos() int { return e.pos }
+func (e *Selector) Pos() int      { return e.pos }
+func (e *Call) Pos() int          { return e.pos }
+func (e *Aggregate) Pos() int     { return e.pos }
+func (e *Binary) Pos() int        { return e.pos }
+func (e *Unary) Pos() int         { return e.pos }
+
+const (
+	MatchEqual    = "="
+	MatchNotEqual = "!="
+	MatchRegex    = "=~"
+	MatchNotRegex = "!~"
+)
+
+// Matches tells whether the label value satisfies the matcher, a missing label has the empty value
+func (m *Matcher) Matches(value string) bool {
+	switch m.Op {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegex:
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+var aggregateOps = map[string]bool{
+	"sum":     true,
+	"avg":     true,
+	"min":     true,
+	"max":     true,
+	"count":   true,
+	"topk":    true,
+	"bottomk": true,
+}
+
+// functions maps the supported functions to whether their argument is a range selector
+var functions = map[string]bool{
+	"rate":          true,
+	"delta":         true,
+	"avg_over_time": true,
+	"min_over_time": true,
+	"max_over_time": true,
+	"sum_over_time": true,
+	"abs":           false,
+}
+
+type parser struct {
+	tokens []token
+	i      int
+}
+
+// Parse parses a query, e.g. `sum by (service) (rate(requests{service=~"echo.*"}[5m]))`.
+// Errors are of type *Error and carry the position of the offending token.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, errorf(t.pos, "unexpected %s after the end of the expression", t)
+	}
+
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.typ != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) expect(typ tokenType, context string) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, errorf(t.pos, "unexpected %s in %s, expected %s", t, context, typ)
+	}
+	return t, nil
+}
+
+func precedence(typ tokenType) int {
+	switch typ {
+	case tokenAdd, tokenSub:
+		return 1
+	case tokenMul, tokenDiv:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// parseExpr parses binary operations binding tighter than minPrecedence, all operators being left associative
+func (p *parser) parseExpr(minPrecedence int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+		prec := precedence(op.typ)
+		if prec == 0 || prec <= minPrecedence {
+			return lhs, nil
+		}
+		p.next()
+
+		binary := Binary{pos: op.pos, Op: op.val, LHS: lhs}
+		if t := p.peek(); t.typ == tokenIdent && (t.val == "on" || t.val == "ignoring") {
+			p.next()
+			binary.On = t.val == "on"
+			binary.Ignoring = t.val == "ignoring"
+			if binary.Labels, err = p.parseLabels(t.val); err != nil {
+				return nil, err
+			}
+
+			if t := p.peek(); t.typ == tokenIdent && (t.val == "group_left" || t.val == "group_right") {
+				p.next()
+				binary.Group = strings.TrimPrefix(t.val, "group_")
+				if p.peek().typ == tokenLeftParen {
+					if binary.Include, err = p.parseLabels(t.val); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+
+		if binary.RHS, err = p.parseExpr(prec); err != nil {
+			return nil, err
+		}
+		lhs = &binary
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if t := p.peek(); t.typ == tokenSub || t.typ == tokenAdd {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if t.typ == tokenAdd {
+			return expr, nil
+		}
+		if n, ok := expr.(*NumberLiteral); ok {
+			return &NumberLiteral{pos: t.pos, Value: -n.Value}, nil
+		}
+		return &Unary{pos: t.pos, Expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+
+	switch t.typ {
+	case tokenNumber:
+		v, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, errorf(t.pos, "invalid number %q", t.val)
+		}
+		return &NumberLiteral{pos: t.pos, Value: v}, nil
+	case tokenLeftParen:
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRightParen, "parenthesized expression"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case tokenLeftBrace:
+		return nil, errorf(t.pos, "selectors must start with a metric name")
+	case tokenIdent:
+		if aggregateOps[t.val] {
+			return p.parseAggregate(t)
+		}
+		if p.peek().typ == tokenLeftParen {
+			return p.parseCall(t)
+		}
+		return p.parseSelector(t)
+	case tokenEOF:
+		return nil, errorf(t.pos, "unexpected end of query, expected an expression")
+	default:
+		return nil, errorf(t.pos, "unexpected %s, expected an expression", t)
+	}
+}
+
+func (p *parser) parseSelector(name token) (Expr, error) {
+	selector := Selector{pos: name.pos, MetricID: name.val}
+
+	if p.peek().typ == tokenLeftBrace {
+		p.next()
+		for p.peek().typ != tokenRightBrace {
+			matcher, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			selector.Matchers = append(selector.Matchers, matcher)
+
+			if p.peek().typ != tokenComma {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(tokenRightBrace, "label matchers"); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek().typ == tokenLeftBracket {
+		p.next()
+		t, err := p.expect(tokenDuration, "range")
+		if err != nil {
+			return nil, err
+		}
+		selector.rangeText = t.val
+		if selector.Range, err = ParseDuration(t.val); err != nil {
+			return nil, errorf(t.pos, "invalid range %q", t.val)
+		}
+		if _, err := p.expect(tokenRightBracket, "range"); err != nil {
+			return nil, err
+		}
+	}
+
+	return &selector, nil
+}
+
+func (p *parser) parseMatcher() (*Matcher, error) {
+	label, err := p.expect(tokenIdent, "label matchers")
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	switch op.typ {
+	case tokenEq, tokenNotEq, tokenRegexMatch, tokenRegexNoMatch:
+	default:
+		return nil, errorf(op.pos, "unexpected %s in label matchers, expected one of =, !=, =~, !~", op)
+	}
+
+	value, err := p.expect(tokenString, "label matchers")
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := Matcher{Label: label.val, Op: op.val, Value: value.val}
+	if op.typ == tokenRegexMatch || op.typ == tokenRegexNoMatch {
+		// regular expressions match whole values
+		if matcher.re, err = regexp.Compile("^(?:" + value.val + ")$"); err != nil {
+			return nil, errorf(value.pos, "invalid regular expression %q: %s", value.val, err)
+		}
+	}
+
+	return &matcher, nil
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	takesRange, ok := functions[name.val]
+	if !ok {
+		return nil, errorf(name.pos, "unknown function %q", name.val)
+	}
+
+	p.next()
+	call := Call{pos: name.pos, Func: name.val}
+	arg, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenRightParen, name.val+" arguments"); err != nil {
+		return nil, err
+	}
+
+	selector, isSelector := arg.(*Selector)
+	if takesRange && (!isSelector || selector.Range == 0) {
+		return nil, errorf(arg.Pos(), "%s expects a range selector, e.g. %s(metric[5m])", name.val, name.val)
+	}
+	call.Args = []Expr{arg}
+
+	return &call, nil
+}
+
+func (p *parser) parseAggregate(op token) (Expr, error) {
+	agg := Aggregate{pos: op.pos, Op: op.val}
+
+	var err error
+	if t := p.peek(); t.typ == tokenIdent && (t.val == "by" || t.val == "without") {
+		p.next()
+		agg.Without = t.val == "without"
+		if agg.Labels, err = p.parseLabels(t.val); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := p.expect(tokenLeftParen, op.val); err != nil {
+		return nil, err
+	}
+	if op.val == "topk" || op.val == "bottomk" {
+		if agg.Param, err = p.parseExpr(0); err != nil {
+			return nil, err
+		}
+		if _, ok := agg.Param.(*NumberLiteral); !ok {
+			return nil, errorf(agg.Param.Pos(), "%s expects a number of series as first argument", op.val)
+		}
+		if _, err := p.expect(tokenComma, op.val+" arguments"); err != nil {
+			return nil, err
+		}
+	}
+	if agg.Expr, err = p.parseExpr(0); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenRightParen, op.val+" arguments"); err != nil {
+		return nil, err
+	}
+
+	// the grouping may also follow the arguments, e.g. sum(mem) by (service)
+	if t := p.peek(); t.typ == tokenIdent && (t.val == "by" || t.val == "without") {
+		if agg.Labels != nil {
+			return nil, errorf(t.pos, "%s already has a grouping", op.val)
+		}
+		p.next()
+		agg.Without = t.val == "without"
+		if agg.Labels, err = p.parseLabels(t.val); err != nil {
+			return nil, err
+		}
+	}
+
+	return &agg, nil
+}
+
+// parseLabels parses a parenthesized list of label names, e.g. (service, service_id)
+func (p *parser) parseLabels(context string) ([]string, error) {
+	if _, err := p.expect(tokenLeftParen, context); err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+	for p.peek().typ != tokenRightParen {
+		label, err := p.expect(tokenIdent, context+" labels")
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label.val)
+
+		if p.peek().typ != tokenComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(tokenRightParen, context+" labels"); err != nil {
+		return nil, err
+	}
+
+	return labels, nil
+}
+
+// ParseDuration parses Go durations along with days and weeks, e.g. 1d or 2w
+func ParseDuration(value string) (time.Duration, error) {
+	for unit, d := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(value, unit) {
+			n, err := strconv.Atoi(strings.TrimSuffix(value, unit))
+			if err != nil || n <= 0 {
+				return 0, strconv.ErrSyntax
+			}
+			return time.Duration(n) * d, nil
+		}
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return d, nil
+}
@@ -4,80 +4,182 @@ import (
 	"clients"
 	"fmt"
 	"log"
+	"metrics"
+	"sort"
+	"sync"
 	"time"
 
 	"svc.orchestrator/storage"
+	"svc.orchestrator/stream"
 )
 
+// droppedDataPoints counts the data points added once the aggregator is stopped
+var droppedDataPoints = metrics.NewCounterVec("orchestrator_aggregator_dropped_data_points",
+	"Data points added after the aggregator was stopped.")
+
 type MetricsAggregator struct {
-	metrics map[string]*clients.Aggregation
-	c       chan *clients.DataPoint
-	done    chan bool
-	ticker  *time.Ticker
-	store   *storage.DataStore
+	metrics    map[string]*clients.Aggregation
+	latest     map[string]*clients.Aggregation
+	latestLock *sync.RWMutex
+	c          chan *clients.DataPoint
+	done       chan bool
+	stopped    chan bool
+	ticker     *time.Ticker
+	interval   time.Duration
+	store      storage.MetricsStore
+	points     *stream.Broker
 }
 
-func NewMetricsAggregator(store *storage.DataStore) *MetricsAggregator {
+// NewMetricsAggregator creates an aggregator flushing to store every interval, every data point
+// it ingests is published to points as a clients.DataPoint when not nil
+func NewMetricsAggregator(store storage.MetricsStore, points *stream.Broker, interval time.Duration) *MetricsAggregator {
 	return &MetricsAggregator{
-		store:   store,
-		metrics: make(map[string]*clients.Aggregation),
-		c:       make(chan *clients.DataPoint, 10000),
-		done:    make(chan bool),
+		store:      store,
+		points:     points,
+		interval:   interval,
+		metrics:    make(map[string]*clients.Aggregation),
+		latest:     make(map[string]*clients.Aggregation),
+		latestLock: &sync.RWMutex{},
+		c:          make(chan *clients.DataPoint, 10000),
+		done:       make(chan bool),
 	}
 }
 
+// AddDataPoint queues dp to be aggregated, it is dropped once the aggregator is stopped
+// rather than blocking on the queue nothing reads anymore
 func (a *MetricsAggregator) AddDataPoint(dp *clients.DataPoint) {
-	a.c <- dp
+	select {
+	case <-a.done:
+		droppedDataPoints.With().Inc()
+		return
+	default:
+	}
+
+	select {
+	case a.c <- dp:
+	case <-a.done:
+		droppedDataPoints.With().Inc()
+	}
 }
 
 func (a *MetricsAggregator) run() {
-	t := time.NewTicker(1 * time.Minute)
+	defer close(a.stopped)
 
 	for {
 		select {
 		case <-a.done:
-			return
-		case <-t.C:
-			log.Println("Storing metric aggregation")
-			err := a.store.InsertAggregations(a.metrics)
-			if err != nil {
-				log.Println(err)
+			// the data points queued before Stop are flushed along with the pending aggregations
+			for len(a.c) > 0 {
+				a.aggregate(<-a.c)
 			}
-			a.metrics = make(map[string]*clients.Aggregation)
+			a.flush()
+			return
+		case <-a.ticker.C:
+			a.flush()
 		case dp := <-a.c:
-			if metric, ok := a.metrics[getAggregationKey(dp.ServiceID, dp.MetricID)]; !ok {
-				a.metrics[getAggregationKey(dp.ServiceID, dp.MetricID)] = &clients.Aggregation{
-					MetricID:  dp.MetricID,
-					ServiceID: dp.ServiceID,
-					TS:        dp.TS,
-					Max:       dp.Value,
-					Min:       dp.Value,
-					Average:   dp.Value,
-					NumValues: 1,
-				}
-			} else {
-				metric.Average = (dp.Value + float64(metric.NumValues)*metric.Average) / float64(metric.NumValues+1)
-				metric.NumValues += 1
-				if metric.Min > dp.Value {
-					metric.Min = dp.Value
-				}
-				if metric.Max < dp.Value {
-					metric.Max = dp.Value
-				}
-			}
+			a.aggregate(dp)
+		}
+	}
+}
+
+func (a *MetricsAggregator) aggregate(dp *clients.DataPoint) {
+	if a.points != nil {
+		a.points.Publish(*dp)
+	}
+	if metric, ok := a.metrics[getAggregationKey(dp.ServiceID, dp.MetricID)]; !ok {
+		a.metrics[getAggregationKey(dp.ServiceID, dp.MetricID)] = &clients.Aggregation{
+			MetricID:  dp.MetricID,
+			ServiceID: dp.ServiceID,
+			TS:        dp.TS,
+			Max:       dp.Value,
+			Min:       dp.Value,
+			Average:   dp.Value,
+			NumValues: 1,
+			Labels:    dp.Labels,
+		}
+	} else {
+		metric.Average = (dp.Value + float64(metric.NumValues)*metric.Average) / float64(metric.NumValues+1)
+		metric.NumValues += 1
+		if metric.Min > dp.Value {
+			metric.Min = dp.Value
+		}
+		if metric.Max < dp.Value {
+			metric.Max = dp.Value
 		}
 	}
 }
 
+func (a *MetricsAggregator) flush() {
+	log.Println("Storing metric aggregation")
+	err := a.store.InsertAggregations(a.metrics)
+	if err != nil {
+		log.Println(err)
+	}
+	a.latestLock.Lock()
+	a.latest = a.metrics
+	a.latestLock.Unlock()
+	a.metrics = make(map[string]*clients.Aggregation)
+}
+
 func (a *MetricsAggregator) Start() {
-	a.done = make(chan bool)
-	a.ticker = time.NewTicker(1 * time.Minute)
+	a.stopped = make(chan bool)
+	a.ticker = time.NewTicker(a.interval)
 	go a.run()
 }
 
+// Stop flushes the pending aggregations to the store and returns once they are stored, the
+// data points added afterwards are not aggregated anymore
 func (a *MetricsAggregator) Stop() {
 	a.ticker.Stop()
-	a.done <- true
+	close(a.done)
+	<-a.stopped
+}
+
+// Collect exposes the depth of the data point queue, the dropped data points and the aggregations of the last flush,
+// as a mesh_<metric> family of averages along with the _min, _max and _samples families
+func (a *MetricsAggregator) Collect(w *metrics.Writer) {
+	w.Family("orchestrator_aggregator_queue_depth", metrics.TypeGauge, "Data points waiting to be aggregated.")
+	w.Sample("orchestrator_aggregator_queue_depth", nil, float64(len(a.c)))
+	droppedDataPoints.Collect(w)
+
+	a.latestLock.RLock()
+	byMetric := map[string][]*clients.Aggregation{}
+	for _, agg := range a.latest {
+		byMetric[agg.MetricID] = append(byMetric[agg.MetricID], agg)
+	}
+	a.latestLock.RUnlock()
+
+	metricIDs := make([]string, 0, len(byMetric))
+	for metricID, aggs := range byMetric {
+		metricIDs = append(metricIDs, metricID)
+		sort.Slice(aggs, func(i, j int) bool { return aggs[i].ServiceID < aggs[j].ServiceID })
+	}
+	sort.Strings(metricIDs)
+
+	for _, metricID := range metricIDs {
+		name := "mesh_" + metrics.SanitizeName(metricID)
+		families := []struct {
+			name  string
+			help  string
+			value func(agg *clients.Aggregation) float64
+		}{
+			{name, "Average of " + metricID + " over the last aggregation interval.", func(agg *clients.Aggregation) float64 { return agg.Average }},
+			{name + "_min", "Minimum of " + metricID + " over the last aggregation interval.", func(agg *clients.Aggregation) float64 { return agg.Min }},
+			{name + "_max", "Maximum of " + metricID + " over the last aggregation interval.", func(agg *clients.Aggregation) float64 { return agg.Max }},
+			{name + "_samples", "Data points of " + metricID + " in the last aggregation interval.", func(agg *clients.Aggregation) float64 { return float64(agg.NumValues) }},
+		}
+
+		for _, family := range families {
+			w.Family(family.name, metrics.TypeGauge, family.help)
+			for _, agg := range byMetric[metricID] {
+				labels := map[string]string{"service_id": agg.ServiceID}
+				for k, v := range agg.Labels {
+					labels[metrics.SanitizeName(k)] = v
+				}
+				w.Sample(family.name, labels, family.value(agg))
+			}
+		}
+	}
 }
 
 func getAggregationKey(hostname, metricID string) string {
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"bytes"
+	"clients"
+	"fmt"
+	"metrics"
+	"strings"
+	"testing"
+	"time"
+
+	"svc.orchestrator/storage"
+)
+
+func TestAddDataPointAfterStop(t *testing.T) {
+	store := storage.NewMemoryStore(storage.DefaultRollupTiers())
+	a := NewMetricsAggregator(store, nil, time.Hour)
+	a.Start()
+
+	now := time.Now().UTC()
+	a.AddDataPoint(&clients.DataPoint{MetricID: "mem", ServiceID: "echo-1", TS: now, Value: 1})
+	a.Stop()
+	// the counter is shared by the aggregators of the process
+	before := droppedDataPoints.With().Get()
+
+	// more data points than the queue holds, none of them is read anymore
+	added := make(chan bool)
+	go func() {
+		for i := 0; i <= cap(a.c); i++ {
+			a.AddDataPoint(&clients.DataPoint{MetricID: "mem", ServiceID: "echo-1", TS: now, Value: 2})
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddDataPoint blocked after Stop")
+	}
+
+	dropped := droppedDataPoints.With().Get()
+	if dropped-before != float64(cap(a.c)+1) {
+		t.Errorf("got dropped=%v, want %d", dropped-before, cap(a.c)+1)
+	}
+	buf := bytes.Buffer{}
+	a.Collect(metrics.NewWriter(&buf, false))
+	if want := fmt.Sprintf("orchestrator_aggregator_dropped_data_points_total %v\n", dropped); !strings.Contains(buf.String(), want) {
+		t.Errorf("got exposition=%s, want %s", buf.String(), want)
+	}
+
+	// the data point added before Stop was flushed
+	resp, err := store.GetStats(&storage.StatsQuery{MetricID: "mem", StartTS: now.Add(-time.Minute), EndTS: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Aggregations) != 1 || resp.Aggregations[0].Average != 1 {
+		t.Errorf("got aggregations=%+v, want the data point added before Stop", resp.Aggregations)
+	}
+}
+
+func TestCollectLastAggregation(t *testing.T) {
+	store := storage.NewMemoryStore(storage.DefaultRollupTiers())
+	a := NewMetricsAggregator(store, nil, time.Hour)
+	a.Start()
+
+	now := time.Now().UTC()
+	for _, dp := range []clients.DataPoint{
+		{MetricID: "http.requests", ServiceID: "echo-2", TS: now, Value: 4, Labels: map[string]string{"service-name": "echo"}},
+		{MetricID: "http.requests", ServiceID: "echo-1", TS: now, Value: 1},
+		{MetricID: "http.requests", ServiceID: "echo-1", TS: now, Value: 3},
+	} {
+		dp := dp
+		a.AddDataPoint(&dp)
+	}
+	a.Stop()
+
+	buf := bytes.Buffer{}
+	a.Collect(metrics.NewWriter(&buf, true))
+	for _, want := range []string{
+		"Data points waiting to be aggregated.\norchestrator_aggregator_queue_depth 0\n",
+		"# TYPE mesh_http_requests gauge\n# HELP mesh_http_requests Average of http.requests over the last aggregation interval.\n" +
+			"mesh_http_requests{service_id=\"echo-1\"} 2\nmesh_http_requests{service_id=\"echo-2\",service_name=\"echo\"} 4\n",
+		"mesh_http_requests_min{service_id=\"echo-1\"} 1\n",
+		"mesh_http_requests_max{service_id=\"echo-1\"} 3\n",
+		"mesh_http_requests_samples{service_id=\"echo-1\"} 2\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got exposition=\n%s\nwant it to contain\n%s", buf.String(), want)
+		}
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eapache/go-resiliency/retrier"
 	"svc.orchestrator/storage"
+	"svc.orchestrator/stream"
 	"svc.orchestrator/types"
 )
 
@@ -16,20 +19,38 @@ type healthChecker struct {
 	info       types.RegistrantInfo
 	ticker     *time.Ticker
 	quit       chan struct{}
+	quitOnce   *sync.Once
 	done       chan types.RegistrantInfo
 	client     clients.HeartbeatClient
 	aggregator *MetricsAggregator
+	observer   types.RequestObserver
+	events     *stream.Broker
+	draining   int32
+	// policy is replaced when the config is reloaded, policyChanged resetting the ticker
+	policy        HealthCheckPolicy
+	policyChanged chan struct{}
+	// the time and instance of the last successful heartbeat
+	lastHeartbeat time.Time
+	serviceID     string
+	statusLock    *sync.Mutex
 }
 
-func newHealthChecker(info types.RegistrantInfo, done chan types.RegistrantInfo, aggregator *MetricsAggregator) *healthChecker {
+func newHealthChecker(info types.RegistrantInfo, done chan types.RegistrantInfo, aggregator *MetricsAggregator,
+	observer types.RequestObserver, events *stream.Broker, policy HealthCheckPolicy) *healthChecker {
 	client := clients.NewHeartbeatClient(info.ControlAddress)
 
 	r := healthChecker{
-		info:       info,
-		done:       done,
-		client:     client,
-		quit:       make(chan struct{}),
-		aggregator: aggregator,
+		info:          info,
+		done:          done,
+		client:        client,
+		quit:          make(chan struct{}),
+		quitOnce:      &sync.Once{},
+		aggregator:    aggregator,
+		observer:      observer,
+		events:        events,
+		statusLock:    &sync.Mutex{},
+		policy:        policy,
+		policyChanged: make(chan struct{}, 1),
 	}
 
 	go r.startHealthCheck()
@@ -38,8 +59,8 @@ func newHealthChecker(info types.RegistrantInfo, done chan types.RegistrantInfo,
 }
 
 func (r *healthChecker) startHealthCheck() {
-	r.ticker = time.NewTicker(10 * time.Second)
-	retries := maxHeartBeatRetries
+	r.ticker = time.NewTicker(r.getPolicy().Interval)
+	failures := 0
 	defer func() {
 		log.Printf("Stopping healthcheck for %s", r.info.String())
 		r.ticker.Stop()
@@ -50,27 +71,105 @@ func (r *healthChecker) startHealthCheck() {
 
 	log.Printf("Starting healthcheck for %s", r.info.String())
 
-	for retries > 0 {
+	for {
 		select {
 		case <-r.quit:
 			log.Printf("Quiting healthcheck for %s", r.info.String())
 			return
+		case <-r.policyChanged:
+			r.ticker.Reset(r.getPolicy().Interval)
 		case <-r.ticker.C:
 			log.Printf("Sending heartbeat for %s (%s).......", r.info.ServiceName, r.info.ControlAddress)
 			if err := r.sendHeartBeat(); err != nil {
-				retries--
+				heartbeatFailures.With(r.info.ServiceName).Inc()
+				failures++
+				retries := r.getPolicy().Failures - failures
 				log.Printf("Error sending heartbeat to service=%s (Retries remaining=%d! err=%s",
 					r.info.ServiceName, retries, err.Error())
+				if retries > 0 {
+					continue
+				}
+				r.publish(clients.InstanceUnhealthy, err)
 				return
 			} else {
-				retries = maxHeartBeatRetries
+				failures = 0
+				r.publish(clients.InstanceHeartbeat, nil)
 			}
 		}
 	}
 }
 
+func (r *healthChecker) getPolicy() HealthCheckPolicy {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+
+	return r.policy
+}
+
+// setPolicy applies policy from the next heartbeat, the failed heartbeats so far counting
+// against its failures
+func (r *healthChecker) setPolicy(policy HealthCheckPolicy) {
+	r.statusLock.Lock()
+	r.policy = policy
+	r.statusLock.Unlock()
+
+	select {
+	case r.policyChanged <- struct{}{}:
+	default:
+	}
+}
+
+// stopHealthCheck stops the health check, it does not block and may be called more than once,
+// e.g. for a health check which already stopped after a failed heartbeat
 func (r *healthChecker) stopHealthCheck() {
-	r.quit <- struct{}{}
+	r.quitOnce.Do(func() { close(r.quit) })
+}
+
+func (r *healthChecker) setDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	atomic.StoreInt32(&r.draining, value)
+}
+
+func (r *healthChecker) isDraining() bool {
+	return atomic.LoadInt32(&r.draining) == 1
+}
+
+// registrant returns the info of the sidecar along with its health
+func (r *healthChecker) registrant() types.RegistrantInfo {
+	info := r.info
+	info.Draining = r.isDraining()
+	info.Health = clients.HealthPending
+
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+
+	if !r.lastHeartbeat.IsZero() {
+		lastHeartbeat := r.lastHeartbeat
+		info.Health = clients.HealthHealthy
+		info.LastHeartbeat = &lastHeartbeat
+		info.ServiceID = r.serviceID
+	}
+	return info
+}
+
+// publish sends an event of the sidecar to the subscribers of the instance events
+func (r *healthChecker) publish(eventType string, err error) {
+	if r.events == nil {
+		return
+	}
+
+	event := clients.InstanceEvent{
+		TS:         time.Now().UTC(),
+		Type:       eventType,
+		Registrant: clients.Registrant(r.registrant()),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	r.events.Publish(event)
 }
 
 func (r *healthChecker) sendHeartBeat() error {
@@ -79,9 +178,12 @@ func (r *healthChecker) sendHeartBeat() error {
 	var expRetrier = retrier.New(retrier.ExponentialBackoff(4, 500*time.Millisecond), nil)
 
 	if err := expRetrier.Run(func() error {
-		req := clients.HeartbeatRequest{}
+		req := clients.HeartbeatRequest{Drain: r.isDraining()}
 
-		resp, err = r.client.Heartbeat(context.Background(), &req)
+		ctx, cancel := context.WithTimeout(context.Background(), r.getPolicy().Timeout)
+		defer cancel()
+
+		resp, err = r.client.Heartbeat(ctx, &req)
 		if err != nil {
 			return err
 		}
@@ -92,37 +194,53 @@ func (r *healthChecker) sendHeartBeat() error {
 	}
 
 	if resp == nil {
-		return fmt.Errorf("hearteat failed for %s", r.info)
+		return fmt.Errorf("hearteat failed for %s", r.info.String())
 	}
 
+	r.statusLock.Lock()
+	r.lastHeartbeat = time.Now().UTC()
+	if len(resp.Stats) > 0 {
+		r.serviceID = resp.Stats[0].ServiceID
+	}
+	r.statusLock.Unlock()
+
+	labels := map[string]string{clients.LabelService: r.info.ServiceName}
 	for _, stats := range resp.Stats {
 		r.aggregator.AddDataPoint(&clients.DataPoint{
 			MetricID:  storage.MetricCPU,
 			ServiceID: stats.ServiceID,
 			TS:        stats.TS,
 			Value:     stats.CPU,
+			Labels:    labels,
 		})
 		r.aggregator.AddDataPoint(&clients.DataPoint{
 			MetricID:  storage.MetricMemory,
 			ServiceID: stats.ServiceID,
 			TS:        stats.TS,
 			Value:     stats.Mem,
+			Labels:    labels,
 		})
 		r.aggregator.AddDataPoint(&clients.DataPoint{
 			MetricID:  storage.MetricThreads,
 			ServiceID: stats.ServiceID,
 			TS:        stats.TS,
 			Value:     stats.Threads,
+			Labels:    labels,
 		})
 		r.aggregator.AddDataPoint(&clients.DataPoint{
 			MetricID:  storage.MetricNumGoroutine,
 			ServiceID: stats.ServiceID,
 			TS:        stats.TS,
 			Value:     stats.NumGoroutines,
+			Labels:    labels,
 		})
 	}
 
-	log.Printf("%s: %+v", r.info, resp.Stats)
+	if len(resp.Requests) > 0 && r.observer != nil {
+		r.observer.ObserveRequests(r.info.ServiceName, resp.Requests)
+	}
+
+	log.Printf("%s: %+v", r.info.String(), resp.Stats)
 
 	return nil
 }
@@ -3,29 +3,59 @@ package registry
 import (
 	"clients"
 	"context"
-	"errors"
 	"log"
+	"metrics"
+	"sort"
 	"sync"
+	"time"
 
+	"svc.orchestrator/stream"
 	"svc.orchestrator/types"
 )
 
-const maxHeartBeatRetries = 1
+// HealthCheckPolicy sets how the sidecars are health checked: a heartbeat is sent every
+// Interval, failing after Timeout, and Failures consecutive failed heartbeats deregister them
+type HealthCheckPolicy struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Failures int
+}
+
+// DefaultHealthCheckPolicy returns the policy used when none is configured
+func DefaultHealthCheckPolicy() HealthCheckPolicy {
+	return HealthCheckPolicy{Interval: 10 * time.Second, Timeout: 5 * time.Second, Failures: 1}
+}
+
+var heartbeatFailures = metrics.NewCounterVec("orchestrator_heartbeat_failures",
+	"Heartbeats which failed after their retries, by service.", "service")
 
 type serviceRegistry struct {
 	aggregator            *MetricsAggregator
+	observer              types.RequestObserver
+	events                *stream.Broker
+	policy                HealthCheckPolicy
 	healthCheckers        map[string][]*healthChecker
 	healthCheckersLock    *sync.RWMutex
 	healthCheckerExitChan chan types.RegistrantInfo
+	// running counts the health checkers until they are removed, stopped ends the remover
+	running *sync.WaitGroup
+	stopped chan struct{}
 }
 
-// NewServiceRegistry creates a new service registry instance
-func NewServiceRegistry(aggregator *MetricsAggregator) *serviceRegistry {
+// NewServiceRegistry creates a new service registry instance, the changes of the sidecars are
+// published as clients.InstanceEvent to events
+func NewServiceRegistry(aggregator *MetricsAggregator, observer types.RequestObserver, events *stream.Broker,
+	policy HealthCheckPolicy) *serviceRegistry {
 	s := serviceRegistry{
 		aggregator:            aggregator,
+		observer:              observer,
+		events:                events,
+		policy:                policy,
 		healthCheckers:        make(map[string][]*healthChecker),
 		healthCheckerExitChan: make(chan types.RegistrantInfo),
 		healthCheckersLock:    &sync.RWMutex{},
+		running:               &sync.WaitGroup{},
+		stopped:               make(chan struct{}),
 	}
 
 	return &s
@@ -35,7 +65,7 @@ func (s *serviceRegistry) Register(ctx context.Context, req *clients.RegisterReq
 	if len(req.ControlAddress) == 0 ||
 		len(req.ServiceName) == 0 ||
 		len(req.DataAddress) == 0 {
-		return nil, errors.New("invalid fields")
+		return nil, types.ErrInvalidRegistrant
 	}
 
 	rInfo := types.NewRegistrantInfo(req.ServiceName, req.ControlAddress, req.DataAddress)
@@ -60,19 +90,50 @@ func (s *serviceRegistry) Unregister(ctx context.Context, req *clients.RegisterR
 	hCheckers, ok := s.healthCheckers[req.ServiceName]
 	if !ok {
 		log.Printf("Service with name=%s does not exist! Skipping...", req.ServiceName)
-		return nil, errors.New("registrant missing")
+		return nil, types.ErrRegistrantNotFound
 	}
 
+	found := false
 	for _, hChecker := range hCheckers {
 		if hChecker.info.ControlAddress == req.ControlAddress {
 			hChecker.stopHealthCheck()
+			found = true
 		}
 	}
+	if !found {
+		log.Printf("Service with name=%s has no registrant control=%s! Skipping...", req.ServiceName, req.ControlAddress)
+		return nil, types.ErrRegistrantNotFound
+	}
 
 	resp := clients.RegisterResponse{Code: clients.RegisterSuccess}
 	return &resp, nil
 }
 
+// Drain marks a registrant as draining, or no longer draining, the sidecar being told on its
+// next heartbeat
+func (s *serviceRegistry) Drain(ctx context.Context, req *clients.RegisterRequest, draining bool) (*clients.RegisterResponse, error) {
+	log.Printf("Setting draining=%t of service=%s control=%s", draining, req.ServiceName, req.ControlAddress)
+
+	s.healthCheckersLock.RLock()
+	defer s.healthCheckersLock.RUnlock()
+
+	for _, hChecker := range s.healthCheckers[req.ServiceName] {
+		if hChecker.info.ControlAddress == req.ControlAddress {
+			hChecker.setDraining(draining)
+			if draining {
+				hChecker.publish(clients.InstanceDraining, nil)
+			} else {
+				hChecker.publish(clients.InstanceServing, nil)
+			}
+			resp := clients.RegisterResponse{Code: clients.RegisterSuccess}
+			return &resp, nil
+		}
+	}
+
+	log.Printf("Service with name=%s has no registrant control=%s! Skipping...", req.ServiceName, req.ControlAddress)
+	return nil, types.ErrRegistrantNotFound
+}
+
 func (s *serviceRegistry) GetServices() (map[string][]types.RegistrantInfo, error) {
 	s.healthCheckersLock.RLock()
 	defer s.healthCheckersLock.RUnlock()
@@ -82,7 +143,7 @@ func (s *serviceRegistry) GetServices() (map[string][]types.RegistrantInfo, erro
 	for serviceName, hCheckers := range s.healthCheckers {
 		rInfos := []types.RegistrantInfo{}
 		for _, hChecker := range hCheckers {
-			rInfos = append(rInfos, hChecker.info)
+			rInfos = append(rInfos, hChecker.registrant())
 		}
 
 		result[serviceName] = rInfos
@@ -91,12 +152,59 @@ func (s *serviceRegistry) GetServices() (map[string][]types.RegistrantInfo, erro
 	return result, nil
 }
 
+// Collect exposes the number of registrants of every service and the heartbeat failures
+func (s *serviceRegistry) Collect(w *metrics.Writer) {
+	s.healthCheckersLock.RLock()
+	serviceNames := make([]string, 0, len(s.healthCheckers))
+	registrants := make(map[string]int, len(s.healthCheckers))
+	for serviceName, hCheckers := range s.healthCheckers {
+		serviceNames = append(serviceNames, serviceName)
+		registrants[serviceName] = len(hCheckers)
+	}
+	s.healthCheckersLock.RUnlock()
+
+	sort.Strings(serviceNames)
+
+	w.Family("orchestrator_registrants", metrics.TypeGauge, "Registered sidecars, by service.")
+	for _, serviceName := range serviceNames {
+		w.Sample("orchestrator_registrants", map[string]string{"service": serviceName}, float64(registrants[serviceName]))
+	}
+
+	heartbeatFailures.Collect(w)
+}
+
 func (s *serviceRegistry) Start() {
 	go s.startRemoveHealthChecker()
 }
 
+// Stop stops every health checker and returns once they are removed, the sidecars being
+// deregistered
 func (s *serviceRegistry) Stop() {
-	close(s.healthCheckerExitChan)
+	s.healthCheckersLock.RLock()
+	for _, hCheckers := range s.healthCheckers {
+		for _, hChecker := range hCheckers {
+			hChecker.stopHealthCheck()
+		}
+	}
+	s.healthCheckersLock.RUnlock()
+
+	s.running.Wait()
+	close(s.stopped)
+}
+
+// SetHealthCheckPolicy applies policy to the registered sidecars from their next heartbeat,
+// and to those registered from now on
+func (s *serviceRegistry) SetHealthCheckPolicy(policy HealthCheckPolicy) {
+	s.healthCheckersLock.Lock()
+	defer s.healthCheckersLock.Unlock()
+
+	s.policy = policy
+	for _, hCheckers := range s.healthCheckers {
+		for _, hChecker := range hCheckers {
+			hChecker.setPolicy(policy)
+		}
+	}
+	log.Printf("Applied health check policy=%+v", policy)
 }
 
 func (s *serviceRegistry) load(rInfos ...types.RegistrantInfo) error {
@@ -109,13 +217,15 @@ func (s *serviceRegistry) load(rInfos ...types.RegistrantInfo) error {
 			for _, hChecker := range hCheckers {
 				if hChecker.info.ControlAddress == rInfo.ControlAddress {
 					log.Printf("Already registered service=%s address=%s", rInfo.ServiceName, rInfo.ControlAddress)
-					return errors.New("registrant exists")
+					return types.ErrRegistrantExists
 				}
 			}
 		}
 
-		hChecker := newHealthChecker(rInfo, s.healthCheckerExitChan, s.aggregator)
+		s.running.Add(1)
+		hChecker := newHealthChecker(rInfo, s.healthCheckerExitChan, s.aggregator, s.observer, s.events, s.policy)
 		s.healthCheckers[rInfo.ServiceName] = append(s.healthCheckers[rInfo.ServiceName], hChecker)
+		hChecker.publish(clients.InstanceRegistered, nil)
 
 		log.Printf("Succesfully registered service=%s address=%s", rInfo.ServiceName, rInfo.ControlAddress)
 	}
@@ -125,12 +235,13 @@ func (s *serviceRegistry) load(rInfos ...types.RegistrantInfo) error {
 
 func (s *serviceRegistry) startRemoveHealthChecker() {
 	for {
-		rInfo, ok := <-s.healthCheckerExitChan
-		if !ok {
+		select {
+		case <-s.stopped:
 			log.Print("Exiting remove healthcheck listener")
+			return
+		case rInfo := <-s.healthCheckerExitChan:
+			s.removeHealthChecker(rInfo)
 		}
-
-		s.removeHealthChecker(rInfo)
 	}
 }
 
@@ -150,6 +261,8 @@ func (s *serviceRegistry) removeHealthChecker(rInfo types.RegistrantInfo) {
 	for _, hChecker := range hCheckers {
 		if hChecker.info.ControlAddress == rInfo.ControlAddress {
 			log.Printf("Succesfully unregistered service=%s control=%s", rInfo.ServiceName, rInfo.ControlAddress)
+			hChecker.publish(clients.InstanceDeregistered, nil)
+			s.running.Done()
 		} else {
 			remaining = append(remaining, hChecker)
 		}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"clients"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"svc.orchestrator/stream"
+	"svc.orchestrator/types"
+)
+
+func instanceEvents(sub *stream.Subscription) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-sub.Events():
+			e := event.(clients.InstanceEvent)
+			events = append(events, e.Type+" "+e.Registrant.ControlAddress)
+		default:
+			return events
+		}
+	}
+}
+
+// TestStopDeregistersSidecars checks that Stop returns once every health checker is removed,
+// along with those already unregistered, the sidecars being deregistered once
+func TestStopDeregistersSidecars(t *testing.T) {
+	events := stream.NewBroker("instances")
+	sub := events.Subscribe(10, nil)
+	s := NewServiceRegistry(nil, nil, events, HealthCheckPolicy{Interval: time.Hour, Timeout: time.Second, Failures: 1})
+	s.Start()
+
+	ctx := context.Background()
+	for _, address := range []string{"http://127.0.0.1:1", "http://127.0.0.1:2"} {
+		req := &clients.RegisterRequest{ServiceName: "echo", ControlAddress: address, DataAddress: address}
+		if _, err := s.Register(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := &clients.RegisterRequest{ServiceName: "echo", ControlAddress: "http://127.0.0.1:1"}
+	if _, err := s.Unregister(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+
+	if services, _ := s.GetServices(); len(services) != 0 {
+		t.Errorf("got services=%v after Stop, want none", services)
+	}
+	if _, err := s.Unregister(ctx, req); err != types.ErrRegistrantNotFound {
+		t.Errorf("got err=%v, want ErrRegistrantNotFound", err)
+	}
+
+	counts := map[string]int{}
+	for _, event := range instanceEvents(sub) {
+		counts[event]++
+	}
+	want := map[string]int{
+		"registered http://127.0.0.1:1": 1, "registered http://127.0.0.1:2": 1,
+		"deregistered http://127.0.0.1:1": 1, "deregistered http://127.0.0.1:2": 1,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("got events=%v, want both sidecars registered and deregistered once", counts)
+	}
+}
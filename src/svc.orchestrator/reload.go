@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"svc.orchestrator/alerting"
+	"svc.orchestrator/registry"
+	"svc.orchestrator/storage"
+)
+
+// reloadPollInterval is how often the config files are polled for changes
+const reloadPollInterval = 5 * time.Second
+
+// configReloads applies the reloaded config, and the rollup and alerting files it names, to the
+// running components: the health check policy, the retention and lateness of the rollup tiers,
+// the alert rules, receivers, routing tree and silences, and the shutdown timeout. The other
+// settings need a restart, a config changing them is rejected.
+type configReloads struct {
+	path     string
+	registry policySetter
+	store    storage.MetricsStore
+	alerts   *alerting.Manager
+	// cfg and tiers are those applied, replaced once a reload is
+	cfg   *orchestratorConfig
+	tiers storage.RollupTiers
+	lock  *sync.RWMutex
+}
+
+// policySetter applies the health check policy of the registry
+type policySetter interface {
+	SetHealthCheckPolicy(policy registry.HealthCheckPolicy)
+}
+
+func newConfigReloads(path string, cfg *orchestratorConfig, tiers storage.RollupTiers, registry policySetter,
+	store storage.MetricsStore, alerts *alerting.Manager) *configReloads {
+	return &configReloads{
+		path:     path,
+		registry: registry,
+		store:    store,
+		alerts:   alerts,
+		cfg:      cfg,
+		tiers:    tiers,
+		lock:     &sync.RWMutex{},
+	}
+}
+
+// config returns the applied config
+func (c *configReloads) config() *orchestratorConfig {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.cfg
+}
+
+// paths returns the files to watch, those of the applied config
+func (c *configReloads) paths() []string {
+	cfg := c.config()
+	return []string{c.path, cfg.Storage.RollupConfig, cfg.Alerting.Rules}
+}
+
+// reload reads and validates the config and the files it names, and then applies them. Nothing
+// is applied unless all of them are valid, the store being the only component whose change
+// may fail and thus applied first.
+func (c *configReloads) reload() ([]string, error) {
+	next, err := readConfig(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	current := c.config()
+	if fixed := restartRequired(current, next); len(fixed) > 0 {
+		return nil, fmt.Errorf("%s can not be reloaded, the orchestrator must be restarted to change them", strings.Join(fixed, ", "))
+	}
+
+	tiers, err := loadRollupTiers(next.Storage.RollupConfig)
+	if err != nil {
+		return nil, err
+	}
+	tierChanges, err := c.tiers.Changes(tiers)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid rollup config=%s", next.Storage.RollupConfig)
+	}
+
+	alerts, err := c.alerts.PrepareReload()
+	if err != nil {
+		return nil, err
+	}
+
+	// the alerting config is applied first since it is read again when changed through the API
+	// meanwhile, which may fail
+	if len(alerts.Changes) > 0 {
+		if err := alerts.Apply(); err != nil {
+			return nil, err
+		}
+	}
+	if len(tierChanges) > 0 {
+		if err := c.store.SetRollupTiers(tiers); err != nil {
+			return nil, errors.Wrapf(err, "Failed applying rollup config=%s", next.Storage.RollupConfig)
+		}
+	}
+	if next.healthCheckPolicy() != current.healthCheckPolicy() {
+		c.registry.SetHealthCheckPolicy(next.healthCheckPolicy())
+	}
+
+	c.lock.Lock()
+	c.cfg, c.tiers = next, tiers
+	c.lock.Unlock()
+
+	changes := settingChanges(current, next)
+	changes = append(changes, tierChanges...)
+	return append(changes, alerts.Changes...), nil
+}
+
+// restartRequired returns the settings which changed but can not be reloaded
+func restartRequired(current, next *orchestratorConfig) []string {
+	fixed := []string{}
+	for _, s := range []struct {
+		name           string
+		previous, next interface{}
+	}{
+		{"listen_address", current.ListenAddress, next.ListenAddress},
+		{"storage.backend", current.Storage.Backend, next.Storage.Backend},
+		{"storage.data_dir", current.Storage.DataDir, next.Storage.DataDir},
+		{"storage.cassandra", current.Storage.Cassandra, next.Storage.Cassandra},
+		{"aggregator", current.Aggregator, next.Aggregator},
+		{"alerting", current.Alerting, next.Alerting},
+		{"slo", current.SLO, next.SLO},
+		{"anomaly", current.Anomaly, next.Anomaly},
+	} {
+		if !reflect.DeepEqual(s.previous, s.next) {
+			fixed = append(fixed, s.name)
+		}
+	}
+	return fixed
+}
+
+// settingChanges describes the reloadable settings which changed, the changes of the files
+// they name being described by their components
+func settingChanges(current, next *orchestratorConfig) []string {
+	changes := []string{}
+	for _, s := range []struct {
+		name           string
+		previous, next string
+	}{
+		{"shutdown_timeout", current.ShutdownTimeout.String(), next.ShutdownTimeout.String()},
+		{"storage.rollup_config", current.Storage.RollupConfig, next.Storage.RollupConfig},
+		{"health_check.interval", current.HealthCheck.Interval.String(), next.HealthCheck.Interval.String()},
+		{"health_check.timeout", current.HealthCheck.Timeout.String(), next.HealthCheck.Timeout.String()},
+		{"health_check.failures", strconv.Itoa(current.HealthCheck.Failures), strconv.Itoa(next.HealthCheck.Failures)},
+	} {
+		if s.previous != s.next {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", s.name, s.previous, s.next))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"svc.orchestrator/alerting"
+	"svc.orchestrator/registry"
+	"svc.orchestrator/storage"
+)
+
+// policyRecorder records the health check policies applied
+type policyRecorder struct {
+	policies []registry.HealthCheckPolicy
+}
+
+func (r *policyRecorder) SetHealthCheckPolicy(policy registry.HealthCheckPolicy) {
+	r.policies = append(r.policies, policy)
+}
+
+// TestReload checks that the health check policy is applied while the settings which need a
+// restart and invalid rollup configs are rejected, leaving the applied config in place
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "orchestrator.yaml")
+	rules := filepath.Join(dir, "alerting.json")
+	// storageLines are the lines of the storage section, content the other sections
+	write := func(storageLines, content string) {
+		content = "storage:\n  backend: memory\n" + storageLines + "alerting:\n  rules: " + rules + "\n" + content
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("", "")
+
+	cfg, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers := storage.DefaultRollupTiers()
+	store := storage.NewMemoryStore(tiers)
+	alerts, err := alerting.NewManager(store, nil, nil, rules, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := &policyRecorder{}
+	reloads := newConfigReloads(path, cfg, tiers, policies, store, alerts)
+
+	for _, tc := range []struct {
+		storage, content string
+		changes          []string
+		err              string
+	}{
+		{"", "", []string{}, ""},
+		{"", "listen_address: :9000\n", nil, "listen_address can not be reloaded"},
+		{"", "health_check:\n  failures: 0\n", nil, "health_check.failures"},
+		{"  rollup_config: " + filepath.Join(dir, "missing.json") + "\n", "", nil, "missing.json"},
+		{"", "health_check:\n  failures: 5\n", []string{`health_check.failures: "1" -> "5"`}, ""},
+	} {
+		write(tc.storage, tc.content)
+		changes, err := reloads.reload()
+		if len(tc.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("config=%q: got err=%v, want %s", tc.storage+tc.content, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(changes, tc.changes) {
+			t.Errorf("config=%q: got changes=%q err=%v, want %q", tc.storage+tc.content, changes, err, tc.changes)
+		}
+	}
+
+	if len(policies.policies) != 1 || policies.policies[0].Failures != 5 {
+		t.Errorf("got policies=%+v, want the one of 5 failures", policies.policies)
+	}
+	if applied := reloads.config(); applied.HealthCheck.Failures != 5 || applied.ListenAddress != cfg.ListenAddress {
+		t.Errorf("got config=%+v, want the last valid one", applied)
+	}
+}
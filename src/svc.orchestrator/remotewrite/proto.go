@@ -0,0 +1,173 @@
+package remotewrite
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// The subset of the remote-write protobuf messages the receiver reads, other fields
+// such as exemplars, native histograms and metadata are skipped:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+
+// WriteRequest is a decoded remote-write payload
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is a labeled series of samples
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value along with its timestamp in milliseconds since unix epoch
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// field is a decoded protobuf field, value is set for varint and fixed fields, data for bytes
+type field struct {
+	number int
+	wire   int
+	value  uint64
+	data   []byte
+}
+
+// unmarshal decodes a WriteRequest
+func unmarshal(data []byte) (*WriteRequest, error) {
+	req := WriteRequest{}
+
+	err := forEachField(data, func(f field) error {
+		if f.number != 1 || f.wire != wireBytes {
+			return nil
+		}
+		ts, err := unmarshalTimeSeries(f.data)
+		if err != nil {
+			return err
+		}
+		req.Timeseries = append(req.Timeseries, *ts)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+func unmarshalTimeSeries(data []byte) (*TimeSeries, error) {
+	ts := TimeSeries{}
+
+	err := forEachField(data, func(f field) error {
+		if f.wire != wireBytes {
+			return nil
+		}
+		switch f.number {
+		case 1:
+			label := Label{}
+			err := forEachField(f.data, func(f field) error {
+				if f.wire != wireBytes {
+					return nil
+				}
+				switch f.number {
+				case 1:
+					label.Name = string(f.data)
+				case 2:
+					label.Value = string(f.data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, label)
+		case 2:
+			sample := Sample{}
+			err := forEachField(f.data, func(f field) error {
+				switch {
+				case f.number == 1 && f.wire == wireFixed64:
+					sample.Value = math.Float64frombits(f.value)
+				case f.number == 2 && f.wire == wireVarint:
+					sample.Timestamp = int64(f.value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, sample)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ts, nil
+}
+
+// forEachField calls fn with every field of a message, in the order they are encoded
+func forEachField(data []byte, fn func(f field) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.Wrapf(ErrInvalidPayload, "invalid field key")
+		}
+		data = data[n:]
+
+		f := field{number: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case wireVarint:
+			if f.value, n = binary.Uvarint(data); n <= 0 {
+				return errors.Wrapf(ErrInvalidPayload, "invalid varint in field=%d", f.number)
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errors.Wrapf(ErrInvalidPayload, "truncated fixed64 in field=%d", f.number)
+			}
+			f.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errors.Wrapf(ErrInvalidPayload, "truncated fixed32 in field=%d", f.number)
+			}
+			f.value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errors.Wrapf(ErrInvalidPayload, "truncated bytes in field=%d", f.number)
+			}
+			f.data = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return errors.Wrapf(ErrInvalidPayload, "unsupported wire type=%d in field=%d", f.wire, f.number)
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
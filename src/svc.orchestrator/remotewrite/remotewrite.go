@@ -0,0 +1,119 @@
+package remotewrite
+
+import (
+	"clients"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+const (
+	labelMetricName = "__name__"
+	labelJob        = "job"
+	labelInstance   = "instance"
+	labelServiceID  = "service_id"
+
+	// MaxPayloadSize bounds the decompressed size of a remote-write payload
+	MaxPayloadSize = 32 << 20
+)
+
+// ErrInvalidPayload is returned for payloads which can not be decoded, they should not be retried
+var ErrInvalidPayload = errors.New("invalid remote-write payload")
+
+// Decode decompresses and unmarshals a snappy compressed remote-write payload
+func Decode(body []byte) (*WriteRequest, error) {
+	size, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidPayload, "invalid snappy block: %s", err)
+	}
+	if size > MaxPayloadSize {
+		return nil, errors.Wrapf(ErrInvalidPayload, "payload of %d bytes exceeds %d bytes", size, MaxPayloadSize)
+	}
+
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidPayload, "invalid snappy block: %s", err)
+	}
+
+	return unmarshal(data)
+}
+
+// DataPoints maps the samples of the request to data points, the metric being the __name__
+// label. The service is the service label, or else the job, and the service instance is
+// the service_id label, or else the instance. Since aggregations are keyed by metric and
+// service instance, the other labels are appended to the service id so that series which
+// only differ by them are aggregated apart, e.g. host:9100{code="500"}. Every label but
+// __name__ is kept in the labels of the data points.
+// Series without a name and NaN samples, such as staleness markers, are counted as dropped.
+func DataPoints(req *WriteRequest) ([]*clients.DataPoint, int) {
+	dataPoints := []*clients.DataPoint{}
+	dropped := 0
+
+	for _, ts := range req.Timeseries {
+		labels := make(map[string]string, len(ts.Labels))
+		for _, label := range ts.Labels {
+			labels[label.Name] = label.Value
+		}
+
+		metricID := labels[labelMetricName]
+		if len(metricID) == 0 {
+			dropped += len(ts.Samples)
+			continue
+		}
+		delete(labels, labelMetricName)
+
+		if _, ok := labels[clients.LabelService]; !ok && len(labels[labelJob]) > 0 {
+			labels[clients.LabelService] = labels[labelJob]
+		}
+		serviceID := seriesServiceID(labels)
+
+		for _, sample := range ts.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				dropped++
+				continue
+			}
+			dataPoints = append(dataPoints, &clients.DataPoint{
+				MetricID:  metricID,
+				ServiceID: serviceID,
+				TS:        time.Unix(0, sample.Timestamp*int64(time.Millisecond)).UTC(),
+				Value:     sample.Value,
+				Labels:    labels,
+			})
+		}
+	}
+
+	return dataPoints, dropped
+}
+
+func seriesServiceID(labels map[string]string) string {
+	serviceID, idLabel := labels[labelServiceID], labelServiceID
+	if len(serviceID) == 0 {
+		serviceID, idLabel = labels[labelInstance], labelInstance
+	}
+	if len(serviceID) == 0 {
+		serviceID, idLabel = labels[clients.LabelService], clients.LabelService
+	}
+
+	names := []string{}
+	for name := range labels {
+		switch name {
+		case idLabel, labelServiceID, labelInstance, labelJob, clients.LabelService:
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return serviceID
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"=\""+labels[name]+"\"")
+	}
+	return serviceID + "{" + strings.Join(pairs, ",") + "}"
+}
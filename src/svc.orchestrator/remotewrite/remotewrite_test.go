@@ -0,0 +1,162 @@
+package remotewrite
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// protobuf encoding of the remote-write messages, along with unknown fields
+
+func appendVarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func appendBytes(b []byte, number int, data []byte) []byte {
+	b = appendVarint(b, uint64(number<<3|wireBytes))
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendFixed64(b []byte, number int, v uint64) []byte {
+	b = appendVarint(b, uint64(number<<3|wireFixed64))
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return append(b, buf...)
+}
+
+func encodeLabel(name, value string) []byte {
+	return appendBytes(appendBytes(nil, 1, []byte(name)), 2, []byte(value))
+}
+
+func encodeSample(value float64, timestamp int64) []byte {
+	b := appendFixed64(nil, 1, math.Float64bits(value))
+	b = appendVarint(b, 2<<3|wireVarint)
+	return appendVarint(b, uint64(timestamp))
+}
+
+func encodeTimeSeries(labels []Label, samples []Sample) []byte {
+	b := []byte{}
+	for _, l := range labels {
+		b = appendBytes(b, 1, encodeLabel(l.Name, l.Value))
+	}
+	for _, s := range samples {
+		b = appendBytes(b, 2, encodeSample(s.Value, s.Timestamp))
+	}
+	return b
+}
+
+func TestDecode(t *testing.T) {
+	labels := []Label{{"__name__", "http_requests_total"}, {"job", "echo"}}
+	samples := []Sample{{Value: 1.5, Timestamp: 1704067200000}, {Value: -2, Timestamp: -1}}
+	series := encodeTimeSeries(labels, samples)
+
+	// unknown fields of every wire type, e.g. from newer protocol versions, are skipped
+	withUnknown := appendVarint(nil, 5<<3|wireVarint)
+	withUnknown = appendVarint(withUnknown, 300)
+	withUnknown = appendFixed64(withUnknown, 6, 42)
+	withUnknown = append(appendVarint(withUnknown, 7<<3|wireFixed32), 1, 2, 3, 4)
+	withUnknown = appendBytes(withUnknown, 3, []byte("metadata"))
+	withUnknown = appendBytes(withUnknown, 1, append(appendBytes(series, 3, []byte("exemplar")), appendBytes(nil, 1, appendBytes(encodeLabel("a", "b"), 9, nil))...))
+
+	oversized := appendVarint(nil, MaxPayloadSize+1)
+
+	tests := []struct {
+		name string
+		body []byte
+		want *WriteRequest
+	}{
+		{"valid", snappy.Encode(nil, appendBytes(appendBytes(nil, 1, series), 1, series)),
+			&WriteRequest{Timeseries: []TimeSeries{{labels, samples}, {labels, samples}}}},
+		{"empty", snappy.Encode(nil, nil), &WriteRequest{}},
+		{"unknown fields", snappy.Encode(nil, withUnknown),
+			&WriteRequest{Timeseries: []TimeSeries{{append(append([]Label{}, labels...), Label{"a", "b"}), samples}}}},
+		{"truncated varint key", snappy.Encode(nil, []byte{0x80}), nil},
+		{"truncated varint value", snappy.Encode(nil, []byte{5<<3 | wireVarint, 0x80, 0x80}), nil},
+		{"truncated timestamp", snappy.Encode(nil, appendBytes(nil, 1, appendBytes(nil, 2, []byte{2<<3 | wireVarint, 0xff}))), nil},
+		{"oversized length prefix", snappy.Encode(nil, appendVarint([]byte{1<<3 | wireBytes}, math.MaxUint64)), nil},
+		{"length past the end", snappy.Encode(nil, appendBytes(nil, 1, series)[:len(series)]), nil},
+		{"truncated fixed64", snappy.Encode(nil, []byte{6<<3 | wireFixed64, 1, 2, 3}), nil},
+		{"truncated fixed32", snappy.Encode(nil, []byte{7<<3 | wireFixed32, 1}), nil},
+		{"group wire type", snappy.Encode(nil, []byte{1<<3 | 3}), nil},
+		{"not snappy", []byte("not a snappy block"), nil},
+		{"corrupt snappy", append(appendVarint(nil, 16), 0xff, 0xff, 0xff), nil},
+		{"payload too large", append(oversized, 0), nil},
+	}
+
+	for _, test := range tests {
+		got, err := Decode(test.body)
+		if test.want == nil {
+			if errors.Cause(err) != ErrInvalidPayload {
+				t.Errorf("%s: got request=%+v err=%v, want ErrInvalidPayload", test.name, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got request=%+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDataPoints(t *testing.T) {
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ms := ts.UnixNano() / int64(time.Millisecond)
+	series := func(samples []Sample, labels ...string) TimeSeries {
+		s := TimeSeries{Samples: samples}
+		for i := 0; i < len(labels); i += 2 {
+			s.Labels = append(s.Labels, Label{labels[i], labels[i+1]})
+		}
+		return s
+	}
+	one := []Sample{{Value: 1, Timestamp: ms}}
+
+	dataPoints, dropped := DataPoints(&WriteRequest{Timeseries: []TimeSeries{
+		series(one, "__name__", "up", "job", "node", "instance", "host:9100"),
+		series(one, "__name__", "http_requests_total", "job", "echo", "instance", "host:8080", "code", "500", "method", "GET"),
+		series(one, "__name__", "queue", "service", "db", "job", "node", "service_id", "db-1", "instance", "host:9100"),
+		series(one, "__name__", "jobs", "job", "batch"),
+		series([]Sample{{Value: math.NaN(), Timestamp: ms}, {Value: math.Inf(1), Timestamp: ms}, {Value: 2, Timestamp: ms + 1000}},
+			"__name__", "up", "instance", "host:9100"),
+		// series without a name are dropped
+		series(one, "job", "node"),
+	}})
+
+	type point struct {
+		metricID, serviceID, service string
+		ts                           time.Time
+		value                        float64
+	}
+	want := []point{
+		{"up", "host:9100", "node", ts, 1},
+		{"http_requests_total", `host:8080{code="500",method="GET"}`, "echo", ts, 1},
+		{"queue", "db-1", "db", ts, 1},
+		{"jobs", "batch", "batch", ts, 1},
+		{"up", "host:9100", "", ts.Add(time.Second), 2},
+	}
+	got := []point{}
+	for _, dp := range dataPoints {
+		if _, ok := dp.Labels["__name__"]; ok {
+			t.Errorf("metric=%s: the __name__ label was kept", dp.MetricID)
+		}
+		got = append(got, point{dp.MetricID, dp.ServiceID, dp.Labels["service"], dp.TS, dp.Value})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got data points=%+v, want %+v", got, want)
+	}
+	if dropped != 3 {
+		t.Errorf("got dropped=%d, want 3", dropped)
+	}
+	if labels := dataPoints[1].Labels; labels["code"] != "500" || labels["instance"] != "host:8080" || labels["job"] != "echo" {
+		t.Errorf("got labels=%v, want every label but __name__", labels)
+	}
+}
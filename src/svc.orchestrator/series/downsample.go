@@ -0,0 +1,211 @@
+package series
+
+import (
+	"clients"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FuncMin   = "min"
+	FuncMax   = "max"
+	FuncAvg   = "avg"
+	FuncSum   = "sum"
+	FuncCount = "count"
+	FuncLast  = "last"
+)
+
+const (
+	FillNull     = "null"
+	FillPrevious = "previous"
+	FillLinear   = "linear"
+)
+
+// MaxPoints bounds the number of points of a downsampled series
+const MaxPoints = 10000
+
+// ErrInvalid is returned for downsampling options or functions which can not be applied
+var ErrInvalid = errors.New("invalid series request")
+
+// DownsampleOptions re-buckets the rows of [StartTS, EndTS) into Step wide buckets, combining
+// the rows of a bucket with Function and filling empty buckets according to Fill
+type DownsampleOptions struct {
+	StartTS  time.Time
+	EndTS    time.Time
+	Step     time.Duration
+	Function string
+	Fill     string
+}
+
+// Validate checks the options, defaulting the function to avg and the fill to null
+func (o *DownsampleOptions) Validate() error {
+	if o.Step < time.Second {
+		return errors.Wrapf(ErrInvalid, "step must be at least 1s")
+	}
+	if !o.StartTS.Before(o.EndTS) {
+		return errors.Wrapf(ErrInvalid, "start must be before end")
+	}
+	if o.EndTS.Sub(o.StartTS)/o.Step > MaxPoints {
+		return errors.Wrapf(ErrInvalid, "step=%s yields more than %d points", o.Step, MaxPoints)
+	}
+
+	switch o.Function {
+	case "":
+		o.Function = FuncAvg
+	case FuncMin, FuncMax, FuncAvg, FuncSum, FuncCount, FuncLast:
+	default:
+		return errors.Wrapf(ErrInvalid, "unknown function=%s", o.Function)
+	}
+
+	switch o.Fill {
+	case "":
+		o.Fill = FillNull
+	case FillNull, FillPrevious, FillLinear:
+	default:
+		return errors.Wrapf(ErrInvalid, "unknown fill=%s", o.Fill)
+	}
+
+	return nil
+}
+
+// StepForPoints returns the whole number of seconds splitting [startTS, endTS) into at most points buckets
+func StepForPoints(startTS, endTS time.Time, points int) (time.Duration, error) {
+	if points < 1 || points > MaxPoints {
+		return 0, errors.Wrapf(ErrInvalid, "points must be between 1 and %d", MaxPoints)
+	}
+
+	step := time.Duration(math.Ceil(endTS.Sub(startTS).Seconds()/float64(points))) * time.Second
+	if step < time.Second {
+		step = time.Second
+	}
+	return step, nil
+}
+
+// Downsample groups rows by service instance and returns one series per instance with a
+// point per step, ordered by service id
+func Downsample(rows []clients.Aggregation, opts DownsampleOptions) ([]clients.Series, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	numBuckets := int((opts.EndTS.Sub(opts.StartTS) + opts.Step - 1) / opts.Step)
+
+	buckets := make(map[string][][]clients.Aggregation)
+	labels := make(map[string]map[string]string)
+	for _, row := range rows {
+		if row.TS.Before(opts.StartTS) || !row.TS.Before(opts.EndTS) {
+			continue
+		}
+		if _, ok := buckets[row.ServiceID]; !ok {
+			buckets[row.ServiceID] = make([][]clients.Aggregation, numBuckets)
+			labels[row.ServiceID] = row.Labels
+		}
+		i := int(row.TS.Sub(opts.StartTS) / opts.Step)
+		buckets[row.ServiceID][i] = append(buckets[row.ServiceID][i], row)
+	}
+
+	result := make([]clients.Series, 0, len(buckets))
+	for serviceID, serviceBuckets := range buckets {
+		points := make([]clients.Point, numBuckets)
+		for i, bucket := range serviceBuckets {
+			points[i].TS = opts.StartTS.Add(time.Duration(i) * opts.Step)
+			if len(bucket) > 0 {
+				v := combine(bucket, opts.Function)
+				points[i].Value = &v
+			}
+		}
+		fill(points, opts.Fill)
+
+		result = append(result, clients.Series{
+			ServiceID: serviceID,
+			Labels:    labels[serviceID],
+			Points:    points,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].ServiceID < result[j].ServiceID })
+
+	return result, nil
+}
+
+// combine reduces the rows of a bucket to a single value, sum and count account for
+// every value behind the stored rows
+func combine(rows []clients.Aggregation, function string) float64 {
+	switch function {
+	case FuncMin:
+		v := rows[0].Min
+		for _, row := range rows[1:] {
+			v = math.Min(v, row.Min)
+		}
+		return v
+	case FuncMax:
+		v := rows[0].Max
+		for _, row := range rows[1:] {
+			v = math.Max(v, row.Max)
+		}
+		return v
+	case FuncLast:
+		last := rows[0]
+		for _, row := range rows[1:] {
+			if !row.TS.Before(last.TS) {
+				last = row
+			}
+		}
+		return last.Average
+	}
+
+	sum, count := 0.0, 0
+	for _, row := range rows {
+		n := row.NumValues
+		if n < 1 {
+			n = 1
+		}
+		sum += row.Average * float64(n)
+		count += n
+	}
+
+	switch function {
+	case FuncSum:
+		return sum
+	case FuncCount:
+		return float64(count)
+	default:
+		return sum / float64(count)
+	}
+}
+
+// fill replaces the null points according to the fill policy. Leading nulls, and trailing
+// ones for linear interpolation, are kept since there is nothing to fill them from.
+func fill(points []clients.Point, policy string) {
+	if policy == FillNull {
+		return
+	}
+
+	previous := -1
+	for i := range points {
+		if points[i].Value == nil {
+			continue
+		}
+
+		if previous >= 0 && i-previous > 1 {
+			for j := previous + 1; j < i; j++ {
+				v := *points[previous].Value
+				if policy == FillLinear {
+					v += (*points[i].Value - v) * float64(j-previous) / float64(i-previous)
+				}
+				points[j].Value = &v
+			}
+		}
+		previous = i
+	}
+
+	if policy == FillPrevious && previous >= 0 {
+		for j := previous + 1; j < len(points); j++ {
+			v := *points[previous].Value
+			points[j].Value = &v
+		}
+	}
+}
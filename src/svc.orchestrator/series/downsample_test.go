@@ -0,0 +1,160 @@
+package series
+
+import (
+	"clients"
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	testStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	null      = math.NaN()
+)
+
+func row(serviceID string, offset time.Duration, min, max, avg float64, count int) clients.Aggregation {
+	return clients.Aggregation{MetricID: "mem", ServiceID: serviceID, TS: testStart.Add(offset), Min: min, Max: max, Average: avg, NumValues: count}
+}
+
+// values returns the values of points, NaN standing for null
+func values(points []clients.Point) []float64 {
+	result := make([]float64, len(points))
+	for i, point := range points {
+		result[i] = null
+		if point.Value != nil {
+			result[i] = *point.Value
+		}
+	}
+	return result
+}
+
+func sameValues(got, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.IsNaN(got[i]) != math.IsNaN(want[i]) || (!math.IsNaN(want[i]) && math.Abs(got[i]-want[i]) > 1e-9) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDownsampleBuckets(t *testing.T) {
+	rows := []clients.Aggregation{
+		row("b", 0, 1, 1, 1, 1),
+		row("a", 0, 1, 3, 2, 2),
+		row("a", 59*time.Second, 0, 8, 4, 2),
+		row("a", time.Minute, 5, 5, 5, 1),
+		// outside of [start, end)
+		row("a", -time.Second, 9, 9, 9, 1),
+		row("a", 3*time.Minute, 9, 9, 9, 1),
+	}
+	opts := DownsampleOptions{StartTS: testStart, EndTS: testStart.Add(3 * time.Minute), Step: time.Minute}
+
+	result, err := Downsample(rows, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].ServiceID != "a" || result[1].ServiceID != "b" {
+		t.Fatalf("got series=%+v, want a and b", result)
+	}
+	for i, point := range result[0].Points {
+		if want := testStart.Add(time.Duration(i) * time.Minute); !point.TS.Equal(want) {
+			t.Errorf("point %d: got ts=%s, want %s", i, point.TS, want)
+		}
+	}
+
+	// the average is weighted by the values behind every row
+	for function, want := range map[string][]float64{
+		FuncAvg:   {3, 5, null},
+		FuncMin:   {0, 5, null},
+		FuncMax:   {8, 5, null},
+		FuncSum:   {12, 5, null},
+		FuncCount: {4, 1, null},
+		FuncLast:  {4, 5, null},
+	} {
+		opts.Function = function
+		result, err := Downsample(rows, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := values(result[0].Points); !sameValues(got, want) {
+			t.Errorf("fn=%s: got %v, want %v", function, got, want)
+		}
+	}
+
+	// a last partial bucket still gets a point
+	opts = DownsampleOptions{StartTS: testStart, EndTS: testStart.Add(90 * time.Second), Step: time.Minute}
+	if result, _ := Downsample(rows, opts); len(result[0].Points) != 2 {
+		t.Errorf("got %d points over 90s, want 2", len(result[0].Points))
+	}
+}
+
+func TestDownsampleFill(t *testing.T) {
+	rows := []clients.Aggregation{
+		row("a", time.Minute, 2, 2, 2, 1),
+		row("a", 4*time.Minute, 8, 8, 8, 1),
+	}
+
+	for policy, want := range map[string][]float64{
+		"":           {null, 2, null, null, 8, null},
+		FillNull:     {null, 2, null, null, 8, null},
+		FillPrevious: {null, 2, 2, 2, 8, 8},
+		FillLinear:   {null, 2, 4, 6, 8, null},
+	} {
+		opts := DownsampleOptions{StartTS: testStart, EndTS: testStart.Add(6 * time.Minute), Step: time.Minute, Fill: policy}
+		result, err := Downsample(rows, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := values(result[0].Points); !sameValues(got, want) {
+			t.Errorf("fill=%q: got %v, want %v", policy, got, want)
+		}
+	}
+}
+
+func TestDownsampleValidate(t *testing.T) {
+	for _, opts := range []DownsampleOptions{
+		{StartTS: testStart, EndTS: testStart.Add(time.Hour), Step: time.Millisecond},
+		{StartTS: testStart, EndTS: testStart, Step: time.Second},
+		{StartTS: testStart, EndTS: testStart.Add(time.Hour), Step: 100 * time.Millisecond},
+		{StartTS: testStart, EndTS: testStart.Add((MaxPoints + 1) * time.Second), Step: time.Second},
+		{StartTS: testStart, EndTS: testStart.Add(time.Hour), Step: time.Minute, Function: "median"},
+		{StartTS: testStart, EndTS: testStart.Add(time.Hour), Step: time.Minute, Fill: "zero"},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("options=%+v: got no error", opts)
+		}
+	}
+}
+
+func TestStepForPoints(t *testing.T) {
+	for _, test := range []struct {
+		rangeLength time.Duration
+		points      int
+		step        time.Duration
+		numPoints   int
+	}{
+		{time.Hour, 60, time.Minute, 60},
+		{1001 * time.Second, 500, 3 * time.Second, 334},
+		{10 * time.Second, 100, time.Second, 10},
+		{time.Hour, 1, time.Hour, 1},
+	} {
+		step, err := StepForPoints(testStart, testStart.Add(test.rangeLength), test.points)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numPoints := int((test.rangeLength + step - 1) / step)
+		if step != test.step || numPoints != test.numPoints || numPoints > test.points {
+			t.Errorf("range=%s points=%d: got step=%s and %d points, want step=%s and %d points", test.rangeLength,
+				test.points, step, numPoints, test.step, test.numPoints)
+		}
+	}
+
+	for _, points := range []int{0, MaxPoints + 1} {
+		if _, err := StepForPoints(testStart, testStart.Add(time.Hour), points); err == nil {
+			t.Errorf("points=%d: got no error", points)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package series
+
+import (
+	"clients"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Function derives new series from evenly spaced series with a point every step
+type Function func(series []clients.Series, step time.Duration) ([]clients.Series, error)
+
+// Pipeline is a chain of functions applied one after the other
+type Pipeline struct {
+	expr      string
+	functions []Function
+}
+
+// ParsePipeline parses functions separated by "|", e.g. "rate|moving_avg(5m)|sum_by(service)|topk(3)".
+// The supported functions are:
+//   - rate: per second rate of a counter, a drop is considered a counter reset
+//   - delta: difference with the previous point
+//   - moving_avg(window): average of the points in the trailing window, a duration or a number of points
+//   - sum_by(label), avg_by(label): combine the series sharing the value of label
+//   - topk(k): the k series with the highest mean
+func ParsePipeline(expr string) (*Pipeline, error) {
+	p := Pipeline{expr: expr}
+
+	for _, stage := range strings.Split(expr, "|") {
+		name, arg, err := splitStage(strings.TrimSpace(stage))
+		if err != nil {
+			return nil, err
+		}
+
+		var function Function
+		switch name {
+		case "rate":
+			function, err = noArg(name, arg, Rate)
+		case "delta":
+			function, err = noArg(name, arg, Delta)
+		case "moving_avg":
+			function, err = movingAvg(arg)
+		case "sum_by":
+			function, err = by(name, arg, sumValues)
+		case "avg_by":
+			function, err = by(name, arg, avgValues)
+		case "topk":
+			function, err = topK(arg)
+		default:
+			err = errors.Wrapf(ErrInvalid, "unknown function=%s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		p.functions = append(p.functions, function)
+	}
+
+	return &p, nil
+}
+
+// String returns the expression the pipeline was parsed from
+func (p *Pipeline) String() string {
+	return p.expr
+}
+
+// Apply runs the functions of the pipeline in order
+func (p *Pipeline) Apply(series []clients.Series, step time.Duration) ([]clients.Series, error) {
+	var err error
+	for _, function := range p.functions {
+		if series, err = function(series, step); err != nil {
+			return nil, err
+		}
+	}
+	return series, nil
+}
+
+// Rate returns the per second rate of counters, treating a decrease as a reset to zero
+func Rate(series []clients.Series, step time.Duration) ([]clients.Series, error) {
+	return mapPairs(series, func(previous, current float64) float64 {
+		if current < previous {
+			return current / step.Seconds()
+		}
+		return (current - previous) / step.Seconds()
+	}), nil
+}
+
+// Delta returns the difference of every point with the previous one
+func Delta(series []clients.Series, step time.Duration) ([]clients.Series, error) {
+	return mapPairs(series, func(previous, current float64) float64 {
+		return current - previous
+	}), nil
+}
+
+// mapPairs replaces every point by f of the previous and current values, points without
+// a previous value become null
+func mapPairs(series []clients.Series, f func(previous, current float64) float64) []clients.Series {
+	result := make([]clients.Series, 0, len(series))
+	for _, s := range series {
+		points := make([]clients.Point, len(s.Points))
+		for i, point := range s.Points {
+			points[i].TS = point.TS
+			if i == 0 || point.Value == nil || s.Points[i-1].Value == nil {
+				continue
+			}
+			v := f(*s.Points[i-1].Value, *point.Value)
+			points[i].Value = &v
+		}
+		result = append(result, clients.Series{ServiceID: s.ServiceID, Labels: s.Labels, Points: points})
+	}
+	return result
+}
+
+func movingAvg(arg string) (Function, error) {
+	if len(arg) == 0 {
+		return nil, errors.Wrapf(ErrInvalid, "moving_avg requires a window")
+	}
+
+	window, err := parseWindow(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(series []clients.Series, step time.Duration) ([]clients.Series, error) {
+		n := window.points
+		if window.duration > 0 {
+			n = int(window.duration / step)
+		}
+		if n < 1 {
+			return nil, errors.Wrapf(ErrInvalid, "moving_avg window=%s is shorter than the step=%s", arg, step)
+		}
+
+		result := make([]clients.Series, 0, len(series))
+		for _, s := range series {
+			points := make([]clients.Point, len(s.Points))
+			for i, point := range s.Points {
+				points[i].TS = point.TS
+
+				values := []float64{}
+				for j := i - n + 1; j <= i; j++ {
+					if j >= 0 && s.Points[j].Value != nil {
+						values = append(values, *s.Points[j].Value)
+					}
+				}
+				if len(values) > 0 {
+					v := avgValues(values)
+					points[i].Value = &v
+				}
+			}
+			result = append(result, clients.Series{ServiceID: s.ServiceID, Labels: s.Labels, Points: points})
+		}
+		return result, nil
+	}, nil
+}
+
+// by combines, point by point, the series sharing the same value of a label
+func by(name, label string, combine func([]float64) float64) (Function, error) {
+	if len(label) == 0 {
+		return nil, errors.Wrapf(ErrInvalid, "%s requires a label", name)
+	}
+
+	return func(series []clients.Series, step time.Duration) ([]clients.Series, error) {
+		groups := map[string][]clients.Series{}
+		for _, s := range series {
+			value := s.Labels[label]
+			groups[value] = append(groups[value], s)
+		}
+
+		result := make([]clients.Series, 0, len(groups))
+		for value, group := range groups {
+			points := make([]clients.Point, len(group[0].Points))
+			for i := range points {
+				points[i].TS = group[0].Points[i].TS
+
+				values := []float64{}
+				for _, s := range group {
+					if i < len(s.Points) && s.Points[i].Value != nil {
+						values = append(values, *s.Points[i].Value)
+					}
+				}
+				if len(values) > 0 {
+					v := combine(values)
+					points[i].Value = &v
+				}
+			}
+			result = append(result, clients.Series{Labels: map[string]string{label: value}, Points: points})
+		}
+
+		sort.Slice(result, func(i, j int) bool { return result[i].Labels[label] < result[j].Labels[label] })
+
+		return result, nil
+	}, nil
+}
+
+func topK(arg string) (Function, error) {
+	k, err := strconv.Atoi(arg)
+	if err != nil || k < 1 {
+		return nil, errors.Wrapf(ErrInvalid, "topk requires a positive number")
+	}
+
+	return func(series []clients.Series, step time.Duration) ([]clients.Series, error) {
+		means := make([]float64, len(series))
+		for i, s := range series {
+			values := []float64{}
+			for _, point := range s.Points {
+				if point.Value != nil {
+					values = append(values, *point.Value)
+				}
+			}
+			means[i] = math.Inf(-1)
+			if len(values) > 0 {
+				means[i] = avgValues(values)
+			}
+		}
+
+		indexes := make([]int, len(series))
+		for i := range indexes {
+			indexes[i] = i
+		}
+		sort.SliceStable(indexes, func(i, j int) bool { return means[indexes[i]] > means[indexes[j]] })
+
+		if k > len(indexes) {
+			k = len(indexes)
+		}
+		result := make([]clients.Series, 0, k)
+		for _, i := range indexes[:k] {
+			result = append(result, series[i])
+		}
+		return result, nil
+	}, nil
+}
+
+type window struct {
+	points   int
+	duration time.Duration
+}
+
+func parseWindow(arg string) (window, error) {
+	if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+		return window{points: n}, nil
+	}
+	if d, err := time.ParseDuration(arg); err == nil && d > 0 {
+		return window{duration: d}, nil
+	}
+	return window{}, errors.Wrapf(ErrInvalid, "invalid window=%s", arg)
+}
+
+// splitStage splits "name(arg)" into its name and argument
+func splitStage(stage string) (string, string, error) {
+	open := strings.Index(stage, "(")
+	if open < 0 {
+		if len(stage) == 0 {
+			return "", "", errors.Wrapf(ErrInvalid, "empty function")
+		}
+		return stage, "", nil
+	}
+	if !strings.HasSuffix(stage, ")") {
+		return "", "", errors.Wrapf(ErrInvalid, "missing ) in function=%s", stage)
+	}
+	return strings.TrimSpace(stage[:open]), strings.TrimSpace(stage[open+1 : len(stage)-1]), nil
+}
+
+func noArg(name, arg string, function Function) (Function, error) {
+	if len(arg) > 0 {
+		return nil, errors.Wrapf(ErrInvalid, "%s takes no argument", name)
+	}
+	return function, nil
+}
+
+func sumValues(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func avgValues(values []float64) float64 {
+	return sumValues(values) / float64(len(values))
+}
@@ -0,0 +1,141 @@
+package series
+
+import (
+	"clients"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newSeries returns a series with a point every minute from testStart, NaN values being null
+func newSeries(serviceID string, labels map[string]string, vs ...float64) clients.Series {
+	points := make([]clients.Point, len(vs))
+	for i, v := range vs {
+		points[i].TS = testStart.Add(time.Duration(i) * time.Minute)
+		if !math.IsNaN(v) {
+			value := v
+			points[i].Value = &value
+		}
+	}
+	return clients.Series{ServiceID: serviceID, Labels: labels, Points: points}
+}
+
+func applyPipeline(t *testing.T, expr string, series ...clients.Series) []clients.Series {
+	t.Helper()
+
+	p, err := ParsePipeline(expr)
+	if err != nil {
+		t.Fatalf("%s: %v", expr, err)
+	}
+	result, err := p.Apply(series, time.Minute)
+	if err != nil {
+		t.Fatalf("%s: %v", expr, err)
+	}
+	return result
+}
+
+func TestRateAndDelta(t *testing.T) {
+	// the counter is reset to zero between the third and fourth points
+	counter := newSeries("a", nil, 60, 120, 240, 60, null, 120)
+
+	for expr, want := range map[string][]float64{
+		"rate":  {null, 1, 2, 1, null, null},
+		"delta": {null, 60, 120, -180, null, null},
+	} {
+		result := applyPipeline(t, expr, counter)
+		if got := values(result[0].Points); !sameValues(got, want) {
+			t.Errorf("%s: got %v, want %v", expr, got, want)
+		}
+		if !result[0].Points[1].TS.Equal(counter.Points[1].TS) {
+			t.Errorf("%s: the timestamps were changed", expr)
+		}
+	}
+}
+
+func TestMovingAvg(t *testing.T) {
+	s := newSeries("a", nil, 1, 2, null, 6, 9)
+
+	for expr, want := range map[string][]float64{
+		// the first points average what they have, nulls are skipped
+		"moving_avg(2)":  {1, 1.5, 2, 6, 7.5},
+		"moving_avg(2m)": {1, 1.5, 2, 6, 7.5},
+		"moving_avg(3)":  {1, 1.5, 1.5, 4, 7.5},
+		"moving_avg(1)":  {1, 2, null, 6, 9},
+		// a window which is not a multiple of the step is truncated to whole points
+		"moving_avg(90s)": {1, 2, null, 6, 9},
+	} {
+		if got := values(applyPipeline(t, expr, s)[0].Points); !sameValues(got, want) {
+			t.Errorf("%s: got %v, want %v", expr, got, want)
+		}
+	}
+
+	p, _ := ParsePipeline("moving_avg(30s)")
+	if _, err := p.Apply([]clients.Series{s}, time.Minute); err == nil {
+		t.Error("moving_avg(30s) over 1m steps: got no error")
+	}
+}
+
+func TestSumAndAvgBy(t *testing.T) {
+	echo := map[string]string{"service": "echo"}
+	series := []clients.Series{
+		newSeries("echo-1", echo, 1, 2, null),
+		newSeries("echo-2", echo, 3, null, null),
+		newSeries("db-1", map[string]string{"service": "db"}, 10, 10, 10),
+	}
+
+	for expr, want := range map[string][][]float64{
+		"sum_by(service)": {{10, 10, 10}, {4, 2, null}},
+		"avg_by(service)": {{10, 10, 10}, {2, 2, null}},
+	} {
+		result := applyPipeline(t, expr, series...)
+		if len(result) != 2 || result[0].Labels["service"] != "db" || result[1].Labels["service"] != "echo" {
+			t.Fatalf("%s: got series=%+v, want db and echo", expr, result)
+		}
+		for i := range result {
+			if got := values(result[i].Points); !sameValues(got, want[i]) {
+				t.Errorf("%s %s: got %v, want %v", expr, result[i].Labels["service"], got, want[i])
+			}
+		}
+	}
+}
+
+func TestTopK(t *testing.T) {
+	series := []clients.Series{
+		newSeries("a", nil, 1, 3),
+		newSeries("b", nil, 5, null),
+		newSeries("c", nil, null, null),
+		newSeries("d", nil, 4, 4),
+		newSeries("e", nil, 2, 6),
+	}
+
+	// b, d and e have a mean of 4 and keep their order, c has no mean and is last
+	for expr, want := range map[string][]string{
+		"topk(1)":  {"b"},
+		"topk(2)":  {"b", "d"},
+		"topk(4)":  {"b", "d", "e", "a"},
+		"topk(10)": {"b", "d", "e", "a", "c"},
+	} {
+		got := []string{}
+		for _, s := range applyPipeline(t, expr, series...) {
+			got = append(got, s.ServiceID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestParsePipeline(t *testing.T) {
+	result := applyPipeline(t, " rate | sum_by(service) | topk(1) ", newSeries("a", map[string]string{"service": "echo"}, 0, 60))
+	if got := values(result[0].Points); !sameValues(got, []float64{null, 1}) {
+		t.Errorf("got %v, want [null 1]", got)
+	}
+
+	for _, expr := range []string{"", "rate|", "rate(1)", "moving_avg", "moving_avg(x)", "moving_avg(-1)",
+		"sum_by", "topk(0)", "topk(x)", "topk(3", "median"} {
+		if _, err := ParsePipeline(expr); err == nil {
+			t.Errorf("%q: got no error", expr)
+		}
+	}
+}
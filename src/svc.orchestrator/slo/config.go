@@ -0,0 +1,123 @@
+package slo
+
+import (
+	"clients"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+
+	"svc.orchestrator/query"
+
+	"github.com/pkg/errors"
+)
+
+// defaultWindow is the compliance window of SLOs which do not set one
+const defaultWindow = "30d"
+
+var (
+	// ErrInvalidConfig is returned for SLOs which fail validation
+	ErrInvalidConfig = errors.New("invalid slo config")
+	// ErrNotFound is returned for unknown SLOs
+	ErrNotFound = errors.New("slo not found")
+)
+
+// names are used in metric ids, so they are restricted to identifiers
+var namePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Config is the content of the slo config file
+type Config struct {
+	SLOs []clients.SLO `json:"slos"`
+}
+
+// slo is a validated SLO
+type slo struct {
+	clients.SLO
+	// objective is the fraction of good requests
+	objective float64
+	window    time.Duration
+	// bucket is the index in RequestLatencyBuckets of the latency bound, -1 without one
+	bucket int
+}
+
+// loadConfig reads the SLOs declared in the json file at path, there are none when it does
+// not exist
+func loadConfig(path string) (*Config, error) {
+	config := Config{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &config, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading slo config=%s", path)
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(ErrInvalidConfig, "Failed parsing slo config=%s: %s", path, err)
+	}
+
+	return &config, nil
+}
+
+func compileSLO(s clients.SLO) (*slo, error) {
+	compiled := slo{SLO: s, objective: s.Objective / 100, bucket: -1}
+	if len(compiled.Window) == 0 {
+		compiled.Window = defaultWindow
+	}
+
+	if !namePattern.MatchString(s.Name) {
+		return nil, errors.Wrapf(ErrInvalidConfig, "slo name=%q must be an identifier", s.Name)
+	}
+	if len(s.Service) == 0 {
+		return nil, errors.Wrapf(ErrInvalidConfig, "slo=%s: service is missing", s.Name)
+	}
+	if s.Objective <= 0 || s.Objective >= 100 {
+		return nil, errors.Wrapf(ErrInvalidConfig, "slo=%s: objective=%g must be within (0, 100)", s.Name, s.Objective)
+	}
+
+	window, err := query.ParseDuration(compiled.Window)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidConfig, "slo=%s: window=%q is not a valid duration", s.Name, s.Window)
+	}
+	compiled.window = window
+
+	if len(s.Latency) > 0 {
+		d, err := time.ParseDuration(s.Latency)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "slo=%s: latency=%q is not a valid duration", s.Name, s.Latency)
+		}
+		for i, bound := range clients.RequestLatencyBuckets {
+			if time.Duration(bound*float64(time.Second)) == d {
+				compiled.bucket = i
+			}
+		}
+		if compiled.bucket < 0 {
+			return nil, errors.Wrapf(ErrInvalidConfig, "slo=%s: latency=%s is not one of the request latency buckets %v",
+				s.Name, s.Latency, clients.RequestLatencyBuckets)
+		}
+	}
+
+	return &compiled, nil
+}
+
+// good counts the good requests among stats, either the successful ones or those which
+// succeeded within the latency bound
+func (s *slo) good(stats clients.RequestStats) int {
+	if s.bucket < 0 {
+		return stats.Requests - stats.Errors
+	}
+	if s.bucket >= len(stats.Latency) {
+		return 0
+	}
+	return stats.Latency[s.bucket]
+}
+
+func goodMetric(name string) string {
+	return "slo:" + name + ":good"
+}
+
+func totalMetric(name string) string {
+	return "slo:" + name + ":total"
+}
@@ -0,0 +1,284 @@
+package slo
+
+import (
+	"clients"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"svc.orchestrator/query"
+	"svc.orchestrator/storage"
+	"svc.orchestrator/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	labelSLO   = "slo"
+	labelRoute = "route"
+)
+
+// Manager turns the request counts reported by the sidecars into the good and total
+// request metrics of every SLO, which are rolled up along with the resource metrics, and
+// computes the error budgets and burn rates of the SLOs from them
+type Manager struct {
+	store storage.MetricsStore
+	sink  types.DataPointSink
+	tiers storage.RollupTiers
+	slos  []*slo
+	lock  *sync.RWMutex
+}
+
+// NewManager loads the SLOs declared in the json file at path, which does not need to exist
+func NewManager(store storage.MetricsStore, sink types.DataPointSink, tiers storage.RollupTiers, path string) (*Manager, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Manager{
+		store: store,
+		sink:  sink,
+		tiers: tiers,
+		lock:  &sync.RWMutex{},
+	}
+
+	names := map[string]bool{}
+	for _, s := range config.SLOs {
+		compiled, err := compileSLO(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid slo config=%s", path)
+		}
+		if names[s.Name] {
+			return nil, errors.Wrapf(ErrInvalidConfig, "Invalid slo config=%s: duplicate slo=%s", path, s.Name)
+		}
+		names[s.Name] = true
+		m.slos = append(m.slos, compiled)
+		store.AddRollupMetrics(goodMetric(s.Name), totalMetric(s.Name))
+	}
+
+	log.Printf("Loaded slos=%d from %s", len(m.slos), path)
+
+	return &m, nil
+}
+
+// ObserveRequests records the good and total requests of every SLO of the service, per instance
+func (m *Manager) ObserveRequests(serviceName string, stats []clients.RequestStats) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, s := range m.slos {
+		if s.Service != serviceName {
+			continue
+		}
+
+		good, total, ts := map[string]int{}, map[string]int{}, map[string]time.Time{}
+		for _, routeStats := range stats {
+			if len(s.Route) > 0 && routeStats.Route != s.Route {
+				continue
+			}
+			good[routeStats.ServiceID] += s.good(routeStats)
+			total[routeStats.ServiceID] += routeStats.Requests
+			ts[routeStats.ServiceID] = routeStats.TS
+		}
+
+		labels := s.labels()
+		for serviceID := range total {
+			m.sink.AddDataPoint(&clients.DataPoint{
+				MetricID:  goodMetric(s.Name),
+				ServiceID: serviceID,
+				TS:        ts[serviceID],
+				Value:     float64(good[serviceID]),
+				Labels:    labels,
+			})
+			m.sink.AddDataPoint(&clients.DataPoint{
+				MetricID:  totalMetric(s.Name),
+				ServiceID: serviceID,
+				TS:        ts[serviceID],
+				Value:     float64(total[serviceID]),
+				Labels:    labels,
+			})
+		}
+	}
+}
+
+// Status returns the state of every SLO, or of the named one, over its window
+func (m *Manager) Status(name string, now time.Time) ([]clients.SLOStatus, error) {
+	m.lock.RLock()
+	slos := m.slos
+	m.lock.RUnlock()
+
+	result := make([]clients.SLOStatus, 0, len(slos))
+	for _, s := range slos {
+		if len(name) > 0 && s.Name != name {
+			continue
+		}
+
+		status := clients.SLOStatus{
+			SLO:         s.SLO,
+			ErrorBudget: 1 - s.objective,
+			BurnRates:   map[string]*float64{},
+			EvaluatedAt: now,
+		}
+
+		var err error
+		if status.Good, status.Total, err = m.count(s, now.Add(-s.window), now); err != nil {
+			return nil, err
+		}
+		if status.Total > 0 {
+			sli := status.Good / status.Total
+			remaining := 1 - (1-sli)/status.ErrorBudget
+			status.SLI, status.BudgetRemaining = &sli, &remaining
+		}
+
+		for _, window := range clients.SLOBurnWindows {
+			d, _ := query.ParseDuration(window)
+			rate, ok, err := m.burnRate(s, d, now)
+			if err != nil {
+				return nil, err
+			}
+			status.BurnRates[window] = nil
+			if ok {
+				status.BurnRates[window] = &rate
+			}
+		}
+
+		result = append(result, status)
+	}
+
+	if len(name) > 0 && len(result) == 0 {
+		return nil, errors.Wrapf(ErrNotFound, "slo=%s", name)
+	}
+	return result, nil
+}
+
+// SLOLabels returns the labels identifying the SLO, ok being false when it does not exist
+func (m *Manager) SLOLabels(name string) (map[string]string, bool) {
+	s := m.get(name)
+	if s == nil {
+		return nil, false
+	}
+	return s.labels(), true
+}
+
+// BurnRate returns how fast the error budget of the SLO was spent over the window, 1 meaning
+// that it would be spent exactly by the end of the SLO window. ok is false when no request
+// was counted.
+func (m *Manager) BurnRate(name string, window time.Duration, now time.Time) (float64, bool, error) {
+	s := m.get(name)
+	if s == nil {
+		return 0, false, errors.Wrapf(ErrNotFound, "slo=%s", name)
+	}
+	return m.burnRate(s, window, now)
+}
+
+func (m *Manager) burnRate(s *slo, window time.Duration, now time.Time) (float64, bool, error) {
+	good, total, err := m.count(s, now.Add(-window), now)
+	if err != nil || total == 0 {
+		return 0, false, err
+	}
+	return (1 - good/total) / (1 - s.objective), true, nil
+}
+
+// count returns the good and total requests of the SLO in [startTS, endTS)
+func (m *Manager) count(s *slo, startTS, endTS time.Time) (float64, float64, error) {
+	good, err := m.sum(goodMetric(s.Name), s.Service, startTS, endTS)
+	if err != nil {
+		return 0, 0, err
+	}
+	total, err := m.sum(totalMetric(s.Name), s.Service, startTS, endTS)
+	if err != nil {
+		return 0, 0, err
+	}
+	return good, total, nil
+}
+
+// sum adds up the values of a metric over every instance of the service in [startTS, endTS).
+// The tier picked for the range holds the windows starting in it, so the window holding startTS
+// is added pro-rated to its part of the range. As the tier only holds finalized windows, the raw
+// rows following the last of them are added.
+func (m *Manager) sum(metricID, serviceName string, startTS, endTS time.Time) (float64, error) {
+	resp, err := m.store.GetStats(&storage.StatsQuery{
+		MetricID:    metricID,
+		ServiceName: serviceName,
+		StartTS:     startTS,
+		EndTS:       endTS,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	sum := sumRows(resp.Aggregations)
+	if resp.Tier == m.tiers.Raw().Table() {
+		return sum, nil
+	}
+
+	covered := startTS
+	resolution := time.Duration(resp.Resolution) * time.Second
+	if windowStart := time.Unix(startTS.Unix()/resp.Resolution*resp.Resolution, 0).UTC(); windowStart.Before(startTS) {
+		first, err := m.store.GetStats(&storage.StatsQuery{
+			MetricID:    metricID,
+			ServiceName: serviceName,
+			Resolution:  strconv.FormatInt(resp.Resolution, 10),
+			StartTS:     windowStart,
+			EndTS:       startTS,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if len(first.Aggregations) > 0 {
+			covered = windowStart.Add(resolution)
+			sum += sumRows(first.Aggregations) * float64(covered.Sub(startTS)) / float64(resolution)
+		}
+	}
+	for _, row := range resp.Aggregations {
+		if windowEnd := row.TS.Add(resolution); windowEnd.After(covered) {
+			covered = windowEnd
+		}
+	}
+	if !covered.Before(endTS) {
+		return sum, nil
+	}
+
+	raw, err := m.store.GetStats(&storage.StatsQuery{
+		MetricID:    metricID,
+		ServiceName: serviceName,
+		Resolution:  "raw",
+		StartTS:     covered,
+		EndTS:       endTS,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sum + sumRows(raw.Aggregations), nil
+}
+
+func (m *Manager) get(name string) *slo {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, s := range m.slos {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *slo) labels() map[string]string {
+	labels := map[string]string{clients.LabelService: s.Service, labelSLO: s.Name}
+	if len(s.Route) > 0 {
+		labels[labelRoute] = s.Route
+	}
+	return labels
+}
+
+// sumRows adds up the values behind rows, the averages being weighted by their number
+func sumRows(rows []clients.Aggregation) float64 {
+	sum := 0.0
+	for _, row := range rows {
+		sum += row.Average * float64(row.NumValues)
+	}
+	return sum
+}
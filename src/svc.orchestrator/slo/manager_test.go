@@ -0,0 +1,140 @@
+package slo
+
+import (
+	"clients"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"svc.orchestrator/storage"
+)
+
+// recordingSink records the data points added to it
+type recordingSink struct {
+	dataPoints []*clients.DataPoint
+}
+
+func (s *recordingSink) AddDataPoint(dp *clients.DataPoint) {
+	s.dataPoints = append(s.dataPoints, dp)
+}
+
+func newTestManager(t *testing.T, store storage.MetricsStore, sink *recordingSink, slos ...clients.SLO) *Manager {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "slo.json")
+	data, _ := json.Marshal(Config{SLOs: slos})
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(store, sink, storage.DefaultRollupTiers(), path)
+	if err != nil {
+		t.Fatalf("Failed creating the slo manager: %+v", err)
+	}
+	return m
+}
+
+func sloRow(metricID string, ts time.Time, count int) clients.Aggregation {
+	return clients.Aggregation{MetricID: metricID, ServiceID: "echo-1", TS: ts, Labels: map[string]string{clients.LabelService: "echo"},
+		Min: 1, Max: 1, Average: 1, NumValues: count}
+}
+
+// TestBurnRate checks the burn rate over a day, which is read from the 5m tier: the window
+// holding the start of the day counts for its part in the day, and the raw rows which were not
+// rolled up yet are added
+func TestBurnRate(t *testing.T) {
+	store := storage.NewMemoryStore(storage.DefaultRollupTiers())
+	m := newTestManager(t, store, &recordingSink{}, clients.SLO{Name: "echo_ok", Service: "echo", Objective: 99})
+
+	// the day starts halfway through a window
+	window := 5 * time.Minute
+	now := time.Now().UTC().Add(-time.Hour).Truncate(window).Add(window / 2)
+	first := now.Add(-24 * time.Hour).Truncate(window)
+
+	rollups := []clients.Aggregation{
+		sloRow(goodMetric("echo_ok"), first, 90), sloRow(totalMetric("echo_ok"), first, 100),
+		sloRow(goodMetric("echo_ok"), first.Add(window), 100), sloRow(totalMetric("echo_ok"), first.Add(window), 100),
+	}
+	raw := []clients.Aggregation{
+		// rolled up already
+		sloRow(goodMetric("echo_ok"), first.Add(window+time.Minute), 100), sloRow(totalMetric("echo_ok"), first.Add(window+time.Minute), 100),
+		sloRow(goodMetric("echo_ok"), now.Add(-time.Minute), 50), sloRow(totalMetric("echo_ok"), now.Add(-time.Minute), 50),
+	}
+	if _, err := store.Import("rollups300", rollups); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Import(storage.DefaultRollupTiers().Raw().Table(), raw); err != nil {
+		t.Fatal(err)
+	}
+
+	// good=45+100+50 and total=50+100+50, spending 2.5% of the requests for a 1% budget
+	rate, ok, err := m.BurnRate("echo_ok", 24*time.Hour, now)
+	if err != nil || !ok {
+		t.Fatalf("got ok=%t err=%v, want a burn rate", ok, err)
+	}
+	if math.Abs(rate-2.5) > 1e-9 {
+		t.Errorf("got burn rate=%g, want 2.5", rate)
+	}
+
+	if _, ok, err := m.BurnRate("echo_ok", time.Hour, now.Add(-2*time.Hour)); ok || err != nil {
+		t.Errorf("got ok=%t err=%v without requests, want no burn rate", ok, err)
+	}
+	if _, _, err := m.BurnRate("nope", time.Hour, now); errors.Cause(err) != ErrNotFound {
+		t.Errorf("got err=%v, want ErrNotFound", err)
+	}
+}
+
+// TestObserveRequests checks that the requests of the SLO routes are counted per instance, the
+// good ones being those within the latency bound
+func TestObserveRequests(t *testing.T) {
+	sink := &recordingSink{}
+	m := newTestManager(t, storage.NewMemoryStore(storage.DefaultRollupTiers()), sink,
+		clients.SLO{Name: "echo_fast", Service: "echo", Route: "/echo", Objective: 99.9, Latency: "200ms"})
+
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	latency := func(within200ms int) []int {
+		buckets := make([]int, len(clients.RequestLatencyBuckets))
+		buckets[5] = within200ms
+		return buckets
+	}
+	m.ObserveRequests("db", []clients.RequestStats{{TS: ts, ServiceID: "db-1", Route: "/echo", Requests: 5, Latency: latency(5)}})
+	m.ObserveRequests("echo", []clients.RequestStats{
+		{TS: ts, ServiceID: "echo-1", Route: "/echo", Requests: 10, Errors: 1, Latency: latency(7)},
+		{TS: ts, ServiceID: "echo-1", Route: "/health", Requests: 20, Latency: latency(20)},
+	})
+
+	labels := map[string]string{clients.LabelService: "echo", labelSLO: "echo_fast", labelRoute: "/echo"}
+	want := []*clients.DataPoint{
+		{MetricID: "slo:echo_fast:good", ServiceID: "echo-1", TS: ts, Value: 7, Labels: labels},
+		{MetricID: "slo:echo_fast:total", ServiceID: "echo-1", TS: ts, Value: 10, Labels: labels},
+	}
+	if !reflect.DeepEqual(sink.dataPoints, want) {
+		t.Errorf("got data points=%+v, want %+v", sink.dataPoints, want)
+	}
+}
+
+func TestCompileSLO(t *testing.T) {
+	for _, s := range []clients.SLO{
+		{Name: "echo-ok", Service: "echo", Objective: 99},
+		{Name: "echo_ok", Objective: 99},
+		{Name: "echo_ok", Service: "echo", Objective: 100},
+		{Name: "echo_ok", Service: "echo", Objective: 99, Window: "a month"},
+		{Name: "echo_ok", Service: "echo", Objective: 99, Latency: "150ms"},
+	} {
+		if _, err := compileSLO(s); errors.Cause(err) != ErrInvalidConfig {
+			t.Errorf("slo=%+v: got err=%v, want ErrInvalidConfig", s, err)
+		}
+	}
+
+	compiled, err := compileSLO(clients.SLO{Name: "echo_ok", Service: "echo", Objective: 99.5, Latency: "250ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compiled.window != 30*24*time.Hour || compiled.bucket != 6 || math.Abs(compiled.objective-0.995) > 1e-9 {
+		t.Errorf("got window=%s bucket=%d objective=%g, want 30d, 6 and 0.995", compiled.window, compiled.bucket, compiled.objective)
+	}
+}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"clients"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// backfillChunkWindows is the number of windows recomputed per read of the source tier
+	backfillChunkWindows = 100
+	// maxBackfillRowsPerSecond throttles the rows read and written by a backfill
+	maxBackfillRowsPerSecond = 500
+	// maxBackfillWindows bounds the time range of a single backfill
+	maxBackfillWindows = 100000
+	// maxBackfillJobs is the number of backfills kept for their status, the oldest finished
+	// ones being dropped first
+	maxBackfillJobs = 20
+)
+
+var (
+	// ErrInvalidBackfill is returned for backfill requests which can not be run
+	ErrInvalidBackfill = errors.New("invalid backfill request")
+	// ErrBackfillRunning is returned while another backfill is in progress
+	ErrBackfillRunning = errors.New("a backfill is already running")
+	// ErrBackfillNotFound is returned for the status of unknown backfills
+	ErrBackfillNotFound = errors.New("backfill not found")
+	// ErrBackfillStopped is the error of the backfills interrupted by StopRollup
+	ErrBackfillStopped = errors.New("backfill stopped")
+)
+
+// backfillJobs runs the backfills of a store in the background, a single one at a time on top
+// of the rate limit of each backfill, and keeps the last ones for their status
+type backfillJobs struct {
+	backend rollupBackend
+	tiers   *tierSet
+	metrics *rolledUpMetrics
+	// jobs are ordered by start, the running one being the last
+	jobs    []*clients.BackfillJob
+	lock    *sync.Mutex
+	done    chan struct{}
+	stopped bool
+	running *sync.WaitGroup
+}
+
+func newBackfillJobs(backend rollupBackend, tiers *tierSet, metrics *rolledUpMetrics) *backfillJobs {
+	return &backfillJobs{
+		backend: backend,
+		tiers:   tiers,
+		metrics: metrics,
+		lock:    &sync.Mutex{},
+		done:    make(chan struct{}),
+		running: &sync.WaitGroup{},
+	}
+}
+
+// StartBackfill validates req and starts recomputing its windows in the background
+func (b *backfillJobs) StartBackfill(req *clients.BackfillRequest) (*clients.BackfillJob, error) {
+	plan, err := planBackfill(b.tiers.get(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.stopped {
+		return nil, ErrBackfillStopped
+	}
+	if n := len(b.jobs); n > 0 && b.jobs[n-1].Status == clients.BackfillRunning {
+		return nil, errors.Wrapf(ErrBackfillRunning, "backfill=%s", b.jobs[n-1].ID)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	job := &clients.BackfillJob{
+		ID:        hex.EncodeToString(id),
+		Status:    clients.BackfillRunning,
+		Request:   *req,
+		Windows:   plan.windows(),
+		StartedAt: time.Now().UTC(),
+	}
+	b.jobs = append(b.jobs, job)
+	if len(b.jobs) > maxBackfillJobs {
+		b.jobs = b.jobs[len(b.jobs)-maxBackfillJobs:]
+	}
+
+	b.running.Add(1)
+	go b.run(job.ID, plan)
+
+	started := *job
+	return &started, nil
+}
+
+// BackfillJob returns the status of the backfill id
+func (b *backfillJobs) BackfillJob(id string) (*clients.BackfillJob, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, job := range b.jobs {
+		if job.ID == id {
+			status := *job
+			return &status, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrBackfillNotFound, "backfill=%s", id)
+}
+
+// stopBackfills interrupts the running backfill between two chunks and waits for it
+func (b *backfillJobs) stopBackfills() {
+	b.lock.Lock()
+	b.stopped = true
+	b.lock.Unlock()
+
+	close(b.done)
+	b.running.Wait()
+}
+
+// run runs the backfill id and then rewinds the tiers rolled up from the backfilled tier to the
+// start of the backfill, so that they are computed again from the rows which changed
+func (b *backfillJobs) run(id string, plan *backfillPlan) {
+	defer b.running.Done()
+
+	resp, err := runBackfill(b.backend, plan, b.done, func(windowsDone int) {
+		b.update(id, func(job *clients.BackfillJob) { job.WindowsDone = windowsDone })
+	})
+	if err == nil && !plan.req.DryRun && resp.Inserted+resp.Updated > 0 {
+		if err = rewindRollups(b.backend, b.tiers.get(), b.metrics, plan.tier, plan.req.MetricID, plan.startTS); err != nil {
+			err = errors.Wrapf(err, "Failed to rewind the rollups of %s", plan.tier.Table())
+		}
+	}
+
+	b.update(id, func(job *clients.BackfillJob) {
+		finishedAt := time.Now().UTC()
+		job.FinishedAt = &finishedAt
+		if err != nil {
+			log.Printf("Failed backfill=%s of %s metric=%s! err=%s", id, plan.tier.Table(), plan.req.MetricID, err.Error())
+			job.Status, job.Error = clients.BackfillFailed, err.Error()
+			return
+		}
+		job.Status, job.Result = clients.BackfillSucceeded, resp
+	})
+}
+
+func (b *backfillJobs) update(id string, fn func(job *clients.BackfillJob)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, job := range b.jobs {
+		if job.ID == id {
+			fn(job)
+			return
+		}
+	}
+}
+
+// backfillPlan is a validated backfill request, its range being aligned on the windows of tier
+type backfillPlan struct {
+	req     clients.BackfillRequest
+	tier    RollupTier
+	startTS time.Time
+	endTS   time.Time
+}
+
+func (p *backfillPlan) windows() int {
+	return int(p.endTS.Sub(p.startTS) / p.tier.Resolution.Duration())
+}
+
+// planBackfill validates req against the tiers
+func planBackfill(tiers RollupTiers, req *clients.BackfillRequest) (*backfillPlan, error) {
+	tier, ok := tiers.Get(req.Tier)
+	if !ok || tier.IsRaw() {
+		return nil, errors.Wrapf(ErrInvalidBackfill, "unknown rollup tier=%s", req.Tier)
+	}
+	if len(req.MetricID) == 0 {
+		return nil, errors.Wrapf(ErrInvalidBackfill, "metric is missing")
+	}
+
+	interval := tier.Interval()
+	resolution := tier.Resolution.Duration()
+	plan := backfillPlan{
+		req:     *req,
+		tier:    tier,
+		startTS: alignWindow(req.StartTS, interval),
+		endTS:   alignWindow(req.EndTS.Add(resolution-time.Second), interval),
+	}
+	if !plan.startTS.Before(plan.endTS) {
+		return nil, errors.Wrapf(ErrInvalidBackfill, "empty time range")
+	}
+	if plan.endTS.Sub(plan.startTS) > maxBackfillWindows*resolution {
+		return nil, errors.Wrapf(ErrInvalidBackfill, "time range exceeds %d windows of %s", maxBackfillWindows, tier.Table())
+	}
+	return &plan, nil
+}
+
+// runBackfill recomputes the windows of the plan from the source tier and upserts the rows
+// which differ from the stored ones, calling progress with the windows done after each chunk.
+// It stops between two chunks once done is closed. Checkpoints are left to the caller.
+func runBackfill(backend rollupBackend, plan *backfillPlan, done chan struct{}, progress func(windowsDone int)) (*clients.BackfillResponse, error) {
+	req, tier := plan.req, plan.tier
+	interval := tier.Interval()
+	resolution := tier.Resolution.Duration()
+
+	log.Printf("Backfilling %s metric=%s service=%s range=[%s, %s) dry-run=%t", tier.Table(), req.MetricID,
+		req.ServiceID, plan.startTS.Format(time.RFC3339), plan.endTS.Format(time.RFC3339), req.DryRun)
+
+	resp := clients.BackfillResponse{
+		Tier:     tier.Table(),
+		MetricID: req.MetricID,
+		StartTS:  plan.startTS,
+		EndTS:    plan.endTS,
+		DryRun:   req.DryRun,
+		Changes:  []clients.BackfillChange{},
+	}
+
+	throttle := newThrottle(maxBackfillRowsPerSecond)
+	windowsDone := 0
+	for chunkStart := plan.startTS; chunkStart.Before(plan.endTS); chunkStart = chunkStart.Add(backfillChunkWindows * resolution) {
+		select {
+		case <-done:
+			return nil, errors.Wrapf(ErrBackfillStopped, "after %d windows", windowsDone)
+		default:
+		}
+
+		chunkEnd := chunkStart.Add(backfillChunkWindows * resolution)
+		if chunkEnd.After(plan.endTS) {
+			chunkEnd = plan.endTS
+		}
+
+		source, err := backend.selectTier(tier.Source, req.MetricID, chunkStart, chunkEnd)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := backend.selectTier(tier.Table(), req.MetricID, chunkStart, chunkEnd)
+		if err != nil {
+			return nil, err
+		}
+		throttle.wait(len(source) + len(stored))
+
+		storedRows := make(map[string]clients.Aggregation)
+		for _, row := range filterService(stored, req.ServiceID) {
+			storedRows[backfillKey(row)] = row
+		}
+
+		changed := []*clients.Aggregation{}
+		for _, agg := range rollupWindows(req.MetricID, interval, filterService(source, req.ServiceID)) {
+			change := clients.BackfillChange{Recomputed: *agg}
+			if row, ok := storedRows[backfillKey(*agg)]; !ok {
+				change.Action = clients.BackfillInsert
+				resp.Inserted++
+			} else if !sameAggregation(row, *agg) {
+				change.Action = clients.BackfillUpdate
+				change.Stored = &row
+				resp.Updated++
+			} else {
+				resp.Unchanged++
+				continue
+			}
+
+			if len(resp.Changes) < clients.MaxBackfillChanges {
+				resp.Changes = append(resp.Changes, change)
+			} else {
+				resp.Truncated = true
+			}
+			changed = append(changed, agg)
+		}
+
+		if !req.DryRun && len(changed) > 0 {
+			if err := backend.storeRollups(tier, changed); err != nil {
+				return nil, errors.Wrapf(err, "Failed storing backfill of %s", tier.Table())
+			}
+			throttle.wait(len(changed))
+		}
+
+		windowsDone += int(chunkEnd.Sub(chunkStart) / resolution)
+		progress(windowsDone)
+	}
+
+	log.Printf("Backfilled %s metric=%s inserted=%d updated=%d unchanged=%d dry-run=%t", tier.Table(),
+		req.MetricID, resp.Inserted, resp.Updated, resp.Unchanged, req.DryRun)
+
+	return &resp, nil
+}
+
+func filterService(rows []clients.Aggregation, serviceID string) []clients.Aggregation {
+	if len(serviceID) == 0 {
+		return rows
+	}
+
+	result := make([]clients.Aggregation, 0, len(rows))
+	for _, row := range rows {
+		if row.ServiceID == serviceID {
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+func backfillKey(agg clients.Aggregation) string {
+	return getAggregationKey(agg.ServiceID, agg.TS.UTC().Format(time.RFC3339))
+}
+
+// sameAggregation compares two rows, ignoring the rounding of the stored floats
+func sameAggregation(a, b clients.Aggregation) bool {
+	const epsilon = 1e-9
+	same := func(x, y float64) bool {
+		return math.Abs(x-y) <= epsilon*math.Max(1, math.Max(math.Abs(x), math.Abs(y)))
+	}
+	return same(a.Min, b.Min) && same(a.Max, b.Max) && same(a.Average, b.Average) && a.NumValues == b.NumValues
+}
+
+// throttle spaces out work so that no more than rate units are done per second
+type throttle struct {
+	rate  int
+	start time.Time
+	done  int
+}
+
+func newThrottle(rate int) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+func (t *throttle) wait(units int) {
+	t.done += units
+	expected := time.Duration(float64(t.done) / float64(t.rate) * float64(time.Second))
+	if elapsed := time.Since(t.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
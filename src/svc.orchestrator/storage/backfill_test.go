@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"clients"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// insertRaw inserts a raw row of metricID every resolution from startTS
+func insertRaw(t *testing.T, store MetricsStore, metricID string, startTS time.Time, resolution time.Duration, n int) {
+	aggs := map[string]*clients.Aggregation{}
+	for i := 0; i < n; i++ {
+		ts := startTS.Add(time.Duration(i) * resolution)
+		aggs[fmt.Sprint(i)] = &clients.Aggregation{MetricID: metricID, ServiceID: "echo-1", TS: ts, Min: 1, Max: 3, Average: 2, NumValues: 1}
+	}
+	if err := store.InsertAggregations(aggs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitBackfill(t *testing.T, store MetricsStore, id string) *clients.BackfillJob {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := store.BackfillJob(id)
+		if err != nil {
+			t.Fatalf("Failed getting backfill=%s: %v", id, err)
+		}
+		if job.Status != clients.BackfillRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("backfill=%s did not finish", id)
+	return nil
+}
+
+func TestBackfillJob(t *testing.T) {
+	store := NewMemoryStore(DefaultRollupTiers())
+	defer store.StopRollup()
+	startTS := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	insertRaw(t, store, MetricMemory, startTS, time.Minute, 60)
+
+	req := &clients.BackfillRequest{Tier: rollup300Table, MetricID: MetricMemory, StartTS: startTS, EndTS: startTS.Add(time.Hour)}
+	job, err := store.StartBackfill(req)
+	if err != nil {
+		t.Fatalf("Failed starting backfill: %v", err)
+	}
+	if job.Status != clients.BackfillRunning || job.Windows != 12 {
+		t.Fatalf("got job=%+v, want a running backfill of 12 windows", job)
+	}
+
+	job = waitBackfill(t, store, job.ID)
+	if job.Status != clients.BackfillSucceeded || job.WindowsDone != 12 || job.Result == nil || job.FinishedAt == nil {
+		t.Fatalf("got job=%+v, want a backfill of 12 windows which succeeded", job)
+	}
+	if job.Result.Inserted != 12 || len(job.Result.Changes) != 12 || job.Result.Truncated {
+		t.Fatalf("got result=%+v, want 12 inserted windows", job.Result)
+	}
+
+	job, err = store.StartBackfill(req)
+	if err != nil {
+		t.Fatalf("Failed starting backfill: %v", err)
+	}
+	if job = waitBackfill(t, store, job.ID); job.Result.Unchanged != 12 || len(job.Result.Changes) != 0 {
+		t.Fatalf("got result=%+v, want 12 unchanged windows", job.Result)
+	}
+
+	if _, err := store.BackfillJob("nope"); errors.Cause(err) != ErrBackfillNotFound {
+		t.Fatalf("got err=%v, want ErrBackfillNotFound", err)
+	}
+	for _, invalid := range []*clients.BackfillRequest{
+		{Tier: metricsTable, MetricID: MetricMemory, StartTS: startTS, EndTS: startTS.Add(time.Hour)},
+		{Tier: rollup300Table, StartTS: startTS, EndTS: startTS.Add(time.Hour)},
+		{Tier: rollup300Table, MetricID: MetricMemory, StartTS: startTS, EndTS: startTS},
+		{Tier: rollup300Table, MetricID: MetricMemory, StartTS: startTS, EndTS: startTS.Add(maxBackfillWindows * 6 * time.Minute)},
+	} {
+		if _, err := store.StartBackfill(invalid); errors.Cause(err) != ErrInvalidBackfill {
+			t.Errorf("request=%+v: got err=%v, want ErrInvalidBackfill", invalid, err)
+		}
+	}
+}
+
+// TestBackfillDryRunTruncatesChanges checks that a dry run lists at most MaxBackfillChanges
+// changes, and that a second backfill is rejected while it runs
+func TestBackfillDryRunTruncatesChanges(t *testing.T) {
+	store := NewMemoryStore(DefaultRollupTiers())
+	defer store.StopRollup()
+	windows := clients.MaxBackfillChanges + 100
+	startTS := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	insertRaw(t, store, MetricMemory, startTS, 5*time.Minute, windows)
+
+	req := &clients.BackfillRequest{Tier: rollup300Table, MetricID: MetricMemory, StartTS: startTS,
+		EndTS: startTS.Add(time.Duration(windows) * 5 * time.Minute), DryRun: true}
+	job, err := store.StartBackfill(req)
+	if err != nil {
+		t.Fatalf("Failed starting backfill: %v", err)
+	}
+	if _, err := store.StartBackfill(req); errors.Cause(err) != ErrBackfillRunning {
+		t.Fatalf("got err=%v, want ErrBackfillRunning", err)
+	}
+
+	job = waitBackfill(t, store, job.ID)
+	if job.Status != clients.BackfillSucceeded {
+		t.Fatalf("got job=%+v, want a backfill which succeeded", job)
+	}
+	if job.Result.Inserted != windows || len(job.Result.Changes) != clients.MaxBackfillChanges || !job.Result.Truncated {
+		t.Fatalf("got inserted=%d changes=%d truncated=%t, want inserted=%d changes=%d truncated", job.Result.Inserted,
+			len(job.Result.Changes), job.Result.Truncated, windows, clients.MaxBackfillChanges)
+	}
+	if rows, _ := store.selectTier(rollup300Table, MetricMemory, startTS, req.EndTS); len(rows) != 0 {
+		t.Fatalf("the dry run wrote %d rows", len(rows))
+	}
+}
+
+// TestBackfillRewindsCascadingTiers checks that the tiers rolled up from a backfilled tier are
+// rewound to the start of the backfill, unless it was a dry run
+func TestBackfillRewindsCascadingTiers(t *testing.T) {
+	store := NewMemoryStore(DefaultRollupTiers())
+	defer store.StopRollup()
+	startTS := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	insertRaw(t, store, MetricMemory, startTS, time.Minute, 60)
+
+	checkpoint := startTS.Add(48 * time.Hour)
+	cascading := []string{rollupTable(7200), rollupTable(86400)}
+	for _, table := range cascading {
+		store.setCheckpoint(table, MetricMemory, checkpoint)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		req := &clients.BackfillRequest{Tier: rollup300Table, MetricID: MetricMemory, StartTS: startTS, EndTS: startTS.Add(time.Hour), DryRun: dryRun}
+		job, err := store.StartBackfill(req)
+		if err != nil {
+			t.Fatalf("Failed starting backfill: %v", err)
+		}
+		if job = waitBackfill(t, store, job.ID); job.Status != clients.BackfillSucceeded {
+			t.Fatalf("got job=%+v, want a backfill which succeeded", job)
+		}
+
+		for _, table := range cascading {
+			tier, _ := store.tiers.get().Get(table)
+			want := alignWindow(startTS, tier.Interval())
+			if dryRun {
+				want = checkpoint
+			}
+			if got, _, _ := store.getCheckpoint(table, MetricMemory); !got.Equal(want) {
+				t.Errorf("dry-run=%t %s: got checkpoint=%s, want %s", dryRun, table, got, want)
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"clients"
 	"fmt"
 	"log"
+	"metrics"
 	"sync"
 	"time"
 
@@ -13,12 +14,13 @@ import (
 
 // https://www.datastax.com/blog/2012/05/metric-collection-and-storage-cassandra
 
+// %s is filled in with the table of the rollup tier
 const (
-	insertDataPointStmt = "INSERT INTO metrics (metric_id, ts, service_id, min, max, avg) VALUES (?, ?, ?, ?, ?, ?)"
-	selectDataPointStmt = "SELECT ts, service_id, min, max, avg FROM metrics WHERE metric_id = ? AND ts > ?"
-	insertRollup120Stmt = "INSERT INTO rollups120 (metric_id, ts, service_id, min, max, avg) VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS"
-	insertRollup300Stmt = "INSERT INTO rollups300 (metric_id, ts, service_id, min, max, avg) VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS"
-	selectRollup300Stmt = "SELECT metric_id, ts, service_id, min, max, avg FROM rollups300 WHERE metric_id = ? AND ts >= ?"
+	insertDataPointStmt  = "INSERT INTO %s (metric_id, ts, service_id, min, max, avg, sum, count, labels) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?"
+	selectDataPointStmt  = "SELECT ts, service_id, min, max, avg, count, labels FROM %s WHERE metric_id = ? AND ts >= ? AND ts < ?"
+	insertRollupStmt     = "INSERT INTO %s (metric_id, ts, service_id, min, max, avg, sum, count, labels) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?"
+	selectCheckpointStmt = "SELECT checkpoint FROM rollup_checkpoints WHERE tier = ? AND metric_id = ?"
+	insertCheckpointStmt = "INSERT INTO rollup_checkpoints (tier, metric_id, checkpoint) VALUES (?, ?, ?)"
 )
 
 const (
@@ -30,18 +32,44 @@ const (
 
 var resourceMetrics = []string{MetricCPU, MetricMemory, MetricThreads, MetricNumGoroutine}
 
+// ResourceMetrics returns the metrics reported in every heartbeat
+func ResourceMetrics() []string {
+	return append([]string{}, resourceMetrics...)
+}
+
+var cassandraWriteDuration = metrics.NewHistogramVec("orchestrator_cassandra_write_duration_seconds",
+	"Duration of the batches written to Cassandra.", metrics.DefaultBuckets, "table")
+
+func init() {
+	metrics.Register(cassandraWriteDuration)
+}
+
+// DataStore is the Cassandra backed MetricsStore
 type DataStore struct {
+	*rolledUpMetrics
+	*rollupListeners
+	*backfillJobs
 	session *gocql.Session
+	tiers   *tierSet
 	done    chan bool
+	workers *sync.WaitGroup
 }
 
-func NewSession(seeds []string) *gocql.Session {
+// Defaults of the Cassandra session settings of StoreOptions
+const (
+	DefaultNumConns       = 10
+	DefaultConnectTimeout = 5 * time.Second
+)
+
+// NewSession connects to keyspace on the Cassandra cluster of seeds with numConns connections
+// per host
+func NewSession(seeds []string, keyspace string, numConns int, connectTimeout time.Duration) *gocql.Session {
 	cluster := gocql.NewCluster(seeds...)
-	cluster.Keyspace = "stats"
-	cluster.NumConns = 10
+	cluster.Keyspace = keyspace
+	cluster.NumConns = numConns
 	cluster.MaxPreparedStmts = 1000
 	cluster.MaxRoutingKeyInfo = 1000
-	cluster.ConnectTimeout = 5 * time.Second
+	cluster.ConnectTimeout = connectTimeout
 	cluster.ReconnectInterval = 5 * time.Second
 
 	session, err := cluster.CreateSession()
@@ -52,31 +80,54 @@ func NewSession(seeds []string) *gocql.Session {
 	return session
 }
 
-func NewDataStore(session *gocql.Session) *DataStore {
-	return &DataStore{
-		session: session,
-		done:    make(chan bool),
+func NewDataStore(session *gocql.Session, tiers RollupTiers) *DataStore {
+	d := &DataStore{
+		rolledUpMetrics: newRolledUpMetrics(),
+		rollupListeners: newRollupListeners(),
+		session:         session,
+		tiers:           newTierSet(tiers),
+		done:            make(chan bool),
+		workers:         &sync.WaitGroup{},
 	}
+	d.backfillJobs = newBackfillJobs(d, d.tiers, d.rolledUpMetrics)
+	return d
 }
 
 func (d *DataStore) StartRollup() {
-	go d.startRollup()
+	startRollup(d.done, d.workers, d, d.tiers, d.rolledUpMetrics, d.rollupListeners)
 }
 
+// StopRollup stops the rollups and the backfills once those in progress are over
 func (d *DataStore) StopRollup() {
-	d.done <- true
+	close(d.done)
+	d.workers.Wait()
+	d.stopBackfills()
+}
+
+func (d *DataStore) SetRollupTiers(tiers RollupTiers) error {
+	return d.tiers.set(tiers)
+}
+
+// Close closes the Cassandra session
+func (d *DataStore) Close() error {
+	d.session.Close()
+	return nil
 }
 
 func (d *DataStore) InsertAggregations(aggs map[string]*clients.Aggregation) error {
 	if len(aggs) == 0 {
 		return nil
 	}
+	raw := d.tiers.get().Raw()
+	stmt := fmt.Sprintf(insertDataPointStmt, raw.Table())
 	batch := gocql.NewBatch(gocql.LoggedBatch)
 	for _, agg := range aggs {
-		batch.Query(insertDataPointStmt, agg.MetricID, agg.TS, agg.ServiceID, agg.Min, agg.Max, agg.Average)
+		batch.Query(stmt, aggregationValues(agg, raw.TTL(agg.TS))...)
 	}
 
+	start := time.Now()
 	err := d.session.ExecuteBatch(batch)
+	cassandraWriteDuration.With(raw.Table()).ObserveSince(start)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to store aggregations")
 	}
@@ -86,146 +137,135 @@ func (d *DataStore) InsertAggregations(aggs map[string]*clients.Aggregation) err
 
 func (d *DataStore) InsertDataPoint(agg *clients.Aggregation) error {
 	// insert a data point
-	return d.session.Query(insertDataPointStmt, agg.MetricID, agg.TS, agg.Min, agg.Max, agg.Average).Exec()
+	raw := d.tiers.get().Raw()
+	return d.session.Query(fmt.Sprintf(insertDataPointStmt, raw.Table()), aggregationValues(agg, raw.TTL(agg.TS))...).Exec()
 }
 
-func (d *DataStore) selectRawDataQuery(metricID string) *gocql.Iter {
-	return d.session.Query(selectDataPointStmt, metricID, time.Now().Add(-10*time.Minute)).Iter()
+func (d *DataStore) InsertWindows(aggs map[string]*clients.Aggregation) error {
+	if err := d.InsertAggregations(aggs); err != nil {
+		return err
+	}
+	return insertWindows(d, d.tiers.get(), aggs)
 }
 
-func (d *DataStore) insertRollup300(agg *clients.Aggregation) error {
-	return d.session.Query(insertRollup300Stmt, agg.MetricID, agg.TS, agg.ServiceID, agg.Min, agg.Max, agg.Average).Exec()
+func (d *DataStore) selectTier(table, metricID string, startTS, endTS time.Time) ([]clients.Aggregation, error) {
+	rows := make([]clients.Aggregation, 0, 10)
+	err := d.scanTier(table, metricID, startTS, endTS, func(row clients.Aggregation) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
 }
 
-func (d *DataStore) insertRollup120(agg *clients.Aggregation) error {
-	return d.session.Query(insertRollup120Stmt, agg.MetricID, agg.TS, agg.ServiceID, agg.Min, agg.Max, agg.Average).Exec()
+func (d *DataStore) scanTier(table, metricID string, startTS, endTS time.Time, fn func(row clients.Aggregation) error) error {
+	iter := d.session.Query(fmt.Sprintf(selectDataPointStmt, table), metricID, startTS, endTS).Iter()
+	for {
+		row := clients.Aggregation{MetricID: metricID}
+		exists := iter.Scan(&row.TS, &row.ServiceID, &row.Min, &row.Max, &row.Average, &row.NumValues, &row.Labels)
+		if !exists {
+			break
+		}
+		if err := fn(row); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return errors.Wrapf(err, "Failed to read %s data for metric=%s", table, metricID)
+	}
+	return nil
 }
 
-func (d *DataStore) startRollup() error {
-	rollup120Timer := time.NewTicker(2 * time.Minute)
-	rollup300Timer := time.NewTicker(5 * time.Minute)
+// pageTier reads a single page, setting the paging state disables the automatic fetching
+// of the next pages by the driver
+func (d *DataStore) pageTier(table, metricID string, startTS, endTS time.Time, pageSize int, state []byte) ([]clients.Aggregation, []byte, error) {
+	iter := d.session.Query(fmt.Sprintf(selectDataPointStmt, table), metricID, startTS, endTS).
+		PageSize(pageSize).PageState(state).Iter()
+	next := iter.PageState()
 
+	rows := make([]clients.Aggregation, 0, pageSize)
 	for {
-		select {
-		case <-d.done:
-			rollup300Timer.Stop()
-			return nil
-		case <-rollup300Timer.C: // aggregation
-			log.Println("Running rollup300")
-			wg := sync.WaitGroup{}
-			for _, metricID := range resourceMetrics {
-				wg.Add(1)
-				func(metricID string) {
-					defer wg.Done()
-					err := d.runRollup(metricID, 300, d.selectRawDataQuery, d.insertRollup300)
-					if err != nil {
-						log.Println(err)
-					}
-				}(metricID)
-				// TODO add rollups7200
-				// TODO add rollups86400
-				// ...
-			}
-			wg.Wait()
-		case <-rollup120Timer.C:
-			log.Println("Running rollup300")
-			wg := sync.WaitGroup{}
-			for _, metricID := range resourceMetrics {
-				wg.Add(1)
-				go func(metricID string) {
-					defer wg.Done()
-					err := d.runRollup(metricID, 120, d.selectRawDataQuery, d.insertRollup120)
-					if err != nil {
-						log.Println(err)
-					}
-				}(metricID)
-			}
-			wg.Wait()
+		row := clients.Aggregation{MetricID: metricID}
+		exists := iter.Scan(&row.TS, &row.ServiceID, &row.Min, &row.Max, &row.Average, &row.NumValues, &row.Labels)
+		if !exists {
+			break
 		}
+		rows = append(rows, row)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, errors.Wrapf(err, "Failed to read a page of %s data for metric=%s", table, metricID)
 	}
+	return rows, next, nil
 }
 
-func (d *DataStore) runRollup(metricID string, aggInterval int64, queryPreviousRollup func(metricID string) *gocql.Iter, storeAggregation func(agg *clients.Aggregation) error) error {
-	metrics := make(map[string]*clients.Aggregation)
-	latestInterval := make(map[string]int64)
-	for {
-		var ts time.Time
-		var serviceID string
-		var min, max, avg float64
-		query := queryPreviousRollup(metricID)
-		for {
-			exists := query.Scan(&ts, &serviceID, &min, &max, &avg)
-			if !exists {
-				return nil
-			}
-
-			aggregationKey := getAggregationKey(serviceID, metricID)
-
-			interval := ts.UTC().Unix() / aggInterval
-			if li, ok := latestInterval[aggregationKey]; ok && li < interval {
-				if agg, ok := metrics[aggregationKey]; ok {
-					err := storeAggregation(agg)
-					if err != nil {
-						return err
-					}
-				}
-
-				delete(metrics, aggregationKey)
-				delete(latestInterval, aggregationKey)
-			}
-
-			// agg each value found in db
-			if agg, ok := metrics[aggregationKey]; !ok {
-				latestInterval[aggregationKey] = interval
-				metrics[aggregationKey] = &clients.Aggregation{
-					MetricID:  metricID,
-					ServiceID: serviceID,
-					TS:        time.Unix(interval*aggInterval, 0),
-					Min:       min,
-					Max:       max,
-					Average:   avg,
-					NumValues: 1,
-				}
-			} else {
-				agg.Average = (avg + float64(agg.NumValues)*agg.Average) / float64(agg.NumValues+1)
-				agg.NumValues += 1
-				if agg.Min > min {
-					agg.Min = min
-				}
-				if agg.Max < max {
-					agg.Max = max
-				}
-			}
-		}
+func (d *DataStore) storeRollups(tier RollupTier, aggs []*clients.Aggregation) error {
+	if len(aggs) == 0 {
+		return nil
+	}
+
+	// all rows share the metric_id partition, so an unlogged batch is a single write
+	stmt := fmt.Sprintf(insertRollupStmt, tier.Table())
+	batch := gocql.NewBatch(gocql.UnloggedBatch)
+	for _, agg := range aggs {
+		batch.Query(stmt, aggregationValues(agg, tier.TTL(agg.TS))...)
 	}
+
+	defer cassandraWriteDuration.With(tier.Table()).ObserveSince(time.Now())
+	if err := d.session.ExecuteBatch(batch); err != nil {
+		return errors.Wrapf(err, "Failed to store %s rollups for metric=%s", tier.Table(), aggs[0].MetricID)
+	}
+	return nil
 }
 
-func (d *DataStore) GetResourceStats(startTS, endTS time.Time) ([]clients.Aggregation, error) {
-	aggregations := make([]clients.Aggregation, 0, 5)
-	for _, metricID := range resourceMetrics {
-		agg, err := d.GetStats(metricID, startTS, endTS)
-		if err != nil {
-			return aggregations, err
-		}
-		aggregations = append(aggregations, agg...)
+func (d *DataStore) getCheckpoint(table, metricID string) (time.Time, bool, error) {
+	var checkpoint time.Time
+	err := d.session.Query(selectCheckpointStmt, table, metricID).Scan(&checkpoint)
+	if err == gocql.ErrNotFound {
+		return checkpoint, false, nil
+	}
+	if err != nil {
+		return checkpoint, false, errors.Wrapf(err, "Failed to read %s checkpoint for metric=%s", table, metricID)
 	}
-	return aggregations, nil
+	return checkpoint, true, nil
 }
 
-func (d *DataStore) GetStats(metricID string, startTS, endTs time.Time) ([]clients.Aggregation, error) {
-	aggregations := make([]clients.Aggregation, 0, 10)
-	iter := d.session.Query(selectRollup300Stmt, metricID, startTS).Iter()
-	for {
-		agg := clients.Aggregation{}
-		exists := iter.Scan(&agg.MetricID, &agg.TS, &agg.ServiceID, &agg.Min, &agg.Max, &agg.Average)
-		if !exists {
-			break
-		}
-		aggregations = append(aggregations, agg)
+func (d *DataStore) setCheckpoint(table, metricID string, checkpoint time.Time) error {
+	err := d.session.Query(insertCheckpointStmt, table, metricID, checkpoint).Exec()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store %s checkpoint for metric=%s", table, metricID)
 	}
-	return aggregations, nil
+	return nil
+}
+
+func (d *DataStore) Export(query *ExportQuery, fn func(row clients.Aggregation) error) error {
+	return exportRows(d, d.tiers.get(), query, fn)
+}
+
+func (d *DataStore) Import(tier string, rows []clients.Aggregation) (int, error) {
+	return importRows(d, d.tiers.get(), d.rolledUpMetrics, tier, rows, time.Now())
+}
+
+func (d *DataStore) GetResourceStats(startTS, endTS time.Time) ([]clients.Aggregation, error) {
+	return getResourceStats(d, startTS, endTS)
+}
+
+func (d *DataStore) GetStats(query *StatsQuery) (*clients.StatsResponse, error) {
+	return queryStats(d, d.tiers.get(), query, time.Now())
+}
+
+func (d *DataStore) StreamStats(query *StatsQuery, header func(resp *clients.StatsResponse) error, fn func(row clients.Aggregation) error) error {
+	return streamStats(d, d.tiers.get(), query, time.Now(), header, fn)
 }
 
 func getAggregationKey(serviceID, metricID string) string {
 	return fmt.Sprintf("%s:%s", serviceID, metricID)
 }
+
+// aggregationValues returns the bind values of the insert statements
+func aggregationValues(agg *clients.Aggregation, ttl int) []interface{} {
+	sum := agg.Average * float64(agg.NumValues)
+	return []interface{}{agg.MetricID, agg.TS, agg.ServiceID, agg.Min, agg.Max, agg.Average, sum, agg.NumValues, agg.Labels, ttl}
+}
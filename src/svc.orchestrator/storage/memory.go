@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"clients"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// expireInterval is how often the embedded stores drop rows past their retention
+const expireInterval = time.Minute
+
+type rowKey struct {
+	ts        int64
+	serviceID string
+}
+
+// memTables mirrors the Cassandra tables in memory, rows are keyed by (metric_id, ts, service_id)
+type memTables struct {
+	tables      map[string]map[string]map[rowKey]clients.Aggregation
+	checkpoints map[string]time.Time
+	lock        *sync.RWMutex
+}
+
+func newMemTables() *memTables {
+	return &memTables{
+		tables:      make(map[string]map[string]map[rowKey]clients.Aggregation),
+		checkpoints: make(map[string]time.Time),
+		lock:        &sync.RWMutex{},
+	}
+}
+
+// insert upserts agg into table
+func (t *memTables) insert(table string, agg clients.Aggregation) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	metrics, ok := t.tables[table]
+	if !ok {
+		metrics = make(map[string]map[rowKey]clients.Aggregation)
+		t.tables[table] = metrics
+	}
+
+	rows, ok := metrics[agg.MetricID]
+	if !ok {
+		rows = make(map[rowKey]clients.Aggregation)
+		metrics[agg.MetricID] = rows
+	}
+
+	rows[rowKey{ts: agg.TS.UnixNano(), serviceID: agg.ServiceID}] = agg
+}
+
+func (t *memTables) getCheckpoint(table, metricID string) (time.Time, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	checkpoint, ok := t.checkpoints[getAggregationKey(table, metricID)]
+	return checkpoint, ok
+}
+
+func (t *memTables) setCheckpoint(table, metricID string, checkpoint time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.checkpoints[getAggregationKey(table, metricID)] = checkpoint
+}
+
+// selectRange returns the rows of metricID in [startTS, endTS), ordered by timestamp and service
+func (t *memTables) selectRange(table, metricID string, startTS, endTS time.Time) []clients.Aggregation {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	result := make([]clients.Aggregation, 0, 10)
+	for _, row := range t.tables[table][metricID] {
+		if row.TS.Before(startTS) || !row.TS.Before(endTS) {
+			continue
+		}
+		result = append(result, row)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].TS.Equal(result[j].TS) {
+			return result[i].TS.Before(result[j].TS)
+		}
+		return result[i].ServiceID < result[j].ServiceID
+	})
+
+	return result
+}
+
+// pageRange returns the page of selectRange following the paging state, which is the
+// timestamp and service of the last row of the previous page
+func (t *memTables) pageRange(table, metricID string, startTS, endTS time.Time, pageSize int, state []byte) ([]clients.Aggregation, []byte, error) {
+	rows := t.selectRange(table, metricID, startTS, endTS)
+
+	if len(state) > 0 {
+		if len(state) < 8 {
+			return nil, nil, errors.New("invalid paging state")
+		}
+		ts, serviceID := int64(binary.BigEndian.Uint64(state)), string(state[8:])
+		rows = rows[sort.Search(len(rows), func(i int) bool {
+			rowTS := rows[i].TS.UnixNano()
+			return rowTS > ts || (rowTS == ts && rows[i].ServiceID > serviceID)
+		}):]
+	}
+
+	if len(rows) <= pageSize {
+		return rows, nil, nil
+	}
+
+	rows = rows[:pageSize]
+	last := rows[len(rows)-1]
+	next := make([]byte, 8, 8+len(last.ServiceID))
+	binary.BigEndian.PutUint64(next, uint64(last.TS.UnixNano()))
+	return rows, append(next, last.ServiceID...), nil
+}
+
+// scanRange calls fn with the rows selectRange returns, stopping at the first error
+func scanRange(t *memTables, table, metricID string, startTS, endTS time.Time, fn func(row clients.Aggregation) error) error {
+	for _, row := range t.selectRange(table, metricID, startTS, endTS) {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expire drops the rows of every tier which are older than the tier retention
+func (t *memTables) expire(tiers RollupTiers, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, tier := range tiers {
+		if tier.Retention == 0 {
+			continue
+		}
+
+		before := now.Add(-tier.Retention.Duration())
+		for _, rows := range t.tables[tier.Table()] {
+			for key, row := range rows {
+				if row.TS.Before(before) {
+					delete(rows, key)
+				}
+			}
+		}
+	}
+}
+
+// startExpiry calls expire every expireInterval until done is closed
+func startExpiry(done chan bool, workers *sync.WaitGroup, expire func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+
+		ticker := time.NewTicker(expireInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				expire()
+			}
+		}
+	}()
+}
+
+// MemoryStore is a MetricsStore keeping everything in process memory, meant for tests and local development
+type MemoryStore struct {
+	*rolledUpMetrics
+	*rollupListeners
+	*backfillJobs
+	tables *memTables
+	tiers  *tierSet
+	done   chan bool
+	// workers are the rollup and expiry goroutines
+	workers *sync.WaitGroup
+}
+
+// NewMemoryStore creates a new in-memory metrics store
+func NewMemoryStore(tiers RollupTiers) *MemoryStore {
+	m := &MemoryStore{
+		rolledUpMetrics: newRolledUpMetrics(),
+		rollupListeners: newRollupListeners(),
+		tables:          newMemTables(),
+		tiers:           newTierSet(tiers),
+		done:            make(chan bool),
+		workers:         &sync.WaitGroup{},
+	}
+	m.backfillJobs = newBackfillJobs(m, m.tiers, m.rolledUpMetrics)
+	return m
+}
+
+func (m *MemoryStore) StartRollup() {
+	startRollup(m.done, m.workers, m, m.tiers, m.rolledUpMetrics, m.rollupListeners)
+	startExpiry(m.done, m.workers, func() { m.tables.expire(m.tiers.get(), time.Now()) })
+}
+
+// StopRollup stops the rollups and the backfills once those in progress are over
+func (m *MemoryStore) StopRollup() {
+	close(m.done)
+	m.workers.Wait()
+	m.stopBackfills()
+}
+
+func (m *MemoryStore) SetRollupTiers(tiers RollupTiers) error {
+	return m.tiers.set(tiers)
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) InsertAggregations(aggs map[string]*clients.Aggregation) error {
+	for _, agg := range aggs {
+		m.tables.insert(m.tiers.get().Raw().Table(), *agg)
+	}
+	return nil
+}
+
+func (m *MemoryStore) InsertWindows(aggs map[string]*clients.Aggregation) error {
+	if err := m.InsertAggregations(aggs); err != nil {
+		return err
+	}
+	return insertWindows(m, m.tiers.get(), aggs)
+}
+
+func (m *MemoryStore) selectTier(table, metricID string, startTS, endTS time.Time) ([]clients.Aggregation, error) {
+	return m.tables.selectRange(table, metricID, startTS, endTS), nil
+}
+
+func (m *MemoryStore) scanTier(table, metricID string, startTS, endTS time.Time, fn func(row clients.Aggregation) error) error {
+	return scanRange(m.tables, table, metricID, startTS, endTS, fn)
+}
+
+func (m *MemoryStore) pageTier(table, metricID string, startTS, endTS time.Time, pageSize int, state []byte) ([]clients.Aggregation, []byte, error) {
+	return m.tables.pageRange(table, metricID, startTS, endTS, pageSize, state)
+}
+
+func (m *MemoryStore) storeRollups(tier RollupTier, aggs []*clients.Aggregation) error {
+	for _, agg := range aggs {
+		m.tables.insert(tier.Table(), *agg)
+	}
+	return nil
+}
+
+func (m *MemoryStore) getCheckpoint(table, metricID string) (time.Time, bool, error) {
+	checkpoint, ok := m.tables.getCheckpoint(table, metricID)
+	return checkpoint, ok, nil
+}
+
+func (m *MemoryStore) setCheckpoint(table, metricID string, checkpoint time.Time) error {
+	m.tables.setCheckpoint(table, metricID, checkpoint)
+	return nil
+}
+
+func (m *MemoryStore) Export(query *ExportQuery, fn func(row clients.Aggregation) error) error {
+	return exportRows(m, m.tiers.get(), query, fn)
+}
+
+func (m *MemoryStore) Import(tier string, rows []clients.Aggregation) (int, error) {
+	return importRows(m, m.tiers.get(), m.rolledUpMetrics, tier, rows, time.Now())
+}
+
+func (m *MemoryStore) GetResourceStats(startTS, endTS time.Time) ([]clients.Aggregation, error) {
+	return getResourceStats(m, startTS, endTS)
+}
+
+func (m *MemoryStore) GetStats(query *StatsQuery) (*clients.StatsResponse, error) {
+	return queryStats(m, m.tiers.get(), query, time.Now())
+}
+
+func (m *MemoryStore) StreamStats(query *StatsQuery, header func(resp *clients.StatsResponse) error, fn func(row clients.Aggregation) error) error {
+	return streamStats(m, m.tiers.get(), query, time.Now(), header, fn)
+}
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"clients"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreExpire(t *testing.T) {
+	store := NewMemoryStore(DefaultRollupTiers())
+	now := time.Now().UTC()
+
+	for _, ts := range []time.Time{now.Add(-8 * 24 * time.Hour), now.Add(-time.Hour)} {
+		store.InsertAggregations(segmentRow("mem", ts, 1))
+		store.storeRollups(RollupTier{Resolution: Duration(5 * time.Minute)}, []*clients.Aggregation{segmentRow("mem", alignWindow(ts, 300), 1)["mem"]})
+	}
+	store.tables.expire(store.tiers.get(), now)
+
+	// the raw rows are kept for 7 days, the rollups for 90
+	for table, want := range map[string]int{metricsTable: 1, rollup300Table: 2} {
+		rows, _ := store.selectTier(table, "mem", now.Add(-30*24*time.Hour), now)
+		if len(rows) != want {
+			t.Errorf("%s: got %d rows, want %d", table, len(rows), want)
+		}
+	}
+}
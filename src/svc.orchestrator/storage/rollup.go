@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"clients"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	metricsTable   = "metrics"
+	rollup120Table = "rollups120"
+	rollup300Table = "rollups300"
+)
+
+const (
+	// initialRollupLookback is how far back a tier without a checkpoint starts rolling up
+	initialRollupLookback = 10 * time.Minute
+	// maxRollupTick bounds how long a coarse tier waits between checks for finished windows
+	maxRollupTick = 5 * time.Minute
+	// maxRollupWindows bounds the windows finalized by a single run, so catching up
+	// after a long downtime is spread over several ticks
+	maxRollupWindows = 1000
+)
+
+// rollupBackend is implemented by every store so that the rollup logic can be shared
+type rollupBackend interface {
+	// selectTier returns the rows of metricID in [startTS, endTS), ordered by timestamp
+	selectTier(table, metricID string, startTS, endTS time.Time) ([]clients.Aggregation, error)
+	// scanTier calls fn with the rows of metricID in [startTS, endTS) without collecting them,
+	// stopping at the first error
+	scanTier(table, metricID string, startTS, endTS time.Time, fn func(row clients.Aggregation) error) error
+	// pageTier returns at most pageSize rows of metricID in [startTS, endTS) following the
+	// paging state, along with the state of the next page which is empty after the last one
+	pageTier(table, metricID string, startTS, endTS time.Time, pageSize int, state []byte) ([]clients.Aggregation, []byte, error)
+	// storeRollups upserts the finalized windows of tier
+	storeRollups(tier RollupTier, aggs []*clients.Aggregation) error
+	// getCheckpoint returns the end of the last finalized window of metricID in table
+	getCheckpoint(table, metricID string) (time.Time, bool, error)
+	setCheckpoint(table, metricID string, checkpoint time.Time) error
+}
+
+// rolledUpMetrics is the set of metrics a store rolls up, the resource metrics along with the
+// metrics added through AddRollupMetrics, and the checkpoints their next rollup rewinds to
+type rolledUpMetrics struct {
+	metricIDs map[string]bool
+	// rewinds are by table and metric, see rewind
+	rewinds map[string]time.Time
+	lock    *sync.RWMutex
+}
+
+func newRolledUpMetrics() *rolledUpMetrics {
+	r := rolledUpMetrics{
+		metricIDs: map[string]bool{},
+		rewinds:   map[string]time.Time{},
+		lock:      &sync.RWMutex{},
+	}
+	for _, metricID := range resourceMetrics {
+		r.metricIDs[metricID] = true
+	}
+
+	return &r
+}
+
+// AddRollupMetrics rolls up the metrics from the next tick of every tier onwards
+func (r *rolledUpMetrics) AddRollupMetrics(metricIDs ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, metricID := range metricIDs {
+		r.metricIDs[metricID] = true
+	}
+}
+
+// rewind moves the checkpoint of metricID in table back to checkpoint, from the next rollup of
+// the tier. The rollup goroutine applies it, so that a rollup in progress can not overwrite it.
+func (r *rolledUpMetrics) rewind(table, metricID string, checkpoint time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := table + ":" + metricID
+	if current, ok := r.rewinds[key]; !ok || checkpoint.Before(current) {
+		r.rewinds[key] = checkpoint
+	}
+}
+
+func (r *rolledUpMetrics) takeRewind(table, metricID string) (time.Time, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := table + ":" + metricID
+	checkpoint, ok := r.rewinds[key]
+	delete(r.rewinds, key)
+	return checkpoint, ok
+}
+
+func (r *rolledUpMetrics) list() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	metricIDs := make([]string, 0, len(r.metricIDs))
+	for metricID := range r.metricIDs {
+		metricIDs = append(metricIDs, metricID)
+	}
+	sort.Strings(metricIDs)
+	return metricIDs
+}
+
+// RollupListener is called with the windows of a metric every time a tier finalized some,
+// ordered by window and service
+type RollupListener func(tier RollupTier, metricID string, aggs []*clients.Aggregation)
+
+// rollupListeners are the listeners added to a store through OnRollup
+type rollupListeners struct {
+	listeners []RollupListener
+	lock      *sync.RWMutex
+}
+
+func newRollupListeners() *rollupListeners {
+	return &rollupListeners{lock: &sync.RWMutex{}}
+}
+
+// OnRollup calls listener after every rollup which finalized windows, from the rollup goroutine
+func (r *rollupListeners) OnRollup(listener RollupListener) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.listeners = append(r.listeners, listener)
+}
+
+func (r *rollupListeners) notify(tier RollupTier, metricID string, aggs []*clients.Aggregation) {
+	r.lock.RLock()
+	listeners := r.listeners
+	r.lock.RUnlock()
+
+	for _, listener := range listeners {
+		listener(tier, metricID, aggs)
+	}
+}
+
+// startRollup runs every rollup tier on its own ticker until done is closed, workers being done
+// once the rollups in progress are over. The tiers are read on every tick, so that a reloaded
+// retention or lateness applies from the next rollup.
+func startRollup(done chan bool, workers *sync.WaitGroup, backend rollupBackend, tiers *tierSet, metrics *rolledUpMetrics,
+	listeners *rollupListeners) {
+	for _, tier := range tiers.get().Rollups() {
+		workers.Add(1)
+		go func(tier RollupTier) {
+			defer workers.Done()
+			runTier(done, backend, tiers, tier, metrics, listeners)
+		}(tier)
+	}
+}
+
+func runTier(done chan bool, backend rollupBackend, tiers *tierSet, tier RollupTier, metrics *rolledUpMetrics,
+	listeners *rollupListeners) {
+	tick := tier.Resolution.Duration()
+	if tick > maxRollupTick {
+		tick = maxRollupTick
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			current := tiers.get()
+			tier, _ = current.Get(tier.Table())
+			rollupMetrics(backend, current, tier, metrics, listeners)
+		}
+	}
+}
+
+func rollupMetrics(backend rollupBackend, tiers RollupTiers, tier RollupTier, metrics *rolledUpMetrics, listeners *rollupListeners) {
+	wg := sync.WaitGroup{}
+	for _, metricID := range metrics.list() {
+		wg.Add(1)
+		go func(metricID string) {
+			defer wg.Done()
+			if checkpoint, ok := metrics.takeRewind(tier.Table(), metricID); ok {
+				if err := rewindCheckpoint(backend, tier, metricID, checkpoint); err != nil {
+					metrics.rewind(tier.Table(), metricID, checkpoint)
+					log.Println(err)
+					return
+				}
+			}
+			aggs, err := runRollup(backend, tiers, tier, metricID, time.Now())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if len(aggs) > 0 {
+				listeners.notify(tier, metricID, aggs)
+			}
+		}(metricID)
+	}
+	wg.Wait()
+}
+
+// rewindCheckpoint moves the checkpoint of metricID in tier back to checkpoint, when it is past it,
+// so that the windows from checkpoint onwards are computed again. Metrics which were never rolled
+// up start from checkpoint rather than initialRollupLookback, e.g. those of imported rows.
+func rewindCheckpoint(backend rollupBackend, tier RollupTier, metricID string, checkpoint time.Time) error {
+	current, ok, err := backend.getCheckpoint(tier.Table(), metricID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Printf("Starting %s checkpoint of metric=%s at %s", tier.Table(), metricID, checkpoint.UTC().Format(time.RFC3339))
+		return backend.setCheckpoint(tier.Table(), metricID, checkpoint)
+	}
+	if !checkpoint.Before(current) {
+		return nil
+	}
+
+	log.Printf("Rewinding %s checkpoint of metric=%s from %s to %s", tier.Table(), metricID,
+		current.UTC().Format(time.RFC3339), checkpoint.UTC().Format(time.RFC3339))
+	return backend.setCheckpoint(tier.Table(), metricID, checkpoint)
+}
+
+// runRollup finalizes the windows of tier which ended at least tier.Lateness ago and, for
+// cascading tiers, which the source tier has finalized too. The source is only read from
+// the metric checkpoint onwards, so every window is computed once and missed windows are
+// filled in on the next run. The finalized windows are returned once the checkpoint moved past them.
+func runRollup(backend rollupBackend, tiers RollupTiers, tier RollupTier, metricID string, now time.Time) ([]*clients.Aggregation, error) {
+	resolution := tier.Resolution.Duration()
+	interval := tier.Interval()
+
+	checkpoint, ok, err := backend.getCheckpoint(tier.Table(), metricID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		checkpoint = alignWindow(now.Add(-initialRollupLookback), interval)
+	}
+
+	limit := alignWindow(now.Add(-tier.Lateness.Duration()), interval)
+	if source, _ := tiers.Get(tier.Source); !source.IsRaw() {
+		sourceCheckpoint, ok, err := backend.getCheckpoint(source.Table(), metricID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, nil
+		}
+		if sourceCheckpoint = alignWindow(sourceCheckpoint, interval); sourceCheckpoint.Before(limit) {
+			limit = sourceCheckpoint
+		}
+	}
+	if maxLimit := checkpoint.Add(maxRollupWindows * resolution); maxLimit.Before(limit) {
+		limit = maxLimit
+	}
+	if !checkpoint.Before(limit) {
+		return nil, nil
+	}
+
+	rows, err := backend.selectTier(tier.Source, metricID, checkpoint, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	aggs := rollupWindows(metricID, interval, rows)
+	if len(aggs) > 0 {
+		if err := backend.storeRollups(tier, aggs); err != nil {
+			return nil, fmt.Errorf("failed storing %s for metric=%s: %s", tier.Table(), metricID, err.Error())
+		}
+	}
+
+	log.Printf("Rolled up %s metric=%s windows=[%s, %s) rows=%d", tier.Table(), metricID,
+		checkpoint.UTC().Format(time.RFC3339), limit.UTC().Format(time.RFC3339), len(aggs))
+
+	if err := backend.setCheckpoint(tier.Table(), metricID, limit); err != nil {
+		return nil, err
+	}
+	return aggs, nil
+}
+
+// rollupWindows aggregates rows into aggInterval seconds windows per service. Source rows are
+// assigned to the window holding their timestamp and the averages are weighted by the number
+// of values behind every row. The result is ordered by window and service.
+func rollupWindows(metricID string, aggInterval int64, rows []clients.Aggregation) []*clients.Aggregation {
+	metrics := make(map[string]*clients.Aggregation)
+	result := make([]*clients.Aggregation, 0, len(rows))
+
+	for _, row := range rows {
+		window := alignWindow(row.TS, aggInterval)
+		aggregationKey := fmt.Sprintf("%d:%s", window.Unix(), getAggregationKey(row.ServiceID, metricID))
+
+		numValues := row.NumValues
+		if numValues < 1 {
+			numValues = 1
+		}
+
+		// agg each value found in db
+		if agg, ok := metrics[aggregationKey]; !ok {
+			agg = &clients.Aggregation{
+				MetricID:  metricID,
+				ServiceID: row.ServiceID,
+				TS:        window,
+				Min:       row.Min,
+				Max:       row.Max,
+				Average:   row.Average,
+				NumValues: numValues,
+				Labels:    row.Labels,
+			}
+			metrics[aggregationKey] = agg
+			result = append(result, agg)
+		} else {
+			agg.Average = (row.Average*float64(numValues) + float64(agg.NumValues)*agg.Average) / float64(agg.NumValues+numValues)
+			agg.NumValues += numValues
+			if agg.Min > row.Min {
+				agg.Min = row.Min
+			}
+			if agg.Max < row.Max {
+				agg.Max = row.Max
+			}
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].TS.Equal(result[j].TS) {
+			return result[i].TS.Before(result[j].TS)
+		}
+		return result[i].ServiceID < result[j].ServiceID
+	})
+
+	return result
+}
+
+// insertWindows merges rows which are not rolled up from the raw tier into the window holding
+// them in every rollup tier, along with the rows already stored for the same window and service
+func insertWindows(backend rollupBackend, tiers RollupTiers, aggs map[string]*clients.Aggregation) error {
+	byMetric := map[string][]clients.Aggregation{}
+	for _, agg := range aggs {
+		byMetric[agg.MetricID] = append(byMetric[agg.MetricID], *agg)
+	}
+
+	for _, tier := range tiers.Rollups() {
+		interval := tier.Interval()
+		for metricID, rows := range byMetric {
+			windows := rollupWindows(metricID, interval, rows)
+			startTS, endTS := windows[0].TS, windows[len(windows)-1].TS.Add(tier.Resolution.Duration())
+			stored, err := backend.selectTier(tier.Table(), metricID, startTS, endTS)
+			if err != nil {
+				return err
+			}
+
+			inserted := map[string]bool{}
+			for _, window := range windows {
+				inserted[fmt.Sprintf("%d:%s", window.TS.Unix(), window.ServiceID)] = true
+			}
+			merged := append([]clients.Aggregation{}, rows...)
+			for _, row := range stored {
+				if inserted[fmt.Sprintf("%d:%s", row.TS.Unix(), row.ServiceID)] {
+					merged = append(merged, row)
+				}
+			}
+
+			if err := backend.storeRollups(tier, rollupWindows(metricID, interval, merged)); err != nil {
+				return fmt.Errorf("failed storing %s for metric=%s: %s", tier.Table(), metricID, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// alignWindow returns the start of the aggInterval seconds window holding ts
+func alignWindow(ts time.Time, aggInterval int64) time.Time {
+	return time.Unix(ts.Unix()/aggInterval*aggInterval, 0).UTC()
+}
+
+func rollupTable(aggInterval int64) string {
+	return fmt.Sprintf("rollups%d", aggInterval)
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"clients"
+	"testing"
+	"time"
+)
+
+func TestInsertWindows(t *testing.T) {
+	store := NewMemoryStore(DefaultRollupTiers())
+
+	startTS := alignWindow(time.Now().Add(-3*time.Hour), 7200)
+	band := func(ts time.Time, serviceID string, value float64) *clients.Aggregation {
+		return &clients.Aggregation{MetricID: "anomaly:mem:score", ServiceID: serviceID, TS: ts, Min: value, Max: value, Average: value, NumValues: 1}
+	}
+
+	// the windows of the second call are merged with those of the first one
+	for _, aggs := range []map[string]*clients.Aggregation{
+		{"a": band(startTS, "echo-1", 1), "b": band(startTS.Add(5*time.Minute), "echo-1", 2)},
+		{"a": band(startTS.Add(10*time.Minute), "echo-1", 6), "b": band(startTS, "echo-2", 4)},
+	} {
+		if err := store.InsertWindows(aggs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string][]clients.Aggregation{
+		"metrics": {
+			{ServiceID: "echo-1", TS: startTS, Min: 1, Max: 1, Average: 1, NumValues: 1},
+			{ServiceID: "echo-2", TS: startTS, Min: 4, Max: 4, Average: 4, NumValues: 1},
+			{ServiceID: "echo-1", TS: startTS.Add(5 * time.Minute), Min: 2, Max: 2, Average: 2, NumValues: 1},
+			{ServiceID: "echo-1", TS: startTS.Add(10 * time.Minute), Min: 6, Max: 6, Average: 6, NumValues: 1},
+		},
+		"rollups120": {
+			{ServiceID: "echo-1", TS: startTS, Min: 1, Max: 1, Average: 1, NumValues: 1},
+			{ServiceID: "echo-2", TS: startTS, Min: 4, Max: 4, Average: 4, NumValues: 1},
+			{ServiceID: "echo-1", TS: startTS.Add(4 * time.Minute), Min: 2, Max: 2, Average: 2, NumValues: 1},
+			{ServiceID: "echo-1", TS: startTS.Add(10 * time.Minute), Min: 6, Max: 6, Average: 6, NumValues: 1},
+		},
+		"rollups300": {
+			{ServiceID: "echo-1", TS: startTS, Min: 1, Max: 1, Average: 1, NumValues: 1},
+			{ServiceID: "echo-2", TS: startTS, Min: 4, Max: 4, Average: 4, NumValues: 1},
+			{ServiceID: "echo-1", TS: startTS.Add(5 * time.Minute), Min: 2, Max: 2, Average: 2, NumValues: 1},
+			{ServiceID: "echo-1", TS: startTS.Add(10 * time.Minute), Min: 6, Max: 6, Average: 6, NumValues: 1},
+		},
+		"rollups7200": {
+			{ServiceID: "echo-1", TS: startTS, Min: 1, Max: 6, Average: 3, NumValues: 3},
+			{ServiceID: "echo-2", TS: startTS, Min: 4, Max: 4, Average: 4, NumValues: 1},
+		},
+	}
+	for table, rows := range want {
+		got, err := store.selectTier(table, "anomaly:mem:score", startTS, startTS.Add(2*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(rows) {
+			t.Errorf("%s: got %d rows, want %d: %+v", table, len(got), len(rows), got)
+			continue
+		}
+		for i, row := range rows {
+			if got[i].ServiceID != row.ServiceID || !got[i].TS.Equal(row.TS) || got[i].Min != row.Min || got[i].Max != row.Max ||
+				got[i].Average != row.Average || got[i].NumValues != row.NumValues {
+				t.Errorf("%s: got row=%+v, want %+v", table, got[i], row)
+			}
+		}
+	}
+}
+
+// TestAddRollupMetrics checks that a metric is only rolled up once registered, e.g. the metrics
+// received through remote-write
+func TestAddRollupMetrics(t *testing.T) {
+	store := NewMemoryStore(DefaultRollupTiers())
+	tiers := store.tiers.get()
+	tier, _ := tiers.Get(rollup300Table)
+
+	ts := alignWindow(time.Now().Add(-initialRollupLookback), tier.Interval()).Add(time.Second)
+	row := importRow("http_requests_total", ts, 3)
+	if err := store.InsertAggregations(map[string]*clients.Aggregation{"a": &row}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, registered := range []bool{false, true} {
+		if registered {
+			store.AddRollupMetrics("http_requests_total")
+		}
+		rollupMetrics(store, tiers, tier, store.rolledUpMetrics, store.rollupListeners)
+
+		rows, _ := store.selectTier(tier.Table(), "http_requests_total", ts.Add(-time.Hour), ts.Add(time.Hour))
+		if registered && (len(rows) != 1 || !rows[0].TS.Equal(alignWindow(ts, tier.Interval())) || rows[0].Average != 3) {
+			t.Errorf("got %s rows=%+v, want the raw row rolled up", tier.Table(), rows)
+		}
+		if !registered && len(rows) != 0 {
+			t.Errorf("got %s rows=%+v before the metric was registered", tier.Table(), rows)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/pkg/errors"
+)
+
+const DefaultKeyspace = "stats"
+
+// keyspaceName matches the unquoted Cassandra identifiers, keyspaces being formatted into the statements
+var keyspaceName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,47}$`)
+
+const (
+	createKeyspaceStmt       = "CREATE KEYSPACE IF NOT EXISTS %s WITH REPLICATION = {'class' : 'SimpleStrategy', 'replication_factor' : 1}"
+	createSchemaVersionStmt  = "CREATE TABLE IF NOT EXISTS %s.schema_migrations (version int PRIMARY KEY, description text, applied_at timestamp)"
+	selectSchemaTableStmt    = "SELECT table_name FROM system_schema.tables WHERE keyspace_name = ? AND table_name = 'schema_migrations'"
+	selectSchemaVersionsStmt = "SELECT version FROM %s.schema_migrations"
+	selectColumnsStmt        = "SELECT column_name FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ?"
+	insertSchemaVersionStmt  = "INSERT INTO %s.schema_migrations (version, description, applied_at) VALUES (?, ?, ?)"
+	createMetricsTableStmt   = "CREATE TABLE IF NOT EXISTS %%s.%s (metric_id varchar, ts timestamp, service_id varchar, min double, max double, avg double, PRIMARY KEY (metric_id, ts, service_id))"
+	addAggregateColumnsStmt  = "ALTER TABLE %%s.%s ADD (sum double, count bigint)"
+	addLabelsColumnStmt      = "ALTER TABLE %%s.%s ADD labels map<text, text>"
+	createCheckpointsStmt    = "CREATE TABLE IF NOT EXISTS %s.rollup_checkpoints (tier varchar, metric_id varchar, checkpoint timestamp, PRIMARY KEY (tier, metric_id))"
+	createTierTableStmt      = "CREATE TABLE IF NOT EXISTS %s.%s (metric_id varchar, ts timestamp, service_id varchar, min double, max double, avg double, sum double, count bigint, labels map<text, text>, PRIMARY KEY (metric_id, ts, service_id))"
+)
+
+// Migration is a versioned, ordered change of the Cassandra schema
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []SchemaStatement
+}
+
+// SchemaStatement is a statement of a migration, with a single %s placeholder which is replaced
+// by the keyspace name. Statements adding Columns to Table are skipped once the columns exist,
+// so that a migration which was only partially applied, e.g. a column added before the version
+// could be recorded, can be re-run. The other statements must be idempotent.
+type SchemaStatement struct {
+	Statement string
+	Table     string
+	Columns   []string
+}
+
+// addColumns returns the statement adding columns to table
+func addColumns(stmt, table string, columns ...string) SchemaStatement {
+	return SchemaStatement{Statement: fmt.Sprintf(stmt, table), Table: table, Columns: columns}
+}
+
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create metrics and rollup tables",
+		Statements: []SchemaStatement{
+			{Statement: fmt.Sprintf(createMetricsTableStmt, metricsTable)},
+			{Statement: fmt.Sprintf(createMetricsTableStmt, rollup120Table)},
+			{Statement: fmt.Sprintf(createMetricsTableStmt, rollup300Table)},
+		},
+	},
+	{
+		Version:     2,
+		Description: "add sum and count columns",
+		Statements: []SchemaStatement{
+			addColumns(addAggregateColumnsStmt, metricsTable, "sum", "count"),
+			addColumns(addAggregateColumnsStmt, rollup120Table, "sum", "count"),
+			addColumns(addAggregateColumnsStmt, rollup300Table, "sum", "count"),
+		},
+	},
+	{
+		Version:     3,
+		Description: "add labels column",
+		Statements: []SchemaStatement{
+			addColumns(addLabelsColumnStmt, metricsTable, "labels"),
+			addColumns(addLabelsColumnStmt, rollup120Table, "labels"),
+			addColumns(addLabelsColumnStmt, rollup300Table, "labels"),
+		},
+	},
+	{
+		Version:     4,
+		Description: "add rollup checkpoints table",
+		Statements: []SchemaStatement{
+			{Statement: createCheckpointsStmt},
+		},
+	},
+}
+
+// Migrator creates the keyspace and applies the pending schema migrations
+type Migrator struct {
+	session  *gocql.Session
+	keyspace string
+}
+
+// NewMigrator creates a migrator of keyspace connected to seeds, outside of any keyspace
+// since the keyspace itself might not exist yet
+func NewMigrator(seeds []string, keyspace string) (*Migrator, error) {
+	if err := ValidateKeyspace(keyspace); err != nil {
+		return nil, err
+	}
+
+	cluster := gocql.NewCluster(seeds...)
+	cluster.ConnectTimeout = 5 * time.Second
+	cluster.Timeout = 30 * time.Second
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed connecting to seeds=%v", seeds)
+	}
+
+	m := Migrator{
+		session:  session,
+		keyspace: keyspace,
+	}
+
+	return &m, nil
+}
+
+// Close closes the migrator session
+func (m *Migrator) Close() {
+	m.session.Close()
+}
+
+// Pending returns the migrations which were not applied yet, ordered by version
+func (m *Migrator) Pending() ([]Migration, error) {
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []Migration{}
+	for _, migration := range migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Migrate creates the keyspace, applies every pending migration and then creates the
+// tables of the rollup tiers missing from the migrations. With dryRun set the statements
+// are only written to out.
+func (m *Migrator) Migrate(tiers RollupTiers, dryRun bool, out io.Writer) error {
+	pending, err := m.Pending()
+	if err != nil {
+		return err
+	}
+
+	bootstrap := []string{
+		fmt.Sprintf(createKeyspaceStmt, m.keyspace),
+		fmt.Sprintf(createSchemaVersionStmt, m.keyspace),
+	}
+
+	tierTables := []string{}
+	for _, tier := range tiers {
+		tierTables = append(tierTables, fmt.Sprintf(createTierTableStmt, m.keyspace, tier.Table()))
+	}
+
+	if dryRun {
+		for _, stmt := range bootstrap {
+			fmt.Fprintf(out, "%s;\n", stmt)
+		}
+		for _, migration := range pending {
+			fmt.Fprintf(out, "-- migration %d: %s\n", migration.Version, migration.Description)
+			for _, stmt := range migration.Statements {
+				fmt.Fprintf(out, "%s;\n", fmt.Sprintf(stmt.Statement, m.keyspace))
+			}
+		}
+		fmt.Fprintf(out, "-- rollup tier tables\n")
+		for _, stmt := range tierTables {
+			fmt.Fprintf(out, "%s;\n", stmt)
+		}
+		fmt.Fprintf(out, "-- %d pending migration(s)\n", len(pending))
+		return nil
+	}
+
+	for _, stmt := range bootstrap {
+		if err := m.session.Query(stmt).Exec(); err != nil {
+			return errors.Wrapf(err, "Failed bootstrapping keyspace=%s", m.keyspace)
+		}
+	}
+
+	for _, migration := range pending {
+		log.Printf("Applying schema migration version=%d: %s", migration.Version, migration.Description)
+		for _, stmt := range migration.Statements {
+			applied, err := m.isApplied(stmt)
+			if err != nil {
+				return err
+			}
+			if applied {
+				log.Printf("Skipping the applied statement of schema migration version=%d: %s", migration.Version, stmt.Statement)
+				continue
+			}
+			if err := m.session.Query(fmt.Sprintf(stmt.Statement, m.keyspace)).Exec(); err != nil {
+				return errors.Wrapf(err, "Failed applying schema migration version=%d", migration.Version)
+			}
+		}
+
+		err := m.session.Query(fmt.Sprintf(insertSchemaVersionStmt, m.keyspace),
+			migration.Version, migration.Description, time.Now().UTC()).Exec()
+		if err != nil {
+			return errors.Wrapf(err, "Failed recording schema migration version=%d", migration.Version)
+		}
+		fmt.Fprintf(out, "Applied migration %d: %s\n", migration.Version, migration.Description)
+	}
+
+	for _, stmt := range tierTables {
+		if err := m.session.Query(stmt).Exec(); err != nil {
+			return errors.Wrapf(err, "Failed creating rollup tier table")
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) appliedVersions() (map[int]bool, error) {
+	applied := map[int]bool{}
+
+	var tableName string
+	iter := m.session.Query(selectSchemaTableStmt, m.keyspace).Iter()
+	exists := iter.Scan(&tableName)
+	if err := iter.Close(); err != nil {
+		return nil, errors.Wrapf(err, "Failed looking up schema version table")
+	}
+	if !exists {
+		return applied, nil
+	}
+
+	var version int
+	iter = m.session.Query(fmt.Sprintf(selectSchemaVersionsStmt, m.keyspace)).Iter()
+	for iter.Scan(&version) {
+		applied[version] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Wrapf(err, "Failed reading schema versions")
+	}
+
+	return applied, nil
+}
+
+// isApplied reports whether the columns the statement adds exist already, reading them from
+// system_schema
+func (m *Migrator) isApplied(stmt SchemaStatement) (bool, error) {
+	if len(stmt.Columns) == 0 {
+		return false, nil
+	}
+
+	existing := map[string]bool{}
+	var column string
+	iter := m.session.Query(selectColumnsStmt, m.keyspace, stmt.Table).Iter()
+	for iter.Scan(&column) {
+		existing[column] = true
+	}
+	if err := iter.Close(); err != nil {
+		return false, errors.Wrapf(err, "Failed reading the columns of table=%s", stmt.Table)
+	}
+
+	for _, column := range stmt.Columns {
+		if !existing[column] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ValidateKeyspace checks that keyspace is a valid unquoted Cassandra identifier
+func ValidateKeyspace(keyspace string) error {
+	if !keyspaceName.MatchString(keyspace) {
+		return fmt.Errorf("keyspace=%q must be a letter followed by at most 47 letters, digits or underscores", keyspace)
+	}
+	return nil
+}
+
+// bootstrapSchema creates the missing keyspace and tables before the data store connects
+func bootstrapSchema(seeds []string, keyspace string, tiers RollupTiers) error {
+	migrator, err := NewMigrator(seeds, keyspace)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	return migrator.Migrate(tiers, false, ioutil.Discard)
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestMigrationsCanBeRerun checks that the statements of the migrations are idempotent, or declare
+// the columns they add so that they are skipped once applied
+func TestMigrationsCanBeRerun(t *testing.T) {
+	for _, migration := range migrations {
+		for _, stmt := range migration.Statements {
+			switch {
+			case strings.HasPrefix(stmt.Statement, "CREATE TABLE IF NOT EXISTS "):
+				if len(stmt.Columns) > 0 {
+					t.Errorf("version=%d: %s declares columns", migration.Version, stmt.Statement)
+				}
+			case strings.HasPrefix(stmt.Statement, "ALTER TABLE %s."+stmt.Table+" ADD "):
+				if len(stmt.Columns) == 0 {
+					t.Errorf("version=%d: %s does not declare the columns it adds", migration.Version, stmt.Statement)
+				}
+				for _, column := range stmt.Columns {
+					if !regexp.MustCompile(`[ (,]` + column + ` `).MatchString(stmt.Statement) {
+						t.Errorf("version=%d: %s does not add column=%s", migration.Version, stmt.Statement, column)
+					}
+				}
+			default:
+				t.Errorf("version=%d: %s can not be re-run", migration.Version, stmt.Statement)
+			}
+		}
+	}
+}
+
+func TestValidateKeyspace(t *testing.T) {
+	for keyspace, valid := range map[string]bool{
+		DefaultKeyspace:         true,
+		"stats_staging2":        true,
+		"":                      false,
+		"2stats":                false,
+		"stats-staging":         false,
+		"stats; DROP TABLE x":   false,
+		strings.Repeat("s", 48): true,
+		strings.Repeat("s", 49): false,
+	} {
+		if err := ValidateKeyspace(keyspace); (err == nil) != valid {
+			t.Errorf("keyspace=%q: got err=%v, want valid=%t", keyspace, err, valid)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"bufio"
+	"clients"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentPrefix      = "segment-"
+	segmentSuffix      = ".log"
+	maxSegmentSize     = 64 * 1024 * 1024
+	segmentFileMode    = 0644
+	segmentDirFileMode = 0755
+)
+
+// segmentRecord is a single line of a segment file, holding either a row of a table
+// or the rollup checkpoint of a metric
+type segmentRecord struct {
+	Table       string              `json:"table"`
+	Aggregation clients.Aggregation `json:"agg"`
+	Checkpoint  *segmentCheckpoint  `json:"checkpoint,omitempty"`
+}
+
+type segmentCheckpoint struct {
+	MetricID string    `json:"metric_id"`
+	TS       time.Time `json:"ts"`
+}
+
+// SegmentStore is an embedded MetricsStore for single node setups. Every write is appended
+// to the active segment file in dataDir, and all segments are replayed into memory on startup.
+type SegmentStore struct {
+	*rolledUpMetrics
+	*rollupListeners
+	*backfillJobs
+	dataDir     string
+	tables      *memTables
+	tiers       *tierSet
+	segment     *os.File
+	segmentID   int
+	segmentSize int64
+	writeLock   *sync.Mutex
+	done        chan bool
+	workers     *sync.WaitGroup
+}
+
+// NewSegmentStore opens, or creates, the segment store located in dataDir
+func NewSegmentStore(dataDir string, tiers RollupTiers) (*SegmentStore, error) {
+	if err := os.MkdirAll(dataDir, segmentDirFileMode); err != nil {
+		return nil, errors.Wrapf(err, "Failed to create data dir=%s", dataDir)
+	}
+
+	s := SegmentStore{
+		rolledUpMetrics: newRolledUpMetrics(),
+		rollupListeners: newRollupListeners(),
+		dataDir:         dataDir,
+		tables:          newMemTables(),
+		tiers:           newTierSet(tiers),
+		writeLock:       &sync.Mutex{},
+		done:            make(chan bool),
+		workers:         &sync.WaitGroup{},
+	}
+	s.backfillJobs = newBackfillJobs(&s, s.tiers, s.rolledUpMetrics)
+
+	segmentIDs, err := s.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, segmentID := range segmentIDs {
+		if err := s.replaySegment(segmentID); err != nil {
+			return nil, err
+		}
+		s.segmentID = segmentID
+	}
+
+	if err := s.openSegment(s.segmentID); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Opened segment store dir=%s segments=%d", dataDir, len(segmentIDs))
+
+	return &s, nil
+}
+
+func (s *SegmentStore) StartRollup() {
+	startRollup(s.done, s.workers, s, s.tiers, s.rolledUpMetrics, s.rollupListeners)
+	startExpiry(s.done, s.workers, s.expire)
+}
+
+// StopRollup stops the rollups and the backfills once those in progress are over
+func (s *SegmentStore) StopRollup() {
+	close(s.done)
+	s.workers.Wait()
+	s.stopBackfills()
+}
+
+func (s *SegmentStore) SetRollupTiers(tiers RollupTiers) error {
+	return s.tiers.set(tiers)
+}
+
+// Close closes the active segment
+func (s *SegmentStore) Close() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	return s.segment.Close()
+}
+
+func (s *SegmentStore) InsertAggregations(aggs map[string]*clients.Aggregation) error {
+	if len(aggs) == 0 {
+		return nil
+	}
+
+	records := make([]segmentRecord, 0, len(aggs))
+	for _, agg := range aggs {
+		records = append(records, segmentRecord{Table: s.tiers.get().Raw().Table(), Aggregation: *agg})
+	}
+
+	return s.append(records...)
+}
+
+func (s *SegmentStore) InsertWindows(aggs map[string]*clients.Aggregation) error {
+	if err := s.InsertAggregations(aggs); err != nil {
+		return err
+	}
+	return insertWindows(s, s.tiers.get(), aggs)
+}
+
+func (s *SegmentStore) selectTier(table, metricID string, startTS, endTS time.Time) ([]clients.Aggregation, error) {
+	return s.tables.selectRange(table, metricID, startTS, endTS), nil
+}
+
+func (s *SegmentStore) scanTier(table, metricID string, startTS, endTS time.Time, fn func(row clients.Aggregation) error) error {
+	return scanRange(s.tables, table, metricID, startTS, endTS, fn)
+}
+
+func (s *SegmentStore) pageTier(table, metricID string, startTS, endTS time.Time, pageSize int, state []byte) ([]clients.Aggregation, []byte, error) {
+	return s.tables.pageRange(table, metricID, startTS, endTS, pageSize, state)
+}
+
+func (s *SegmentStore) storeRollups(tier RollupTier, aggs []*clients.Aggregation) error {
+	records := make([]segmentRecord, 0, len(aggs))
+	for _, agg := range aggs {
+		records = append(records, segmentRecord{Table: tier.Table(), Aggregation: *agg})
+	}
+	return s.append(records...)
+}
+
+func (s *SegmentStore) getCheckpoint(table, metricID string) (time.Time, bool, error) {
+	checkpoint, ok := s.tables.getCheckpoint(table, metricID)
+	return checkpoint, ok, nil
+}
+
+func (s *SegmentStore) setCheckpoint(table, metricID string, checkpoint time.Time) error {
+	return s.append(segmentRecord{Table: table, Checkpoint: &segmentCheckpoint{MetricID: metricID, TS: checkpoint}})
+}
+
+// expire drops the expired rows from memory and deletes the segments which were last
+// written before the longest retention. The live checkpoints are rewritten to the active
+// segment first, since the deleted segments may hold the only record of them.
+func (s *SegmentStore) expire() {
+	now := time.Now()
+	s.tables.expire(s.tiers.get(), now)
+
+	maxRetention := s.tiers.get().MaxRetention()
+	if maxRetention == 0 {
+		return
+	}
+
+	segmentIDs, err := s.listSegments()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.writeLock.Lock()
+	activeSegmentID := s.segmentID
+	s.writeLock.Unlock()
+
+	expired := []string{}
+	for _, segmentID := range segmentIDs {
+		if segmentID >= activeSegmentID {
+			continue
+		}
+
+		path := s.segmentPath(segmentID)
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if now.Sub(info.ModTime()) < maxRetention {
+			continue
+		}
+		expired = append(expired, path)
+	}
+
+	if len(expired) == 0 {
+		return
+	}
+	if err := s.rewriteCheckpoints(); err != nil {
+		log.Printf("Failed rewriting checkpoints, keeping expired segments err=%s", err.Error())
+		return
+	}
+
+	for _, path := range expired {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed removing expired segment=%s err=%s", path, err.Error())
+			continue
+		}
+		log.Printf("Removed expired segment=%s", path)
+	}
+}
+
+// rewriteCheckpoints appends every checkpoint held in memory to the active segment. The write
+// lock is held from reading them to writing them so that a newer checkpoint is not overwritten.
+func (s *SegmentStore) rewriteCheckpoints() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	return s.write(s.tables.checkpointRecords())
+}
+
+func (s *SegmentStore) Export(query *ExportQuery, fn func(row clients.Aggregation) error) error {
+	return exportRows(s, s.tiers.get(), query, fn)
+}
+
+func (s *SegmentStore) Import(tier string, rows []clients.Aggregation) (int, error) {
+	return importRows(s, s.tiers.get(), s.rolledUpMetrics, tier, rows, time.Now())
+}
+
+func (s *SegmentStore) GetResourceStats(startTS, endTS time.Time) ([]clients.Aggregation, error) {
+	return getResourceStats(s, startTS, endTS)
+}
+
+func (s *SegmentStore) GetStats(query *StatsQuery) (*clients.StatsResponse, error) {
+	return queryStats(s, s.tiers.get(), query, time.Now())
+}
+
+func (s *SegmentStore) StreamStats(query *StatsQuery, header func(resp *clients.StatsResponse) error, fn func(row clients.Aggregation) error) error {
+	return streamStats(s, s.tiers.get(), query, time.Now(), header, fn)
+}
+
+// append writes the records to the active segment, syncs it and only then applies them in memory
+func (s *SegmentStore) append(records ...segmentRecord) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	return s.write(records)
+}
+
+// write appends the records to the active segment, the write lock must be held
+func (s *SegmentStore) write(records []segmentRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	w := bufio.NewWriter(s.segment)
+	written := int64(0)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to marshal segment record")
+		}
+		n, err := w.Write(append(line, '\n'))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to write segment=%d", s.segmentID)
+		}
+		written += int64(n)
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrapf(err, "Failed to write segment=%d", s.segmentID)
+	}
+	if err := s.segment.Sync(); err != nil {
+		return errors.Wrapf(err, "Failed to sync segment=%d", s.segmentID)
+	}
+
+	for _, record := range records {
+		s.tables.apply(record)
+	}
+
+	s.segmentSize += written
+	if s.segmentSize >= maxSegmentSize {
+		if err := s.segment.Close(); err != nil {
+			return errors.Wrapf(err, "Failed to close segment=%d", s.segmentID)
+		}
+		return s.openSegment(s.segmentID + 1)
+	}
+
+	return nil
+}
+
+func (s *SegmentStore) openSegment(segmentID int) error {
+	path := s.segmentPath(segmentID)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, segmentFileMode)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open segment=%s", path)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "Failed to stat segment=%s", path)
+	}
+
+	s.segment = f
+	s.segmentID = segmentID
+	s.segmentSize = info.Size()
+
+	return nil
+}
+
+// replaySegment applies the records of a segment in memory. A torn write at the tail, expected
+// after a crash, is truncated so that the next append does not extend the partial record.
+func (s *SegmentStore) replaySegment(segmentID int) error {
+	path := s.segmentPath(segmentID)
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open segment=%s", path)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	offset, validOffset := int64(0), int64(0)
+	line := 0
+	for {
+		data, err := r.ReadBytes('\n')
+		offset += int64(len(data))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to replay segment=%s", path)
+		}
+
+		line++
+		record := segmentRecord{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Printf("Skipping corrupt record segment=%s line=%d err=%s", path, line, err.Error())
+			continue
+		}
+		s.tables.apply(record)
+		validOffset = offset
+	}
+
+	if validOffset < offset {
+		log.Printf("Truncating torn tail segment=%s size=%d truncated=%d", path, offset, offset-validOffset)
+		if err := os.Truncate(path, validOffset); err != nil {
+			return errors.Wrapf(err, "Failed to truncate segment=%s", path)
+		}
+	}
+
+	return nil
+}
+
+// apply replays a segment record into memory
+func (t *memTables) apply(record segmentRecord) {
+	if record.Checkpoint != nil {
+		t.setCheckpoint(record.Table, record.Checkpoint.MetricID, record.Checkpoint.TS)
+		return
+	}
+	t.insert(record.Table, record.Aggregation)
+}
+
+// checkpointRecords returns the segment records of every checkpoint
+func (t *memTables) checkpointRecords() []segmentRecord {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	records := make([]segmentRecord, 0, len(t.checkpoints))
+	for key, checkpoint := range t.checkpoints {
+		parts := strings.SplitN(key, ":", 2)
+		records = append(records, segmentRecord{Table: parts[0], Checkpoint: &segmentCheckpoint{MetricID: parts[1], TS: checkpoint}})
+	}
+	return records
+}
+
+func (s *SegmentStore) listSegments() ([]int, error) {
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to list data dir=%s", s.dataDir)
+	}
+
+	segmentIDs := []int{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		var segmentID int
+		if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), "%d", &segmentID); err != nil {
+			log.Printf("Skipping unknown file=%s in data dir=%s", name, s.dataDir)
+			continue
+		}
+		segmentIDs = append(segmentIDs, segmentID)
+	}
+
+	sort.Ints(segmentIDs)
+
+	return segmentIDs, nil
+}
+
+func (s *SegmentStore) segmentPath(segmentID int) string {
+	return filepath.Join(s.dataDir, fmt.Sprintf("%s%06d%s", segmentPrefix, segmentID, segmentSuffix))
+}
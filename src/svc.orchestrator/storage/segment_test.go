@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"clients"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func segmentRow(metricID string, ts time.Time, value float64) map[string]*clients.Aggregation {
+	row := importRow(metricID, ts, value)
+	return map[string]*clients.Aggregation{metricID: &row}
+}
+
+// TestSegmentStoreReplay checks that a reopened segment store holds what a memory store fed the
+// same writes holds
+func TestSegmentStoreReplay(t *testing.T) {
+	dataDir := t.TempDir()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	s, err := NewSegmentStore(dataDir, DefaultRollupTiers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemoryStore(DefaultRollupTiers())
+
+	for _, store := range []MetricsStore{s, m} {
+		for i := 0; i < 3; i++ {
+			if err := store.InsertAggregations(segmentRow("mem", now.Add(time.Duration(i)*time.Minute), float64(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.setCheckpoint(rollup300Table, "mem", now)
+	m.setCheckpoint(rollup300Table, "mem", now)
+	s.Close()
+
+	s, err = NewSegmentStore(dataDir, DefaultRollupTiers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	got, _ := s.selectTier(metricsTable, "mem", now.Add(-time.Hour), now.Add(time.Hour))
+	want, _ := m.selectTier(metricsTable, "mem", now.Add(-time.Hour), now.Add(time.Hour))
+	if len(got) != 3 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows=%+v, want %+v", got, want)
+	}
+	if checkpoint, ok, _ := s.getCheckpoint(rollup300Table, "mem"); !ok || !checkpoint.Equal(now) {
+		t.Errorf("got checkpoint=%s, want %s", checkpoint, now)
+	}
+}
+
+func TestSegmentStoreTruncatesTornTail(t *testing.T) {
+	dataDir := t.TempDir()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	s, err := NewSegmentStore(dataDir, DefaultRollupTiers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.InsertAggregations(segmentRow("mem", now, 1))
+	s.Close()
+
+	// a crash in the middle of a write
+	f, err := os.OpenFile(s.segmentPath(0), os.O_APPEND|os.O_WRONLY, segmentFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"table":"metrics","agg":{"metric_id":"me`)
+	f.Close()
+
+	// the next write starts on a line of its own, so it survives the next replay
+	for i := 2; i <= 3; i++ {
+		s, err = NewSegmentStore(dataDir, DefaultRollupTiers())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, _ := s.selectTier(metricsTable, "mem", now.Add(-time.Hour), now.Add(time.Hour))
+		if len(rows) != i-1 {
+			t.Fatalf("got rows=%+v, want %d", rows, i-1)
+		}
+		s.InsertAggregations(segmentRow("mem", now.Add(time.Duration(i)*time.Minute), float64(i)))
+		s.Close()
+	}
+}
+
+func TestSegmentStoreExpireKeepsCheckpoints(t *testing.T) {
+	dataDir := t.TempDir()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// segments are only removed when every tier expires its rows
+	tiers := DefaultRollupTiers()[:4]
+
+	s, err := NewSegmentStore(dataDir, tiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setCheckpoint(rollup300Table, "quiet", now.Add(-time.Hour))
+	s.setCheckpoint(rollup300Table, "mem", now.Add(-time.Hour))
+
+	// the first segment is rolled over and was last written before the longest retention
+	s.segment.Close()
+	if err := s.openSegment(1); err != nil {
+		t.Fatal(err)
+	}
+	s.setCheckpoint(rollup300Table, "mem", now)
+	old := now.Add(-2 * s.tiers.get().MaxRetention())
+	if err := os.Chtimes(s.segmentPath(0), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	s.expire()
+	s.Close()
+	if _, err := os.Stat(s.segmentPath(0)); !os.IsNotExist(err) {
+		t.Errorf("got err=%v, want the expired segment removed", err)
+	}
+
+	s, err = NewSegmentStore(dataDir, tiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for metricID, want := range map[string]time.Time{"quiet": now.Add(-time.Hour), "mem": now} {
+		if checkpoint, ok, _ := s.getCheckpoint(rollup300Table, metricID); !ok || !checkpoint.Equal(want) {
+			t.Errorf("%s: got checkpoint=%s ok=%t, want %s", metricID, checkpoint, ok, want)
+		}
+	}
+}
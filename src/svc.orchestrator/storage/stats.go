@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"clients"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// rawResolution is the flush interval of the metrics aggregator, i.e. the spacing of raw rows
+	rawResolution = time.Minute
+	// maxStatsPoints is the number of points per series above which a coarser tier is picked
+	maxStatsPoints = 500
+	// MaxStatsPageSize bounds the rows of a page of stats
+	MaxStatsPageSize = 10000
+)
+
+// ErrInvalidQuery is returned for stats queries which can not be served
+var ErrInvalidQuery = errors.New("invalid stats query")
+
+// StatsQuery selects the aggregations of a metric in [StartTS, EndTS). The tier is picked
+// from the range length unless Resolution is set, to either "raw", a duration e.g. "5m"
+// or a number of seconds. Results are optionally restricted to a single service instance
+// or to every instance of a service. Setting Step, the width of the buckets the result will be
+// re-bucketed into, picks the coarsest tier which is still finer than a bucket.
+// Setting PageSize returns the rows a page at a time, PageToken being the NextPageToken of
+// the previous page. Pages hold at most PageSize rows, fewer when rows are filtered by service.
+type StatsQuery struct {
+	MetricID    string
+	ServiceID   string
+	ServiceName string
+	Resolution  string
+	Step        time.Duration
+	StartTS     time.Time
+	EndTS       time.Time
+	PageSize    int
+	PageToken   string
+}
+
+// pageToken is the opaque, base64 encoded, token of the next page. It pins the tier the
+// first page was read from and is only valid for the query it was returned for.
+type pageToken struct {
+	Tier  string `json:"t"`
+	Query uint64 `json:"q"`
+	State []byte `json:"s"`
+}
+
+func queryStats(backend rollupBackend, tiers RollupTiers, query *StatsQuery, now time.Time) (*clients.StatsResponse, error) {
+	if query.PageSize > 0 || len(query.PageToken) > 0 {
+		return pageStats(backend, tiers, query, now)
+	}
+
+	var resp *clients.StatsResponse
+	aggregations := make([]clients.Aggregation, 0, 10)
+	err := streamStats(backend, tiers, query, now, func(header *clients.StatsResponse) error {
+		resp = header
+		return nil
+	}, func(row clients.Aggregation) error {
+		aggregations = append(aggregations, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Aggregations = aggregations
+	return resp, nil
+}
+
+// streamStats calls header with the response, without aggregations, once the tier is selected
+// and then fn with every row as it is read
+func streamStats(backend rollupBackend, tiers RollupTiers, query *StatsQuery, now time.Time,
+	header func(resp *clients.StatsResponse) error, fn func(row clients.Aggregation) error) error {
+	if err := validateStatsQuery(query); err != nil {
+		return err
+	}
+
+	tier, err := selectStatsTier(tiers, query, now)
+	if err != nil {
+		return err
+	}
+
+	if err := header(statsHeader(tier, query)); err != nil {
+		return err
+	}
+
+	return backend.scanTier(tier.Table(), query.MetricID, query.StartTS, query.EndTS, func(row clients.Aggregation) error {
+		if !matchesService(query, row) {
+			return nil
+		}
+		return fn(row)
+	})
+}
+
+// pageStats returns a page of rows of the tier selected for the first page
+func pageStats(backend rollupBackend, tiers RollupTiers, query *StatsQuery, now time.Time) (*clients.StatsResponse, error) {
+	if err := validateStatsQuery(query); err != nil {
+		return nil, err
+	}
+	if query.PageSize < 1 || query.PageSize > MaxStatsPageSize {
+		return nil, errors.Wrapf(ErrInvalidQuery, "page size must be between 1 and %d", MaxStatsPageSize)
+	}
+
+	var tier RollupTier
+	var state []byte
+	if len(query.PageToken) > 0 {
+		token, err := decodePageToken(query.PageToken)
+		if err != nil || token.Query != statsQueryHash(query) {
+			return nil, errors.Wrapf(ErrInvalidQuery, "page token does not belong to this query")
+		}
+		var ok bool
+		if tier, ok = tiers.Get(token.Tier); !ok {
+			return nil, errors.Wrapf(ErrInvalidQuery, "page token refers to an unknown tier=%s", token.Tier)
+		}
+		state = token.State
+	} else {
+		var err error
+		if tier, err = selectStatsTier(tiers, query, now); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, next, err := backend.pageTier(tier.Table(), query.MetricID, query.StartTS, query.EndTS, query.PageSize, state)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := statsHeader(tier, query)
+	resp.Aggregations = make([]clients.Aggregation, 0, len(rows))
+	for _, row := range rows {
+		if matchesService(query, row) {
+			resp.Aggregations = append(resp.Aggregations, row)
+		}
+	}
+	if len(next) > 0 {
+		resp.NextPageToken = encodePageToken(pageToken{Tier: tier.Table(), Query: statsQueryHash(query), State: next})
+	}
+
+	return resp, nil
+}
+
+func validateStatsQuery(query *StatsQuery) error {
+	if len(query.MetricID) == 0 {
+		return errors.Wrapf(ErrInvalidQuery, "metric is missing")
+	}
+	if !query.StartTS.Before(query.EndTS) {
+		return errors.Wrapf(ErrInvalidQuery, "start must be before end")
+	}
+	return nil
+}
+
+func statsHeader(tier RollupTier, query *StatsQuery) *clients.StatsResponse {
+	return &clients.StatsResponse{
+		MetricID:   query.MetricID,
+		Tier:       tier.Table(),
+		Resolution: int64(tierResolution(tier) / time.Second),
+		StartTS:    query.StartTS,
+		EndTS:      query.EndTS,
+	}
+}
+
+func matchesService(query *StatsQuery, row clients.Aggregation) bool {
+	if len(query.ServiceID) > 0 && row.ServiceID != query.ServiceID {
+		return false
+	}
+	if len(query.ServiceName) > 0 && row.Labels[clients.LabelService] != query.ServiceName {
+		return false
+	}
+	return true
+}
+
+// statsQueryHash identifies the rows a query selects, so that page tokens can not be mixed up
+// between queries
+func statsQueryHash(query *StatsQuery) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%d\x00%d", query.MetricID, query.ServiceID, query.ServiceName,
+		query.Resolution, query.StartTS.UnixNano(), query.EndTS.UnixNano())
+	return h.Sum64()
+}
+
+func encodePageToken(token pageToken) string {
+	b, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageToken(value string) (pageToken, error) {
+	token := pageToken{}
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(b, &token)
+	return token, err
+}
+
+// selectStatsTier returns the tier of the requested resolution, or else the finest tier which
+// both still retains the start of the range and serves it in at most maxStatsPoints per series.
+// Queries with a step use the coarsest retaining tier which still has several rows per step.
+func selectStatsTier(tiers RollupTiers, query *StatsQuery, now time.Time) (RollupTier, error) {
+	if len(query.Resolution) > 0 {
+		return tiers.ForResolution(query.Resolution)
+	}
+
+	if query.Step > 0 {
+		for i := len(tiers) - 1; i >= 0; i-- {
+			tier := tiers[i]
+			if tier.Retention > 0 && query.StartTS.Before(now.Add(-tier.Retention.Duration())) {
+				continue
+			}
+			if tierResolution(tier) <= query.Step {
+				return tier, nil
+			}
+		}
+	}
+
+	rangeLength := query.EndTS.Sub(query.StartTS)
+	for _, tier := range tiers {
+		if tier.Retention > 0 && query.StartTS.Before(now.Add(-tier.Retention.Duration())) {
+			continue
+		}
+		if rangeLength/tierResolution(tier) <= maxStatsPoints {
+			return tier, nil
+		}
+	}
+
+	return tiers[len(tiers)-1], nil
+}
+
+// ForResolution returns the tier with the given resolution, either "raw", a duration or a number of seconds
+func (t RollupTiers) ForResolution(resolution string) (RollupTier, error) {
+	var d time.Duration
+	if resolution != "raw" {
+		seconds, err := strconv.ParseInt(resolution, 10, 64)
+		if err == nil {
+			d = time.Duration(seconds) * time.Second
+		} else if d, err = time.ParseDuration(resolution); err != nil || d <= 0 {
+			return RollupTier{}, errors.Wrapf(ErrInvalidQuery, "invalid resolution=%s", resolution)
+		}
+	}
+
+	for _, tier := range t {
+		if tier.Resolution.Duration() == d {
+			return tier, nil
+		}
+	}
+	return RollupTier{}, errors.Wrapf(ErrInvalidQuery, "no tier with resolution=%s", resolution)
+}
+
+func tierResolution(tier RollupTier) time.Duration {
+	if tier.IsRaw() {
+		return rawResolution
+	}
+	return tier.Resolution.Duration()
+}
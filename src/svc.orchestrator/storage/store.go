@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"clients"
+	"fmt"
+	"time"
+)
+
+const (
+	StorageCassandra = "cassandra"
+	StorageMemory    = "memory"
+	StorageSegment   = "segment"
+)
+
+// MetricsStore persists metric aggregations, rolls them up and serves them back
+type MetricsStore interface {
+	InsertAggregations(aggs map[string]*clients.Aggregation) error
+	// InsertWindows inserts rows computed for the windows of a tier, rather than rolled up, into
+	// the raw tier and merges them into every rollup tier. Their metrics must not be rolled up.
+	InsertWindows(aggs map[string]*clients.Aggregation) error
+	StartRollup()
+	// StopRollup stops the rollups and the backfills once those in progress are over
+	StopRollup()
+	// Close releases the storage, once the rollups are stopped and nothing is written anymore
+	Close() error
+	// SetRollupTiers replaces the tiers by the same ones with another retention or lateness,
+	// applied from the next rollup and write. Other changes are rejected, see RollupTiers.Changes.
+	SetRollupTiers(tiers RollupTiers) error
+	// AddRollupMetrics rolls up the given metrics along with the resource metrics
+	AddRollupMetrics(metricIDs ...string)
+	// OnRollup calls listener with the windows of every rollup
+	OnRollup(listener RollupListener)
+	GetStats(query *StatsQuery) (*clients.StatsResponse, error)
+	// StreamStats calls header with the response, without aggregations, once the tier is
+	// selected and then fn with every row as it is read
+	StreamStats(query *StatsQuery, header func(resp *clients.StatsResponse) error, fn func(row clients.Aggregation) error) error
+	GetResourceStats(startTS, endTS time.Time) ([]clients.Aggregation, error)
+	// StartBackfill validates req and recomputes its windows in the background, one backfill
+	// running at a time
+	StartBackfill(req *clients.BackfillRequest) (*clients.BackfillJob, error)
+	// BackfillJob returns the status of a backfill, one of the last ones started
+	BackfillJob(id string) (*clients.BackfillJob, error)
+	// Export calls fn with every row selected by query as it is read
+	Export(query *ExportQuery, fn func(row clients.Aggregation) error) error
+	// Import validates and upserts a batch of rows into the tier with the given table, skipping
+	// the rows past its retention, and returns the number of rows imported
+	Import(tier string, rows []clients.Aggregation) (int, error)
+}
+
+// StoreOptions holds the settings needed to build any of the storage backends
+type StoreOptions struct {
+	Backend string
+	Seeds   []string
+	// Keyspace, NumConns and ConnectTimeout configure the Cassandra session, the defaults when zero
+	Keyspace       string
+	NumConns       int
+	ConnectTimeout time.Duration
+	DataDir        string
+	Tiers          RollupTiers
+}
+
+// NewMetricsStore creates the storage backend selected by opts.Backend
+func NewMetricsStore(opts StoreOptions) (MetricsStore, error) {
+	switch opts.Backend {
+	case StorageCassandra:
+		keyspace, numConns, connectTimeout := opts.Keyspace, opts.NumConns, opts.ConnectTimeout
+		if len(keyspace) == 0 {
+			keyspace = DefaultKeyspace
+		}
+		if numConns <= 0 {
+			numConns = DefaultNumConns
+		}
+		if connectTimeout <= 0 {
+			connectTimeout = DefaultConnectTimeout
+		}
+		if err := bootstrapSchema(opts.Seeds, keyspace, opts.Tiers); err != nil {
+			return nil, err
+		}
+		return NewDataStore(NewSession(opts.Seeds, keyspace, numConns, connectTimeout), opts.Tiers), nil
+	case StorageMemory:
+		return NewMemoryStore(opts.Tiers), nil
+	case StorageSegment:
+		return NewSegmentStore(opts.DataDir, opts.Tiers)
+	default:
+		return nil, fmt.Errorf("unknown storage backend=%s", opts.Backend)
+	}
+}
+
+func getResourceStats(store MetricsStore, startTS, endTS time.Time) ([]clients.Aggregation, error) {
+	aggregations := make([]clients.Aggregation, 0, 5)
+	for _, metricID := range resourceMetrics {
+		stats, err := store.GetStats(&StatsQuery{MetricID: metricID, StartTS: startTS, EndTS: endTS})
+		if err != nil {
+			return aggregations, err
+		}
+		aggregations = append(aggregations, stats.Aggregations...)
+	}
+	return aggregations, nil
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Duration is a time.Duration which is read from, and written to, json as a string e.g. "5m"
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Wrapf(err, "duration must be a string e.g. \"5m\"")
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// RollupTier describes a table holding aggregations at a single resolution. The raw tier
+// has no resolution and is fed by the metrics aggregator, every other tier is rolled up
+// from its source tier. A window is only finalized once it ended at least Lateness ago,
+// leaving time for late data to arrive. Rows expire after the retention, or never when it is zero.
+type RollupTier struct {
+	Resolution Duration `json:"resolution"`
+	Source     string   `json:"source,omitempty"`
+	Retention  Duration `json:"retention"`
+	Lateness   Duration `json:"lateness,omitempty"`
+}
+
+// Table returns the name of the table storing the tier
+func (t RollupTier) Table() string {
+	if t.IsRaw() {
+		return metricsTable
+	}
+	return rollupTable(t.Interval())
+}
+
+// IsRaw reports whether t is the tier written by the metrics aggregator
+func (t RollupTier) IsRaw() bool {
+	return t.Resolution == 0
+}
+
+// Interval returns the resolution in seconds
+func (t RollupTier) Interval() int64 {
+	return int64(t.Resolution.Duration() / time.Second)
+}
+
+// TTL returns the seconds a row at ts has left before it is past the retention, as expected by
+// Cassandra where 0 disables expiration, so that late and imported rows expire with their window.
+// Rows already past the retention are given a second.
+func (t RollupTier) TTL(ts time.Time) int {
+	if t.Retention == 0 {
+		return 0
+	}
+	ttl := int(time.Until(ts.Add(t.Retention.Duration())) / time.Second)
+	if ttl < 1 {
+		return 1
+	}
+	return ttl
+}
+
+// isExpired reports whether a row at ts is past the retention at now
+func (t RollupTier) isExpired(ts, now time.Time) bool {
+	return t.Retention > 0 && ts.Before(now.Add(-t.Retention.Duration()))
+}
+
+// RollupTiers is the full set of tiers, ordered by resolution with the raw tier first
+type RollupTiers []RollupTier
+
+type rollupTiersConfig struct {
+	Tiers RollupTiers `json:"tiers"`
+}
+
+// DefaultRollupTiers returns the tiers used when no rollup config is given. The 2m and 5m tiers
+// are both rolled up from the raw tier since 2m windows do not fit in 5m ones.
+func DefaultRollupTiers() RollupTiers {
+	return RollupTiers{
+		{Resolution: 0, Retention: Duration(7 * 24 * time.Hour)},
+		{Resolution: Duration(2 * time.Minute), Source: metricsTable, Retention: Duration(30 * 24 * time.Hour), Lateness: Duration(2 * time.Minute)},
+		{Resolution: Duration(5 * time.Minute), Source: metricsTable, Retention: Duration(90 * 24 * time.Hour), Lateness: Duration(2 * time.Minute)},
+		{Resolution: Duration(2 * time.Hour), Source: rollup300Table, Retention: Duration(365 * 24 * time.Hour)},
+		{Resolution: Duration(24 * time.Hour), Source: rollupTable(7200)},
+	}
+}
+
+// LoadRollupTiers reads and validates the tiers declared in the json file at path
+func LoadRollupTiers(path string) (RollupTiers, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading rollup config=%s", path)
+	}
+
+	config := rollupTiersConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(err, "Failed parsing rollup config=%s", path)
+	}
+
+	tiers := config.Tiers
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].Resolution < tiers[j].Resolution })
+
+	if err := tiers.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid rollup config=%s", path)
+	}
+
+	return tiers, nil
+}
+
+// Validate checks that there is exactly one raw tier and that every rollup tier reads from
+// an existing, finer grained, source tier whose windows fit exactly in its own, i.e. its
+// resolution is a multiple of the source one.
+func (t RollupTiers) Validate() error {
+	if len(t) == 0 || !t[0].IsRaw() {
+		return errors.New("a raw tier with no resolution is required")
+	}
+
+	seen := map[string]RollupTier{}
+	for _, tier := range t {
+		if tier.Resolution < 0 || tier.Retention < 0 || tier.Lateness < 0 {
+			return fmt.Errorf("tier=%s: resolution, retention and lateness must not be negative", tier.Table())
+		}
+		if tier.Resolution.Duration()%time.Second != 0 {
+			return fmt.Errorf("tier=%s: resolution must be a whole number of seconds", tier.Table())
+		}
+		if _, ok := seen[tier.Table()]; ok {
+			return fmt.Errorf("tier=%s is declared more than once", tier.Table())
+		}
+
+		if !tier.IsRaw() {
+			source, ok := seen[tier.Source]
+			if !ok {
+				return fmt.Errorf("tier=%s: source=%s must be declared with a finer resolution", tier.Table(), tier.Source)
+			}
+			if source.Resolution >= tier.Resolution {
+				return fmt.Errorf("tier=%s: resolution must be coarser than the source=%s resolution", tier.Table(), tier.Source)
+			}
+			if !source.IsRaw() && tier.Resolution%source.Resolution != 0 {
+				return fmt.Errorf("tier=%s: resolution must be a multiple of the source=%s resolution", tier.Table(), tier.Source)
+			}
+		}
+
+		seen[tier.Table()] = tier
+	}
+
+	return nil
+}
+
+// Raw returns the tier written by the metrics aggregator
+func (t RollupTiers) Raw() RollupTier {
+	return t[0]
+}
+
+// Rollups returns every tier except the raw one
+func (t RollupTiers) Rollups() []RollupTier {
+	return t[1:]
+}
+
+// Get returns the tier stored in table
+func (t RollupTiers) Get(table string) (RollupTier, bool) {
+	for _, tier := range t {
+		if tier.Table() == table {
+			return tier, true
+		}
+	}
+	return RollupTier{}, false
+}
+
+// MaxRetention returns the longest retention, or zero when some tier is kept forever
+func (t RollupTiers) MaxRetention() time.Duration {
+	max := time.Duration(0)
+	for _, tier := range t {
+		if tier.Retention == 0 {
+			return 0
+		}
+		if tier.Retention.Duration() > max {
+			max = tier.Retention.Duration()
+		}
+	}
+	return max
+}
+
+// Changes returns the changes from t to next, which only differ by the retention and lateness
+// of their tiers. Adding, removing or re-sourcing a tier needs its table to be migrated and
+// is an error.
+func (t RollupTiers) Changes(next RollupTiers) ([]string, error) {
+	if len(t) != len(next) {
+		return nil, fmt.Errorf("the tiers can not be added or removed without a restart, %d tiers are declared instead of %d", len(next), len(t))
+	}
+
+	changes := []string{}
+	for i, tier := range t {
+		if next[i].Table() != tier.Table() || next[i].Source != tier.Source {
+			return nil, fmt.Errorf("tier=%s: the resolution and source can not be changed without a restart", tier.Table())
+		}
+		if next[i].Retention != tier.Retention {
+			changes = append(changes, fmt.Sprintf("tier=%s retention: %s -> %s", tier.Table(), tier.Retention.Duration(), next[i].Retention.Duration()))
+		}
+		if next[i].Lateness != tier.Lateness {
+			changes = append(changes, fmt.Sprintf("tier=%s lateness: %s -> %s", tier.Table(), tier.Lateness.Duration(), next[i].Lateness.Duration()))
+		}
+	}
+	return changes, nil
+}
+
+// tierSet holds the tiers of a store, replaced as a whole when their retention or lateness is
+// reloaded
+type tierSet struct {
+	tiers RollupTiers
+	lock  *sync.RWMutex
+}
+
+func newTierSet(tiers RollupTiers) *tierSet {
+	return &tierSet{tiers: tiers, lock: &sync.RWMutex{}}
+}
+
+func (s *tierSet) get() RollupTiers {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.tiers
+}
+
+func (s *tierSet) set(tiers RollupTiers) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := tiers.Validate(); err != nil {
+		return err
+	}
+	if _, err := s.tiers.Changes(tiers); err != nil {
+		return err
+	}
+	s.tiers = tiers
+	return nil
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultRollupTiersAreValid(t *testing.T) {
+	if err := DefaultRollupTiers().Validate(); err != nil {
+		t.Fatalf("The default tiers are invalid: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	raw := RollupTier{Retention: Duration(24 * time.Hour)}
+	tier := func(resolution time.Duration, source string) RollupTier {
+		return RollupTier{Resolution: Duration(resolution), Source: source}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		tiers RollupTiers
+		err   string
+	}{
+		{"raw only", RollupTiers{raw}, ""},
+		{"from raw", RollupTiers{raw, tier(2*time.Minute, metricsTable), tier(5*time.Minute, metricsTable)}, ""},
+		{"cascading", RollupTiers{raw, tier(time.Minute, metricsTable), tier(5*time.Minute, "rollups60"), tier(time.Hour, "rollups300")}, ""},
+		{"no raw", RollupTiers{tier(time.Minute, metricsTable)}, "raw tier"},
+		{"unknown source", RollupTiers{raw, tier(5*time.Minute, "rollups60")}, "must be declared"},
+		{"finer than source", RollupTiers{raw, tier(5*time.Minute, metricsTable), tier(time.Minute, "rollups300")}, "coarser"},
+		{"straddling source", RollupTiers{raw, tier(2*time.Minute, metricsTable), tier(5*time.Minute, "rollups120")}, "multiple"},
+		{"fractional seconds", RollupTiers{raw, tier(1500*time.Millisecond, metricsTable)}, "whole number"},
+		{"declared twice", RollupTiers{raw, tier(time.Minute, metricsTable), tier(time.Minute, metricsTable)}, "more than once"},
+	} {
+		err := tc.tiers.Validate()
+		switch {
+		case len(tc.err) == 0 && err != nil:
+			t.Errorf("%s: got err=%v, want none", tc.name, err)
+		case len(tc.err) > 0 && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: got err=%v, want one containing %q", tc.name, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"clients"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ImportBatchRows bounds the rows of a single write of an import, and the batches handed to Import
+const ImportBatchRows = 100
+
+// ErrInvalidTransfer is returned for export and import requests which can not be served
+var ErrInvalidTransfer = errors.New("invalid export or import request")
+
+// ExportQuery selects the rows of a metric in [StartTS, EndTS) of a tier, the raw tier when
+// Tier is empty, optionally restricted to a service instance or to every instance of a service
+type ExportQuery struct {
+	Tier        string
+	MetricID    string
+	ServiceID   string
+	ServiceName string
+	StartTS     time.Time
+	EndTS       time.Time
+}
+
+// ImportRowError is returned by Import for an invalid row, Index is its position in the batch.
+// Nothing of the batch is written then.
+type ImportRowError struct {
+	Index int
+	Msg   string
+}
+
+func (e *ImportRowError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Index, e.Msg)
+}
+
+// exportRows calls fn with the rows selected by query as they are read, ordered by timestamp.
+// Errors of the query itself are returned before fn is first called.
+func exportRows(backend rollupBackend, tiers RollupTiers, query *ExportQuery, fn func(row clients.Aggregation) error) error {
+	tier := tiers.Raw()
+	if len(query.Tier) > 0 {
+		var ok bool
+		if tier, ok = tiers.Get(query.Tier); !ok {
+			return errors.Wrapf(ErrInvalidTransfer, "unknown tier=%s", query.Tier)
+		}
+	}
+	if len(query.MetricID) == 0 {
+		return errors.Wrapf(ErrInvalidTransfer, "metric is missing")
+	}
+	if !query.StartTS.Before(query.EndTS) {
+		return errors.Wrapf(ErrInvalidTransfer, "start must be before end")
+	}
+
+	return backend.scanTier(tier.Table(), query.MetricID, query.StartTS, query.EndTS, func(row clients.Aggregation) error {
+		if len(query.ServiceID) > 0 && row.ServiceID != query.ServiceID {
+			return nil
+		}
+		if len(query.ServiceName) > 0 && row.Labels[clients.LabelService] != query.ServiceName {
+			return nil
+		}
+		return fn(row)
+	})
+}
+
+// importRows validates every row of the batch and then upserts them into the tier, by metric
+// and in writes of at most ImportBatchRows, skipping the rows past the retention of the tier.
+// Rows are keyed by metric, timestamp and service instance so importing the same rows again
+// leaves the tier unchanged. Every imported metric is rolled up from then on, and the tiers
+// rolled up from the tier are rewound to its first row, so that the windows they finalized
+// already are computed again with the rows.
+// It returns the number of rows imported.
+func importRows(backend rollupBackend, tiers RollupTiers, metrics *rolledUpMetrics, table string, rows []clients.Aggregation, now time.Time) (int, error) {
+	tier, ok := tiers.Get(table)
+	if !ok {
+		return 0, errors.Wrapf(ErrInvalidTransfer, "unknown tier=%s", table)
+	}
+
+	byMetric := map[string][]*clients.Aggregation{}
+	firstTS := map[string]time.Time{}
+	for i := range rows {
+		if err := validateImportRow(tier, rows[i]); err != nil {
+			return 0, &ImportRowError{Index: i, Msg: err.Error()}
+		}
+		if tier.isExpired(rows[i].TS, now) {
+			continue
+		}
+		metricID := rows[i].MetricID
+		byMetric[metricID] = append(byMetric[metricID], &rows[i])
+		if first, ok := firstTS[metricID]; !ok || rows[i].TS.Before(first) {
+			firstTS[metricID] = rows[i].TS
+		}
+	}
+
+	metricIDs := make([]string, 0, len(byMetric))
+	for metricID := range byMetric {
+		metricIDs = append(metricIDs, metricID)
+	}
+	sort.Strings(metricIDs)
+
+	imported := 0
+	for _, metricID := range metricIDs {
+		aggs := byMetric[metricID]
+		for start := 0; start < len(aggs); start += ImportBatchRows {
+			end := start + ImportBatchRows
+			if end > len(aggs) {
+				end = len(aggs)
+			}
+			if err := backend.storeRollups(tier, aggs[start:end]); err != nil {
+				return imported, errors.Wrapf(err, "Failed to import %d rows of metric=%s into %s", end-start, metricID, tier.Table())
+			}
+			imported += end - start
+		}
+
+		metrics.AddRollupMetrics(metricID)
+		if err := rewindRollups(backend, tiers, metrics, tier, metricID, firstTS[metricID]); err != nil {
+			return imported, errors.Wrapf(err, "Failed to rewind the rollups of metric=%s", metricID)
+		}
+	}
+
+	return imported, nil
+}
+
+// rewindRollups rewinds the tiers rolled up from tier, and in turn those rolled up from them, to
+// the window holding ts. The rewind is also left to the rollup goroutine of every tier, in case
+// a rollup in progress read the source before the rows were imported.
+func rewindRollups(backend rollupBackend, tiers RollupTiers, metrics *rolledUpMetrics, tier RollupTier, metricID string, ts time.Time) error {
+	for _, next := range tiers.Rollups() {
+		if next.Source != tier.Table() {
+			continue
+		}
+		checkpoint := alignWindow(ts, next.Interval())
+		if err := rewindCheckpoint(backend, next, metricID, checkpoint); err != nil {
+			return err
+		}
+		metrics.rewind(next.Table(), metricID, checkpoint)
+
+		if err := rewindRollups(backend, tiers, metrics, next, metricID, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateImportRow(tier RollupTier, row clients.Aggregation) error {
+	switch {
+	case len(row.MetricID) == 0:
+		return errors.New("metric_id is missing")
+	case len(row.ServiceID) == 0:
+		return errors.New("service_id is missing")
+	case row.TS.IsZero():
+		return errors.New("time is missing")
+	case row.NumValues < 1:
+		return errors.New("count must be at least 1")
+	}
+
+	for _, v := range []float64{row.Min, row.Max, row.Average} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return errors.New("min, max and avg must be finite")
+		}
+	}
+	// rollups compute averages in floating point, allow them to be off by a rounding error
+	tolerance := 1e-9 * math.Max(math.Abs(row.Min), math.Abs(row.Max))
+	if row.Min > row.Max || row.Average < row.Min-tolerance || row.Average > row.Max+tolerance {
+		return errors.Errorf("avg=%g must be between min=%g and max=%g", row.Average, row.Min, row.Max)
+	}
+
+	if !tier.IsRaw() && !alignWindow(row.TS, tier.Interval()).Equal(row.TS) {
+		return errors.Errorf("time=%s is not aligned to the %s windows of %s", row.TS.Format(time.RFC3339), tier.Resolution.Duration(), tier.Table())
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"clients"
+	"testing"
+	"time"
+)
+
+func importRow(metricID string, ts time.Time, value float64) clients.Aggregation {
+	return clients.Aggregation{MetricID: metricID, ServiceID: "echo-1", TS: ts, Min: value, Max: value, Average: value, NumValues: 1}
+}
+
+func TestImportSkipsExpiredRows(t *testing.T) {
+	store := NewMemoryStore(DefaultRollupTiers())
+	now := time.Now().UTC()
+
+	imported, err := store.Import(metricsTable, []clients.Aggregation{
+		importRow("mem", now.Add(-8*24*time.Hour), 1),
+		importRow("mem", now.Add(-time.Hour), 2),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 1 {
+		t.Errorf("got imported=%d, want 1", imported)
+	}
+
+	rows, _ := store.selectTier(metricsTable, "mem", now.Add(-30*24*time.Hour), now)
+	if len(rows) != 1 || rows[0].Average != 2 {
+		t.Errorf("got rows=%+v, want the row of an hour ago", rows)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	tier := RollupTier{Resolution: Duration(5 * time.Minute), Retention: Duration(time.Hour)}
+	now := time.Now()
+
+	if ttl := tier.TTL(now.Add(-30 * time.Minute)); ttl < 1790 || ttl > 1800 {
+		t.Errorf("got ttl=%d for a row of 30m ago, want 1800", ttl)
+	}
+	if ttl := tier.TTL(now.Add(-2 * time.Hour)); ttl != 1 {
+		t.Errorf("got ttl=%d for an expired row, want 1", ttl)
+	}
+	if ttl := (RollupTier{}).TTL(now.Add(-2 * time.Hour)); ttl != 0 {
+		t.Errorf("got ttl=%d without retention, want 0", ttl)
+	}
+}
+
+func TestImportRewindsRollups(t *testing.T) {
+	store := NewMemoryStore(DefaultRollupTiers())
+	tiers := store.tiers.get()
+	now := time.Now().UTC()
+
+	// every tier finalized its windows up to now
+	for _, tier := range tiers.Rollups() {
+		if err := store.setCheckpoint(tier.Table(), "mem", alignWindow(now, tier.Interval())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := alignWindow(now.Add(-3*time.Hour), 7200).Add(7 * time.Minute)
+	if _, err := store.Import(metricsTable, []clients.Aggregation{importRow("mem", ts, 4), importRow("mem", ts.Add(time.Hour), 6)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tier := range tiers.Rollups() {
+		checkpoint, _, _ := store.getCheckpoint(tier.Table(), "mem")
+		if want := alignWindow(ts, tier.Interval()); !checkpoint.Equal(want) {
+			t.Errorf("%s: got checkpoint=%s, want %s", tier.Table(), checkpoint, want)
+		}
+		if _, ok := store.takeRewind(tier.Table(), "mem"); !ok {
+			t.Errorf("%s: the rewind was not left to the rollup", tier.Table())
+		}
+	}
+
+	// a rollup in progress moved the checkpoint past the rows, the pending rewind undoes it
+	tier, _ := tiers.Get(rollup300Table)
+	store.setCheckpoint(tier.Table(), "mem", alignWindow(now, tier.Interval()))
+	store.rewind(tier.Table(), "mem", alignWindow(ts, tier.Interval()))
+	rollupMetrics(store, tiers, tier, store.rolledUpMetrics, store.rollupListeners)
+
+	rows, _ := store.selectTier(tier.Table(), "mem", ts.Add(-time.Hour), now)
+	if len(rows) != 2 || !rows[0].TS.Equal(alignWindow(ts, tier.Interval())) || rows[0].Average != 4 || rows[1].Average != 6 {
+		t.Errorf("got %s rows=%+v, want the imported rows rolled up", tier.Table(), rows)
+	}
+}
+
+// TestImportRollsUpImportedMetrics checks that the metrics which are not rolled up yet, e.g.
+// the custom metrics of another orchestrator, are rolled up from their imported rows
+func TestImportRollsUpImportedMetrics(t *testing.T) {
+	store := NewMemoryStore(DefaultRollupTiers())
+	tiers := store.tiers.get()
+	now := time.Now().UTC()
+
+	ts := alignWindow(now.Add(-3*time.Hour), 300).Add(time.Minute)
+	if _, err := store.Import(metricsTable, []clients.Aggregation{importRow("jobs_total", ts, 4)}); err != nil {
+		t.Fatal(err)
+	}
+	if metricIDs := store.list(); !containsString(metricIDs, "jobs_total") {
+		t.Errorf("got rolled up metrics=%v, want jobs_total", metricIDs)
+	}
+
+	tier, _ := tiers.Get(rollup300Table)
+	rollupMetrics(store, tiers, tier, store.rolledUpMetrics, store.rollupListeners)
+
+	rows, _ := store.selectTier(tier.Table(), "jobs_total", ts.Add(-time.Hour), now)
+	if len(rows) != 1 || !rows[0].TS.Equal(alignWindow(ts, tier.Interval())) || rows[0].Average != 4 {
+		t.Errorf("got %s rows=%+v, want the imported row rolled up", tier.Table(), rows)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
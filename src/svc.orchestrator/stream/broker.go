@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"log"
+	"metrics"
+	"sync"
+)
+
+// DefaultBuffer is the number of events buffered for a subscriber which did not ask for a size
+const DefaultBuffer = 256
+
+// Filter tells whether a subscriber wants an event
+type Filter func(event interface{}) bool
+
+// Broker fans the published events out to its subscribers. Publishing never blocks: a
+// subscriber whose buffer is full is dropped, its channel being closed, so that a slow
+// consumer can not hold back the publisher.
+type Broker struct {
+	name        string
+	subscribers map[*Subscription]struct{}
+	lock        *sync.RWMutex
+	published   *metrics.Value
+	dropped     *metrics.Value
+}
+
+// NewBroker creates a broker, name labels its metrics
+func NewBroker(name string) *Broker {
+	return &Broker{
+		name:        name,
+		subscribers: map[*Subscription]struct{}{},
+		lock:        &sync.RWMutex{},
+		published:   brokerEvents.With(name),
+		dropped:     brokerDropped.With(name),
+	}
+}
+
+var (
+	brokerEvents = metrics.NewCounterVec("orchestrator_stream_events",
+		"Events published to the subscribers of a stream.", "stream")
+	brokerDropped = metrics.NewCounterVec("orchestrator_stream_dropped_subscribers",
+		"Subscribers dropped for not keeping up with a stream.", "stream")
+)
+
+func init() {
+	metrics.Register(brokerEvents, brokerDropped)
+}
+
+// Subscription receives the events matching its filter until it is closed or dropped
+type Subscription struct {
+	events  chan interface{}
+	filter  Filter
+	dropped bool
+}
+
+// Events is closed once the subscription is closed or dropped
+func (s *Subscription) Events() <-chan interface{} {
+	return s.events
+}
+
+// Dropped tells whether the subscription was dropped for falling behind, it is only set once
+// Events was closed
+func (s *Subscription) Dropped() bool {
+	return s.dropped
+}
+
+// Subscribe returns a subscription to the events matching filter, every event when nil, with
+// a buffer of buffer events or DefaultBuffer when not positive
+func (b *Broker) Subscribe(buffer int, filter Filter) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+
+	s := Subscription{
+		events: make(chan interface{}, buffer),
+		filter: filter,
+	}
+
+	b.lock.Lock()
+	b.subscribers[&s] = struct{}{}
+	b.lock.Unlock()
+
+	return &s
+}
+
+// Unsubscribe closes the subscription, it is a no-op for dropped subscriptions
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.remove(s, false)
+}
+
+// Publish sends the event to the matching subscribers, dropping those whose buffer is full
+func (b *Broker) Publish(event interface{}) {
+	var slow []*Subscription
+
+	b.lock.RLock()
+	for s := range b.subscribers {
+		if s.filter != nil && !s.filter(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	b.lock.RUnlock()
+
+	b.published.Inc()
+	for _, s := range slow {
+		b.remove(s, true)
+	}
+}
+
+// Subscribers returns the number of subscribers
+func (b *Broker) Subscribers() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.subscribers)
+}
+
+func (b *Broker) remove(s *Subscription, dropped bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.subscribers[s]; !ok {
+		return
+	}
+	delete(b.subscribers, s)
+	s.dropped = dropped
+	close(s.events)
+
+	if dropped {
+		b.dropped.Inc()
+		log.Printf("Dropped slow subscriber of stream=%s, buffer=%d", b.name, cap(s.events))
+	}
+}
@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"reflect"
+	"testing"
+)
+
+func receive(s *Subscription) []interface{} {
+	events := []interface{}{}
+	for {
+		select {
+		case event, ok := <-s.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// TestPublishFilters checks that every subscriber receives the events matching its filter
+func TestPublishFilters(t *testing.T) {
+	b := NewBroker("test")
+	all := b.Subscribe(0, nil)
+	even := b.Subscribe(10, func(event interface{}) bool { return event.(int)%2 == 0 })
+
+	for i := 0; i < 5; i++ {
+		b.Publish(i)
+	}
+
+	if got, want := receive(all), []interface{}{0, 1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got events=%v without a filter, want %v", got, want)
+	}
+	if got, want := receive(even), []interface{}{0, 2, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got events=%v, want %v", got, want)
+	}
+	if cap(all.events) != DefaultBuffer {
+		t.Errorf("got buffer=%d, want %d", cap(all.events), DefaultBuffer)
+	}
+}
+
+// TestSlowSubscriberIsDropped checks that a subscriber whose buffer is full is dropped, keeping
+// the events it buffered, while the others keep receiving
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	b := NewBroker("test")
+	slow := b.Subscribe(2, nil)
+	fast := b.Subscribe(10, nil)
+
+	for i := 0; i < 3; i++ {
+		b.Publish(i)
+	}
+
+	if got, want := receive(slow), []interface{}{0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got events=%v of the slow subscriber, want %v", got, want)
+	}
+	if _, ok := <-slow.Events(); ok || !slow.Dropped() {
+		t.Errorf("got open=%t dropped=%t, want the slow subscriber closed and dropped", ok, slow.Dropped())
+	}
+	if got, want := receive(fast), []interface{}{0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got events=%v of the fast subscriber, want %v", got, want)
+	}
+	if n := b.Subscribers(); n != 1 {
+		t.Errorf("got subscribers=%d, want 1", n)
+	}
+
+	// the handler of the dropped subscriber still unsubscribes it
+	b.Unsubscribe(slow)
+	if !slow.Dropped() {
+		t.Errorf("unsubscribing cleared dropped")
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	b := NewBroker("test")
+	s := b.Subscribe(1, nil)
+	b.Unsubscribe(s)
+	b.Unsubscribe(s)
+
+	if _, ok := <-s.Events(); ok || s.Dropped() {
+		t.Errorf("got open=%t dropped=%t, want the subscription closed and not dropped", ok, s.Dropped())
+	}
+	b.Publish(1)
+	if n := b.Subscribers(); n != 0 {
+		t.Errorf("got subscribers=%d, want 0", n)
+	}
+}
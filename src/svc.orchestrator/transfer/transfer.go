@@ -0,0 +1,244 @@
+package transfer
+
+import (
+	"bufio"
+	"clients"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"metrics"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FormatCSV         = "csv"
+	FormatNDJSON      = "ndjson"
+	FormatOpenMetrics = "openmetrics"
+)
+
+// csvHeader are the columns of CSV exports, imports may order them differently and omit labels
+var csvHeader = []string{"metric_id", "service_id", "time", "min", "max", "avg", "count", "labels"}
+
+// ErrInvalidFormat is returned for unknown formats and rows which can not be parsed
+var ErrInvalidFormat = errors.New("invalid transfer format")
+
+// RowWriter encodes rows one at a time, Close must be called once every row was written
+type RowWriter interface {
+	Write(row clients.Aggregation) error
+	Close() error
+}
+
+// RowReader decodes rows one at a time, returning io.EOF after the last one
+type RowReader interface {
+	Read() (clients.Aggregation, error)
+	// Line returns the line of the input the last row was read from
+	Line() int
+}
+
+// ContentType returns the media type of a format
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatOpenMetrics:
+		return metrics.ContentTypeOpenMetrics
+	default:
+		return "application/x-ndjson"
+	}
+}
+
+// NewWriter creates a writer of the rows of metricID. OpenMetrics exports hold the averages,
+// as the mesh_<metric> gauge along with the timestamp of the rows, and can not be imported back.
+func NewWriter(format string, w io.Writer, metricID string) (RowWriter, error) {
+	switch format {
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(csvHeader); err != nil {
+			return nil, err
+		}
+		return &csvWriter{writer: writer}, nil
+	case FormatNDJSON:
+		return &ndjsonWriter{encoder: json.NewEncoder(w)}, nil
+	case FormatOpenMetrics:
+		name := "mesh_" + metrics.SanitizeName(metricID)
+		writer := metrics.NewWriter(w, true)
+		writer.Family(name, metrics.TypeGauge, "Average of "+metricID+" over the rows of the exported tier.")
+		return &openMetricsWriter{writer: writer, name: name}, nil
+	default:
+		return nil, errors.Wrapf(ErrInvalidFormat, "unknown export format=%s", format)
+	}
+}
+
+// NewReader creates a reader of CSV or NDJSON rows
+func NewReader(format string, r io.Reader) (RowReader, error) {
+	switch format {
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidFormat, "line 1: invalid CSV header: %s", err)
+		}
+		columns := map[string]int{}
+		for i, name := range header {
+			columns[name] = i
+		}
+		for _, name := range csvHeader[:len(csvHeader)-1] {
+			if _, ok := columns[name]; !ok {
+				return nil, errors.Wrapf(ErrInvalidFormat, "line 1: CSV header is missing column=%s", name)
+			}
+		}
+		return &csvReader{reader: reader, columns: columns, line: 1}, nil
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &ndjsonReader{scanner: scanner}, nil
+	default:
+		return nil, errors.Wrapf(ErrInvalidFormat, "unknown import format=%s", format)
+	}
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func (w *csvWriter) Write(row clients.Aggregation) error {
+	labels := ""
+	if len(row.Labels) > 0 {
+		b, err := json.Marshal(row.Labels)
+		if err != nil {
+			return err
+		}
+		labels = string(b)
+	}
+
+	return w.writer.Write([]string{
+		row.MetricID,
+		row.ServiceID,
+		row.TS.UTC().Format(time.RFC3339Nano),
+		strconv.FormatFloat(row.Min, 'g', -1, 64),
+		strconv.FormatFloat(row.Max, 'g', -1, 64),
+		strconv.FormatFloat(row.Average, 'g', -1, 64),
+		strconv.Itoa(row.NumValues),
+		labels,
+	})
+}
+
+func (w *csvWriter) Close() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type csvReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+	line    int
+}
+
+func (r *csvReader) Read() (clients.Aggregation, error) {
+	row := clients.Aggregation{}
+
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return row, err
+	}
+	r.line, _ = r.reader.FieldPos(0)
+	if err != nil {
+		return row, errors.Wrapf(ErrInvalidFormat, "line %d: %s", r.line, err)
+	}
+
+	field := func(name string) string {
+		if i, ok := r.columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	row.MetricID = field("metric_id")
+	row.ServiceID = field("service_id")
+	if row.TS, err = time.Parse(time.RFC3339Nano, field("time")); err != nil {
+		return row, errors.Wrapf(ErrInvalidFormat, "line %d: invalid time=%s", r.line, field("time"))
+	}
+	for name, v := range map[string]*float64{"min": &row.Min, "max": &row.Max, "avg": &row.Average} {
+		if *v, err = strconv.ParseFloat(field(name), 64); err != nil {
+			return row, errors.Wrapf(ErrInvalidFormat, "line %d: invalid %s=%s", r.line, name, field(name))
+		}
+	}
+	if row.NumValues, err = strconv.Atoi(field("count")); err != nil {
+		return row, errors.Wrapf(ErrInvalidFormat, "line %d: invalid count=%s", r.line, field("count"))
+	}
+	if labels := field("labels"); len(labels) > 0 {
+		if err := json.Unmarshal([]byte(labels), &row.Labels); err != nil {
+			return row, errors.Wrapf(ErrInvalidFormat, "line %d: labels must be a JSON object of strings", r.line)
+		}
+	}
+
+	return row, nil
+}
+
+func (r *csvReader) Line() int {
+	return r.line
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *ndjsonWriter) Write(row clients.Aggregation) error {
+	return w.encoder.Encode(row)
+}
+
+func (w *ndjsonWriter) Close() error {
+	return nil
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *ndjsonReader) Read() (clients.Aggregation, error) {
+	row := clients.Aggregation{}
+
+	for r.scanner.Scan() {
+		r.line++
+		if len(r.scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(r.scanner.Bytes(), &row); err != nil {
+			return row, errors.Wrapf(ErrInvalidFormat, "line %d: %s", r.line, err)
+		}
+		return row, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return row, errors.Wrapf(ErrInvalidFormat, "line %d: %s", r.line+1, err)
+	}
+
+	return row, io.EOF
+}
+
+func (r *ndjsonReader) Line() int {
+	return r.line
+}
+
+type openMetricsWriter struct {
+	writer *metrics.Writer
+	name   string
+}
+
+func (w *openMetricsWriter) Write(row clients.Aggregation) error {
+	labels := map[string]string{"service_id": row.ServiceID}
+	for k, v := range row.Labels {
+		labels[metrics.SanitizeName(k)] = v
+	}
+	w.writer.SampleAt(w.name, labels, row.Average, row.TS)
+	return nil
+}
+
+func (w *openMetricsWriter) Close() error {
+	w.writer.Close()
+	return nil
+}
@@ -0,0 +1,131 @@
+package transfer
+
+import (
+	"bytes"
+	"clients"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var testRows = []clients.Aggregation{
+	{MetricID: "mem", ServiceID: "echo-1", TS: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Min: 0.5, Max: 2, Average: 1.25, NumValues: 4,
+		Labels: map[string]string{clients.LabelService: "echo", "code": `5"00`}},
+	{MetricID: "mem", ServiceID: "db,1", TS: time.Date(2024, 1, 1, 0, 5, 0, 500, time.UTC), Min: -1, Max: 1e21, Average: 3, NumValues: 1},
+}
+
+func readAll(t *testing.T, reader RowReader) []clients.Aggregation {
+	t.Helper()
+
+	rows := []clients.Aggregation{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// TestRoundTrip checks that the CSV and NDJSON exports are imported back as they were exported
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatCSV, FormatNDJSON} {
+		buf := &bytes.Buffer{}
+		writer, err := NewWriter(format, buf, "mem")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range testRows {
+			if err := writer.Write(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := NewReader(format, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows := readAll(t, reader); !reflect.DeepEqual(rows, testRows) {
+			t.Errorf("%s: got rows=%+v, want %+v", format, rows, testRows)
+		}
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	// the columns may be in any order and the labels omitted
+	input := "count,avg,max,min,time,service_id,metric_id\n2,1.5,2,1,2024-01-01T00:00:00Z,echo-1,mem\n"
+	reader, err := NewReader(FormatCSV, strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []clients.Aggregation{{MetricID: "mem", ServiceID: "echo-1", TS: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Min: 1, Max: 2, Average: 1.5, NumValues: 2}}
+	if rows := readAll(t, reader); !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows=%+v, want %+v", rows, want)
+	}
+
+	if _, err := NewReader(FormatCSV, strings.NewReader("metric_id,service_id,time,min,max,avg\n")); errors.Cause(err) != ErrInvalidFormat {
+		t.Errorf("got err=%v for a header without count, want ErrInvalidFormat", err)
+	}
+}
+
+// TestReadErrors checks that the rows which can not be parsed are reported with their line
+func TestReadErrors(t *testing.T) {
+	header := strings.Join(csvHeader, ",") + "\n"
+	valid := "mem,echo-1,2024-01-01T00:00:00Z,1,1,1,1,\n"
+	for _, tc := range []struct {
+		format, input, want string
+	}{
+		{FormatCSV, header + valid + "mem,echo-1,yesterday,1,1,1,1,\n", "line 3: invalid time=yesterday"},
+		{FormatCSV, header + "mem,echo-1,2024-01-01T00:00:00Z,1,one,1,1,\n", "line 2: invalid max=one"},
+		{FormatCSV, header + "mem,echo-1,2024-01-01T00:00:00Z,1,1,1,1.5,\n", "line 2: invalid count=1.5"},
+		{FormatCSV, header + valid + valid + `mem,echo-1,2024-01-01T00:00:00Z,1,1,1,1,"[1]"` + "\n", "line 4: labels must be a JSON object"},
+		{FormatNDJSON, "{\"metric_id\": \"mem\"}\n\n{\"metric_id\": 1}\n", "line 3:"},
+	} {
+		reader, err := NewReader(tc.format, strings.NewReader(tc.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for err == nil {
+			_, err = reader.Read()
+		}
+		if errors.Cause(err) != ErrInvalidFormat || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s %q: got err=%v, want %s", tc.format, tc.input, err, tc.want)
+		}
+	}
+
+	if _, err := NewReader(FormatOpenMetrics, strings.NewReader("")); errors.Cause(err) != ErrInvalidFormat {
+		t.Errorf("got err=%v importing openmetrics, want ErrInvalidFormat", err)
+	}
+	if _, err := NewWriter("xml", &bytes.Buffer{}, "mem"); errors.Cause(err) != ErrInvalidFormat {
+		t.Errorf("got err=%v for an unknown format, want ErrInvalidFormat", err)
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer, err := NewWriter(FormatOpenMetrics, buf, "http.requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(testRows[0])
+	writer.Close()
+
+	want := "# TYPE mesh_http_requests gauge\n" +
+		"# HELP mesh_http_requests Average of http.requests over the rows of the exported tier.\n" +
+		"mesh_http_requests{code=\"5\\\"00\",service=\"echo\",service_id=\"echo-1\"} 1.25 1704067200\n" +
+		"# EOF\n"
+	if buf.String() != want {
+		t.Errorf("got export=\n%s\nwant\n%s", buf.String(), want)
+	}
+}
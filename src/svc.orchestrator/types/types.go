@@ -4,24 +4,29 @@ import (
 	"clients"
 	"context"
 	"fmt"
-)
+	"time"
 
-// ServiceInfos ...
-type ServiceInfos struct {
-	Services []ServiceInfo `json:"services"`
-}
+	"github.com/pkg/errors"
+)
 
-// ServiceInfo ...
-type ServiceInfo struct {
-	ServiceName string           `json:"service_name"`
-	Registrants []RegistrantInfo `json:"registrants"`
-}
+var (
+	// ErrInvalidRegistrant is returned for registrations missing some of their fields
+	ErrInvalidRegistrant = errors.New("invalid fields")
+	// ErrRegistrantExists is returned when registering a sidecar which is already registered
+	ErrRegistrantExists = errors.New("registrant exists")
+	// ErrRegistrantNotFound is returned when unregistering a sidecar which is not registered
+	ErrRegistrantNotFound = errors.New("registrant missing")
+)
 
 // RegistrantInfo ...
 type RegistrantInfo struct {
-	ControlAddress string `json:"control_address"`
-	DataAddress    string `json:"data_address"`
-	ServiceName    string `json:"service_name"`
+	ControlAddress string     `json:"control_address"`
+	DataAddress    string     `json:"data_address"`
+	ServiceName    string     `json:"service_name"`
+	Draining       bool       `json:"draining,omitempty"`
+	Health         string     `json:"health,omitempty"`
+	LastHeartbeat  *time.Time `json:"last_heartbeat,omitempty"`
+	ServiceID      string     `json:"service_id,omitempty"`
 }
 
 // NewRegistrantInfo creates a new registrant info instance
@@ -45,7 +50,26 @@ func (ri *RegistrantInfo) String() string {
 type ServiceRegistry interface {
 	Register(ctx context.Context, req *clients.RegisterRequest) (*clients.RegisterResponse, error)
 	Unregister(ctx context.Context, req *clients.RegisterRequest) (*clients.RegisterResponse, error)
+	Drain(ctx context.Context, req *clients.RegisterRequest, draining bool) (*clients.RegisterResponse, error)
 	GetServices() (map[string][]RegistrantInfo, error)
 	Start()
 	Stop()
 }
+
+// ConfigReloader reloads the config of the orchestrator and records the reloads
+type ConfigReloader interface {
+	// Reload reloads the config now, trigger telling what asked for it
+	Reload(trigger string) clients.ConfigEvent
+	// Events returns the last reloads, oldest first
+	Events() []clients.ConfigEvent
+}
+
+// DataPointSink accepts data points to aggregate and store
+type DataPointSink interface {
+	AddDataPoint(dp *clients.DataPoint)
+}
+
+// RequestObserver accepts the request counts reported by the sidecars of a service
+type RequestObserver interface {
+	ObserveRequests(serviceName string, stats []clients.RequestStats)
+}